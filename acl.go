@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ========== FOLDER ACCESS ==========
+// FOLDER_ACCESS_FILE says who may see which folders, one rule per line:
+//
+//	# folder        who
+//	kids/           public      anyone, even without PUBLIC_READ
+//	family/         login       any account
+//	family/taxes/   alice bob   only these accounts
+//	/               login       the whole library (instead of PUBLIC_READ)
+//
+// The most specific rule covering a file wins, so family/taxes/ above is
+// closed to everyone but alice and bob even though family/ isn't. Files no
+// rule covers follow PUBLIC_READ as before. Rules are checked by folder
+// listings (on the page and in the API, which leave out what the user can't
+// see), search, tag, favorite, duplicate, year-in-review and trash pages, the
+// map, the photos of albums and journal entries, /view/, /viewer/,
+// /download/, /thumb/ and the other per-file routes, zip downloads and
+// WebDAV. Generated copies (thumb/, preview/, trash/...) are never served as
+// files of their own. Other writes only need a login, but a file has to be
+// readable to be moved (from and to), shared or restored from the trash.
+
+type folderRule struct {
+	folder string   // without slashes, "" for the whole library
+	who    string   // "public", "login" or "users"
+	users  []string
+}
+
+// folderRules are most specific (longest folder) first.
+var folderRules []folderRule
+
+// loadFolderRules reads FOLDER_ACCESS_FILE; blank lines and # comments are
+// skipped.
+func loadFolderRules(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil { return err }
+	for n, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		// User names may be separated by spaces or commas
+		fields := strings.Fields(strings.ReplaceAll(line, ",", " "))
+		if len(fields) == 0 { continue }
+		if len(fields) < 2 { return fmt.Errorf("%s:%d: want folder and public, login or user names", name, n+1) }
+		rule := folderRule{ folder: strings.Trim(fields[0], "/"), who: fields[1] }
+		if rule.who != "public" && rule.who != "login" {
+			rule.who, rule.users = "users", fields[1:]
+			for _, u := range rule.users {
+				if _, ok := users[u]; !ok { log.Printf("⚠️ %s:%d: no account %q", name, n+1, u) }
+			}
+		} else if len(fields) > 2 {
+			return fmt.Errorf("%s:%d: %s takes no user names", name, n+1, rule.who)
+		}
+		folderRules = append(folderRules, rule)
+	}
+	sort.SliceStable(folderRules, func(i, j int) bool { return len(folderRules[i].folder) > len(folderRules[j].folder) })
+	log.Printf("🔒 %d folder access rule(s) from %s", len(folderRules), name)
+	return nil
+}
+
+// canRead reports whether user ("" when logged out) may see name, a file or
+// folder of the library.
+func canRead(user, name string) bool {
+	name = strings.Trim(name, "/")
+	for _, rule := range folderRules {
+		if rule.folder != "" && name != rule.folder && !strings.HasPrefix(name, rule.folder+"/") { continue }
+		switch rule.who {
+		case "public":
+			return true
+		case "login":
+			return user != ""
+		}
+		return slices.Contains(rule.users, user)
+	}
+	return publicRead || len(users) == 0 || user != ""
+}
+
+// publicFolderUnder reports whether a folder access rule opens part of folder
+// to everyone.
+func publicFolderUnder(folder string) bool {
+	for _, rule := range folderRules {
+		if rule.who == "public" && (folder == "" || rule.folder == folder || strings.HasPrefix(rule.folder, folder+"/")) { return true }
+	}
+	return false
+}
+
+// allowRead checks the rules for name and answers the request itself when
+// they say no: the login page when logged out, otherwise a 404 so closed
+// folders look like they aren't there.
+func allowRead(w http.ResponseWriter, r *http.Request, name string) bool {
+	user := currentUser(r)
+	if canRead(user, name) { return true }
+	switch {
+	case user == "":
+		loginTarget(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		apiError(w, http.StatusNotFound, "not found")
+	default:
+		http.NotFound(w, r)
+	}
+	return false
+}
+
+// readableNames is names without the ones user can't see.
+func readableNames(user string, names []string) []string {
+	if len(folderRules) == 0 { return names }
+	var out []string
+	for _, name := range names {
+		if canRead(user, name) { out = append(out, name) }
+	}
+	return out
+}
+
+// visibleListing leaves out the files and folders user can't see.
+func visibleListing(user string, l folderListing) folderListing {
+	if len(folderRules) == 0 { return l }
+	out := folderListing{}
+	for _, f := range l.Files {
+		if name, _ := f["Name"].(string); canRead(user, name) { out.Files = append(out.Files, f) }
+	}
+	for _, folder := range l.Folders {
+		if canRead(user, folder) { out.Folders = append(out.Folders, folder) }
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ========== ADMIN DASHBOARD ==========
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	// Last 30 days of egress, newest first
+	var days []map[string]any
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		day := now.AddDate(0, 0, -i).Format("2006-01-02")
+		counts := egress.Day(day)
+		var total int64
+		row := map[string]any{ "Date": day }
+		for _, route := range egressRoutes {
+			row[route] = humanReadableSize(counts[route])
+			total += counts[route]
+		}
+		if total == 0 { continue }
+		row["Total"] = humanReadableSize(total)
+		days = append(days, row)
+	}
+
+	monthTotal := egress.MonthToDate()
+	cache := thumbs.Stats()
+	alert := ""
+	if egress.alertGB > 0 { alert = fmt.Sprintf("%.1f GB", egress.alertGB) }
+
+	b2Days, b2Month, b2Top := b2calls.Month()
+
+	tpls.ExecuteTemplate(w, "admin.html", map[string]any{
+		"BucketName":   bktName,
+		"EgressDays":   days,
+		"MonthEgress":  humanReadableSize(monthTotal),
+		"MonthCost":    fmt.Sprintf("$%.2f", egress.Cost(monthTotal)),
+		"PricePerGB":   fmt.Sprintf("$%.3f", egress.pricePerGB),
+		"FreeGB":       egress.freeGB,
+		"AlertAt":      alert,
+		"AlertReached": egress.alertGB > 0 && float64(monthTotal)/1e9 >= egress.alertGB,
+		"B2Days":       b2Days,
+		"B2Month":      b2Month,
+		"B2Top":        b2Top,
+		"B2Prices":     fmt.Sprintf("B $%.4f / 10k · C $%.4f / 1k after %d free per class per day", b2calls.priceB, b2calls.priceC, b2calls.freePerDay),
+		"Cache":        cache,
+		"CacheSize":    humanReadableSize(cache.Bytes),
+		"CacheMax":     humanReadableSize(cache.MaxBytes),
+		"DiskSize":     humanReadableSize(cache.DiskBytes),
+		"DiskMax":      humanReadableSize(cache.DiskMaxBytes),
+		"Backfill":     backfill.Status(),
+		"ThumbWidth":   thumbWidth,
+		"Catalog":      catalogStatusNow(),
+		"Stats":        statsView(),
+		"Quotas":       quotaViews(),
+	})
+}
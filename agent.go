@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ishushreyas/memories/client"
+)
+
+// ========== DESKTOP AGENT ==========
+// `memories agent` keeps folders of a desktop pushed to a server, over its
+// API (client/), so it needs none of the server's storage or DB:
+//
+//	AGENT_SERVER=https://photos.example.com AGENT_USER=alice AGENT_PASSWORD=... \
+//	  memories agent ~/Pictures=Desktop/ ~/Scans=Scans/
+//
+// Each DIR=FOLDER/ pair (or AGENT_FOLDERS, "DIR=FOLDER,..." when no
+// arguments are given) is scanned every AGENT_INTERVAL (default 1m), and new
+// and changed files go up by resumable upload, which picks up where a dropped
+// connection left off; a scan that can't reach the server is simply tried
+// again at the next one. Like the watched folders (watch.go), files modified
+// in the last WATCH_SETTLE (default 30s) wait for the next scan and dotfiles
+// stay behind; local deletes don't delete anything on the server.
+//
+// A new file whose bytes the library already has is skipped, and a name
+// that is taken is settled by AGENT_COLLISION (rename, the default, or reject
+// or overwrite; see uploadname.go). A changed file replaces the copy it
+// uploaded before, unless that copy changed on the server since: then both
+// are kept, the local one under a new name, and the conflict is logged.
+// Files refused for good (a rejected name, say) aren't tried again until
+// they change; over quota, the scan stops and tries again next time.
+//
+// AGENT_TOKEN is an API token to use; otherwise AGENT_USER and
+// AGENT_PASSWORD get one, which is kept with what was uploaded in
+// AGENT_STATE (default memories/agent.json in the user's config directory).
+// The agent runs in a terminal or as a login service (systemd --user, a
+// launchd agent, Task Scheduler); there is no tray icon, which would need a
+// GUI toolkit.
+
+// agentFile is what the agent knows of a local file it has sent.
+type agentFile struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA1     string    `json:"sha1"`
+	Name     string    `json:"name,omitempty"`    // where it went; "" if skipped or refused
+	Version  string    `json:"version,omitempty"` // of Name as uploaded
+}
+
+type agentState struct {
+	Token string               `json:"token,omitempty"`
+	Files map[string]agentFile `json:"files"` // by absolute local path
+}
+
+// agentPair is a local directory pushed to a library folder.
+type agentPair struct {
+	dir, folder string
+}
+
+var errAgentSignIn = errors.New("the server turned the token down")
+
+func agentCommand(ctx context.Context, args []string) error {
+	server := os.Getenv("AGENT_SERVER")
+	if server == "" { return usageError("agent needs AGENT_SERVER, the server's URL") }
+	if len(args) == 0 { args = splitList(os.Getenv("AGENT_FOLDERS")) }
+	if len(args) == 0 { return usageError("agent takes DIR=FOLDER/ pairs (or AGENT_FOLDERS)") }
+	var pairs []agentPair
+	for _, arg := range args {
+		i := strings.LastIndex(arg, "=")
+		if i <= 0 { return usageError(fmt.Sprintf("%q is not DIR=FOLDER/", arg)) }
+		dir, folder := arg[:i], strings.Trim(arg[i+1:], "/")
+		if st, err := os.Stat(dir); err != nil || !st.IsDir() { return fmt.Errorf("%s is not a directory", dir) }
+		pairs = append(pairs, agentPair{ dir, folder })
+	}
+
+	statePath, err := agentStatePath()
+	if err != nil { return err }
+	state, err := loadAgentState(statePath)
+	if err != nil { return err }
+	if os.Getenv("AGENT_TOKEN") == "" && os.Getenv("AGENT_USER") == "" && state.Token == "" { return usageError("agent needs AGENT_TOKEN, or AGENT_USER and AGENT_PASSWORD") }
+	c := client.New(server, os.Getenv("AGENT_TOKEN"))
+	if c.Token == "" { c.Token = state.Token }
+
+	// Ctrl-C stops between files, not halfway through an upload
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	every := envDuration("AGENT_INTERVAL", time.Minute)
+	for _, p := range pairs { fmt.Printf("🖥️ Pushing %s to %s/ on %s\n", p.dir, p.folder, server) }
+	fmt.Println("🖥️ Ctrl-C to stop")
+	for {
+		if c.Token == "" {
+			if err := agentSignIn(ctx, c, state, statePath); err != nil {
+				if ctx.Err() != nil { return nil }
+				// A wrong password won't get better: stop
+				if _, ok := err.(usageError); ok || client.IsStatus(err, http.StatusUnauthorized) { return err }
+				log.Printf("🖥️ Agent: %v", err)
+			}
+		}
+		if c.Token != "" {
+			for _, p := range pairs {
+				sent, err := agentScan(ctx, c, state, p)
+				if sent > 0 { log.Printf("🖥️ Agent %s: %d file(s) uploaded", p.dir, sent) }
+				if err == errAgentSignIn {
+					if os.Getenv("AGENT_TOKEN") != "" { saveAgentState(statePath, state); return fmt.Errorf("AGENT_TOKEN: %w", err) }
+					log.Printf("🖥️ Agent: %v, signing in again", err)
+					c.Token, state.Token = "", ""
+					break
+				}
+				if err != nil { log.Printf("🖥️ Agent %s: %v", p.dir, err) }
+			}
+			if err := saveAgentState(statePath, state); err != nil { log.Printf("🖥️ Agent: could not save %s: %v", statePath, err) }
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(every):
+		}
+	}
+}
+
+// agentSignIn gets c a token for AGENT_USER and AGENT_PASSWORD, and keeps it
+// in the state for the next run.
+func agentSignIn(ctx context.Context, c *client.Client, state *agentState, statePath string) error {
+	user := os.Getenv("AGENT_USER")
+	if user == "" { return usageError("the kept token was turned down; set AGENT_USER and AGENT_PASSWORD to sign in again") }
+	host, _ := os.Hostname()
+	token, err := c.Login(ctx, user, os.Getenv("AGENT_PASSWORD"), "memories agent on "+host)
+	if err != nil { return err }
+	log.Printf("🖥️ Agent signed in as %s", user)
+	state.Token = token
+	return saveAgentState(statePath, state)
+}
+
+// agentScan uploads what changed in p.dir since it was last sent.
+func agentScan(ctx context.Context, c *client.Client, state *agentState, p agentPair) (int, error) {
+	files, err := localFiles(p.dir, p.folder)
+	if err != nil { return 0, err }
+	settle := envDuration("WATCH_SETTLE", 30*time.Second)
+	sent := 0
+	for _, f := range files {
+		if ctx.Err() != nil { break }
+		st, err := os.Stat(f.local)
+		if err != nil || time.Since(st.ModTime()) < settle { continue }
+		key, _ := filepath.Abs(f.local)
+		seen, known := state.Files[key]
+		if known && seen.Size == st.Size() && seen.Modified.Equal(st.ModTime()) { continue }
+
+		size, sha, err := hashLocal(f.local)
+		if err != nil { log.Printf("🖥️ Agent %s: %v", f.local, err); continue }
+		next := agentFile{ Size: size, Modified: st.ModTime(), SHA1: sha, Name: seen.Name, Version: seen.Version }
+		if known && sha == seen.SHA1 { state.Files[key] = next; continue } // touched, not changed
+
+		opt := client.UploadOptions{ Folder: path.Dir(f.name), Name: path.Base(f.name), Collision: os.Getenv("AGENT_COLLISION"), SkipDuplicates: true }
+		if seen.Name != "" {
+			remote, err := c.Stat(ctx, seen.Name)
+			switch {
+			case err == nil && remote.Version == seen.Version:
+				// Still the copy sent before: replace it
+				opt = client.UploadOptions{ Folder: path.Dir(seen.Name), Name: path.Base(seen.Name), Collision: "overwrite" }
+			case err == nil:
+				log.Printf("⚠️ Agent: %s changed here and on the server, keeping both", seen.Name)
+				opt.Collision = "rename"
+			case client.IsStatus(err, http.StatusUnauthorized):
+				return sent, errAgentSignIn
+			case !client.IsStatus(err, http.StatusNotFound):
+				// Tried again next scan; a 404 (gone from the server) goes on
+				// to be sent like a new file
+				log.Printf("🖥️ Agent %s: %v", seen.Name, err)
+				continue
+			}
+		}
+
+		// A file started is finished; the scan stops before the next one
+		res, err := c.Upload(context.WithoutCancel(ctx), f.local, opt)
+		switch {
+		case client.IsStatus(err, http.StatusUnauthorized):
+			return sent, errAgentSignIn
+		case client.IsStatus(err, http.StatusRequestEntityTooLarge):
+			return sent, err
+		case client.IsStatus(err, http.StatusConflict), client.IsStatus(err, http.StatusBadRequest):
+			// Refused for good: not tried again until it changes
+			log.Printf("🖥️ Agent %s: %v", f.local, err)
+			next.Name, next.Version = "", ""
+		case err != nil:
+			log.Printf("🖥️ Agent %s: %v (trying again next scan)", f.local, err)
+			continue
+		case res.Skipped:
+			next.Name, next.Version = "", ""
+		default:
+			next.Name, next.Version = res.Name, ""
+			if remote, err := c.Stat(ctx, res.Name); err == nil { next.Version = remote.Version }
+			fmt.Println("✅", res.Name)
+			sent++
+		}
+		state.Files[key] = next
+	}
+	return sent, nil
+}
+
+// agentStatePath is AGENT_STATE, or agent.json in the user's config directory.
+func agentStatePath() (string, error) {
+	if p := os.Getenv("AGENT_STATE"); p != "" { return p, nil }
+	dir, err := os.UserConfigDir()
+	if err != nil { return "", fmt.Errorf("set AGENT_STATE: %w", err) }
+	return filepath.Join(dir, "memories", "agent.json"), nil
+}
+
+func loadAgentState(p string) (*agentState, error) {
+	state := &agentState{ Files: map[string]agentFile{} }
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) { return state, nil }
+	if err != nil { return nil, err }
+	if err := json.Unmarshal(data, state); err != nil { return nil, fmt.Errorf("%s: %w", p, err) }
+	if state.Files == nil { state.Files = map[string]agentFile{} }
+	return state, nil
+}
+
+// saveAgentState writes the state whole or not at all; it holds a token, so
+// only the user can read it.
+func saveAgentState(p string, state *agentState) error {
+	data, err := json.Marshal(state)
+	if err != nil { return err }
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil { return err }
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".agent-*")
+	if err != nil { return err }
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr == nil { werr = cerr }
+	if werr == nil { werr = os.Rename(tmp.Name(), p) }
+	if werr != nil { os.Remove(tmp.Name()) }
+	return werr
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ========== ALBUMS ==========
+// Albums are curated, ordered collections stored in the "albums" DB bucket.
+// An album may have a parent, so "Wedding → Ceremony → Reception" is three
+// albums linked by Parent. Items keep their manual order (index = position)
+// and may come from any folders. The cover is one of the items, the first
+// one unless picked.
+
+type album struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Cover       string    `json:"cover,omitempty"` // item shown on the album's card
+	Parent      string    `json:"parent,omitempty"`
+	Position    int       `json:"position"` // order among siblings
+	Items       []string  `json:"items"`    // object names, in display order
+	Created     time.Time `json:"created"`
+}
+
+func getAlbum(id string) (*album, bool) {
+	var a album
+	found, err := dbGet("albums", id, &a)
+	if !found || err != nil { return nil, false }
+	return &a, true
+}
+
+func saveAlbum(a *album) error { return dbPut("albums", a.ID, a) }
+
+func allAlbums() []*album {
+	var albums []*album
+	dbEach("albums", func(key string, data []byte) error {
+		var a album
+		if json.Unmarshal(data, &a) == nil { albums = append(albums, &a) }
+		return nil
+	})
+	return albums
+}
+
+// childAlbums returns the sub-albums of parent ("" = top level) in order.
+func childAlbums(parent string) []*album {
+	var children []*album
+	for _, a := range allAlbums() {
+		if a.Parent == parent { children = append(children, a) }
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Position != children[j].Position { return children[i].Position < children[j].Position }
+		return children[i].Created.Before(children[j].Created)
+	})
+	return children
+}
+
+// albumTrail returns the album and its ancestors, root first.
+func albumTrail(a *album) []*album {
+	trail := []*album{a}
+	for seen := map[string]bool{ a.ID: true }; a.Parent != "" && !seen[a.Parent]; {
+		parent, ok := getAlbum(a.Parent)
+		if !ok { break }
+		seen[parent.ID] = true
+		trail = append([]*album{parent}, trail...)
+		a = parent
+	}
+	return trail
+}
+
+// coverName is the item shown on the album's card, "" for an empty album.
+func (a *album) coverName() string {
+	if a.Cover != "" && slices.Contains(a.Items, a.Cover) { return a.Cover }
+	if len(a.Items) > 0 { return a.Items[0] }
+	return ""
+}
+
+// albumCard is the template data for an album's card, as user sees it: a
+// cover user can't see is left off and the count is of what they can.
+func albumCard(user string, a *album) map[string]any {
+	coverURL := appURL("/static/file-icon.png")
+	if c := a.coverName(); c != "" && isThumbable(c) && canRead(user, c) { coverURL = appURL("/thumb/" + c) }
+	return map[string]any{ "ID": a.ID, "Title": a.Title, "Description": a.Description, "Count": len(readableNames(user, a.Items)), "CoverURL": coverURL }
+}
+
+// deleteAlbum removes an album; its sub-albums move up to its parent.
+func deleteAlbum(a *album) error {
+	siblings := len(childAlbums(a.Parent))
+	for i, child := range childAlbums(a.ID) {
+		child.Parent, child.Position = a.Parent, siblings+i
+		if err := saveAlbum(child); err != nil { return err }
+	}
+	return dbDelete("albums", a.ID)
+}
+
+// albumPath is "Wedding → Ceremony", for pickers.
+func albumPath(a *album) string {
+	var titles []string
+	for _, t := range albumTrail(a) { titles = append(titles, t.Title) }
+	return strings.Join(titles, " → ")
+}
+
+// ========== ALBUM HANDLERS ==========
+// GET  /albums                  top-level albums
+// POST /albums                  create (title, parent)
+// GET  /albums/{id}             sub-albums + items
+// POST /albums/{id}/edit        rename / describe (title, description)
+// POST /albums/{id}/cover       pick the cover (name, one of the items)
+// POST /albums/{id}/delete      delete the album (not its files)
+// POST /albums/{id}/items       add an item (name)
+// POST /albums/{id}/remove      remove an item (name)
+// POST /albums/{id}/order       persist item order (JSON array of names)
+// POST /albums/{id}/order-albums persist sub-album order (JSON array of ids)
+func albumsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/albums"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	if r.Method == http.MethodGet {
+		if action != "" { http.NotFound(w, r); return }
+		renderAlbum(w, r, id)
+		return
+	}
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if currentUser(r) == "" { http.Error(w, "login required", 401); return }
+
+	if id == "" {
+		createAlbum(w, r)
+		return
+	}
+
+	a, ok := getAlbum(id)
+	if !ok { http.NotFound(w, r); return }
+
+	switch action {
+	case "edit":
+		title := strings.TrimSpace(r.FormValue("title"))
+		if title == "" { http.Error(w, "missing title", 400); return }
+		a.Title, a.Description = title, strings.TrimSpace(r.FormValue("description"))
+	case "cover":
+		name := r.FormValue("name")
+		if !slices.Contains(a.Items, name) { http.Error(w, "cover must be in the album", 400); return }
+		a.Cover = name
+	case "delete":
+		if err := deleteAlbum(a); err != nil { http.Error(w, "delete failed", 500); return }
+		back := "/albums"
+		if a.Parent != "" { back += "/" + a.Parent }
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	case "items":
+		name := r.FormValue("name")
+		if name == "" { http.Error(w, "missing name", 400); return }
+		if !slices.Contains(a.Items, name) { a.Items = append(a.Items, name) }
+	case "remove":
+		a.Items = slices.DeleteFunc(a.Items, func(n string) bool { return n == r.FormValue("name") })
+		if a.Cover == r.FormValue("name") { a.Cover = "" }
+	case "order":
+		var order []string
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil { http.Error(w, "bad json", 400); return }
+		a.Items = reorder(a.Items, order)
+	case "order-albums":
+		var order []string
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil { http.Error(w, "bad json", 400); return }
+		for i, childID := range order {
+			if child, ok := getAlbum(childID); ok && child.Parent == a.ID {
+				child.Position = i
+				saveAlbum(child)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.NotFound(w, r); return
+	}
+
+	if err := saveAlbum(a); err != nil { http.Error(w, "save failed", 500); return }
+	if action == "order" { w.WriteHeader(http.StatusNoContent); return }
+	http.Redirect(w, r, "/albums/"+a.ID, http.StatusSeeOther)
+}
+
+func createAlbum(w http.ResponseWriter, r *http.Request) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" { http.Error(w, "missing title", 400); return }
+	parent := r.FormValue("parent")
+	if parent != "" {
+		if _, ok := getAlbum(parent); !ok { http.Error(w, "unknown parent album", 400); return }
+	}
+
+	a := &album{ ID: newID(), Title: title, Description: strings.TrimSpace(r.FormValue("description")), Parent: parent, Position: len(childAlbums(parent)), Created: time.Now() }
+	if err := saveAlbum(a); err != nil { http.Error(w, "save failed", 500); return }
+	http.Redirect(w, r, "/albums/"+a.ID, http.StatusSeeOther)
+}
+
+// reorder applies the client's order to items, ignoring unknown names and
+// keeping any items the client didn't mention at the end.
+func reorder(items, order []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, name := range order {
+		if slices.Contains(items, name) && !seen[name] {
+			out = append(out, name)
+			seen[name] = true
+		}
+	}
+	for _, name := range items {
+		if !seen[name] { out = append(out, name) }
+	}
+	return out
+}
+
+func renderAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	data := map[string]any{
+		"BucketName": bktName,
+		"LoggedIn":   currentUser(r) != "",
+		"Album":      nil,
+		"Trail":      nil,
+	}
+
+	parent := ""
+	if id != "" {
+		a, ok := getAlbum(id)
+		if !ok { http.NotFound(w, r); return }
+		parent = a.ID
+		data["Album"] = a
+		data["Trail"] = albumTrail(a)
+
+		var items []map[string]any
+		for _, name := range readableNames(currentUser(r), a.Items) {
+			thumbURL := appURL("/static/file-icon.png")
+			if isThumbable(name) {
+				thumbURL = appURL("/thumb/" + name)
+			}
+			items = append(items, map[string]any{ "Name": name, "ThumbURL": thumbURL, "IsCover": name == a.coverName() })
+		}
+		data["Items"] = items
+	}
+
+	var children []map[string]any
+	for _, c := range childAlbums(parent) { children = append(children, albumCard(currentUser(r), c)) }
+	data["Children"] = children
+
+	tpls.ExecuteTemplate(w, "album.html", data)
+}
+
+// albumChoices lists every album with its full path, for the viewer picker.
+func albumChoices() []map[string]string {
+	var choices []map[string]string
+	for _, a := range allAlbums() {
+		choices = append(choices, map[string]string{ "ID": a.ID, "Path": albumPath(a) })
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i]["Path"] < choices[j]["Path"] })
+	return choices
+}
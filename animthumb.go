@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ========== ANIMATED VIDEO PREVIEWS ==========
+// With ANIM_THUMBS=webp (or gif, for ffmpeg builds without libwebp) video
+// cards in the grid play a short silent loop on hover instead of the still
+// thumbnail. The loop is ANIM_SECONDS (default 3) long at ANIM_FPS (default
+// 8) from VIDEO_THUMB_OFFSET on, thumbWidth wide, cut by ffmpeg on the first
+// hover and stored at thumb-anim/<key without ext>.webp tagged with the
+// original's version. At most ANIM_WORKERS (default 1) are cut at a time.
+// Off by default.
+//
+// GET /thumb-anim/{name}[?v=version]
+
+var knownAnimFormats = map[string]thumbFormat{
+	"webp": { "webp", ".webp", "image/webp", []string{ "-c:v", "libwebp", "-quality", "60", "-loop", "0" } },
+	"gif":  { "gif", ".gif", "image/gif", []string{ "-loop", "0" } },
+}
+
+var (
+	animFormat *thumbFormat // nil when animated previews are off
+	animSlots  chan struct{}
+)
+
+func initAnimThumbs() {
+	name := os.Getenv("ANIM_THUMBS")
+	if name == "" { return }
+	f, ok := knownAnimFormats[name]
+	if !ok { log.Printf("⚠️ Unknown ANIM_THUMBS %q (want webp or gif), animated previews are off", name); return }
+	animFormat = &f
+	animSlots = make(chan struct{}, max(envInt("ANIM_WORKERS", 1), 1))
+}
+
+// animKey maps an original's storage key to its animated preview in format f.
+func animKey(key string, f thumbFormat) string {
+	return path.Join("thumb-anim", strings.TrimSuffix(key, path.Ext(key))+f.ext)
+}
+
+// animURL is the hover preview for a grid card, "" if it has none.
+func animURL(name, version string) string {
+	if animFormat == nil || !isVideo(name) { return "" }
+	return appURL("/thumb-anim/" + name + "?v=" + version)
+}
+
+// renderAnimThumb cuts the loop from a local copy of the video.
+func renderAnimThumb(ctx context.Context, local string, f thumbFormat) ([]byte, error) {
+	out, err := createTemp("anim-*"+f.ext)
+	if err != nil { return nil, err }
+	out.Close()
+	defer os.Remove(out.Name())
+
+	filter := fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos", envInt("ANIM_FPS", 8), thumbWidth)
+	// GIF needs its own palette to look like anything
+	if f.name == "gif" { filter += ",split[a][b];[a]palettegen[p];[b][p]paletteuse" }
+	args := []string{ "-y", "-ss", strconv.FormatFloat(defaultFramePick().Offset, 'f', 3, 64), "-t", strconv.Itoa(envInt("ANIM_SECONDS", 3)), "-i", local, "-vf", filter, "-an" }
+	args = append(append(args, f.args...), out.Name())
+	if output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		log.Printf("FFmpeg animated preview failed: %s", string(output))
+		return nil, err
+	}
+	return os.ReadFile(out.Name())
+}
+
+// ========== ANIMATED PREVIEW HANDLER ==========
+func animThumbHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/thumb-anim/")
+	if animFormat == nil || name == "" || !isVideo(name) { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	f := *animFormat
+	key := storageKey(name)
+	serveDerived(w, r, key, animKey(key, f), f.contentType, func(ctx context.Context) ([]byte, error) {
+		select {
+		case animSlots <- struct{}{}:
+			defer func() { <-animSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		local, err := downloadTemp(ctx, key, filepath.Ext(name))
+		if err != nil { return nil, err }
+		defer os.Remove(local)
+		log.Printf("Cutting animated preview: %s", name)
+		return renderAnimThumb(ctx, local, f)
+	})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ========== API TOKENS ==========
+// API clients authenticate with "Authorization: Bearer <token>". Tokens are
+// either static (API_TOKENS="user:token,user2:token2") or issued by
+// POST /api/v1/token in exchange for a username and password. Issued tokens
+// are stored hashed in the "api_tokens" bucket and never expire until revoked.
+
+type apiToken struct {
+	User    string    `json:"user"`
+	Name    string    `json:"name,omitempty"` // client label, e.g. "Pixel 8"
+	Created time.Time `json:"created"`
+}
+
+var staticTokens = map[string]string{} // token -> user
+
+func initAPITokens() {
+	for _, pair := range splitList(os.Getenv("API_TOKENS")) {
+		user, token, ok := strings.Cut(pair, ":")
+		if !ok || user == "" || len(token) < 16 {
+			log.Println("⚠️ Ignoring malformed API_TOKENS entry (want user:token, token at least 16 chars)")
+			continue
+		}
+		staticTokens[token] = user
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenUser resolves a bearer token to its user, or "".
+func tokenUser(token string) string {
+	for t, user := range staticTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 { return user }
+	}
+	var t apiToken
+	if found, _ := dbGet("api_tokens", hashToken(token), &t); found {
+		if _, ok := users[t.User]; ok { return t.User }
+	}
+	return ""
+}
+
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok { return "" }
+	return strings.TrimSpace(token)
+}
+
+// ========== REST API ==========
+// All responses are JSON; errors are {"error": "..."} with a matching status.
+//
+// POST   /api/v1/token               {username, password, name} -> {token}
+// DELETE /api/v1/token               revoke the calling token
+// GET    /api/v1/files?prefix=&page= one folder level, paged
+// GET    /api/v1/files?sort=&type=&offset=  the same, reordered or filtered
+//                                    (needs the catalog, see sort.go)
+// GET    /api/v1/files?view=         favorites, hidden or all files (without,
+//                                    hidden ones are left out; see hidden.go)
+// GET    /api/v1/files?q=&sort=&type=  name search (needs the catalog)
+// POST   /api/v1/files               multipart upload (same fields as /upload)
+// GET    /api/v1/files/{name}        metadata (size, type, version, sidecar)
+// DELETE /api/v1/files/{name}        move to the trash (?permanent=true deletes)
+// GET    /api/v1/thumbnail/{name}    {url} of the thumbnail
+// *      /api/v1/uploads[/{id}]      resumable uploads, see chunked.go
+// POST   /api/v1/batch               one action over many files, see batch.go
+// GET    /api/v1/neighbors/{name}?sort=&type=  the files before and after
+//                                    it in its folder, see neighbors.go
+
+type apiFile struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Uploaded    time.Time `json:"uploaded"`
+	ContentType string    `json:"content_type"`
+	Version     string    `json:"version"`
+	ThumbURL    string    `json:"thumb_url,omitempty"`
+	ViewURL     string    `json:"view_url"`
+	DownloadURL string    `json:"download_url"`
+	Meta        *sidecar  `json:"meta,omitempty"`
+}
+
+func apiFileFrom(e map[string]any) apiFile {
+	name := e["Name"].(string)
+	f := apiFile{
+		Name:        name,
+		Size:        e["Bytes"].(int64),
+		Uploaded:    e["Uploaded"].(time.Time),
+		ContentType: e["ContentType"].(string),
+		Version:     e["Version"].(string),
+		ViewURL:     appURL("/view/" + name + "?raw=true"),
+		DownloadURL: appURL("/download/" + name),
+	}
+	if e["IsMedia"] == true { f.ThumbURL = e["ThumbURL"].(string) }
+	return f
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{ "error": msg })
+}
+
+// acceptsJSON implements the API's side of content negotiation: a client
+// that sends an Accept header must allow application/json.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" { return true }
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil { continue }
+		if mt == "application/json" || mt == "application/*" || mt == "*/*" { return true }
+	}
+	return false
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	if !acceptsJSON(r) { apiError(w, http.StatusNotAcceptable, "this API only serves application/json"); return }
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/")
+	resource, name, _ := strings.Cut(rest, "/")
+
+	switch resource {
+	case "token":
+		tokenHandler(w, r)
+		return
+	case "files", "thumbnail", "uploads", "batch", "neighbors":
+	default:
+		apiError(w, http.StatusNotFound, "unknown endpoint"); return
+	}
+
+	// Everything else follows the same read/write rules as the HTML UI
+	user := currentUser(r)
+	if r.Method == http.MethodGet {
+		folder := name
+		if folder == "" { folder = r.URL.Query().Get("prefix") }
+		if !allowRead(w, r, folder) { return }
+	}
+	if r.Method != http.MethodGet && user == "" { apiError(w, 401, "authentication required"); return }
+
+	if resource == "uploads" {
+		if user == "" { apiError(w, 401, "authentication required"); return }
+		uploadsHandler(w, r, user, name)
+		return
+	}
+	if resource == "neighbors" {
+		if r.Method != http.MethodGet { apiError(w, http.StatusMethodNotAllowed, "method not allowed"); return }
+		neighborsHandler(w, r, name)
+		return
+	}
+	if resource == "batch" {
+		if user == "" { apiError(w, 401, "authentication required"); return }
+		batchHandler(w, r)
+		return
+	}
+
+	// Changes run to completion even if the client goes away
+	ctx := r.Context()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead { ctx = context.WithoutCancel(ctx) }
+	switch {
+	case resource == "thumbnail" && r.Method == http.MethodGet && name != "":
+		f, ok := apiStat(ctx, name)
+		if !ok { apiError(w, 404, "not found"); return }
+		if f.ThumbURL == "" { apiError(w, 404, "no thumbnail for this file type"); return }
+		writeJSON(w, 200, map[string]string{ "url": f.ThumbURL })
+
+	case resource == "files" && name == "" && r.Method == http.MethodGet:
+		prefix := strings.Trim(r.URL.Query().Get("prefix"), "/")
+		listPrefix := keyPrefix
+		if prefix != "" { listPrefix = prefix + "/" }
+		if q := r.URL.Query().Get("q"); q != "" {
+			if !catalogReady() { apiError(w, http.StatusServiceUnavailable, "index is still being built"); return }
+			files := []apiFile{}
+			sortBy, kind := listOrder(r)
+			for _, e := range catalogSearch(listPrefix, q, sortBy, kind, envInt("SEARCH_LIMIT", 500)) {
+				if canRead(user, e.Name) { files = append(files, apiFileFrom(e.fileEntry())) }
+			}
+			writeJSON(w, 200, map[string]any{ "prefix": prefix, "q": q, "files": files })
+			return
+		}
+		view := listView(r)
+		if sortBy, kind := listOrder(r); sortBy != "name" || kind != "all" || needsCatalog(view) {
+			if !catalogReady() { apiError(w, http.StatusServiceUnavailable, "index is still being built"); return }
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			offset = max(offset, 0)
+			l, more := catalogSortedPage(listPrefix, sortBy, kind, view, offset, envInt("PAGE_SIZE", 100))
+			visible := visibleListing(user, l)
+			files := []apiFile{}
+			for _, e := range visible.Files { files = append(files, apiFileFrom(e)) }
+			resp := map[string]any{ "prefix": prefix, "sort": sortBy, "type": kind, "view": view, "files": files, "folders": visible.Folders }
+			if more { resp["next_offset"] = offset + len(l.Files) }
+			writeJSON(w, 200, resp)
+			return
+		}
+		tok := decodePageToken(r.URL.Query().Get("page"))
+		l, next, err := listPage(ctx, listPrefix, tok.Start, envInt("PAGE_SIZE", 100))
+		if err != nil { apiError(w, 502, "listing failed"); return }
+		l = visibleListing(user, filterView(l, view))
+
+		files := []apiFile{}
+		for _, e := range l.Files { files = append(files, apiFileFrom(e)) }
+		resp := map[string]any{ "prefix": prefix, "files": files, "folders": l.Folders }
+		if next != "" { resp["next_page"] = tok.next(next) }
+		if prev, ok := tok.prev(); ok { resp["prev_page"] = prev }
+		writeJSON(w, 200, resp)
+
+	case resource == "files" && name == "" && r.Method == http.MethodPost:
+		results, err := receiveUploads(r)
+		if err != nil { apiError(w, 400, err.Error()); return }
+		status := http.StatusCreated
+		for _, res := range results {
+			if res.Error != "" { status = http.StatusMultiStatus }
+		}
+		writeJSON(w, status, results)
+
+	case resource == "files" && name != "" && r.Method == http.MethodGet:
+		f, ok := apiStat(ctx, name)
+		if !ok { apiError(w, 404, "not found"); return }
+		if sc, ok := readSidecar(ctx, name); ok { f.Meta = &sc }
+		writeJSON(w, 200, f)
+
+	case resource == "files" && name != "" && r.Method == http.MethodDelete:
+		if _, ok := apiStat(ctx, name); !ok { apiError(w, 404, "not found"); return }
+		if err := removeFile(ctx, name, r.URL.Query().Get("permanent") == "true"); err != nil { apiError(w, 502, "delete failed"); return }
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiStat looks up one file by display name.
+func apiStat(ctx context.Context, name string) (apiFile, bool) {
+	if casMode {
+		if e, ok := casLookup(name); ok { return apiFileFrom(fileEntry(name, e.Size, e.Uploaded, e.Hash)), true }
+	}
+	attrs, err := store.Attrs(ctx, name)
+	if err != nil { return apiFile{}, false }
+	return apiFileFrom(fileEntry(name, attrs.Size, attrs.Modified, sourceVersion(attrs))), true
+}
+
+// tokenHandler issues (POST) or revokes (DELETE) bearer tokens.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Name     string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apiError(w, 400, "bad json"); return }
+
+		ip := clientIP(r)
+		if wait := throttle.Locked(req.Username, ip); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			apiError(w, http.StatusTooManyRequests, "too many failed attempts"); return
+		}
+		if !checkCredentials(req.Username, req.Password) {
+			throttle.Fail(req.Username, ip)
+			log.Printf("[auth] API token denied for user=%q from ip=%s", req.Username, ip)
+			apiError(w, 401, "invalid username or password"); return
+		}
+		throttle.Succeed(req.Username, ip)
+
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		token := hex.EncodeToString(raw)
+		if err := dbPut("api_tokens", hashToken(token), apiToken{ User: req.Username, Name: req.Name, Created: time.Now() }); err != nil {
+			apiError(w, 500, "could not save token"); return
+		}
+		log.Printf("[auth] API token issued for user=%q (%s) from ip=%s", req.Username, req.Name, ip)
+		writeJSON(w, 201, map[string]string{ "token": token, "user": req.Username })
+
+	case http.MethodDelete:
+		token := bearerToken(r)
+		if token == "" || tokenUser(token) == "" { apiError(w, 401, "authentication required"); return }
+		if _, static := staticTokens[token]; static { apiError(w, 409, "static tokens are revoked by removing them from API_TOKENS"); return }
+		dbDelete("api_tokens", hashToken(token))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
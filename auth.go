@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ========== AUTH ==========
+// Accounts come from AUTH_USER with AUTH_PASSWORD (hashed at startup) or
+// AUTH_PASSWORD_HASH, and/or USERS_FILE, an htpasswd-style file of
+// "user:bcrypt-hash" lines. Sessions are stateless HMAC-signed cookies:
+// "user|expiryUnix|signature".
+//
+// Writes (upload, delete, edits) always need a login. Reads need one too
+// unless PUBLIC_READ=1. With no accounts configured the gallery stays
+// readable by everyone and all writes are disabled. FOLDER_ACCESS_FILE
+// changes who may read per folder (see acl.go).
+
+const sessionCookie = "session"
+const sessionTTL = 7 * 24 * time.Hour
+
+var (
+	users         = map[string][]byte{} // user -> bcrypt hash
+	publicRead    bool
+	sessionSecret []byte
+)
+
+// dummyHash is compared against for unknown users so a miss takes as long as
+// a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("memories"), bcrypt.DefaultCost)
+
+func initAuth() {
+	if u := os.Getenv("AUTH_USER"); u != "" {
+		if h := os.Getenv("AUTH_PASSWORD_HASH"); h != "" {
+			users[u] = []byte(h)
+		} else if p := os.Getenv("AUTH_PASSWORD"); p != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+			if err != nil { log.Fatal("Password hash error:", err) }
+			users[u] = hash
+		}
+	}
+	if f := os.Getenv("USERS_FILE"); f != "" {
+		if err := loadUsersFile(f); err != nil { log.Fatal("Users file error:", err) }
+	}
+	if f := os.Getenv("FOLDER_ACCESS_FILE"); f != "" {
+		if err := loadFolderRules(f); err != nil { log.Fatal("Folder access file error:", err) }
+	}
+	publicRead = os.Getenv("PUBLIC_READ") == "1"
+
+	if s := os.Getenv("SESSION_SECRET"); s != "" {
+		sessionSecret = []byte(s)
+	} else {
+		sessionSecret = make([]byte, 32)
+		rand.Read(sessionSecret)
+		log.Println("⚠️ SESSION_SECRET not set, sessions will not survive a restart")
+	}
+	switch {
+	case len(users) == 0:
+		log.Println("⚠️ No accounts configured (AUTH_USER or USERS_FILE): gallery is public and read-only")
+	case publicRead:
+		log.Printf("🔒 %d account(s); public read enabled", len(users))
+	default:
+		log.Printf("🔒 %d account(s); login required", len(users))
+	}
+}
+
+// loadUsersFile reads "user:hash" lines; blank lines and # comments are
+// skipped. Only bcrypt hashes ($2a$, $2b$, $2y$) are accepted.
+func loadUsersFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil { return err }
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" { return fmt.Errorf("%s:%d: want user:hash", name, n+1) }
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil { return fmt.Errorf("%s:%d: %v", name, n+1, err) }
+		users[user] = []byte(hash)
+	}
+	return nil
+}
+
+func signSession(user string, expires time.Time) string {
+	payload := user + "|" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// currentUser returns the logged-in user for the request, or "" if none.
+// API clients are identified by a bearer token instead of the cookie.
+func currentUser(r *http.Request) string {
+	if token := bearerToken(r); token != "" { return tokenUser(token) }
+
+	c, err := r.Cookie(sessionCookie)
+	if err != nil { return "" }
+
+	encoded, sig, ok := strings.Cut(c.Value, ".")
+	if !ok { return "" }
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil { return "" }
+
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write(payload)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(sig)) { return "" }
+
+	user, exp, ok := strings.Cut(string(payload), "|")
+	if !ok { return "" }
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix { return "" }
+	return user
+}
+
+func checkCredentials(user, password string) bool {
+	hash, ok := users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// basicCreds remembers Basic credentials that checked out (by a hash of the
+// header) for basicCredsTTL, since WebDAV clients and feed readers send them
+// with every request and bcrypt is slow on purpose.
+var basicCreds sync.Map // sha256 of the Authorization header -> basicLogin
+
+type basicLogin struct {
+	user    string
+	expires time.Time
+}
+
+const basicCredsTTL = 10 * time.Minute
+
+// basicUser checks the request's HTTP Basic credentials, for clients that
+// can't keep a session cookie.
+func basicUser(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok { return "", false }
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	key := hex.EncodeToString(sum[:])
+	if l, ok := basicCreds.Load(key); ok && time.Now().Before(l.(basicLogin).expires) { return l.(basicLogin).user, true }
+
+	ip := clientIP(r)
+	if throttle.Locked(user, ip) > 0 { return "", false }
+	if !checkCredentials(user, password) {
+		throttle.Fail(user, ip)
+		log.Printf("[auth] Basic authentication failure for user=%q from ip=%s", user, ip)
+		return "", false
+	}
+	throttle.Succeed(user, ip)
+	basicCreds.Store(key, basicLogin{ user, time.Now().Add(basicCredsTTL) })
+	return user, true
+}
+
+// loginTarget sends browsers to the login page and API/asset requests a 401.
+func loginTarget(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") { apiError(w, http.StatusUnauthorized, "authentication required"); return }
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	http.Error(w, "login required", http.StatusUnauthorized)
+}
+
+// requireLogin guards write routes (and admin pages).
+func requireLogin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) == "" { loginTarget(w, r); return }
+		h(w, r)
+	}
+}
+
+// requireRead guards read routes: open in public-read mode or when no accounts
+// exist, otherwise login required. Handlers still check writes themselves.
+// Routes serving one file or folder check folder access instead (acl.go).
+func requireRead(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !publicRead && len(users) > 0 && currentUser(r) == "" { loginTarget(w, r); return }
+		h(w, r)
+	}
+}
+
+// ========== LOGIN HANDLERS ==========
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		tpls.ExecuteTemplate(w, "login.html", map[string]any{ "BucketName": bktName, "Error": "", "Next": r.URL.Query().Get("next") })
+		return
+	}
+
+	user := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	ip := clientIP(r)
+
+	if wait := throttle.Locked(user, ip); wait > 0 {
+		log.Printf("[auth] blocked login for user=%q from ip=%s (locked for %s)", user, ip, wait.Round(time.Second))
+		w.WriteHeader(http.StatusTooManyRequests)
+		tpls.ExecuteTemplate(w, "login.html", map[string]any{ "BucketName": bktName, "Error": "Too many failed attempts. Try again later.", "Next": r.FormValue("next") })
+		return
+	}
+
+	if !checkCredentials(user, password) {
+		throttle.Fail(user, ip)
+		log.Printf("[auth] authentication failure for user=%q from ip=%s", user, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		tpls.ExecuteTemplate(w, "login.html", map[string]any{ "BucketName": bktName, "Error": "Invalid username or password", "Next": r.FormValue("next") })
+		return
+	}
+
+	throttle.Succeed(user, ip)
+	log.Printf("[auth] login success for user=%q from ip=%s", user, ip)
+
+	expires := time.Now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSession(user, expires),
+		Path:     appURL("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	http.Redirect(w, r, localPath(r.FormValue("next")), http.StatusSeeOther)
+}
+
+// localPath is next if it is a path on this site, else "/". Browsers read
+// "/\host" as "//host", so backslashes are refused along with schemes,
+// hosts and paths starting "//".
+func localPath(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.ContainsRune(next+u.Path, '\\') { return "/" }
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || !strings.HasPrefix(next, "/") { return "/" }
+	return next
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{ Name: sessionCookie, Value: "", Path: appURL("/"), MaxAge: -1 })
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
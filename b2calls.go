@@ -0,0 +1,183 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== B2 TRANSACTIONS ==========
+// Every B2 API call the app makes goes through keyTransport, which counts
+// them per API per day. Like egress, counters are kept in memory and merged
+// into the "b2_calls" DB bucket (key "2006-01-02", value {"b2_list_file_names":
+// n, ...}) every minute.
+//
+// B2 bills calls by class, each with 2,500 free per day:
+//
+//	Class A  uploads, deletes, hides              free
+//	Class B  downloads, b2_get_file_info          B2_CLASS_B_PRICE (default $0.004) per 10,000
+//	Class C  listings, copies, authorizations     B2_CLASS_C_PRICE (default $0.004) per 1,000
+//
+// B2_FREE_CALLS_PER_DAY changes the allowance.
+
+var b2ClassA = []string{
+	"b2_cancel_large_file", "b2_delete_file_version", "b2_finish_large_file", "b2_get_upload_part_url",
+	"b2_get_upload_url", "b2_hide_file", "b2_start_large_file", "b2_upload_file", "b2_upload_part",
+}
+
+var b2ClassB = []string{ "b2_download_file_by_id", "b2_download_file_by_name", "b2_get_file_info" }
+
+// b2Class is "A", "B" or "C"; anything not listed is billed as C.
+func b2Class(api string) string {
+	switch {
+	case slices.Contains(b2ClassA, api):
+		return "A"
+	case slices.Contains(b2ClassB, api):
+		return "B"
+	}
+	return "C"
+}
+
+// b2APIName names the call a request to B2 makes: "/b2api/v2/b2_upload_file"
+// is b2_upload_file, "/file/bucket/name" (GET or HEAD) a download by name.
+func b2APIName(req *http.Request) string {
+	p := req.URL.Path
+	if strings.HasPrefix(p, "/file/") { return "b2_download_file_by_name" }
+	if i := strings.LastIndex(p, "/b2_"); i >= 0 { return p[i+1:] }
+	return ""
+}
+
+type b2CallTracker struct {
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // day -> API -> calls not yet flushed
+
+	priceB     float64 // USD per 10,000 class B calls
+	priceC     float64 // USD per 1,000 class C calls
+	freePerDay int64   // per class
+}
+
+var b2calls *b2CallTracker
+
+func newB2CallTracker() *b2CallTracker {
+	return &b2CallTracker{
+		pending:    map[string]map[string]int64{},
+		priceB:     envFloat("B2_CLASS_B_PRICE", 0.004),
+		priceC:     envFloat("B2_CLASS_C_PRICE", 0.004),
+		freePerDay: int64(envInt("B2_FREE_CALLS_PER_DAY", 2500)),
+	}
+}
+
+// send makes a B2 request and counts it once B2 has answered.
+func send(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && b2calls != nil { b2calls.Add(b2APIName(req)) }
+	return resp, err
+}
+
+func (t *b2CallTracker) Add(api string) {
+	if api == "" { return }
+	day := time.Now().Format("2006-01-02")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[day] == nil { t.pending[day] = map[string]int64{} }
+	t.pending[day][api]++
+}
+
+func (t *b2CallTracker) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[string]map[string]int64{}
+	t.mu.Unlock()
+	if len(pending) == 0 { return }
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("b2_calls"))
+		if err != nil { return err }
+		for day, apis := range pending {
+			counts := map[string]int64{}
+			if data := b.Get([]byte(day)); data != nil { json.Unmarshal(data, &counts) }
+			for api, n := range apis { counts[api] += n }
+			data, _ := json.Marshal(counts)
+			if err := b.Put([]byte(day), data); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil { log.Println("Failed to persist B2 call counters:", err) }
+}
+
+func (t *b2CallTracker) run() {
+	for range time.Tick(time.Minute) { t.flush() }
+}
+
+// Day returns the calls per API for a single day, including unflushed ones.
+func (t *b2CallTracker) Day(day string) map[string]int64 {
+	counts := map[string]int64{}
+	dbGet("b2_calls", day, &counts)
+	t.mu.Lock()
+	for api, n := range t.pending[day] { counts[api] += n }
+	t.mu.Unlock()
+	return counts
+}
+
+// Classes sums a day's calls per class.
+func (t *b2CallTracker) Classes(counts map[string]int64) map[string]int64 {
+	classes := map[string]int64{ "A": 0, "B": 0, "C": 0 }
+	for api, n := range counts { classes[b2Class(api)] += n }
+	return classes
+}
+
+// Cost estimates one day's bill; the free allowance is per day, so a month
+// is the sum of its days.
+func (t *b2CallTracker) Cost(classes map[string]int64) float64 {
+	billed := func(n int64) float64 { return float64(max(n-t.freePerDay, 0)) }
+	return billed(classes["B"])*t.priceB/10000 + billed(classes["C"])*t.priceC/1000
+}
+
+// b2CallRow is a day (or the month) on the admin page.
+type b2CallRow struct {
+	Date     string
+	A, B, C  int64
+	Cost     string
+	OverFree bool // class B or C past the free allowance
+}
+
+// Month returns the days of the current month with calls, newest first,
+// month-to-date totals and the busiest APIs over the month.
+func (t *b2CallTracker) Month() (days []b2CallRow, total b2CallRow, top []map[string]any) {
+	now := time.Now()
+	perAPI := map[string]int64{}
+	var cost float64
+	for d := now; d.Month() == now.Month(); d = d.AddDate(0, 0, -1) {
+		counts := t.Day(d.Format("2006-01-02"))
+		for api, n := range counts { perAPI[api] += n }
+		c := t.Classes(counts)
+		if c["A"]+c["B"]+c["C"] == 0 { continue }
+		dayCost := t.Cost(c)
+		cost += dayCost
+		days = append(days, b2CallRow{
+			Date: d.Format("2006-01-02"), A: c["A"], B: c["B"], C: c["C"],
+			Cost: fmt.Sprintf("$%.4f", dayCost), OverFree: c["B"] > t.freePerDay || c["C"] > t.freePerDay,
+		})
+		total.A, total.B, total.C = total.A+c["A"], total.B+c["B"], total.C+c["C"]
+	}
+	total.Cost = fmt.Sprintf("$%.2f", cost)
+
+	apis := make([]string, 0, len(perAPI))
+	for api := range perAPI { apis = append(apis, api) }
+	slices.SortFunc(apis, func(a, b string) int {
+		if c := cmp.Compare(perAPI[b], perAPI[a]); c != 0 { return c }
+		return strings.Compare(a, b)
+	})
+	for _, api := range apis[:min(len(apis), 10)] {
+		top = append(top, map[string]any{ "API": api, "Class": b2Class(api), "Calls": perAPI[api] })
+	}
+	return days, total, top
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ========== RESTRICTED B2 KEYS ==========
+// blazer resolves buckets via b2_list_buckets, which keys without the
+// listBuckets capability can't call. keyTransport sits under the B2 client,
+// remembers what b2_authorize_account says the key is allowed to do, and
+// answers b2_list_buckets itself for bucket-restricted keys that lack it.
+// Calls that do reach B2 are counted (see b2calls.go).
+
+type keyAllowance struct {
+	Capabilities []string `json:"capabilities"`
+	BucketID     string   `json:"bucketId"`
+	BucketName   string   `json:"bucketName"`
+	NamePrefix   string   `json:"namePrefix"`
+}
+
+func (a keyAllowance) can(capability string) bool { return slices.Contains(a.Capabilities, capability) }
+
+type keyTransport struct {
+	mu        sync.Mutex
+	accountID string
+	allowed   keyAllowance
+	session   b2Session
+}
+
+// b2Session is where and how to call the B2 API directly, for the few calls
+// blazer doesn't make or doesn't expose (see b2versions.go, directupload.go).
+type b2Session struct {
+	APIURL      string `json:"apiUrl"`
+	DownloadURL string `json:"downloadUrl"`
+	Token       string `json:"authorizationToken"`
+}
+
+var keyInfo = &keyTransport{}
+
+// keyPrefix is the name prefix the key is restricted to ("" if unrestricted),
+// inside B2_PREFIX when that is set. All listings must stay under it or B2
+// rejects them.
+var keyPrefix string
+
+func (t *keyTransport) allowance() keyAllowance {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.allowed
+}
+
+func (t *keyTransport) currentSession() b2Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.session
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/b2_authorize_account"):
+		resp, err := send(req)
+		if err != nil || resp.StatusCode != 200 { return resp, err }
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil { return nil, err }
+
+		var auth struct {
+			b2Session
+			AccountID string       `json:"accountId"`
+			Allowed   keyAllowance `json:"allowed"`
+		}
+		if json.Unmarshal(body, &auth) == nil {
+			t.mu.Lock()
+			t.accountID, t.allowed, t.session = auth.AccountID, auth.Allowed, auth.b2Session
+			t.mu.Unlock()
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+
+	case strings.HasSuffix(req.URL.Path, "/b2_list_buckets"):
+		t.mu.Lock()
+		a, account := t.allowed, t.accountID
+		t.mu.Unlock()
+		if a.BucketID == "" || a.can("listBuckets") { break }
+
+		if req.Body != nil { req.Body.Close() }
+		body, _ := json.Marshal(map[string]any{
+			"buckets": []map[string]any{{
+				"accountId":  account,
+				"bucketId":   a.BucketID,
+				"bucketName": a.BucketName,
+				"bucketType": "allPrivate",
+			}},
+		})
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{ "Content-Type": {"application/json"} },
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return send(req)
+}
+
+// checkKeyCapabilities logs what the key is restricted to and fails fast when
+// it can't possibly serve the gallery.
+func checkKeyCapabilities() {
+	a := keyInfo.allowance()
+	keyPrefix = a.NamePrefix
+	if keyPrefix != "" && namePrefix != "" {
+		switch {
+		case strings.HasPrefix(keyPrefix, namePrefix): keyPrefix = keyPrefix[len(namePrefix):]
+		case strings.HasPrefix(namePrefix, keyPrefix): keyPrefix = ""
+		default: log.Fatalf("❌ B2 key is restricted to prefix %q, outside B2_PREFIX %q", a.NamePrefix, namePrefix)
+		}
+	}
+
+	if a.BucketID != "" {
+		log.Printf("🔑 B2 key is restricted to bucket %q", a.BucketName)
+		if a.BucketName != "" && a.BucketName != bktName {
+			log.Fatalf("❌ B2 key only allows bucket %q but B2_BUCKET_NAME is %q", a.BucketName, bktName)
+		}
+		if !a.can("listBuckets") {
+			log.Println("🔑 B2 key has no listBuckets capability, resolving the bucket from the key itself")
+		}
+	}
+	if keyPrefix != "" {
+		log.Printf("🔑 B2 key is restricted to prefix %q, listings are scoped to it", keyPrefix)
+		if !strings.HasPrefix("thumb/", keyPrefix) {
+			log.Printf("⚠️ thumb/ is outside the key's prefix %q, thumbnails cannot be stored", keyPrefix)
+		}
+	}
+
+	required := []struct{ capability, usedFor string; fatal bool }{
+		{"listFiles", "listing the gallery", true},
+		{"readFiles", "viewing and downloading", true},
+		{"writeFiles", "uploads and thumbnails", false},
+	}
+	for _, req := range required {
+		if a.can(req.capability) { continue }
+		if req.fatal {
+			log.Fatalf("❌ B2 key is missing the %s capability (needed for %s)", req.capability, req.usedFor)
+		}
+		log.Printf("⚠️ B2 key is missing the %s capability (needed for %s)", req.capability, req.usedFor)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kurin/blazer/base"
+)
+
+// ========== B2 FILE VERSIONS ==========
+// B2 keeps every version of a name: an upload to a used name adds a newer
+// one, and b2_delete_file_version removes one at a time (Delete loops over
+// them all, see storage_b2.go). blazer lists versions but hides
+// their file IDs, and has no call to read or copy a version by ID, so these
+// go to the B2 API directly with the session keyTransport saw at
+// authorization (still through it, so they are counted):
+//
+//	b2_list_file_versions    the versions of one name, newest first
+//	b2_download_file_by_id   read an older version
+//	b2_copy_file             restore one: a server-side copy as the newest
+//	b2_delete_file_version   drop one for good
+
+// objectVersion is one stored version of a key.
+type objectVersion struct {
+	ID       string
+	Size     int64
+	SHA1     string
+	Uploaded time.Time
+	Hidden   bool // a hide marker: the name looked deleted from here on
+}
+
+// versionedStorage is implemented by backends that keep old versions. IDs
+// are the backend's own; callers check one is among key's Versions first.
+type versionedStorage interface {
+	// Versions lists key's versions, newest first.
+	Versions(ctx context.Context, key string) ([]objectVersion, error)
+	GetVersion(ctx context.Context, key, id string) (io.ReadCloser, error)
+	// RestoreVersion makes a copy of version id key's newest version.
+	RestoreVersion(ctx context.Context, key, id string) error
+	DeleteVersion(ctx context.Context, key, id string) error
+}
+
+// versionsOf is the backend holding key, if it keeps versions, and key's
+// name there.
+func versionsOf(key string) (versionedStorage, string, bool) {
+	s, key := backendOf(key)
+	vs, ok := s.(versionedStorage)
+	return vs, key, ok
+}
+
+// b2Error is the body B2 answers a failed call with.
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var b2Client = &http.Client{ Transport: keyInfo }
+
+// b2Call POSTs req to a B2 API and decodes the answer into resp,
+// re-authorizing once if the session has expired.
+func (s *b2Storage) b2Call(ctx context.Context, api string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil { return err }
+	for attempt := 0; ; attempt++ {
+		sess := keyInfo.currentSession()
+		hreq, err := http.NewRequestWithContext(ctx, "POST", sess.APIURL+"/b2api/v2/"+api, bytes.NewReader(body))
+		if err != nil { return err }
+		hreq.Header.Set("Authorization", sess.Token)
+		err = b2Do(hreq, resp)
+		if attempt == 0 && isExpiredToken(err) {
+			if err := s.reauthorize(ctx); err != nil { return err }
+			continue
+		}
+		return err
+	}
+}
+
+// b2Do sends a B2 request and decodes a JSON answer into resp (if non-nil).
+func b2Do(req *http.Request, resp any) error {
+	r, err := b2Client.Do(req)
+	if err != nil { return err }
+	defer r.Body.Close()
+	if r.StatusCode != 200 { return b2Failure(req, r) }
+	if resp == nil { return nil }
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// b2Failure turns a B2 error answer into an error, wrapping errNotFound for
+// a missing file.
+func b2Failure(req *http.Request, r *http.Response) error {
+	var e b2Error
+	json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&e)
+	e.Status = r.StatusCode
+	api := b2APIName(req)
+	switch {
+	case e.Status == 404 || e.Code == "not_found" || e.Code == "file_not_present":
+		return fmt.Errorf("%s: %s: %w", api, e.Message, errNotFound)
+	case e.Status == 401:
+		return fmt.Errorf("%s: %w", api, &e)
+	}
+	return fmt.Errorf("%s: %s (%d %s)", api, e.Message, e.Status, e.Code)
+}
+
+func (e *b2Error) Error() string { return e.Message + " (" + e.Code + ")" }
+
+func isExpiredToken(err error) bool {
+	var e *b2Error
+	return errors.As(err, &e) && (e.Code == "expired_auth_token" || e.Code == "bad_auth_token")
+}
+
+// reauthorize gets a fresh session (tokens last 24h), for blazer's base
+// client too.
+func (s *b2Storage) reauthorize(ctx context.Context) error {
+	fresh, err := base.AuthorizeAccount(ctx, s.creds[0], s.creds[1], base.Transport(keyInfo))
+	if err != nil { return err }
+	s.api.Update(fresh)
+	return nil
+}
+
+func (s *b2Storage) Versions(ctx context.Context, key string) ([]objectVersion, error) {
+	type file struct {
+		FileID          string            `json:"fileId"`
+		FileName        string            `json:"fileName"`
+		Action          string            `json:"action"`
+		ContentLength   int64             `json:"contentLength"`
+		ContentSha1     string            `json:"contentSha1"`
+		FileInfo        map[string]string `json:"fileInfo"`
+		UploadTimestamp int64             `json:"uploadTimestamp"`
+	}
+	var versions []objectVersion
+	startName, startID := key, ""
+	for {
+		var page struct {
+			Files        []file  `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+			NextFileID   *string `json:"nextFileId"`
+		}
+		req := map[string]any{ "bucketId": s.listBucket.ID, "prefix": key, "startFileName": startName, "maxFileCount": 1000 }
+		if startID != "" { req["startFileId"] = startID }
+		if err := s.b2Call(ctx, "b2_list_file_versions", req, &page); err != nil { return nil, err }
+		for _, f := range page.Files {
+			// The prefix also matches longer names, which sort after this one
+			if f.FileName != key { return versions, nil }
+			if f.Action != "upload" && f.Action != "hide" { continue }
+			v := objectVersion{ ID: f.FileID, Size: f.ContentLength, SHA1: f.ContentSha1, Uploaded: time.UnixMilli(f.UploadTimestamp), Hidden: f.Action == "hide" }
+			if sha, ok := f.FileInfo["large_file_sha1"]; ok { v.SHA1 = sha }
+			versions = append(versions, v)
+		}
+		if page.NextFileName == nil || *page.NextFileName != key { return versions, nil }
+		startName, startID = *page.NextFileName, ""
+		if page.NextFileID != nil { startID = *page.NextFileID }
+	}
+}
+
+func (s *b2Storage) GetVersion(ctx context.Context, key, id string) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		sess := keyInfo.currentSession()
+		req, err := http.NewRequestWithContext(ctx, "GET", sess.DownloadURL+"/b2api/v2/b2_download_file_by_id?fileId="+url.QueryEscape(id), nil)
+		if err != nil { return nil, err }
+		req.Header.Set("Authorization", sess.Token)
+		r, err := b2Client.Do(req)
+		if err != nil { return nil, err }
+		if r.StatusCode == 200 { return r.Body, nil }
+		err = b2Failure(req, r)
+		r.Body.Close()
+		if attempt == 0 && isExpiredToken(err) {
+			if err := s.reauthorize(ctx); err != nil { return nil, err }
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (s *b2Storage) RestoreVersion(ctx context.Context, key, id string) error {
+	return s.b2Call(ctx, "b2_copy_file", map[string]any{ "sourceFileId": id, "fileName": key }, nil)
+}
+
+func (s *b2Storage) DeleteVersion(ctx context.Context, key, id string) error {
+	return s.b2Call(ctx, "b2_delete_file_version", map[string]any{ "fileName": key, "fileId": id }, nil)
+}
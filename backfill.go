@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== THUMBNAIL BACKFILL ==========
+// Walks the whole bucket, finds media without a thumb/ object and renders
+// them with BACKFILL_WORKERS (default 2) workers, so the first gallery visit
+// doesn't have to. JPEGs without a sidecar (uploaded before EXIF was read)
+// get their EXIF extracted too, which puts them on the map, and videos not
+// yet run through ffprobe get their duration and resolution. Runs on demand
+// from /admin/backfill, or at startup with BACKFILL_ON_START=1. Only one run at a time. On shutdown no new jobs are
+// started, but thumbnails already rendering are finished.
+//
+// Pointed at a bucket that already holds thousands of photos, a run at
+// startup keeps the first visits from rendering them all at once. Files in
+// shallower folders go first, so the pages a visitor opens first are ready
+// soonest, and BACKFILL_RATE=2 caps the run at two files a second (default
+// no cap) to leave B2 transactions, CPU and the THUMB_WORKERS slots for
+// visitors. Progress, rate and time left are logged every
+// backfillLogInterval and shown on /admin.
+//
+// A regenerating run (mode=regenerate, after changing THUMB_WIDTH or
+// THUMB_QUALITY) renders every file's thumbnail again, existing or not, and
+// drops its other sizes and formats, which are rendered again on demand.
+// Browsers may keep showing thumbnails they cached until a hard refresh,
+// since the cached URLs name the same original version.
+
+type backfillStatus struct {
+	Running    bool      `json:"running"`
+	Regenerate bool      `json:"regenerate,omitempty"` // rendering every thumbnail again
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Scanned    int       `json:"scanned"`
+	Queued     int       `json:"queued"`
+	Done       int       `json:"done"`
+	Failed     int       `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+	// Derived from the above when read
+	PerSecond float64 `json:"per_second"`
+	Percent   int     `json:"percent"`
+	Left      string  `json:"left,omitempty"` // time left at the current rate, "3m"
+}
+
+const backfillLogInterval = 30 * time.Second
+
+type backfiller struct {
+	mu     sync.Mutex
+	status backfillStatus
+}
+
+var backfill = &backfiller{}
+
+func (b *backfiller) Status() backfillStatus {
+	b.mu.Lock()
+	s := b.status
+	b.mu.Unlock()
+	processed := s.Done + s.Failed
+	if s.Queued > 0 { s.Percent = processed * 100 / s.Queued }
+	end := s.Finished
+	if s.Running { end = time.Now() }
+	if elapsed := end.Sub(s.Started).Seconds(); processed > 0 && elapsed > 0 {
+		s.PerSecond = float64(processed) / elapsed
+		if s.Running && s.Queued > processed {
+			s.Left = (time.Duration(float64(s.Queued-processed)/s.PerSecond) * time.Second).Round(time.Minute).String()
+			if s.Left == "0s" { s.Left = "under a minute" }
+		}
+	}
+	return s
+}
+
+func (b *backfiller) update(fn func(s *backfillStatus)) {
+	b.mu.Lock()
+	fn(&b.status)
+	b.mu.Unlock()
+}
+
+// Start kicks off a run in the background, one that renders every
+// thumbnail again with regenerate. It reports false if one is already in
+// progress.
+func (b *backfiller) Start(regenerate bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.status.Running { return false }
+	b.status = backfillStatus{ Running: true, Regenerate: regenerate, Started: time.Now() }
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		b.run(shutdownCtx, regenerate)
+	}()
+	return true
+}
+
+// backfillJob is one file to catch up: the display name to render from, the
+// source version to tag its thumbnail with, and what it's missing.
+type backfillJob struct {
+	name, version      string
+	thumb, exif, video bool
+}
+
+func (b *backfiller) run(ctx context.Context, regenerate bool) {
+	defer b.update(func(s *backfillStatus) { s.Running, s.Finished = false, time.Now() })
+
+	jobs, err := b.scan(ctx, regenerate)
+	if err != nil {
+		log.Println("Backfill scan failed:", err)
+		b.update(func(s *backfillStatus) { s.Error = err.Error() })
+		return
+	}
+	b.update(func(s *backfillStatus) { s.Queued = len(jobs) })
+	if regenerate {
+		log.Printf("🖼️ Backfill: rendering the thumbnails of %d file(s) again at %dpx", len(jobs), thumbWidth)
+	} else {
+		log.Printf("🖼️ Backfill: %d file(s) missing a thumbnail, EXIF or video metadata", len(jobs))
+	}
+
+	stopLog := make(chan struct{})
+	go b.logProgress(stopLog)
+	defer close(stopLog)
+
+	limit := newRateLimiter(envFloat("BACKFILL_RATE", 0))
+	queue := make(chan backfillJob)
+	var wg sync.WaitGroup
+	for n := envInt("BACKFILL_WORKERS", 2); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if limit.wait(ctx, 1) != nil { continue }
+				ok := b.render(ctx, job, regenerate)
+				b.update(func(s *backfillStatus) {
+					if ok { s.Done++ } else { s.Failed++ }
+				})
+			}
+		}()
+	}
+feed:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-ctx.Done():
+			log.Println("🖼️ Backfill stopping for shutdown")
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	log.Printf("🖼️ Backfill finished: %+v", b.Status())
+}
+
+// logProgress logs how far the run is every backfillLogInterval until stop
+// is closed.
+func (b *backfiller) logProgress(stop chan struct{}) {
+	t := time.NewTicker(backfillLogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			s := b.Status()
+			if s.Queued == 0 { continue }
+			left := ""
+			if s.Left != "" { left = ", " + s.Left + " left" }
+			log.Printf("🖼️ Backfill: %d of %d (%d%%), %d failed, %.1f/s%s", s.Done+s.Failed, s.Queued, s.Percent, s.Failed, s.PerSecond, left)
+		}
+	}
+}
+
+// scan lists the bucket once for existing thumbs (unless all are rendered
+// again anyway) and once for originals and their sidecars.
+func (b *backfiller) scan(ctx context.Context, regenerate bool) ([]backfillJob, error) {
+	have := map[string]bool{}
+	if !regenerate {
+		if err := listAll(ctx, "thumb/", func(f *objectAttrs) { have[f.Name] = true }); err != nil { return nil, err }
+	}
+
+	var jobs []backfillJob
+	err := listAll(ctx, keyPrefix, func(f *objectAttrs) {
+		if isSidecar(f.Name) { have[f.Name] = true }
+		if !isLibraryFile(f.Name) { return }
+		b.update(func(s *backfillStatus) { s.Scanned++ })
+		jobs = append(jobs, backfillJob{ f.Name, sourceVersion(f), isThumbable(f.Name) && !have[getThumbPath(f.Name)], false, false })
+	})
+	if err != nil { return nil, err }
+	// Sidecars sort after their file, so EXIF is only decided once all are seen
+	for i := range jobs { jobs[i].exif = hasEXIF(jobs[i].name) && !have[sidecarKey(jobs[i].name)] }
+
+	// Content-addressed blobs: one thumbnail per hash, whichever name comes first
+	if casMode {
+		entries, names := casEntries()
+		seen := map[string]bool{}
+		for _, name := range names {
+			e := entries[name]
+			b.update(func(s *backfillStatus) { s.Scanned++ })
+			job := backfillJob{ name, e.Hash, !seen[e.Hash] && isThumbable(name) && !have[getThumbPath(casKey(e.Hash))], hasEXIF(name) && !have[sidecarKey(name)], false }
+			if job.thumb { seen[e.Hash] = true }
+			jobs = append(jobs, job)
+		}
+	}
+	if hasFFprobe {
+		probed := map[string]bool{}
+		dbEach("videos", func(key string, _ []byte) error { probed[key] = true; return nil })
+		for i := range jobs { jobs[i].video = isVideo(jobs[i].name) && !probed[jobs[i].name] }
+	}
+	jobs = slices.DeleteFunc(jobs, func(j backfillJob) bool { return !j.thumb && !j.exif && !j.video })
+	slices.SortStableFunc(jobs, func(a, b backfillJob) int { return strings.Count(a.name, "/") - strings.Count(b.name, "/") })
+	return jobs, nil
+}
+
+func (b *backfiller) render(ctx context.Context, job backfillJob, regenerate bool) bool {
+	if job.exif { b.extractEXIF(ctx, job.name) }
+	if job.video { b.probeVideo(ctx, job.name) }
+	if !job.thumb { return true }
+	data, err := buildThumbnail(ctx, job.name, thumbWidth, false)
+	if err != nil {
+		log.Printf("Backfill %s: %v", job.name, err)
+		return false
+	}
+	if regenerate { removeThumbVariants(ctx, storageKey(job.name)) }
+	thumbKey := getThumbPath(storageKey(job.name))
+	if err := writeThumb(ctx, thumbKey, data, job.version); err != nil {
+		log.Printf("Backfill %s: %v", job.name, err)
+		return false
+	}
+	thumbs.Put(thumbKey, job.version, data)
+	catalogMarkThumb(job.name)
+	return true
+}
+
+// extractEXIF reads EXIF for a file uploaded before it was kept. A photo
+// without any still gets a sidecar, so the next run skips it.
+func (b *backfiller) extractEXIF(ctx context.Context, name string) {
+	local, err := downloadTemp(ctx, storageKey(name), path.Ext(name))
+	if err != nil { log.Printf("Backfill EXIF %s: %v", name, err); return }
+	defer os.Remove(local)
+	if info, ok := readEXIF(local); ok { saveEXIF(ctx, name, info); return }
+	sc, _ := readSidecar(ctx, name)
+	if err := writeSidecar(ctx, name, sc); err != nil { log.Printf("Backfill EXIF %s: %v", name, err) }
+}
+
+// probeVideo reads the metadata of a video uploaded before it was kept.
+func (b *backfiller) probeVideo(ctx context.Context, name string) {
+	local, err := downloadTemp(ctx, storageKey(name), path.Ext(name))
+	if err != nil { log.Printf("Backfill video metadata %s: %v", name, err); return }
+	defer os.Remove(local)
+	probeAndSave(ctx, name, local)
+}
+
+func isThumbable(name string) bool {
+	return thumbnailer.Supported(name)
+}
+
+// ========== BACKFILL HANDLER ==========
+// GET  /admin/backfill -> status JSON
+// POST /admin/backfill -> start a run (form posts redirect back to /admin);
+//                         mode=regenerate renders every thumbnail again
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		started := backfill.Start(r.FormValue("mode") == "regenerate")
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			return
+		}
+		status := http.StatusAccepted
+		if !started { status = http.StatusConflict }
+		writeJSON(w, status, backfill.Status())
+		return
+	}
+	writeJSON(w, 200, backfill.Status())
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ========== TRANSFER LIMITS ==========
+// Originals (/view/, /download/, /transcoded/, zip downloads) can be capped
+// so one client pulling a whole album doesn't saturate the uplink or the B2
+// download allowance. Thumbnails are never limited.
+//
+//	DOWNLOAD_CONCURRENCY=8        transfers at once, all clients together
+//	DOWNLOAD_CLIENT_CONCURRENCY=2 transfers at once per client IP
+//	DOWNLOAD_RATE_KB=4096         KB/s, all clients together
+//	DOWNLOAD_CLIENT_RATE_KB=1024  KB/s per client IP
+//
+// All are off (0) by default. A request over a concurrency limit waits up to
+// DOWNLOAD_WAIT (default 30s) for a slot, then gets a 429 with Retry-After.
+// Rates are enforced while the response is written, so a video keeps
+// playing, just not faster than allowed.
+
+type transferLimits struct {
+	mu         sync.Mutex
+	total      chan struct{} // nil = unlimited
+	perClient  int
+	totalRate  *rateLimiter
+	clientRate float64 // bytes/s, 0 = unlimited
+	clients    map[string]*clientTransfers
+	wait       time.Duration
+}
+
+// clientTransfers is the state of one IP with transfers in flight; it is
+// dropped when the last one ends.
+type clientTransfers struct {
+	active int
+	slots  chan struct{}
+	rate   *rateLimiter
+}
+
+var transfers *transferLimits
+
+func newTransferLimits() *transferLimits {
+	t := &transferLimits{
+		perClient:  envInt("DOWNLOAD_CLIENT_CONCURRENCY", 0),
+		totalRate:  newRateLimiter(envFloat("DOWNLOAD_RATE_KB", 0) * 1024),
+		clientRate: envFloat("DOWNLOAD_CLIENT_RATE_KB", 0) * 1024,
+		clients:    map[string]*clientTransfers{},
+		wait:       envDuration("DOWNLOAD_WAIT", 30*time.Second),
+	}
+	if n := envInt("DOWNLOAD_CONCURRENCY", 0); n > 0 { t.total = make(chan struct{}, n) }
+	return t
+}
+
+func (t *transferLimits) enabled() bool {
+	return t.total != nil || t.perClient > 0 || t.totalRate != nil || t.clientRate > 0
+}
+
+func (t *transferLimits) client(ip string) *clientTransfers {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clients[ip]
+	if c == nil {
+		c = &clientTransfers{ rate: newRateLimiter(t.clientRate) }
+		if t.perClient > 0 { c.slots = make(chan struct{}, t.perClient) }
+		t.clients[ip] = c
+	}
+	c.active++
+	return c
+}
+
+func (t *transferLimits) done(ip string, c *clientTransfers) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.active--; c.active == 0 { delete(t.clients, ip) }
+}
+
+// acquire takes a slot from each channel in turn (nil ones are unlimited)
+// and returns the function giving them back.
+func acquire(ctx context.Context, slots ...chan struct{}) (release func(), ok bool) {
+	var held []chan struct{}
+	release = func() {
+		for _, s := range held { <-s }
+	}
+	for _, s := range slots {
+		if s == nil { continue }
+		select {
+		case s <- struct{}{}:
+			held = append(held, s)
+		case <-ctx.Done():
+			release()
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// limitTransfer applies the transfer limits to a route serving originals.
+func limitTransfer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !transfers.enabled() { h(w, r); return }
+		ip := clientIP(r)
+		c := transfers.client(ip)
+		defer transfers.done(ip, c)
+
+		ctx, cancel := context.WithTimeout(r.Context(), transfers.wait)
+		// Per client first, so one client's queue doesn't hold global slots
+		release, ok := acquire(ctx, c.slots, transfers.total)
+		cancel()
+		if !ok {
+			if r.Context().Err() != nil { return }
+			log.Printf("Transfer limit: %s turned away from %s", ip, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(transfers.wait.Seconds()), 1)))
+			http.Error(w, "too many downloads at once, try again shortly", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		if transfers.totalRate == nil && c.rate == nil { h(w, r); return }
+		h(&throttledWriter{ ResponseWriter: w, ctx: r.Context(), limits: []*rateLimiter{ c.rate, transfers.totalRate } }, r)
+	}
+}
+
+// ========== RATE LIMITING ==========
+// rateLimiter is a token bucket holding up to a quarter second of traffic.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/s
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec float64) *rateLimiter {
+	if bytesPerSec <= 0 { return nil }
+	return &rateLimiter{ rate: bytesPerSec, tokens: bytesPerSec / 4, last: time.Now() }
+}
+
+// wait blocks until n bytes may be sent. Tokens go negative, so concurrent
+// writers queue behind each other instead of all waking at once.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil { return nil }
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate/4)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 { return nil }
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledWriter writes the response in small pieces, each once every
+// limiter allows it.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	limits []*rateLimiter
+}
+
+const throttleChunk = 16 << 10
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		for _, l := range tw.limits {
+			if err := l.wait(tw.ctx, len(chunk)); err != nil { return written, err }
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil { return written, err }
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter { return tw.ResponseWriter }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ========== BASE PATH ==========
+// BASE_PATH (say /memories) serves the app under a subpath of a reverse
+// proxy's site. The proxy may pass the prefix on (nginx: location /memories/
+// { proxy_pass http://127.0.0.1:8080; }) or strip it (proxy_pass
+// http://127.0.0.1:8080/;); either works, and /memories redirects to
+// /memories/.
+//
+// Routes are matched with the prefix taken off, so handlers see the paths
+// they always have. On the way out the prefix is put back on redirects
+// (Location); the URLs the app writes itself go through appURL in Go,
+// {{base}} in templates and requestOrigin for absolute links (feeds,
+// notifications), and the session cookie is scoped to the prefix.
+
+var basePath = strings.TrimSuffix("/"+strings.Trim(os.Getenv("BASE_PATH"), "/"), "/")
+
+// appURL is the URL clients reach an app path ("/thumb/a.jpg") at.
+func appURL(p string) string { return basePath + p }
+
+// withBasePath returns h taking BASE_PATH off requests and putting it back
+// on redirects, or h unchanged without one.
+func withBasePath(h http.Handler) http.Handler {
+	if basePath == "" { return h }
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			to := basePath + "/"
+			if r.URL.RawQuery != "" { to += "?" + r.URL.RawQuery }
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
+		}
+		if p, ok := strings.CutPrefix(r.URL.Path, basePath+"/"); ok {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + p
+			if raw, ok := strings.CutPrefix(r.URL.RawPath, basePath+"/"); ok { r2.URL.RawPath = "/" + raw } else { r2.URL.RawPath = "" }
+			r = r2
+		}
+		h.ServeHTTP(basePathWriter{ w }, r)
+	})
+}
+
+// basePathWriter puts BASE_PATH on the app paths handlers redirect to.
+type basePathWriter struct{ http.ResponseWriter }
+
+func (w basePathWriter) WriteHeader(code int) {
+	if to := w.Header().Get("Location"); strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") { w.Header().Set("Location", appURL(to)) }
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w basePathWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ========== BATCH OPERATIONS ==========
+// POST /api/v1/batch runs one action over many files:
+//
+//	{"action": "delete",    "names": [...], "permanent": false}
+//	{"action": "move",      "names": [...], "folder": "2023/trip"}
+//	{"action": "tag",       "names": [...], "tag": "family"}
+//	{"action": "thumbnail", "names": [...]}
+//
+// Files are processed by BATCH_WORKERS (default 4) workers and the response
+// lists one result per name, in request order: 200 when all succeeded, 207
+// when some failed.
+
+type batchRequest struct {
+	Action    string   `json:"action"`
+	Names     []string `json:"names"`
+	Folder    string   `json:"folder,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	Permanent bool     `json:"permanent,omitempty"`
+}
+
+type batchResult struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	NewName string `json:"new_name,omitempty"` // for moves
+	Error   string `json:"error,omitempty"`
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { apiError(w, http.StatusMethodNotAllowed, "method not allowed"); return }
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apiError(w, 400, "bad json"); return }
+	if len(req.Names) == 0 { apiError(w, 400, "no names given"); return }
+	if max := envInt("BATCH_LIMIT", 1000); len(req.Names) > max { apiError(w, 400, fmt.Sprintf("at most %d names per batch", max)); return }
+
+	var op func(ctx context.Context, name string) (string, error)
+	switch req.Action {
+	case "delete":
+		op = func(ctx context.Context, name string) (string, error) {
+			if _, ok := apiStat(ctx, name); !ok { return "", fmt.Errorf("not found") }
+			return "", removeFile(ctx, name, req.Permanent)
+		}
+	case "move":
+		folder := strings.Trim(path.Clean("/"+req.Folder), "/")
+		user := currentUser(r)
+		op = func(ctx context.Context, name string) (string, error) {
+			to := path.Join(folder, path.Base(name))
+			if !canRead(user, name) || !canRead(user, to) { return "", fmt.Errorf("not found") }
+			return to, moveFile(ctx, name, to)
+		}
+	case "tag":
+		tag := strings.TrimSpace(req.Tag)
+		if tag == "" { apiError(w, 400, "tag is required"); return }
+		op = func(ctx context.Context, name string) (string, error) { return "", addTag(ctx, name, tag) }
+	case "thumbnail":
+		op = func(ctx context.Context, name string) (string, error) { return "", regenerateThumb(ctx, name) }
+	default:
+		apiError(w, 400, "unknown action (want delete, move, tag or thumbnail)"); return
+	}
+
+	// Like uploads, a batch finishes even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	results := make([]batchResult, len(req.Names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := min(envInt("BATCH_WORKERS", 4), len(req.Names)); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				name := strings.Trim(req.Names[i], "/")
+				res := batchResult{ Name: name }
+				newName, err := op(ctx, name)
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.OK, res.NewName = true, newName
+				}
+				results[i] = res
+			}
+		}()
+	}
+	for i := range req.Names { jobs <- i }
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		if !res.OK { failed++ }
+	}
+	log.Printf("📦 Batch %s by %s: %d of %d succeeded", req.Action, currentUser(r), len(results)-failed, len(results))
+	status := http.StatusOK
+	if failed > 0 { status = http.StatusMultiStatus }
+	writeJSON(w, status, map[string]any{ "action": req.Action, "succeeded": len(results) - failed, "failed": failed, "results": results })
+}
+
+// addTag tags one file, keeping the rest of its sidecar.
+func addTag(ctx context.Context, name, tag string) error {
+	if _, ok := apiStat(ctx, name); !ok || !isLibraryFile(name) { return fmt.Errorf("not found") }
+	sc, _ := readSidecar(ctx, name)
+	if hasTag(tagEntry{ Tags: sc.Tags }, tag) { return nil }
+	sc.Tags = append(sc.Tags, tag)
+	return writeSidecar(ctx, name, sc)
+}
+
+// regenerateThumb renders the default thumbnail again from the original and
+// drops the other sizes and formats so they follow.
+func regenerateThumb(ctx context.Context, name string) error {
+	if !isThumbable(name) { return fmt.Errorf("no thumbnail for this file type") }
+	key := storageKey(name)
+	attrs, err := store.Attrs(ctx, key)
+	if err != nil { return fmt.Errorf("not found") }
+
+	data, err := buildThumbnail(ctx, name, thumbWidth, false)
+	if err != nil { return err }
+	version := sourceVersion(attrs)
+	removeThumbVariants(ctx, key)
+	thumbKey := getThumbPath(key)
+	if err := writeThumb(ctx, thumbKey, data, version); err != nil { return err }
+	thumbs.Put(thumbKey, version, data)
+	catalogMarkThumb(name)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ========== MULTIPLE BUCKETS ==========
+// B2_BUCKETS=photos,docs serves several buckets from one instance. The first
+// is the primary bucket and holds the library root as before; every other one
+// shows up as a top-level folder named after it, so docs/report.pdf is
+// report.pdf in the docs bucket. Everything the app generates (thumbnails,
+// renditions, sidecars, trash) lives in the primary bucket, so the others
+// only ever hold originals.
+//
+// /b/{bucket}/{route}/{rest} is /{route}/{bucket}/{rest} (/{route}/{rest} for
+// the primary bucket), e.g. /b/docs/view/report.pdf, and /b/{bucket}/ is the
+// bucket's root folder. Folder pages get a bucket selector.
+
+// mountedBuckets are the buckets after the primary, in B2_BUCKETS order.
+var mountedBuckets []string
+
+// mountedStorage routes keys under a mounted bucket's folder to that bucket
+// and everything else to the primary.
+type mountedStorage struct {
+	primary Storage
+	mounts  map[string]Storage
+}
+
+func newMountedStorage(ctx context.Context, primary Storage, names []string, mounts map[string]Storage) *mountedStorage {
+	mountedBuckets = names
+	for _, name := range names {
+		if objs, _, err := primary.List(ctx, name+"/", "", "", 1); err == nil && len(objs) > 0 {
+			log.Printf("⚠️ Folder %s/ in the primary bucket is hidden by the %s bucket", name, name)
+		}
+	}
+	return &mountedStorage{ primary: primary, mounts: mounts }
+}
+
+// route finds the backend for key and its name there; mount is the folder
+// ("docs/") the backend is mounted at, "" for the primary.
+func (m *mountedStorage) route(key string) (s Storage, rel, mount string) {
+	if top, rest, ok := strings.Cut(key, "/"); ok {
+		if s, ok := m.mounts[top]; ok { return s, rest, top + "/" }
+	}
+	return m.primary, key, ""
+}
+
+// mountStart is where a listing resuming at start begins inside mount; ok is
+// false if start is past all of it.
+func mountStart(start, mount string) (rel string, ok bool) {
+	if start <= mount { return "", true }
+	if strings.HasPrefix(start, mount) { return start[len(mount):], true }
+	return "", false
+}
+
+// List merges the primary's listing with the mounted buckets under prefix.
+// A page ends at the first name some backend didn't get to, so the names
+// after it come back on the next page in order.
+func (m *mountedStorage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	if s, rel, mount := m.route(prefix); mount != "" {
+		relStart, ok := mountStart(start, mount)
+		if !ok { return nil, "", nil }
+		objs, next, err := s.List(ctx, rel, delimiter, relStart, count)
+		if err != nil { return nil, "", err }
+		for i := range objs { objs[i].Name = mount + objs[i].Name }
+		if next != "" { next = mount + next }
+		return objs, next, nil
+	}
+
+	primary, next, err := m.primary.List(ctx, prefix, delimiter, start, count)
+	if err != nil { return nil, "", err }
+	var objs []objectAttrs
+	for _, o := range primary {
+		if _, _, mount := m.route(o.Name); mount == "" { objs = append(objs, o) }
+	}
+	var nexts []string
+	if next != "" { nexts = append(nexts, next) }
+
+	for _, name := range mountedBuckets {
+		mount := name + "/"
+		if !strings.HasPrefix(mount, prefix) { continue }
+		if delimiter == "/" {
+			if start <= mount { objs = append(objs, objectAttrs{ Name: mount, Folder: true }) }
+			continue
+		}
+		relStart, ok := mountStart(start, mount)
+		if !ok { continue }
+		more, mnext, err := m.mounts[name].List(ctx, "", "", relStart, count)
+		if err != nil { return nil, "", err }
+		for _, o := range more {
+			o.Name = mount + o.Name
+			objs = append(objs, o)
+		}
+		if mnext != "" { nexts = append(nexts, mount+mnext) }
+	}
+
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	next = ""
+	if len(nexts) > 0 {
+		next = slices.Min(nexts)
+		objs = slices.DeleteFunc(objs, func(o objectAttrs) bool { return o.Name >= next })
+	}
+	if len(objs) > count {
+		next = objs[count].Name
+		objs = objs[:count]
+	}
+	return objs, next, nil
+}
+
+func (m *mountedStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s, rel, _ := m.route(key)
+	return s.Get(ctx, rel, offset, length)
+}
+
+func (m *mountedStorage) Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error {
+	s, rel, _ := m.route(key)
+	return s.Put(ctx, rel, r, attrs)
+}
+
+func (m *mountedStorage) Delete(ctx context.Context, key string) error {
+	s, rel, _ := m.route(key)
+	return s.Delete(ctx, rel)
+}
+
+func (m *mountedStorage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	s, rel, mount := m.route(key)
+	a, err := s.Attrs(ctx, rel)
+	if err != nil { return nil, err }
+	a.Name = mount + a.Name
+	return a, nil
+}
+
+// ========== BUCKET ROUTES ==========
+// bucketRouteHandler serves /b/{bucket}/... as the path it stands for.
+func bucketRouteHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/b/"), "/")
+	primary := bucket == bktName
+	if !primary && !slices.Contains(mountedBuckets, bucket) { http.NotFound(w, r); return }
+
+	path := "/" + rest
+	switch {
+	case primary:
+	case rest == "":
+		path = "/browse/" + bucket + "/"
+	default:
+		route, name, _ := strings.Cut(rest, "/")
+		path = "/" + route + "/" + bucket + "/" + name
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path, r2.URL.RawPath = path, ""
+	http.DefaultServeMux.ServeHTTP(w, r2)
+}
+
+// bucketChoices is the template data for the bucket selector of a folder
+// page, nil when only one bucket is configured.
+func bucketChoices(folder string) []map[string]any {
+	if len(mountedBuckets) == 0 { return nil }
+	top, _, _ := strings.Cut(folder, "/")
+	current := bktName
+	if slices.Contains(mountedBuckets, top) { current = top }
+	var choices []map[string]any
+	for _, name := range append([]string{ bktName }, mountedBuckets...) {
+		choices = append(choices, map[string]any{ "Name": name, "URL": appURL("/b/" + name + "/"), "Active": name == current })
+	}
+	return choices
+}
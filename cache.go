@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ========== THUMBNAIL CACHE ==========
+// Size-capped LRU of recently served thumbnails. Entries remember the source
+// version they were rendered from so a hit is only served when it's current.
+// Misses fall through to the optional disk tier (diskcache.go) before B2.
+
+type cacheEntry struct {
+	key     string
+	version string
+	data    []byte
+}
+
+type thumbCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	disk     *diskCache // nil when disabled
+
+	hits, misses, evictions int64
+}
+
+var thumbs *thumbCache
+
+func newThumbCache(maxBytes int64) *thumbCache {
+	return &thumbCache{ maxBytes: maxBytes, ll: list.New(), items: map[string]*list.Element{} }
+}
+
+// Get returns the cached bytes for key if they were rendered from version,
+// checking RAM first and then disk (promoting disk hits into RAM).
+func (c *thumbCache) Get(key, version string) ([]byte, bool) {
+	if data, ok := c.getRAM(key, version); ok { return data, true }
+	if c.disk == nil { return nil, false }
+	data, ok := c.disk.Get(key, version)
+	if ok { c.putRAM(key, version, data) }
+	return data, ok
+}
+
+func (c *thumbCache) getRAM(key, version string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.version == version {
+			c.ll.MoveToFront(el)
+			c.hits++
+			return e.data, true
+		}
+	}
+	c.misses++
+	return nil, false
+}
+
+// Put stores a thumbnail in both tiers.
+func (c *thumbCache) Put(key, version string, data []byte) {
+	c.putRAM(key, version, data)
+	if c.disk != nil { c.disk.Put(key, version, data) }
+}
+
+func (c *thumbCache) putRAM(key, version string, data []byte) {
+	if int64(len(data)) > c.maxBytes { return }
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		c.size += int64(len(data)) - int64(len(e.data))
+		e.version, e.data = version, data
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheEntry{ key: key, version: version, data: data })
+		c.size += int64(len(data))
+	}
+
+	for c.size > c.maxBytes {
+		oldest := c.ll.Back()
+		e := oldest.Value.(*cacheEntry)
+		c.ll.Remove(oldest)
+		delete(c.items, e.key)
+		c.size -= int64(len(e.data))
+		c.evictions++
+	}
+}
+
+func (c *thumbCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.size -= int64(len(el.Value.(*cacheEntry).data))
+	}
+}
+
+type cacheStats struct {
+	Entries                 int
+	Bytes, MaxBytes         int64
+	Hits, Misses, Evictions int64
+	HitRate                 float64 // percent
+
+	// Disk tier; zero when disabled
+	DiskEntries                         int
+	DiskBytes, DiskMaxBytes             int64
+	DiskHits, DiskMisses, DiskEvictions int64
+}
+
+func (c *thumbCache) Stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := cacheStats{ Entries: c.ll.Len(), Bytes: c.size, MaxBytes: c.maxBytes, Hits: c.hits, Misses: c.misses, Evictions: c.evictions }
+	if total := c.hits + c.misses; total > 0 { s.HitRate = float64(c.hits) * 100 / float64(total) }
+	if d := c.disk; d != nil {
+		d.mu.Lock()
+		s.DiskEntries, s.DiskBytes, s.DiskMaxBytes = len(d.files), d.size, d.maxBytes
+		s.DiskHits, s.DiskMisses, s.DiskEvictions = d.hits, d.misses, d.evictions
+		d.mu.Unlock()
+	}
+	return s
+}
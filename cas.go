@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// ========== CONTENT-ADDRESSED STORAGE ==========
+// With CONTENT_ADDRESSED=1 uploads are stored once under objects/ab/cd/<sha1>
+// and the human-readable name lives only in the "cas_names" DB bucket. Two
+// names with the same bytes share one object (and one thumbnail), a rename is
+// a DB edit, and a key's contents never change, so its URLs are immutable.
+// An object goes once no name and no trashed file points at it any more:
+// deleted, purged from the trash, or uploaded over with other bytes.
+//
+// Objects uploaded before the mode was enabled keep resolving by name until
+//
+//	memories cas-migrate [PREFIX]
+//
+// moves them into objects/ (with the server stopped, like every command).
+// Each is hashed as it is read, stored once by its SHA1, given its name in
+// cas_names and then deleted by name; its thumbnail comes along, and other
+// renditions (previews, transcodes) are made again when first asked for.
+// Sidecars, tags, albums and share links are by name and don't change. An
+// interrupted run can be repeated: what is already in cas_names is skipped.
+// Trashed files and, on B2, older versions stay where they are.
+
+var casMode bool
+
+type casEntry struct {
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Uploaded    time.Time `json:"uploaded"`
+}
+
+func initCAS() {
+	casMode = os.Getenv("CONTENT_ADDRESSED") == "1"
+}
+
+func casKey(hash string) string {
+	return path.Join("objects", hash[:2], hash[2:4], hash)
+}
+
+func casLookup(name string) (casEntry, bool) {
+	var e casEntry
+	found, err := dbGet("cas_names", name, &e)
+	return e, found && err == nil
+}
+
+func casPut(name string, e casEntry) error { return dbPut("cas_names", name, e) }
+
+// casEntries returns every name→hash mapping, ordered by name.
+func casEntries() (map[string]casEntry, []string) {
+	entries := map[string]casEntry{}
+	var names []string
+	dbEach("cas_names", func(key string, data []byte) error {
+		var e casEntry
+		if json.Unmarshal(data, &e) == nil {
+			entries[key] = e
+			names = append(names, key)
+		}
+		return nil
+	})
+	return entries, names
+}
+
+// casExists reports whether the bytes for hash are already in the bucket.
+func casExists(ctx context.Context, hash string) bool {
+	return objectExists(ctx, casKey(hash))
+}
+
+// storageKey maps a display name to the storage key holding its bytes.
+func storageKey(name string) string {
+	if !casMode { return name }
+	if e, ok := casLookup(name); ok { return casKey(e.Hash) }
+	return name
+}
+
+// casReferenced reports whether a name, or a trashed file other than the
+// trash item except, still points at hash.
+func casReferenced(hash, except string) bool {
+	if trashHolds(hash, except) { return true }
+	entries, _ := casEntries()
+	for _, e := range entries {
+		if e.Hash == hash { return true }
+	}
+	return false
+}
+
+// casRemoveObject deletes hash's object and what was rendered from it; name
+// is one it was stored under, which says what renditions it can have.
+func casRemoveObject(ctx context.Context, hash, name string) error {
+	key := casKey(hash)
+	if err := store.Delete(ctx, key); err != nil { return err }
+	removeThumbs(ctx, key)
+	if needsTranscode(name) { store.Delete(ctx, transcodedKey(key)) }
+	if isVideo(name) { deleteHLS(ctx, key) }
+	return nil
+}
+
+// casReplaced removes the object name pointed at before an upload over it,
+// if nothing else points at it.
+func casReplaced(ctx context.Context, name string, old casEntry) {
+	if casReferenced(old.Hash, "") { return }
+	if err := casRemoveObject(ctx, old.Hash, name); err != nil { log.Printf("Replaced object of %s not removed: %v", name, err) }
+}
+
+func casMigrateCommand(ctx context.Context, args []string) error {
+	if len(args) > 1 { return usageError("cas-migrate takes at most a prefix") }
+	if !casMode { return usageError("cas-migrate moves files into the content-addressed layout; set CONTENT_ADDRESSED=1") }
+	prefix := keyPrefix
+	if len(args) == 1 { prefix = args[0] }
+
+	var files []objectAttrs
+	err := listAll(ctx, prefix, func(f *objectAttrs) {
+		if isLibraryFile(f.Name) && !isSidecar(f.Name) { files = append(files, *f) }
+	})
+	if err != nil { return err }
+	fmt.Printf("📦 Moving %d file(s) into objects/\n", len(files))
+
+	var moved, failed int
+	for _, f := range files {
+		if ctx.Err() != nil { break }
+		if _, done := casLookup(f.Name); done { continue }
+		if err := casMigrate(ctx, f); err != nil {
+			log.Printf("cas-migrate %s: %v", f.Name, err)
+			failed++
+			continue
+		}
+		fmt.Println("✅", f.Name)
+		moved++
+	}
+	fmt.Printf("📦 Migration finished: %d moved, %d failed\n", moved, failed)
+	if failed > 0 { return fmt.Errorf("%d file(s) failed", failed) }
+	return nil
+}
+
+// casMigrate moves one by-name file to its object.
+func casMigrate(ctx context.Context, f objectAttrs) error {
+	rc, err := getObject(ctx, f.Name)
+	if err != nil { return err }
+	tmp, err := createTemp("cas-*")
+	if err != nil { rc.Close(); return err }
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hasher := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), rc)
+	rc.Close()
+	if err != nil { return err }
+	sha := hex.EncodeToString(hasher.Sum(nil))
+	if want := objectSHA1(ctx, f.Name); want != "" && want != sha { return fmt.Errorf("read back as %s, stored as %s", sha, want) }
+
+	key := casKey(sha)
+	if !casExists(ctx, sha) {
+		tmp.Seek(0, io.SeekStart)
+		if err := store.Put(ctx, key, tmp, objectAttrs{ ContentType: detectContentType(f.Name), SHA1: sha }); err != nil { return err }
+	}
+	// The object's thumbnail, unless another name brought one already
+	if thumb := getThumbPath(key); !objectExists(ctx, thumb) {
+		if rc, err := getObject(ctx, getThumbPath(f.Name)); err == nil {
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err == nil { writeThumb(ctx, thumb, data, sha) }
+		}
+	}
+	if err := casPut(f.Name, casEntry{ Hash: sha, Size: size, ContentType: detectContentType(f.Name), Uploaded: f.Modified }); err != nil { return err }
+	if e, ok := catalogGet(f.Name); ok {
+		e.Version, e.Thumb = sha, e.Thumb || objectExists(ctx, getThumbPath(key))
+		catalogPut(e)
+	}
+
+	// Only now is the by-name copy let go
+	if err := store.Delete(ctx, f.Name); err != nil { return err }
+	removeThumbs(ctx, f.Name)
+	if needsTranscode(f.Name) { deleteIfExists(ctx, transcodedKey(f.Name)) }
+	if isVideo(f.Name) { deleteHLS(ctx, f.Name) }
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== CATALOG ==========
+// A local index of every library file in the "catalog" bucket, keyed by
+// display name, so folder pages, folder cards and search never touch the B2
+// API. It is rebuilt from a full bucket listing at startup (when empty), every
+// CATALOG_RESYNC (default 6h, 0 disables) to pick up changes made outside the
+// app, from POST /admin/resync, or with `memories resync` while the server
+// is stopped. Uploads, moves and deletes update it in place.
+//
+// Until the first sync has finished, listings fall back to B2.
+//
+// "catalog_hashes" indexes entries by content SHA1 ("<sha1>/<name>" -> "")
+// for duplicate detection. Large files stored without a SHA1 aren't in it.
+
+type catalogEntry struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+	ContentType string    `json:"content_type"`
+	Version     string    `json:"version"`
+	Thumb       bool      `json:"thumb"` // a thumb/ object exists
+}
+
+func (e catalogEntry) fileEntry() map[string]any { return fileEntry(e.Name, e.Size, e.Modified, e.Version) }
+
+type catalogStatus struct {
+	Running bool      `json:"running"`
+	Synced  time.Time `json:"synced"` // last completed sync
+	Files   int       `json:"files"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	catalogMu    sync.Mutex
+	catalogState catalogStatus
+)
+
+var errSyncRunning = errors.New("catalog sync already running")
+
+func catalogStatusNow() catalogStatus {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	return catalogState
+}
+
+func catalogReady() bool { return !catalogStatusNow().Synced.IsZero() }
+
+func initCatalog() {
+	var st catalogStatus
+	dbGet("catalog_meta", "status", &st)
+	st.Running, st.Error = false, ""
+	catalogState = st
+}
+
+func catalogPut(e catalogEntry) {
+	old, found := catalogGet(e.Name)
+	if err := dbPut("catalog", e.Name, e); err != nil { log.Printf("Catalog update %s failed: %v", e.Name, err); return }
+	if found && old.Version != e.Version { dbDelete("catalog_hashes", hashIndexKey(old)) }
+	if isSHA1(e.Version) { dbPut("catalog_hashes", hashIndexKey(e), "") }
+}
+
+func hashIndexKey(e catalogEntry) string { return e.Version + "/" + e.Name }
+
+func isSHA1(s string) bool {
+	if len(s) != 40 { return false }
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// namesWithHash lists the catalogued names holding content sha, except one.
+func namesWithHash(sha, except string) []string {
+	if !isSHA1(sha) { return nil }
+	var names []string
+	prefix := []byte(sha + "/")
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog_hashes"))
+		if b == nil { return nil }
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if name := string(k[len(prefix):]); name != except { names = append(names, name) }
+		}
+		return nil
+	})
+	return names
+}
+
+// duplicateGroups returns every hash held by more than one name.
+func duplicateGroups() map[string][]string {
+	groups := map[string][]string{}
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog_hashes"))
+		if b == nil { return nil }
+		return b.ForEach(func(k, _ []byte) error {
+			sha, name, _ := strings.Cut(string(k), "/")
+			groups[sha] = append(groups[sha], name)
+			return nil
+		})
+	})
+	for sha, names := range groups {
+		if len(names) < 2 { delete(groups, sha) }
+	}
+	return groups
+}
+
+func catalogGet(name string) (catalogEntry, bool) {
+	var e catalogEntry
+	found, _ := dbGet("catalog", name, &e)
+	return e, found
+}
+
+func catalogDelete(name string) {
+	if old, found := catalogGet(name); found { dbDelete("catalog_hashes", hashIndexKey(old)) }
+	dbDelete("catalog", name)
+}
+
+func catalogRename(from, to string) {
+	e, ok := catalogGet(from)
+	if !ok { return }
+	catalogDelete(from)
+	e.Name, e.ContentType = to, detectContentType(to)
+	catalogPut(e)
+}
+
+func catalogMarkThumb(name string) {
+	if e, ok := catalogGet(name); ok && !e.Thumb {
+		e.Thumb = true
+		catalogPut(e)
+	}
+}
+
+// catalogRefresh re-reads one name from B2 (or the CAS table).
+func catalogRefresh(ctx context.Context, name string) {
+	f, ok := apiStat(ctx, name)
+	if !ok { catalogDelete(name); return }
+	old, _ := catalogGet(name)
+	catalogPut(catalogEntry{ Name: name, Size: f.Size, Modified: f.Uploaded, ContentType: f.ContentType, Version: f.Version, Thumb: old.Thumb })
+}
+
+// syncCatalog rebuilds the catalog from a full listing. Entries written
+// after the listing started (concurrent uploads) are kept.
+func syncCatalog(ctx context.Context) (int, error) {
+	catalogMu.Lock()
+	if catalogState.Running { catalogMu.Unlock(); return 0, errSyncRunning }
+	catalogState.Running = true
+	catalogMu.Unlock()
+
+	started := time.Now()
+	n, err := rebuildCatalog(ctx, started)
+
+	catalogMu.Lock()
+	catalogState.Running = false
+	if err != nil {
+		catalogState.Error = err.Error()
+	} else {
+		catalogState.Synced, catalogState.Files, catalogState.Error = started, n, ""
+		dbPut("catalog_meta", "status", catalogState)
+	}
+	catalogMu.Unlock()
+	return n, err
+}
+
+func rebuildCatalog(ctx context.Context, started time.Time) (int, error) {
+	haveThumb := map[string]bool{}
+	if err := listAll(ctx, "thumb/", func(f *objectAttrs) { haveThumb[f.Name] = true }); err != nil { return 0, err }
+
+	fresh := map[string]catalogEntry{}
+	var sidecars []string
+	err := listAll(ctx, keyPrefix, func(f *objectAttrs) {
+		if name := strings.TrimSuffix(f.Name, ".json"); isSidecar(f.Name) && isLibraryFile(name) { sidecars = append(sidecars, name) }
+		if !isLibraryFile(f.Name) { return }
+		fresh[f.Name] = catalogEntry{ f.Name, f.Size, f.Modified, detectContentType(f.Name), sourceVersion(f), haveThumb[getThumbPath(f.Name)] }
+	})
+	if err != nil { return 0, err }
+	if casMode {
+		entries, names := casEntries()
+		for _, name := range names {
+			e := entries[name]
+			fresh[name] = catalogEntry{ name, e.Size, e.Uploaded, detectContentType(name), e.Hash, haveThumb[getThumbPath(casKey(e.Hash))] }
+		}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if old := tx.Bucket([]byte("catalog")); old != nil {
+			old.ForEach(func(k, v []byte) error {
+				var e catalogEntry
+				if _, listed := fresh[string(k)]; !listed && json.Unmarshal(v, &e) == nil && e.Modified.After(started) { fresh[e.Name] = e }
+				return nil
+			})
+			if err := tx.DeleteBucket([]byte("catalog")); err != nil { return err }
+		}
+		if tx.Bucket([]byte("catalog_hashes")) != nil {
+			if err := tx.DeleteBucket([]byte("catalog_hashes")); err != nil { return err }
+		}
+		b, err := tx.CreateBucket([]byte("catalog"))
+		if err != nil { return err }
+		hb, err := tx.CreateBucket([]byte("catalog_hashes"))
+		if err != nil { return err }
+		for name, e := range fresh {
+			data, _ := json.Marshal(e)
+			if err := b.Put([]byte(name), data); err != nil { return err }
+			if isSHA1(e.Version) {
+				if err := hb.Put([]byte(hashIndexKey(e)), []byte(`""`)); err != nil { return err }
+			}
+		}
+		return nil
+	})
+	if err == nil && sidecarIndexMissing() { rebuildSidecarIndex(ctx, sidecars) }
+	return len(fresh), err
+}
+
+// runCatalogSync builds the catalog at startup if needed and keeps it fresh.
+func runCatalogSync() {
+	every := envDuration("CATALOG_RESYNC", 6*time.Hour)
+	// Indexes added since the last sync are built right away
+	fresh := catalogReady() && !dbMissing("catalog_hashes") && !sidecarIndexMissing()
+	if fresh && every <= 0 { return }
+	if fresh { time.Sleep(every) }
+	for {
+		start := time.Now()
+		if n, err := syncCatalog(shutdownCtx); err != nil {
+			log.Println("Catalog sync failed:", err)
+		} else {
+			log.Printf("📇 Catalog synced: %d file(s) in %s", n, time.Since(start).Round(time.Millisecond))
+		}
+		if every <= 0 { return }
+		time.Sleep(every)
+	}
+}
+
+// catalogPage is listPage served from the catalog.
+func catalogPage(prefix, start string, size int) (folderListing, string) {
+	var l folderListing
+	next := ""
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog"))
+		if b == nil { return nil }
+		c := b.Cursor()
+		from := prefix
+		if start > prefix { from = start }
+		count := 0
+		for k, v := c.Seek([]byte(from)); k != nil && bytes.HasPrefix(k, []byte(prefix)); {
+			name := string(k)
+			if top, _, nested := strings.Cut(name[len(prefix):], "/"); nested {
+				folder := prefix + top
+				if count == size { next = folder + "/"; break }
+				l.Folders = append(l.Folders, folder)
+				count++
+				// '0' sorts right after '/': skip everything inside the folder
+				k, v = c.Seek([]byte(folder + "0"))
+				continue
+			}
+			if count == size { next = name; break }
+			var e catalogEntry
+			if json.Unmarshal(v, &e) == nil { l.Files = append(l.Files, e.fileEntry()); count++ }
+			k, v = c.Next()
+		}
+		return nil
+	})
+	return l, next
+}
+
+// catalogFolder counts the files below folder and finds the newest media file.
+func catalogFolder(folder string) (count int, newest *catalogEntry) {
+	prefix := []byte(folder + "/")
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog"))
+		if b == nil { return nil }
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			count++
+			var e catalogEntry
+			if json.Unmarshal(v, &e) != nil || !isThumbable(e.Name) { continue }
+			if newest == nil || e.Modified.After(newest.Modified) { newest = &e }
+		}
+		return nil
+	})
+	return count, newest
+}
+
+// catalogSearch finds files below prefix whose name, caption, title or
+// description contains q
+// (case-insensitive), restricted to kind and ordered by sortBy (see sort.go).
+func catalogSearch(prefix, q, sortBy, kind string, limit int) []catalogEntry {
+	q = strings.ToLower(q)
+	var hits []catalogEntry
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog"))
+		if b == nil { return nil }
+		captions, details := tx.Bucket([]byte("captions")), tx.Bucket([]byte("details"))
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if !strings.Contains(strings.ToLower(string(k)), q) && !captionContains(captions, k, q) && !detailsContain(details, k, q) { continue }
+			var e catalogEntry
+			if json.Unmarshal(v, &e) == nil && (kind == "all" || fileKind(e.Name, e.ContentType) == kind) { hits = append(hits, e) }
+		}
+		return nil
+	})
+	sortEntries(hits, sortBy)
+	if limit > 0 && len(hits) > limit { hits = hits[:limit] }
+	return hits
+}
+
+// ========== CAPTIONS ==========
+// Captions are written in the viewer and kept in the sidecar; the "captions"
+// bucket (name -> caption) indexes them for search.
+
+func indexCaption(name string, sc sidecar) {
+	if sc.Caption == "" { dbDelete("captions", name); return }
+	if err := dbPut("captions", name, sc.Caption); err != nil { log.Printf("Caption index update %s failed: %v", name, err) }
+}
+
+// fileCaption is name's caption, "" if it has none.
+func fileCaption(name string) string {
+	var caption string
+	dbGet("captions", name, &caption)
+	return caption
+}
+
+// captionContains reports whether the indexed caption of name contains q,
+// which is lower case.
+func captionContains(captions *bolt.Bucket, name []byte, q string) bool {
+	if captions == nil { return false }
+	var caption string
+	data := captions.Get(name)
+	return data != nil && json.Unmarshal(data, &caption) == nil && strings.Contains(strings.ToLower(caption), q)
+}
+
+// fileDetails is the title and description written in the viewer; the
+// "details" bucket (name -> fileDetails) indexes them for search and the
+// map.
+type fileDetails struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func indexDetails(name string, sc sidecar) {
+	if sc.Title == "" && sc.Description == "" { dbDelete("details", name); return }
+	if err := dbPut("details", name, fileDetails{ sc.Title, sc.Description }); err != nil { log.Printf("Details index update %s failed: %v", name, err) }
+}
+
+// fileTitle is name's title, "" if it has none.
+func fileTitle(name string) string {
+	var d fileDetails
+	dbGet("details", name, &d)
+	return d.Title
+}
+
+// detailsContain reports whether the indexed title or description of name
+// contains q, which is lower case.
+func detailsContain(details *bolt.Bucket, name []byte, q string) bool {
+	if details == nil { return false }
+	var d fileDetails
+	data := details.Get(name)
+	return data != nil && json.Unmarshal(data, &d) == nil && (strings.Contains(strings.ToLower(d.Title), q) || strings.Contains(strings.ToLower(d.Description), q))
+}
+
+// ========== SEARCH & RESYNC HANDLERS ==========
+// GET /search?q=&sort=&type= searches the whole library by name, caption,
+// title and description.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" { http.Redirect(w, r, "/", http.StatusSeeOther); return }
+	sortBy, kind := listOrder(r)
+	var files []map[string]any
+	user := currentUser(r)
+	for _, e := range catalogSearch(keyPrefix, q, sortBy, kind, envInt("SEARCH_LIMIT", 500)) {
+		if !canRead(user, e.Name) { continue }
+		f := e.fileEntry()
+		f["Caption"] = fileCaption(e.Name)
+		f["Title"] = fileTitle(e.Name)
+		files = append(files, f)
+	}
+	tpls.ExecuteTemplate(w, "index.html", map[string]any{
+		"BucketName": bktName,
+		"Files":      files,
+		"Query":      q,
+		"Sort":       sortBy,
+		"Type":       kind,
+		"Kinds":      kindTabs(appURL("/search"), url.Values{ "q": { q } }, sortBy, kind),
+		"Indexing":   !catalogReady(),
+		"TagList":    topTags(envInt("TAG_CHIPS", 12)),
+		"LoggedIn":   currentUser(r) != "",
+		"Layout":     layoutFor(r),
+		"Back":       r.URL.RequestURI(),
+	})
+}
+
+// POST /admin/resync rebuilds the catalog in the background.
+func resyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		go func() {
+			if n, err := syncCatalog(shutdownCtx); err != nil {
+				log.Println("Catalog sync failed:", err)
+			} else {
+				log.Printf("📇 Catalog synced: %d file(s)", n)
+			}
+		}()
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, catalogStatusNow())
+		return
+	}
+	writeJSON(w, 200, catalogStatusNow())
+}
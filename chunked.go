@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== RESUMABLE UPLOADS ==========
+// Large videos are sent in chunks so a dropped connection only costs the
+// chunk in flight. The protocol is a small subset of tus:
+//
+// POST   /api/v1/uploads       {name, folder, size, sha1, skip_duplicates, collision, organize} -> {id, offset, chunk_size}
+// HEAD   /api/v1/uploads/{id}  Upload-Offset / Upload-Length headers
+// GET    /api/v1/uploads/{id}  session JSON (same as POST)
+// PATCH  /api/v1/uploads/{id}  chunk body, Upload-Offset header must match
+// PUT    /api/v1/uploads/{id}  the same, or placed by Content-Range instead
+// DELETE /api/v1/uploads/{id}  abort
+//
+// The upload page's drag-and-drop speaks the same protocol at /upload/chunk,
+// signed in with the session cookie: it slices each file into chunk_size
+// pieces, sends each with its checksum and retries failed chunks from the
+// offset the server reports.
+//
+// Checksums are for clients on flaky links (a phone backing up its camera
+// roll, say): sha1 (hex) given up front is checked against the assembled
+// file, which is dropped with a 422 if they differ. Together with
+// skip_duplicates it also lets the client skip a file the library already
+// has before sending a byte (the POST then answers 200 with the result). A
+// chunk may carry Upload-Checksum: sha1 <base64>, as in tus; one that doesn't
+// match is discarded with a 460 and sent again from the same offset.
+//
+// Content-Range: bytes 0-1048575/52428800 is accepted in place of
+// Upload-Offset (the total must be the session's size), and
+// Content-Range: bytes */52428800 with an empty body asks for the offset.
+//
+// Chunks are appended to a spool file under UPLOAD_SPOOL_DIR (default
+// ./cache/uploads) and the offset is kept in the "uploads" bucket, so sessions
+// survive restarts. When the last byte arrives the file goes to B2 through
+// storeLocal (large-file API, parallel parts). The name and collision policy
+// (uploadname.go) are applied when the session starts, so a rejected name
+// is a 409 before any bytes are sent, and again at the end (only then for
+// organize=date, whose folder comes from the bytes), and so is the user's
+// upload quota (quota.go). Sessions idle for longer than
+// UPLOAD_SESSION_TTL (default 24h) are removed.
+
+type uploadSession struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Size           int64     `json:"size"`
+	Offset         int64     `json:"offset"`
+	User           string    `json:"user"`
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+	ChunkMax       int64     `json:"chunk_size"`
+	SHA1           string    `json:"sha1,omitempty"` // expected checksum of the whole file
+	SkipDuplicates bool      `json:"skip_duplicates,omitempty"`
+	Collision      string    `json:"collision,omitempty"` // see uploadname.go
+	Organize       string    `json:"organize,omitempty"`  // see organize.go
+}
+
+var (
+	spoolDir    string
+	uploadLocks sync.Map // session id -> *sync.Mutex
+)
+
+func initSpool() {
+	spoolDir = os.Getenv("UPLOAD_SPOOL_DIR")
+	if spoolDir == "" { spoolDir = filepath.Join("cache", "uploads") }
+	if err := os.MkdirAll(spoolDir, 0755); err != nil { log.Println("⚠️ Resumable uploads disabled:", err) }
+}
+
+func (s uploadSession) spoolPath() string { return filepath.Join(spoolDir, s.ID) }
+
+func sessionLock(id string) *sync.Mutex {
+	mu, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func dropSession(s uploadSession) {
+	os.Remove(s.spoolPath())
+	dbDelete("uploads", s.ID)
+	uploadLocks.Delete(s.ID)
+}
+
+func setOffsetHeaders(w http.ResponseWriter, s uploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// uploadChunkHandler serves /upload/chunk[/{id}] for the upload page.
+func uploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == "" { apiError(w, 401, "login required"); return }
+	uploadsHandler(w, r, user, strings.Trim(strings.TrimPrefix(r.URL.Path, "/upload/chunk"), "/"))
+}
+
+// uploadsHandler serves /api/v1/uploads[/{id}]; user is already authenticated.
+func uploadsHandler(w http.ResponseWriter, r *http.Request, user, id string) {
+	if id == "" {
+		if r.Method != http.MethodPost { apiError(w, http.StatusMethodNotAllowed, "method not allowed"); return }
+		createUpload(w, r, user)
+		return
+	}
+
+	var s uploadSession
+	if found, _ := dbGet("uploads", id, &s); !found || s.User != user { apiError(w, 404, "no such upload"); return }
+
+	switch r.Method {
+	case http.MethodHead:
+		setOffsetHeaders(w, s)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		setOffsetHeaders(w, s)
+		writeJSON(w, 200, s)
+	case http.MethodPatch, http.MethodPut:
+		appendChunk(w, r, s)
+	case http.MethodDelete:
+		mu := sessionLock(id)
+		if !mu.TryLock() { apiError(w, 409, "a chunk is being written"); return }
+		defer mu.Unlock()
+		dropSession(s)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, user string) {
+	var req struct {
+		Name   string `json:"name"`
+		Folder string `json:"folder"`
+		Size   int64  `json:"size"`
+		SHA1   string `json:"sha1"`
+		// Drop the upload at the end if the bytes are already in the
+		// library (the result says which file has them)
+		SkipDuplicates bool   `json:"skip_duplicates"`
+		Collision      string `json:"collision"`
+		Organize       string `json:"organize"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apiError(w, 400, "bad json"); return }
+	if req.Name == "" { apiError(w, 400, "invalid name"); return }
+	name, err := cleanUploadName(req.Folder, req.Name)
+	if err != nil { apiError(w, 400, err.Error()); return }
+	policy, err := collisionPolicy(req.Collision)
+	if err != nil { apiError(w, 400, err.Error()); return }
+	dated, err := organizeByDate(req.Organize, name)
+	if err != nil { apiError(w, 400, err.Error()); return }
+	organize := ""
+	if dated { organize = "date" }
+	// Checked now so a client learns before sending anything, and again at
+	// the end in case the name was taken meanwhile
+	if !dated {
+		claimed, release, err := claimUploadName(r.Context(), name, policy)
+		if err != nil { apiError(w, http.StatusConflict, err.Error()); return }
+		release()
+		name = claimed
+	}
+	if req.Size <= 0 { apiError(w, 400, "size must be positive"); return }
+	if err := fitsQuota(user, req.Size); err != nil { apiError(w, http.StatusRequestEntityTooLarge, err.Error()); return }
+	sha := strings.ToLower(req.SHA1)
+	if b, err := hex.DecodeString(sha); sha != "" && (err != nil || len(b) != sha1.Size) { apiError(w, 400, "sha1 must be 40 hex digits"); return }
+	if sha != "" && req.SkipDuplicates {
+		if dupes := namesWithHash(sha, name); len(dupes) > 0 {
+			log.Printf("Upload %s: skipped before sending, same content as %s", name, dupes[0])
+			writeJSON(w, 200, uploadResult{ Name: name, SHA1: sha, DuplicateOf: dupes[0], Skipped: true })
+			return
+		}
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	now := time.Now()
+	s := uploadSession{
+		ID:             hex.EncodeToString(raw),
+		Name:           name,
+		Size:           req.Size,
+		User:           user,
+		Created:        now,
+		Updated:        now,
+		ChunkMax:       int64(envInt("UPLOAD_CHUNK_MB", 8)) << 20,
+		SHA1:           sha,
+		SkipDuplicates: req.SkipDuplicates,
+		Collision:      policy,
+		Organize:       organize,
+	}
+	f, err := os.Create(s.spoolPath())
+	if err != nil { log.Println("Spool error:", err); apiError(w, 500, "could not start upload"); return }
+	f.Close()
+	if err := dbPut("uploads", s.ID, s); err != nil { os.Remove(s.spoolPath()); apiError(w, 500, "could not start upload"); return }
+
+	log.Printf("⏫ Upload session %s: %s (%s) by %s", s.ID, s.Name, humanReadableSize(s.Size), user)
+	w.Header().Set("Location", "/api/v1/uploads/"+s.ID)
+	setOffsetHeaders(w, s)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// appendChunk writes the request body at the session's offset. Whatever
+// arrived before a dropped connection is kept, so the client resumes from
+// the offset reported by HEAD rather than from the start of its chunk.
+func appendChunk(w http.ResponseWriter, r *http.Request, s uploadSession) {
+	mu := sessionLock(s.ID)
+	if !mu.TryLock() { apiError(w, 409, "a chunk is already being written"); return }
+	defer mu.Unlock()
+	// Re-read under the lock: another request may just have advanced it
+	if found, _ := dbGet("uploads", s.ID, &s); !found { apiError(w, 404, "no such upload"); return }
+
+	limit := s.ChunkMax
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil { offset, err = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64) }
+	if cr := r.Header.Get("Content-Range"); err != nil && cr != "" {
+		start, end, total, ok := parseContentRange(cr)
+		if !ok || total != s.Size { apiError(w, 400, "Content-Range must be bytes start-end/size or bytes */size"); return }
+		if start < 0 {
+			setOffsetHeaders(w, s)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		offset, limit, err = start, min(limit, end-start+1), nil
+	}
+	if err != nil { apiError(w, 400, "Upload-Offset or Content-Range header required"); return }
+	wantSum, checked := chunkChecksum(r)
+	if !checked && r.Header.Get("Upload-Checksum") != "" { apiError(w, 400, "Upload-Checksum must be sha1 <base64>"); return }
+	if offset != s.Offset {
+		setOffsetHeaders(w, s)
+		apiError(w, 409, "offset mismatch, resume from Upload-Offset"); return
+	}
+
+	if s.Offset < s.Size {
+		f, err := os.OpenFile(s.spoolPath(), os.O_WRONLY, 0)
+		if err != nil { log.Println("Spool error:", err); apiError(w, 500, "spool file missing"); return }
+		// Bytes past the recorded offset are from a write that was never committed
+		f.Truncate(s.Offset)
+		f.Seek(s.Offset, io.SeekStart)
+		hasher := sha1.New()
+		n, copyErr := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r.Body, min(limit, s.Size-s.Offset)))
+		if err := f.Close(); err != nil && copyErr == nil { copyErr = err }
+
+		// A chunk that doesn't match its checksum is left past the offset,
+		// where the next write truncates it
+		if checked && copyErr == nil && !bytes.Equal(wantSum, hasher.Sum(nil)) {
+			setOffsetHeaders(w, s)
+			apiError(w, 460, "chunk checksum mismatch, send it again"); return
+		}
+
+		s.Offset += n
+		s.Updated = time.Now()
+		dbPut("uploads", s.ID, s)
+		if copyErr != nil {
+			log.Printf("Upload session %s interrupted at %d: %v", s.ID, s.Offset, copyErr)
+			setOffsetHeaders(w, s)
+			apiError(w, 400, "chunk interrupted, resume from Upload-Offset"); return
+		}
+	}
+
+	if s.Offset < s.Size {
+		setOffsetHeaders(w, s)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Last chunk: check it and hand the assembled file to B2. A storage
+	// failure keeps the session, so the client can retry with an empty PATCH
+	// at the final offset; wrong bytes can only be sent again from scratch.
+	_, sha, err := hashLocal(s.spoolPath())
+	if err != nil { apiError(w, 500, "spool file missing"); return }
+	if s.SHA1 != "" && sha != s.SHA1 {
+		log.Printf("Upload session %s: checksum mismatch (expected %s, received %s)", s.ID, s.SHA1, sha)
+		dropSession(s)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{ "error": "checksum mismatch, upload the file again", "expected": s.SHA1, "received": sha })
+		return
+	}
+	// Checked again: other uploads may have used the room meanwhile
+	hold, err := holdQuota(s.User, s.Size)
+	if err != nil { setOffsetHeaders(w, s); apiError(w, http.StatusRequestEntityTooLarge, err.Error()); return }
+	defer hold()
+	res := finishUpload(r.Context(), s, sha)
+	if res.Error != "" {
+		status := http.StatusBadGateway
+		if res.Error == nameTakenMessage(res.Name) { status = http.StatusConflict }
+		setOffsetHeaders(w, s)
+		apiError(w, status, res.Error)
+		return
+	}
+	dropSession(s)
+	log.Printf("✅ Upload session %s complete: %s", s.ID, res.Name)
+	chargeUploads(s.User, res)
+	notifyUploads(requestOrigin(r), s.User, res)
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func finishUpload(ctx context.Context, s uploadSession, sha string) uploadResult {
+	// Not tied to the request: a client giving up shouldn't abort the B2 upload
+	ctx = context.WithoutCancel(ctx)
+	policy := s.Collision
+	if policy == "" { policy = "overwrite" } // sessions from before collision policies
+	wanted := s.Name
+	if s.Organize == "date" { wanted = datedName(wanted, s.spoolPath()) }
+	name, release, err := claimUploadName(ctx, wanted, policy)
+	if err != nil { return uploadResult{ Name: wanted, Error: err.Error() } }
+	defer release()
+	return storeLocal(ctx, s.spoolPath(), s.Size, sha, name, s.SkipDuplicates, nil)
+}
+
+// chunkChecksum reads Upload-Checksum: sha1 <base64>.
+func chunkChecksum(r *http.Request) ([]byte, bool) {
+	algo, value, ok := strings.Cut(r.Header.Get("Upload-Checksum"), " ")
+	if !ok || algo != "sha1" { return nil, false }
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	return sum, err == nil && len(sum) == sha1.Size
+}
+
+// parseContentRange reads "bytes start-end/total"; for "bytes */total"
+// start and end are -1.
+func parseContentRange(v string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(v, "bytes ")
+	if !found { return 0, 0, 0, false }
+	rng, size, found := strings.Cut(spec, "/")
+	if !found { return 0, 0, 0, false }
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil { return 0, 0, 0, false }
+	if rng == "*" { return -1, -1, total, true }
+	from, to, found := strings.Cut(rng, "-")
+	if !found { return 0, 0, 0, false }
+	start, err1 := strconv.ParseInt(from, 10, 64)
+	end, err2 := strconv.ParseInt(to, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start || end >= total { return 0, 0, 0, false }
+	return start, end, total, true
+}
+
+// sweepUploads removes abandoned sessions and their spool files.
+func sweepUploads() {
+	ttl := envDuration("UPLOAD_SESSION_TTL", 24*time.Hour)
+	for {
+		var stale []uploadSession
+		dbEach("uploads", func(k string, v []byte) error {
+			var s uploadSession
+			if json.Unmarshal(v, &s) == nil && time.Since(s.Updated) > ttl { stale = append(stale, s) }
+			return nil
+		})
+		for _, s := range stale {
+			mu := sessionLock(s.ID)
+			if !mu.TryLock() { continue }
+			log.Printf("🧹 Dropping abandoned upload %s (%s, %d/%d bytes)", s.ID, s.Name, s.Offset, s.Size)
+			dropSession(s)
+			mu.Unlock()
+		}
+		sweepDirectUploads(ttl)
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ishushreyas/memories/config"
+)
+
+// ========== COMMANDS ==========
+// The binary doubles as a small CLI sharing the server's storage and DB
+// code. Every command but serve needs the server stopped, since it holds
+// the DB lock.
+//
+//	memories [serve]                run the web server
+//	memories sync DIR FOLDER/       upload a local directory with thumbnails
+//	memories watch DIR FOLDER/      keep uploading a local directory (watch.go)
+//	memories import-takeout ZIP... FOLDER/
+//	                                import a Google Takeout export (takeout.go)
+//	memories backfill-thumbs        render missing thumbnails and EXIF
+//	memories verify [PREFIX]        check stored files against their SHA1s
+//	memories resync                 rebuild the catalog from storage
+//	memories cas-migrate [PREFIX]   move by-name files into objects/ (cas.go)
+//	memories config check           check the config file and environment
+//	memories agent DIR=FOLDER/...   push local directories to a server (agent.go)
+//
+// sync skips files already stored with the same SHA1, so an interrupted run
+// can simply be repeated; SYNC_WORKERS (default 4) files go up at once.
+// Videos queued for TRANSCODE_ON_UPLOAD are left to the server, which makes
+// their renditions on first play. verify reads every file back with
+// VERIFY_WORKERS (default 4) workers and exits 1 if any doesn't match; files
+// the backend has no SHA1 for are counted as unchecked. config check
+// (config/) connects to nothing, so it also works with the server running:
+// it prints each setting and where it comes from, then what's wrong, and
+// exits 1 if the server couldn't work with it. agent talks to a server over
+// its API rather than to storage, so it runs anywhere, server or not.
+
+type command struct {
+	name, args, help string
+	run              func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{ "serve", "", "run the web server (default)", nil },
+	{ "sync", "DIR FOLDER/", "upload a local directory with thumbnails", syncCommand },
+	{ "watch", "DIR FOLDER/", "keep uploading new and changed files of a directory", watchCommand },
+	{ "import-takeout", "ZIP... FOLDER/", "import a Google Takeout export with its metadata", importTakeoutCommand },
+	{ "backfill-thumbs", "", "render missing thumbnails and EXIF", backfillCommand },
+	{ "verify", "[PREFIX]", "check stored files against their SHA1s", verifyCommand },
+	{ "resync", "", "rebuild the catalog from storage", resyncCommand },
+	{ "cas-migrate", "[PREFIX]", "move by-name files into the content-addressed layout", casMigrateCommand },
+	{ "config", "check", "check the config file and environment", nil },
+	{ "agent", "DIR=FOLDER/...", "push local directories to a server over its API", agentCommand },
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name { return c, true }
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: memories <command> [args]\n\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+}
+
+// runCommand runs c to completion and returns the exit code.
+func runCommand(c command, args []string) int {
+	err := c.run(context.Background(), args)
+	background.Wait()
+	// agent opens neither
+	if b2calls != nil { b2calls.flush() }
+	if db != nil {
+		if cerr := db.Close(); cerr != nil { log.Println("⚠️ Metadata DB close:", cerr) }
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %s: %v\n", c.name, err)
+		if _, ok := err.(usageError); ok { usage(); return 2 }
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// ========== SYNC ==========
+type syncFile struct {
+	local, name string
+}
+
+func syncCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 { return usageError("sync takes a local directory and a folder") }
+	dir, folder := args[0], strings.Trim(args[1], "/")
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() { return fmt.Errorf("%s is not a directory", dir) }
+
+	files, err := localFiles(dir, folder)
+	if err != nil { return err }
+	fmt.Printf("📤 Syncing %d file(s) from %s to %s/\n", len(files), dir, folder)
+
+	var stored, unchanged, failed atomic.Int64
+	queue := make(chan syncFile)
+	var wg sync.WaitGroup
+	for n := envInt("SYNC_WORKERS", 4); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				switch syncOne(ctx, f) {
+				case "stored": stored.Add(1)
+				case "unchanged": unchanged.Add(1)
+				default: failed.Add(1)
+				}
+			}
+		}()
+	}
+	for _, f := range files { queue <- f }
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("📤 Sync finished: %d stored, %d unchanged, %d failed\n", stored.Load(), unchanged.Load(), failed.Load())
+	if failed.Load() > 0 { return fmt.Errorf("%d file(s) failed", failed.Load()) }
+	return nil
+}
+
+// localFiles lists the files under dir with the library names they get in
+// folder.
+func localFiles(dir, folder string) ([]syncFile, error) {
+	var files []syncFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil { return err }
+		// Dotfiles and dot-directories (.DS_Store, .git) stay behind
+		if strings.HasPrefix(d.Name(), ".") && p != dir {
+			if d.IsDir() { return filepath.SkipDir }
+			return nil
+		}
+		if !d.Type().IsRegular() { return nil }
+		rel, err := filepath.Rel(dir, p)
+		if err != nil { return err }
+		name := path.Join(folder, filepath.ToSlash(rel))
+		if !isLibraryFile(name) { log.Printf("Sync: skipping %s (reserved name)", name); return nil }
+		files = append(files, syncFile{ p, name })
+		return nil
+	})
+	return files, err
+}
+
+// syncOne stores one file unless the same bytes are already there.
+func syncOne(ctx context.Context, f syncFile) string {
+	size, sha, err := hashLocal(f.local)
+	if err != nil { log.Printf("Sync %s: %v", f.name, err); return "failed" }
+	if storedSHA1(ctx, f.name) == sha { return "unchanged" }
+
+	res := storeLocal(ctx, f.local, size, sha, f.name, false, nil)
+	if res.Error != "" { return "failed" }
+	fmt.Println("✅", f.name)
+	return "stored"
+}
+
+// storedSHA1 is the SHA1 storage (or the content-addressed index) has for
+// name, "" if it isn't stored or the backend doesn't know.
+func storedSHA1(ctx context.Context, name string) string {
+	if casMode {
+		e, _ := casLookup(name)
+		return e.Hash
+	}
+	return objectSHA1(ctx, name)
+}
+
+// objectSHA1 is the SHA1 the backend has for key, "" if it doesn't know.
+func objectSHA1(ctx context.Context, key string) string {
+	attrs, err := store.Attrs(ctx, key)
+	if err != nil { return "" }
+	if sha := attrs.Info["large_file_sha1"]; sha != "" { return sha }
+	if attrs.SHA1 == "none" { return "" }
+	return attrs.SHA1
+}
+
+func hashLocal(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil { return 0, "", err }
+	defer f.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, f)
+	if err != nil { return 0, "", err }
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ========== BACKFILL & RESYNC ==========
+func backfillCommand(ctx context.Context, args []string) error {
+	if len(args) > 0 { return usageError("backfill-thumbs takes no arguments") }
+	backfill.Start(false)
+	background.Wait()
+	st := backfill.Status()
+	fmt.Printf("🖼️ Backfill finished: %d scanned, %d rendered, %d failed\n", st.Scanned, st.Done, st.Failed)
+	if st.Error != "" { return fmt.Errorf("%s", st.Error) }
+	if st.Failed > 0 { return fmt.Errorf("%d file(s) failed", st.Failed) }
+	return nil
+}
+
+func resyncCommand(ctx context.Context, args []string) error {
+	if len(args) > 0 { return usageError("resync takes no arguments") }
+	n, err := syncCatalog(ctx)
+	if err != nil { return fmt.Errorf("catalog sync failed: %w", err) }
+	fmt.Printf("📇 Catalog synced: %d file(s)\n", n)
+	return nil
+}
+
+// ========== VERIFY ==========
+type verifyJob struct {
+	name, key, sha string
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+	if len(args) > 1 { return usageError("verify takes at most a prefix") }
+	prefix := keyPrefix
+	if len(args) == 1 { prefix = args[0] }
+
+	var jobs []verifyJob
+	var unchecked int
+	if casMode {
+		entries, names := casEntries()
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) { jobs = append(jobs, verifyJob{ name, casKey(entries[name].Hash), entries[name].Hash }) }
+		}
+	} else {
+		err := listAll(ctx, prefix, func(f *objectAttrs) {
+			if !isLibraryFile(f.Name) { return }
+			if f.SHA1 == "" || f.SHA1 == "none" { unchecked++; return }
+			jobs = append(jobs, verifyJob{ f.Name, f.Name, f.SHA1 })
+		})
+		if err != nil { return err }
+	}
+	fmt.Printf("🔍 Verifying %d file(s)\n", len(jobs))
+
+	var ok, bad atomic.Int64
+	queue := make(chan verifyJob)
+	var wg sync.WaitGroup
+	for n := envInt("VERIFY_WORKERS", 4); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := verifyOne(ctx, job); err != nil {
+					fmt.Printf("❌ %s: %v\n", job.name, err)
+					bad.Add(1)
+					continue
+				}
+				ok.Add(1)
+			}
+		}()
+	}
+	for _, job := range jobs { queue <- job }
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("🔍 Verify finished: %d ok, %d bad, %d unchecked (no SHA1 stored)\n", ok.Load(), bad.Load(), unchecked)
+	if bad.Load() > 0 { return fmt.Errorf("%d file(s) failed verification", bad.Load()) }
+	return nil
+}
+
+func verifyOne(ctx context.Context, job verifyJob) error {
+	rc, err := getObject(ctx, job.key)
+	if err != nil { return err }
+	defer rc.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, rc); err != nil { return fmt.Errorf("read failed: %w", err) }
+	if got := hex.EncodeToString(h.Sum(nil)); got != job.sha { return fmt.Errorf("SHA1 is %s, expected %s", got, job.sha) }
+	return nil
+}
+
+// configCommand is `memories config check`. loadErr is what loading the
+// config file failed with.
+func configCommand(args []string, loadErr error) int {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "❌ config: the only subcommand is check")
+		usage()
+		return 2
+	}
+	if config.File != "" {
+		fmt.Printf("⚙️ Config file: %s\n", config.File)
+	} else {
+		fmt.Println("⚙️ No config file (set CONFIG_FILE or add memories.yaml), environment only")
+	}
+	if loadErr != nil {
+		for _, line := range strings.Split(loadErr.Error(), "\n") { fmt.Printf("❌ %s\n", line) }
+		return 1
+	}
+	for _, v := range config.Effective() {
+		fmt.Printf("  %-36s %-28s %s (%s)\n", v.Key, v.Env, v.Value, v.Source)
+	}
+	problems := config.Check()
+	if _, err := exec.LookPath("ffmpeg"); err != nil { problems = append(problems, config.Problem{ Error: true, Msg: "ffmpeg is not installed" }) }
+	failed := false
+	for _, p := range problems {
+		fmt.Println(p)
+		failed = failed || p.Error
+	}
+	if failed { return 1 }
+	fmt.Println("✅ Config OK")
+	return 0
+}
@@ -0,0 +1,267 @@
+// Package client talks to a memories server over its API, for programs that
+// push files to a library from elsewhere: `memories agent` on a desktop is
+// built on it. It signs in for a token and uploads through the resumable
+// upload protocol (POST /api/v1/uploads, then PATCH chunks with their
+// checksums), so a dropped connection only costs the chunk in flight.
+//
+// Requests that fail on the way (no connection, a 5xx answer, 429) are
+// tried again Retries times, waiting twice as long each time from a second
+// up to a minute; an upload picks up from the offset the server reports.
+// Answers that retrying can't change (a taken name, a full quota) come back
+// as *Error with the server's status and message.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a connection to one server as one user.
+type Client struct {
+	Server  string // base URL, with the server's BASE_PATH if it has one
+	Token   string // API token (see Login)
+	HTTP    *http.Client
+	Retries int
+}
+
+// New returns a client for server authenticating with token.
+func New(server, token string) *Client {
+	return &Client{ Server: strings.TrimSuffix(server, "/"), Token: token, HTTP: &http.Client{}, Retries: 5 }
+}
+
+// Error is an error answer from the server.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%d %s", e.Status, e.Message) }
+
+// IsStatus reports whether err is the server answering status.
+func IsStatus(err error, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == status
+}
+
+// File is a file's metadata, as GET /api/v1/files/{name} gives it.
+type File struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Uploaded    time.Time `json:"uploaded"`
+	ContentType string    `json:"content_type"`
+	Version     string    `json:"version"`
+}
+
+// Result is the outcome of an upload, as the server reports it.
+type Result struct {
+	Name        string `json:"name"`
+	Size        string `json:"size,omitempty"`
+	SHA1        string `json:"sha1,omitempty"`
+	Deduped     bool   `json:"deduped,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Skipped     bool   `json:"skipped,omitempty"`
+}
+
+// UploadOptions are the fields of a resumable upload (see the server's
+// chunked.go); Name defaults to the local file's.
+type UploadOptions struct {
+	Folder         string
+	Name           string
+	Collision      string // rename, reject or overwrite; "" for the server's default
+	SkipDuplicates bool
+	Organize       string // date or none; "" for the server's default
+}
+
+// Login exchanges a username and password for an API token, which the
+// client uses from then on. label names the token in the server's list.
+func (c *Client) Login(ctx context.Context, user, password, label string) (string, error) {
+	body, _ := json.Marshal(map[string]string{ "username": user, "password": password, "name": label })
+	var out struct{ Token string `json:"token"` }
+	if _, err := c.call(ctx, http.MethodPost, "/api/v1/token", body, &out); err != nil { return "", err }
+	c.Token = out.Token
+	return out.Token, nil
+}
+
+// Stat looks name up; a missing file is an *Error with status 404.
+func (c *Client) Stat(ctx context.Context, name string) (File, error) {
+	var f File
+	_, err := c.call(ctx, http.MethodGet, "/api/v1/files/"+escapeName(name), nil, &f)
+	return f, err
+}
+
+// session is what POST /api/v1/uploads answers.
+type session struct {
+	ID        string `json:"id"`
+	Offset    int64  `json:"offset"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// Upload sends the file at local.
+func (c *Client) Upload(ctx context.Context, local string, opt UploadOptions) (Result, error) {
+	f, err := os.Open(local)
+	if err != nil { return Result{}, err }
+	defer f.Close()
+	hasher := sha1.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil { return Result{}, err }
+	if opt.Name == "" { opt.Name = filepath.Base(local) }
+
+	body, _ := json.Marshal(map[string]any{
+		"name": opt.Name, "folder": opt.Folder, "size": size, "sha1": hex.EncodeToString(hasher.Sum(nil)),
+		"skip_duplicates": opt.SkipDuplicates, "collision": opt.Collision, "organize": opt.Organize,
+	})
+	var raw json.RawMessage
+	resp, err := c.call(ctx, http.MethodPost, "/api/v1/uploads", body, &raw)
+	if err != nil { return Result{}, err }
+	// Skipped before sending: the library has these bytes
+	if resp.StatusCode == http.StatusOK {
+		var res Result
+		return res, json.Unmarshal(raw, &res)
+	}
+	var s session
+	if err := json.Unmarshal(raw, &s); err != nil { return Result{}, err }
+	if s.ChunkSize <= 0 { return Result{}, errors.New("the server gave no chunk size") }
+
+	buf := make([]byte, s.ChunkSize)
+	offset, failures := s.Offset, 0
+	retry := func(cause error) error {
+		if failures++; failures > c.Retries { return cause }
+		if err := c.wait(ctx, failures); err != nil { return err }
+		// Part of what was sent may have been kept
+		if at, err := c.offset(ctx, s.ID); err == nil { offset = at }
+		return nil
+	}
+	for {
+		n, err := f.ReadAt(buf[:min(s.ChunkSize, size-offset)], offset)
+		if err != nil && err != io.EOF { return Result{}, err }
+		chunk := buf[:n]
+		sum := sha1.Sum(chunk)
+		req, err := c.request(ctx, http.MethodPatch, "/api/v1/uploads/"+s.ID, chunk)
+		if err != nil { return Result{}, err }
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			if err := retry(err); err != nil { return Result{}, err }
+			continue
+		}
+		answer, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		at, hasOffset := responseOffset(resp)
+		switch {
+		case resp.StatusCode == http.StatusCreated:
+			var res Result
+			return res, json.Unmarshal(answer, &res)
+		case resp.StatusCode == http.StatusNoContent && hasOffset:
+			offset, failures = at, 0
+		case resp.StatusCode == http.StatusConflict && hasOffset && !(at == size && offset+int64(n) == size):
+			// Out of step (an earlier chunk got further than it seemed)
+			offset = at
+			if err := retry(errorFrom(resp, answer)); err != nil { return Result{}, err }
+		case resp.StatusCode == http.StatusConflict && !hasOffset, resp.StatusCode == 460, retryable(resp.StatusCode):
+			// Another write still running, a corrupted chunk or a server
+			// trouble: the same again, from where the server is
+			if err := retry(errorFrom(resp, answer)); err != nil { return Result{}, err }
+		case resp.StatusCode == http.StatusBadRequest && hasOffset:
+			offset = at
+			if err := retry(errorFrom(resp, answer)); err != nil { return Result{}, err }
+		default:
+			// The name was taken at the end, the quota is full, the checksum of
+			// the whole file didn't match, the session is gone...
+			return Result{}, errorFrom(resp, answer)
+		}
+	}
+}
+
+// offset asks the server where upload id is.
+func (c *Client) offset(ctx context.Context, id string) (int64, error) {
+	req, err := c.request(ctx, http.MethodHead, "/api/v1/uploads/"+id, nil)
+	if err != nil { return 0, err }
+	resp, err := c.HTTP.Do(req)
+	if err != nil { return 0, err }
+	resp.Body.Close()
+	at, ok := responseOffset(resp)
+	if !ok { return 0, errorFrom(resp, nil) }
+	return at, nil
+}
+
+// call sends a JSON request, retrying what may go through another time, and
+// decodes a successful answer into out.
+func (c *Client) call(ctx context.Context, method, path string, body []byte, out any) (*http.Response, error) {
+	for failures := 0; ; failures++ {
+		req, err := c.request(ctx, method, path, body)
+		if err != nil { return nil, err }
+		if body != nil { req.Header.Set("Content-Type", "application/json") }
+		resp, err := c.HTTP.Do(req)
+		var answer []byte
+		if err == nil {
+			answer, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		switch {
+		case err == nil && resp.StatusCode < 300:
+			if out != nil && len(answer) > 0 { err = json.Unmarshal(answer, out) }
+			return resp, err
+		case err == nil && !retryable(resp.StatusCode):
+			return resp, errorFrom(resp, answer)
+		case failures >= c.Retries:
+			if err == nil { err = errorFrom(resp, answer) }
+			return resp, err
+		}
+		if err := c.wait(ctx, failures+1); err != nil { return nil, err }
+	}
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil { r = bytes.NewReader(body) }
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, r)
+	if err != nil { return nil, err }
+	if c.Token != "" { req.Header.Set("Authorization", "Bearer "+c.Token) }
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// wait sleeps before try number failures+1.
+func (c *Client) wait(ctx context.Context, failures int) error {
+	d := min(time.Second<<min(failures-1, 6), time.Minute)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500 && status != http.StatusNotImplemented
+}
+
+func responseOffset(resp *http.Response) (int64, bool) {
+	at, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	return at, err == nil
+}
+
+func errorFrom(resp *http.Response, answer []byte) *Error {
+	var body struct{ Error string `json:"error"` }
+	if json.Unmarshal(answer, &body) != nil || body.Error == "" { body.Error = http.StatusText(resp.StatusCode) }
+	return &Error{ Status: resp.StatusCode, Message: body.Error }
+}
+
+// escapeName escapes a library name for a URL path.
+func escapeName(name string) string { return (&url.URL{ Path: name }).EscapedPath() }
@@ -0,0 +1,496 @@
+// Package config reads the optional config file and checks the settings.
+//
+// Everything in memories is configured by environment variables; the file is
+// a tidier way of giving them. It is YAML, CONFIG_FILE or else memories.yaml
+// in the working directory, with the settings grouped by what they are for:
+//
+//	listen: ":8080"
+//	storage:
+//	  backend: b2
+//	  b2:
+//	    key_id: 0012ab...
+//	    app_key: K001...
+//	    bucket: family-photos
+//	thumbnails:
+//	  sizes: [600, 1200]
+//	  cache_dir: /var/cache/memories
+//	auth:
+//	  user: alice
+//	  password_hash: $2a$10$...
+//	limits:
+//	  download_rate_kb: 4096
+//	env:
+//	  SOME_VAR: anything # passed through as is
+//
+// Settings lists every key and the variable it sets. Load only sets
+// variables that aren't set already, so the environment (and .env) override
+// the file. Unknown keys and values of the wrong type fail the load; Check
+// looks at the effective settings as a whole, which `memories config check`
+// prints.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kind is the type of a setting's value.
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	IntList // "600,1200"
+	Float
+	Duration // "30s", "72h"
+	Bool
+	List   // "a,b" or "a b"
+	Choice // one of Choices
+)
+
+// Setting is one key of the file and the variable it sets.
+type Setting struct {
+	Key     string // dotted path in the file: "storage.b2.bucket"
+	Env     string
+	Kind    Kind
+	Choices []string // Choice; "" is always allowed and means the default
+	On, Off string   // Bool: the variable's value for true and false
+	AnyOn   bool     // Bool: any value other than Off counts as true
+	Max     int      // Int and IntList, 0 = no limit
+	Secret  bool     // masked by Effective
+}
+
+func str(key, env string) Setting                   { return Setting{ Key: key, Env: env } }
+func num(key, env string) Setting                   { return Setting{ Key: key, Env: env, Kind: Int } }
+func numMax(key, env string, max int) Setting       { return Setting{ Key: key, Env: env, Kind: Int, Max: max } }
+func float(key, env string) Setting                 { return Setting{ Key: key, Env: env, Kind: Float } }
+func dur(key, env string) Setting                   { return Setting{ Key: key, Env: env, Kind: Duration } }
+func list(key, env string) Setting                  { return Setting{ Key: key, Env: env, Kind: List } }
+func flag(key, env, on, off string) Setting         { return Setting{ Key: key, Env: env, Kind: Bool, On: on, Off: off } }
+func choice(key, env string, c ...string) Setting   { return Setting{ Key: key, Env: env, Kind: Choice, Choices: c } }
+func secret(s Setting) Setting                      { s.Secret = true; return s }
+
+// Settings is every setting the file can give, grouped like the file.
+var Settings = []Setting{
+	str("listen", "LISTEN_ADDR"),
+	numMax("port", "PORT", 65535),
+	str("base_path", "BASE_PATH"),
+	str("db", "META_DB"),
+
+	choice("storage.backend", "STORAGE_BACKEND", "b2", "s3", "local"),
+	dur("storage.timeout", "STORAGE_TIMEOUT"),
+	flag("storage.content_addressed", "CONTENT_ADDRESSED", "1", ""),
+	str("storage.b2.key_id", "B2_KEY_ID"),
+	secret(str("storage.b2.app_key", "B2_APP_KEY")),
+	str("storage.b2.bucket", "B2_BUCKET_NAME"),
+	list("storage.b2.buckets", "B2_BUCKETS"),
+	str("storage.b2.prefix", "B2_PREFIX"),
+	float("storage.b2.class_b_price", "B2_CLASS_B_PRICE"),
+	float("storage.b2.class_c_price", "B2_CLASS_C_PRICE"),
+	num("storage.b2.free_calls_per_day", "B2_FREE_CALLS_PER_DAY"),
+	str("storage.s3.endpoint", "S3_ENDPOINT"),
+	str("storage.s3.bucket", "S3_BUCKET"),
+	str("storage.s3.region", "S3_REGION"),
+	str("storage.s3.access_key_id", "S3_ACCESS_KEY_ID"),
+	secret(str("storage.s3.secret_access_key", "S3_SECRET_ACCESS_KEY")),
+	{ Key: "storage.s3.path_style", Env: "S3_PATH_STYLE", Kind: Bool, On: "1", Off: "0", AnyOn: true },
+	str("storage.local.dir", "LOCAL_STORAGE_DIR"),
+
+	numMax("thumbnails.width", "THUMB_WIDTH", 4096),
+	numMax("thumbnails.quality", "THUMB_QUALITY", 100),
+	{ Key: "thumbnails.sizes", Env: "THUMB_SIZES", Kind: IntList, Max: 4096 },
+	list("thumbnails.formats", "THUMB_FORMATS"),
+	num("thumbnails.workers", "THUMB_WORKERS"),
+	num("thumbnails.buffer_mb", "THUMB_BUFFER_MB"),
+	num("thumbnails.cache_mb", "THUMB_CACHE_MB"),
+	str("thumbnails.cache_dir", "THUMB_CACHE_DIR"),
+	num("thumbnails.disk_cache_mb", "THUMB_DISK_CACHE_MB"),
+	dur("thumbnails.render_timeout", "RENDER_TIMEOUT"),
+	choice("thumbnails.video_mode", "VIDEO_THUMB_MODE", "smart", "offset", "middle"),
+	dur("thumbnails.video_offset", "VIDEO_THUMB_OFFSET"),
+	num("thumbnails.sheet_minutes", "VIDEO_SHEET_MINUTES"),
+	numMax("thumbnails.sheet_grid", "VIDEO_SHEET_GRID", 6),
+	choice("thumbnails.animated", "ANIM_THUMBS", "webp", "gif"),
+	num("thumbnails.anim_fps", "ANIM_FPS"),
+	num("thumbnails.anim_seconds", "ANIM_SECONDS"),
+	num("thumbnails.anim_workers", "ANIM_WORKERS"),
+	num("previews.width", "PREVIEW_WIDTH"),
+	numMax("previews.quality", "PREVIEW_QUALITY", 100),
+	numMax("previews.upright_quality", "UPRIGHT_QUALITY", 100),
+	num("previews.min_kb", "PREVIEW_MIN_KB"),
+	num("previews.raw_width", "RAW_PREVIEW_WIDTH"),
+	str("previews.raw_decoder", "RAW_DECODER"),
+	str("previews.svg_rasterizer", "SVG_RASTERIZER"),
+	num("previews.text_kb", "TEXT_PREVIEW_KB"),
+
+	num("video.hls_min_mb", "HLS_MIN_MB"),
+	flag("video.transcode_on_upload", "TRANSCODE_ON_UPLOAD", "1", ""),
+	num("video.transcode_workers", "TRANSCODE_WORKERS"),
+
+	str("auth.user", "AUTH_USER"),
+	secret(str("auth.password", "AUTH_PASSWORD")),
+	secret(str("auth.password_hash", "AUTH_PASSWORD_HASH")),
+	str("auth.users_file", "USERS_FILE"),
+	str("auth.folder_access_file", "FOLDER_ACCESS_FILE"),
+	secret(str("auth.session_secret", "SESSION_SECRET")),
+	secret(list("auth.api_tokens", "API_TOKENS")),
+	flag("auth.public_read", "PUBLIC_READ", "1", ""),
+	{ Key: "auth.trust_proxy", Env: "TRUST_PROXY", Kind: Bool, On: "1", AnyOn: true },
+	num("auth.login.max_attempts", "LOGIN_MAX_ATTEMPTS"),
+	num("auth.login.max_attempts_per_ip", "LOGIN_MAX_ATTEMPTS_PER_IP"),
+	dur("auth.login.window", "LOGIN_WINDOW"),
+	dur("auth.login.lockout", "LOGIN_LOCKOUT"),
+
+	str("tls.cert_file", "TLS_CERT_FILE"),
+	str("tls.key_file", "TLS_KEY_FILE"),
+	list("tls.domains", "TLS_DOMAINS"),
+	str("tls.email", "TLS_EMAIL"),
+	str("tls.cache_dir", "TLS_CACHE_DIR"),
+	str("tls.redirect_addr", "HTTP_REDIRECT_ADDR"),
+
+	dur("http.read_timeout", "HTTP_READ_TIMEOUT"),
+	dur("http.write_timeout", "HTTP_WRITE_TIMEOUT"),
+	dur("http.shutdown_timeout", "SHUTDOWN_TIMEOUT"),
+	str("http.access_log", "ACCESS_LOG"),
+	{ Key: "http.webdav", Env: "WEBDAV", Kind: Bool, On: "on", Off: "off", AnyOn: true },
+
+	num("uploads.workers", "UPLOAD_WORKERS"),
+	num("uploads.part_workers", "UPLOAD_PART_WORKERS"),
+	num("uploads.chunk_mb", "UPLOAD_CHUNK_MB"),
+	str("uploads.spool_dir", "UPLOAD_SPOOL_DIR"),
+	dur("uploads.session_ttl", "UPLOAD_SESSION_TTL"),
+	num("uploads.direct_mb", "DIRECT_UPLOAD_MB"),
+	num("uploads.direct_part_mb", "DIRECT_UPLOAD_PART_MB"),
+	dur("uploads.progress_interval", "UPLOAD_PROGRESS_INTERVAL"),
+	choice("uploads.names", "UPLOAD_NAMES", "safe", "strict", "keep"),
+	choice("uploads.collision", "UPLOAD_COLLISION", "rename", "reject", "overwrite"),
+	choice("uploads.organize", "UPLOAD_ORGANIZE", "none", "date"),
+	str("uploads.organize_layout", "ORGANIZE_LAYOUT"),
+	num("uploads.url_max_mb", "URL_UPLOAD_MAX_MB"),
+	dur("uploads.url_timeout", "URL_UPLOAD_TIMEOUT"),
+	list("uploads.url_types", "URL_UPLOAD_TYPES"),
+	flag("uploads.url_private", "URL_UPLOAD_PRIVATE", "1", ""),
+	num("uploads.quota_mb", "UPLOAD_QUOTA_MB"),
+	list("uploads.user_quotas", "USER_QUOTAS"),
+	str("scratch.dir", "SCRATCH_DIR"),
+	num("scratch.max_mb", "SCRATCH_MAX_MB"),
+	dur("scratch.max_age", "SCRATCH_MAX_AGE"),
+	dur("scratch.sweep", "SCRATCH_SWEEP"),
+
+	num("limits.download_concurrency", "DOWNLOAD_CONCURRENCY"),
+	num("limits.download_client_concurrency", "DOWNLOAD_CLIENT_CONCURRENCY"),
+	float("limits.download_rate_kb", "DOWNLOAD_RATE_KB"),
+	float("limits.download_client_rate_kb", "DOWNLOAD_CLIENT_RATE_KB"),
+	dur("limits.download_wait", "DOWNLOAD_WAIT"),
+	num("limits.download_redirect_mb", "DOWNLOAD_REDIRECT_MB"),
+	dur("limits.download_url_ttl", "DOWNLOAD_URL_TTL"),
+	num("limits.page_size", "PAGE_SIZE"),
+	num("limits.search_limit", "SEARCH_LIMIT"),
+	num("limits.map_limit", "MAP_LIMIT"),
+	num("limits.batch_limit", "BATCH_LIMIT"),
+	num("limits.feed_size", "FEED_SIZE"),
+	num("limits.tag_chips", "TAG_CHIPS"),
+	float("limits.egress_price_per_gb", "EGRESS_PRICE_PER_GB"),
+	float("limits.egress_free_gb", "EGRESS_FREE_GB"),
+	float("limits.egress_alert_gb", "EGRESS_ALERT_GB"),
+
+	num("workers.backfill", "BACKFILL_WORKERS"),
+	float("workers.backfill_rate", "BACKFILL_RATE"),
+	num("workers.list", "LIST_WORKERS"),
+	num("workers.batch", "BATCH_WORKERS"),
+	num("workers.sync", "SYNC_WORKERS"),
+	num("workers.verify", "VERIFY_WORKERS"),
+	flag("backfill_on_start", "BACKFILL_ON_START", "1", ""),
+	flag("dev_mode", "DEV_MODE", "1", ""),
+	dur("catalog_resync", "CATALOG_RESYNC"),
+	num("trash_retention_days", "TRASH_RETENTION_DAYS"),
+	num("exports.part_mb", "EXPORT_PART_MB"),
+	dur("exports.retention", "EXPORT_RETENTION"),
+	num("home.recent_count", "RECENT_COUNT"),
+	num("home.on_this_day_count", "ON_THIS_DAY_COUNT"),
+	choice("gallery.grid", "GALLERY_GRID", "small", "medium", "large"),
+	choice("gallery.layout", "GALLERY_LAYOUT", "card", "square", "masonry"),
+	choice("gallery.theme", "GALLERY_THEME", "auto", "light", "dark"),
+	str("shares.default_expiry", "SHARE_DEFAULT_EXPIRY"),
+	choice("weather", "WEATHER_PROVIDER", "open-meteo"),
+
+	str("faces.detector", "FACE_DETECTOR"),
+	dur("faces.scan_interval", "FACE_SCAN_INTERVAL"),
+	num("faces.scan_width", "FACE_SCAN_WIDTH"),
+	float("faces.min_score", "FACE_MIN_SCORE"),
+	float("faces.match", "FACE_MATCH"),
+
+	str("watch.dir", "WATCH_DIR"),
+	str("watch.folder", "WATCH_FOLDER"),
+	dur("watch.interval", "WATCH_INTERVAL"),
+	dur("watch.settle", "WATCH_SETTLE"),
+
+	str("agent.server", "AGENT_SERVER"),
+	secret(str("agent.token", "AGENT_TOKEN")),
+	str("agent.user", "AGENT_USER"),
+	secret(str("agent.password", "AGENT_PASSWORD")),
+	list("agent.folders", "AGENT_FOLDERS"),
+	dur("agent.interval", "AGENT_INTERVAL"),
+	choice("agent.collision", "AGENT_COLLISION", "rename", "reject", "overwrite"),
+	str("agent.state", "AGENT_STATE"),
+
+	list("notify.webhooks", "NOTIFY_WEBHOOKS"),
+	secret(str("notify.webhook_secret", "NOTIFY_WEBHOOK_SECRET")),
+	list("notify.email_to", "NOTIFY_EMAIL_TO"),
+	dur("notify.delay", "NOTIFY_DELAY"),
+	numMax("reminders.hour", "REMINDER_HOUR", 23),
+	str("reminders.webhook", "REMINDER_WEBHOOK_URL"),
+	str("email.smtp_host", "SMTP_HOST"),
+	numMax("email.smtp_port", "SMTP_PORT", 65535),
+	str("email.smtp_user", "SMTP_USER"),
+	secret(str("email.smtp_pass", "SMTP_PASS")),
+	str("email.from", "SMTP_FROM"),
+	list("email.alert_to", "ALERT_EMAIL_TO"),
+}
+
+func lookup(key string) (Setting, bool) {
+	for _, s := range Settings {
+		if s.Key == key { return s, true }
+	}
+	return Setting{}, false
+}
+
+// File is the config file Load read, "" if there is none.
+var File string
+
+// fromFile are the variables Load set from the file.
+var fromFile = map[string]bool{}
+
+// Load reads the config file, if there is one, and sets the variables it
+// gives that aren't set already.
+func Load() error {
+	name := os.Getenv("CONFIG_FILE")
+	if name == "" {
+		if _, err := os.Stat("memories.yaml"); err != nil { return nil }
+		name = "memories.yaml"
+	}
+	File = name
+	vars, err := parse(name)
+	if err != nil { return err }
+	for env, v := range vars {
+		if _, set := os.LookupEnv(env); set { continue }
+		os.Setenv(env, v)
+		fromFile[env] = true
+	}
+	return nil
+}
+
+// parse reads a config file into the variables it sets.
+func parse(name string) (map[string]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil { return nil, err }
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil { return nil, err }
+
+	vars := map[string]string{}
+	var errs []error
+	if raw, ok := doc["env"]; ok {
+		m, ok := raw.(map[string]any)
+		if !ok { errs = append(errs, errors.New("env: want a map of variables")) }
+		for k, v := range m { vars[k] = fmt.Sprint(v) }
+		delete(doc, "env")
+	}
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			key := prefix + k
+			s, known := lookup(key)
+			if sub, ok := v.(map[string]any); ok && !known { walk(key+".", sub); continue }
+			if !known { errs = append(errs, fmt.Errorf("%s: unknown setting", key)); continue }
+			value, err := fileValue(s, v)
+			if err != nil { errs = append(errs, fmt.Errorf("%s: %w", key, err)); continue }
+			if err := s.validate(value); err != nil { errs = append(errs, fmt.Errorf("%s: %w", key, err)); continue }
+			vars[s.Env] = value
+		}
+	}
+	walk("", doc)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return vars, errors.Join(errs...)
+}
+
+// fileValue is v from the file as the setting's variable value.
+func fileValue(s Setting, v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if s.Kind != Bool { return "", errors.New("want a value, not true/false") }
+		if v { return s.On, nil }
+		return s.Off, nil
+	case []any:
+		if s.Kind != List && s.Kind != IntList { return "", errors.New("want one value, not a list") }
+		items := make([]string, len(v))
+		for i, item := range v { items[i] = fmt.Sprint(item) }
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("want a value, not a map")
+	}
+	if s.Kind == Bool { return "", errors.New("want true or false") }
+	return fmt.Sprint(v), nil
+}
+
+// validate checks a variable value against the setting's kind.
+func (s Setting) validate(v string) error {
+	if v == "" { return nil }
+	checkInt := func(item string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		switch {
+		case err != nil:
+			return fmt.Errorf("%q is not a whole number", item)
+		case n < 0:
+			return fmt.Errorf("%d is negative", n)
+		case s.Max > 0 && n > s.Max:
+			return fmt.Errorf("%d is over %d", n, s.Max)
+		}
+		return nil
+	}
+	switch s.Kind {
+	case Int:
+		return checkInt(v)
+	case IntList:
+		for _, item := range strings.Split(v, ",") {
+			if err := checkInt(item); err != nil { return err }
+		}
+	case Float:
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 { return fmt.Errorf("%q is not a number of at least 0", v) }
+	case Duration:
+		if _, err := time.ParseDuration(v); err != nil { return fmt.Errorf("%q is not a duration like 30s or 72h", v) }
+	case Bool:
+		if !s.AnyOn && v != s.On && v != s.Off { return fmt.Errorf("%q is neither %q (true) nor %q (false)", v, s.On, s.Off) }
+	case Choice:
+		for _, c := range s.Choices {
+			if v == c { return nil }
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(s.Choices, ", "))
+	}
+	return nil
+}
+
+// ========== CHECK ==========
+
+// Problem is something Check found. Errors are settings the server can't
+// work with; warnings are ones it works around.
+type Problem struct {
+	Error bool
+	Msg   string
+}
+
+func (p Problem) String() string {
+	if p.Error { return "❌ " + p.Msg }
+	return "⚠️ " + p.Msg
+}
+
+// Check validates the effective settings: every value against its kind, and
+// the ones that only work together.
+func Check() []Problem {
+	var problems []Problem
+	fail := func(format string, a ...any) { problems = append(problems, Problem{ true, fmt.Sprintf(format, a...) }) }
+	warn := func(format string, a ...any) { problems = append(problems, Problem{ false, fmt.Sprintf(format, a...) }) }
+	get := os.Getenv
+	missing := func(names ...string) []string {
+		var m []string
+		for _, n := range names {
+			if get(n) == "" { m = append(m, n) }
+		}
+		return m
+	}
+
+	for _, s := range Settings {
+		if err := s.validate(get(s.Env)); err != nil { fail("%s: %v", s.Env, err) }
+	}
+
+	switch get("STORAGE_BACKEND") {
+	case "", "b2":
+		m := missing("B2_KEY_ID", "B2_APP_KEY")
+		if get("B2_BUCKET_NAME") == "" && get("B2_BUCKETS") == "" { m = append(m, "B2_BUCKET_NAME (or B2_BUCKETS)") }
+		if len(m) > 0 { fail("the b2 backend needs %s", strings.Join(m, ", ")) }
+	case "s3":
+		if m := missing("S3_ENDPOINT", "S3_BUCKET", "S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY"); len(m) > 0 { fail("the s3 backend needs %s", strings.Join(m, ", ")) }
+	case "local":
+		if get("LOCAL_STORAGE_DIR") == "" { fail("the local backend needs LOCAL_STORAGE_DIR") }
+	}
+
+	if get("DEV_MODE") == "1" { warn("DEV_MODE=1 re-reads the templates on every page and turns caching off, it is meant for working on the HTML") }
+	if strings.ContainsAny(get("BASE_PATH"), "?#") { fail("BASE_PATH is a path such as /memories, without ? or #") }
+	if (get("TLS_CERT_FILE") == "") != (get("TLS_KEY_FILE") == "") { fail("set both TLS_CERT_FILE and TLS_KEY_FILE") }
+	if get("TLS_CERT_FILE") != "" && get("TLS_DOMAINS") != "" { warn("TLS_CERT_FILE is set, so TLS_DOMAINS is ignored") }
+	for _, f := range []string{ "TLS_CERT_FILE", "TLS_KEY_FILE", "USERS_FILE", "FOLDER_ACCESS_FILE" } {
+		if name := get(f); name != "" {
+			if _, err := os.Stat(name); err != nil { fail("%s: %v", f, err) }
+		}
+	}
+
+	accounts := get("USERS_FILE") != "" || get("AUTH_USER") != ""
+	switch {
+	case get("AUTH_USER") != "" && get("AUTH_PASSWORD") == "" && get("AUTH_PASSWORD_HASH") == "":
+		fail("AUTH_USER needs AUTH_PASSWORD or AUTH_PASSWORD_HASH")
+	case get("AUTH_USER") == "" && (get("AUTH_PASSWORD") != "" || get("AUTH_PASSWORD_HASH") != ""):
+		warn("AUTH_PASSWORD is set without AUTH_USER and is ignored")
+	case !accounts:
+		warn("no accounts (AUTH_USER or USERS_FILE): the gallery is public and read-only")
+	}
+	for _, entry := range strings.Split(get("USER_QUOTAS"), ",") {
+		if strings.TrimSpace(entry) == "" { continue }
+		user, mb, ok := strings.Cut(entry, "=")
+		if n, err := strconv.Atoi(strings.TrimSpace(mb)); !ok || strings.TrimSpace(user) == "" || err != nil || n < 0 { fail("USER_QUOTAS: %q is not user=MB", strings.TrimSpace(entry)) }
+	}
+	if !accounts && (get("UPLOAD_QUOTA_MB") != "" || get("USER_QUOTAS") != "") { warn("upload quotas are per account, and there are none") }
+	for _, entry := range strings.Split(get("AGENT_FOLDERS"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" && strings.LastIndex(entry, "=") <= 0 { fail("AGENT_FOLDERS: %q is not DIR=FOLDER", entry) }
+	}
+	if accounts && get("SESSION_SECRET") == "" { warn("SESSION_SECRET is not set, sessions will not survive a restart") }
+	if len(get("SESSION_SECRET")) > 0 && len(get("SESSION_SECRET")) < 16 { warn("SESSION_SECRET is shorter than 16 characters") }
+
+	if get("SMTP_HOST") == "" {
+		for _, to := range []string{ "NOTIFY_EMAIL_TO", "ALERT_EMAIL_TO" } {
+			if get(to) != "" { fail("%s needs SMTP_HOST", to) }
+		}
+	}
+	if get("WATCH_DIR") != "" {
+		if st, err := os.Stat(get("WATCH_DIR")); err != nil || !st.IsDir() { warn("WATCH_DIR %s is not a directory", get("WATCH_DIR")) }
+	}
+	if get("DIRECT_UPLOAD_MB") != "" && get("DIRECT_UPLOAD_MB") != "0" {
+		if b := get("STORAGE_BACKEND"); b != "" && b != "b2" { warn("DIRECT_UPLOAD_MB only works with the b2 backend") }
+		if get("CONTENT_ADDRESSED") == "1" { warn("DIRECT_UPLOAD_MB does nothing in content-addressed mode") }
+	}
+	if b := get("STORAGE_BACKEND"); b != "" && b != "b2" && get("DOWNLOAD_REDIRECT_MB") != "" && get("DOWNLOAD_REDIRECT_MB") != "0" {
+		warn("DOWNLOAD_REDIRECT_MB only works with the b2 backend")
+	}
+	if n := get("VIDEO_SHEET_GRID"); n == "0" || n == "1" { fail("VIDEO_SHEET_GRID is 2 to 6 frames per side") }
+	if get("VIDEO_SHEET_GRID") != "" && get("VIDEO_SHEET_MINUTES") == "" { warn("VIDEO_SHEET_GRID is set without VIDEO_SHEET_MINUTES, so only videos given a sheet at /thumb/regenerate get one") }
+	if get("LISTEN_ADDR") != "" && get("PORT") != "" { warn("LISTEN_ADDR is set, so PORT is ignored") }
+	return problems
+}
+
+// Value is a setting that is set, as Effective reports it.
+type Value struct {
+	Setting
+	Value  string // masked for secrets
+	Source string // "file" or "env"
+}
+
+// Effective is every setting that is set, in the order of Settings.
+func Effective() []Value {
+	var values []Value
+	for _, s := range Settings {
+		v, set := os.LookupEnv(s.Env)
+		if !set { continue }
+		source := "env"
+		if fromFile[s.Env] { source = "file" }
+		if s.Secret && v != "" { v = "********" }
+		values = append(values, Value{ s, v, source })
+	}
+	return values
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"path"
+)
+
+// ========== FOLDER COVERS ==========
+// A folder's cover is the file picked in the viewer ("covers" DB bucket,
+// folder -> object name), or else its newest image/video (see folderCard).
+
+func folderCover(folder string) string {
+	var name string
+	dbGet("covers", folder, &name)
+	return name
+}
+
+// coverHandler makes the posted file its folder's cover. Login required.
+func coverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	name := r.FormValue("name")
+	folder := path.Dir(name)
+	if name == "" || folder == "." { http.Error(w, "file is not in a folder", 400); return }
+
+	if err := dbPut("covers", folder, name); err != nil { http.Error(w, "save failed", 500); return }
+	http.Redirect(w, r, "/browse/"+folder+"/", http.StatusSeeOther)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// ========== WEBDAV ==========
+// /dav/ serves the library as a WebDAV share, so it can be mounted as a
+// network drive (Finder: Go > Connect to Server, http://host/dav/; Windows:
+// Map network drive) and files dragged in and out. Clients log in with HTTP
+// Basic auth using the normal accounts (an API token as a Bearer header works
+// too); in public-read mode, or without accounts, browsing and downloading
+// need no login. Folders closed to a user by FOLDER_ACCESS_FILE (acl.go)
+// don't show up for them. WEBDAV=off turns the share off.
+//
+// Files written over WebDAV go through storeLocal like any upload, so they
+// get thumbnails, EXIF and a catalog entry. Deletes move to the trash, and
+// moves use the same copy-then-delete path as /move. Generated folders and
+// sidecars are hidden, and the dotfiles Finder drops everywhere (.DS_Store,
+// ._name) are accepted but not stored. B2 has no empty folders: one made over
+// WebDAV is only remembered until the server restarts, unless a file lands in
+// it first. Windows only sends Basic credentials over HTTPS (see tls.go).
+
+func davHandler() http.HandlerFunc {
+	locks := webdav.NewMemLS()
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := davAuthorized(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="memories", charset="UTF-8"`)
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		body := &davBody{ ReadCloser: r.Body }
+		r.Body = body
+		// webdav writes hrefs and reads Destination headers with the prefix
+		// the client sees, so it gets the full path back
+		r.URL.Path, r.URL.RawPath = appURL(r.URL.Path), ""
+		// A fresh FileSystem per request keeps the stat cache to one PROPFIND
+		h := &webdav.Handler{
+			Prefix:     appURL("/dav"),
+			FileSystem: &davFS{ seen: map[string]davInfo{}, body: body, user: user, origin: requestOrigin(r) },
+			LockSystem: locks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !os.IsNotExist(err) { log.Printf("DAV %s %s: %v", r.Method, r.URL.Path, err) }
+			},
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// davBody remembers a failed read of the request body: webdav closes (and so
+// stores) a PUT's file even when the upload was cut short.
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF { b.err = err }
+	return n, err
+}
+
+// davAuthorized lets reads through when the library is readable without a
+// login and otherwise wants a user: a session, a token or Basic credentials.
+// It returns the user, "" for an anonymous read.
+func davAuthorized(r *http.Request) (string, bool) {
+	if user := currentUser(r); user != "" { return user, true }
+	if _, _, ok := r.BasicAuth(); ok { return basicUser(r) }
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		if publicRead || len(users) == 0 { return "", true }
+	}
+	return "", false
+}
+
+// ========== DAV FILESYSTEM ==========
+// davFolders are empty folders made with MKCOL (name -> true).
+var davFolders sync.Map
+
+type davFS struct {
+	// seen holds what Readdir found, so PROPFIND doesn't stat every child again
+	seen   map[string]davInfo
+	body   *davBody
+	user   string // "" for an anonymous read
+	origin string // for the links in upload notifications
+}
+
+// davName turns a WebDAV path ("/a/b.jpg") into a display name ("a/b.jpg").
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// davVisible reports whether name is part of the library as the share shows it.
+func davVisible(name string) bool {
+	if name == "" { return true }
+	top, _, _ := strings.Cut(name, "/")
+	return !isInternalFolder(top) && isLibraryFile(name) && !strings.HasPrefix(path.Base(name), ".")
+}
+
+// visible is davVisible narrowed to the folders the user may read.
+func (fs *davFS) visible(name string) bool { return davVisible(name) && canRead(fs.user, name) }
+
+// davJunk reports whether name is Finder metadata, which is dropped on write.
+func davJunk(name string) bool {
+	base := path.Base(name)
+	return base == ".DS_Store" || strings.HasPrefix(base, "._")
+}
+
+// davError maps move and delete failures to the errors webdav understands.
+func davError(err error) error {
+	var me moveError
+	if errors.As(err, &me) {
+		switch me.status {
+		case 404: return os.ErrNotExist
+		case 409: return os.ErrExist
+		case 400: return os.ErrPermission
+		}
+	}
+	return err
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.lookup(ctx, davName(name))
+	if err != nil { return nil, err }
+	return info, nil
+}
+
+func (fs *davFS) lookup(ctx context.Context, name string) (davInfo, error) {
+	if name == "" { return davInfo{ dir: true }, nil }
+	if !fs.visible(name) { return davInfo{}, os.ErrNotExist }
+	if info, ok := fs.seen[name]; ok { return info, nil }
+
+	if e, ok := catalogGet(name); ok { return davInfo{ name: name, size: e.Size, modified: e.Modified, version: e.Version }, nil }
+	if casMode {
+		if e, ok := casLookup(name); ok { return davInfo{ name: name, size: e.Size, modified: e.Uploaded, version: e.Hash }, nil }
+	}
+	if attrs, err := store.Attrs(ctx, name); err == nil {
+		return davInfo{ name: name, size: attrs.Size, modified: attrs.Modified, version: sourceVersion(attrs) }, nil
+	}
+
+	if _, ok := davFolders.Load(name); ok { return davInfo{ name: name, dir: true }, nil }
+	l, _, err := listPage(ctx, name+"/", "", 1)
+	if err != nil { return davInfo{}, err }
+	if len(l.Files) > 0 || len(l.Folders) > 0 { return davInfo{ name: name, dir: true }, nil }
+	return davInfo{}, os.ErrNotExist
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 { return fs.create(ctx, name, flag) }
+	info, err := fs.lookup(ctx, name)
+	if err != nil { return nil, err }
+	f := &davFile{ fs: fs, ctx: ctx, info: info }
+	if !info.dir { f.body = &objectReadSeeker{ ctx: ctx, key: storageKey(name), size: info.size } }
+	return f, nil
+}
+
+// create opens name for writing. The bytes are spooled to a temp file and
+// stored on Close.
+func (fs *davFS) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if name == "" { return nil, os.ErrPermission }
+	if davJunk(name) { return &davFile{ fs: fs, ctx: ctx, info: davInfo{ name: name, modified: time.Now() }, junk: true }, nil }
+	if !fs.visible(name) { return nil, os.ErrPermission }
+	if parent, err := fs.lookup(ctx, parentFolder(name)); err != nil || !parent.dir { return nil, os.ErrNotExist }
+	if existing, err := fs.lookup(ctx, name); err == nil {
+		if existing.dir || flag&os.O_EXCL != 0 { return nil, os.ErrExist }
+	}
+
+	spool, err := createTemp("dav-*"+filepath.Ext(name))
+	if err != nil { return nil, err }
+	return &davFile{ fs: fs, ctx: ctx, info: davInfo{ name: name, modified: time.Now() }, spool: spool, hasher: sha1.New() }, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davName(name)
+	if name == "" || !fs.visible(name) { return os.ErrPermission }
+	if _, err := fs.lookup(ctx, name); err == nil { return os.ErrExist }
+	if parent, err := fs.lookup(ctx, parentFolder(name)); err != nil || !parent.dir { return os.ErrNotExist }
+	davFolders.Store(name, true)
+	log.Printf("📁 DAV folder %s/", name)
+	return nil
+}
+
+// RemoveAll moves a file, or every file in a folder, to the trash.
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	if name == "" || !fs.visible(name) { return os.ErrPermission }
+	// Like a delete from the UI, this finishes even if the client hangs up
+	ctx = context.WithoutCancel(ctx)
+	info, err := fs.lookup(ctx, name)
+	if err != nil { return nil }
+	delete(fs.seen, name)
+	if !info.dir { return davError(removeFile(ctx, name, false)) }
+
+	items, err := zipItemsUnder(ctx, name+"/")
+	if err != nil { return err }
+	for _, it := range items {
+		if err := removeFile(ctx, it.name, false); err != nil { return davError(err) }
+	}
+	forgetDavFolders(name, "")
+	return nil
+}
+
+// Rename moves a file, or every file in a folder, to newName.
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = davName(oldName), davName(newName)
+	if oldName == "" || newName == "" || !fs.visible(oldName) || !fs.visible(newName) { return os.ErrPermission }
+	ctx = context.WithoutCancel(ctx)
+	info, err := fs.lookup(ctx, oldName)
+	if err != nil { return err }
+	delete(fs.seen, oldName)
+	if !info.dir {
+		if err := moveFile(ctx, oldName, newName); err != nil { return davError(err) }
+		log.Printf("🚚 DAV moved %s -> %s", oldName, newName)
+		return nil
+	}
+	if strings.HasPrefix(newName+"/", oldName+"/") { return os.ErrPermission }
+
+	items, err := zipItemsUnder(ctx, oldName+"/")
+	if err != nil { return err }
+	// A folder with something closed to the user in it moves whole or not at all
+	for _, it := range items {
+		if !fs.visible(it.name) { return os.ErrPermission }
+	}
+	for _, it := range items {
+		if err := moveFile(ctx, it.name, newName+strings.TrimPrefix(it.name, oldName)); err != nil { return davError(err) }
+	}
+	forgetDavFolders(oldName, newName)
+	log.Printf("🚚 DAV moved %s/ -> %s/ (%d file(s))", oldName, newName, len(items))
+	return nil
+}
+
+// forgetDavFolders drops the remembered empty folders at and below folder,
+// recreating them under to if it isn't "".
+func forgetDavFolders(folder, to string) {
+	davFolders.Range(func(k, _ any) bool {
+		name := k.(string)
+		if name != folder && !strings.HasPrefix(name, folder+"/") { return true }
+		davFolders.Delete(name)
+		if to != "" { davFolders.Store(to+strings.TrimPrefix(name, folder), true) }
+		return true
+	})
+}
+
+// readdir lists the files and folders directly under dir.
+func (fs *davFS) readdir(ctx context.Context, dir string) ([]os.FileInfo, error) {
+	prefix := keyPrefix
+	if dir != "" { prefix = dir + "/" }
+	var infos []os.FileInfo
+	listed := map[string]bool{}
+	add := func(info davInfo) {
+		if listed[info.name] || !fs.visible(info.name) { return }
+		listed[info.name] = true
+		fs.seen[info.name] = info
+		infos = append(infos, info)
+	}
+
+	start := ""
+	for {
+		l, next, err := listPage(ctx, prefix, start, 1000)
+		if err != nil { return nil, err }
+		for _, folder := range l.Folders { add(davInfo{ name: folder, dir: true }) }
+		for _, e := range l.Files {
+			name, _ := e["Name"].(string)
+			size, _ := e["Bytes"].(int64)
+			modified, _ := e["Uploaded"].(time.Time)
+			version, _ := e["Version"].(string)
+			add(davInfo{ name: name, size: size, modified: modified, version: version })
+		}
+		if next == "" { break }
+		start = next
+	}
+	davFolders.Range(func(k, _ any) bool {
+		if name := k.(string); parentFolder(name) == dir { add(davInfo{ name: name, dir: true }) }
+		return true
+	})
+	return infos, nil
+}
+
+// ========== DAV FILES ==========
+// davInfo describes a file or folder of the share.
+type davInfo struct {
+	name     string // display name, "" for the root
+	size     int64
+	modified time.Time
+	version  string
+	dir      bool
+}
+
+func (i davInfo) Name() string {
+	if i.name == "" { return "/" }
+	return path.Base(i.name)
+}
+func (i davInfo) Size() int64        { return i.size }
+func (i davInfo) ModTime() time.Time { return i.modified }
+func (i davInfo) IsDir() bool        { return i.dir }
+func (i davInfo) Sys() any           { return nil }
+
+func (i davInfo) Mode() os.FileMode {
+	if i.dir { return os.ModeDir | 0755 }
+	return 0644
+}
+
+// ContentType saves webdav from reading the start of every file in a PROPFIND.
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.dir { return "", webdav.ErrNotImplemented }
+	return detectContentType(i.name), nil
+}
+
+// ETag matches the one /view/ and /download/ send.
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.version == "" { return "", webdav.ErrNotImplemented }
+	return `"` + i.version + `"`, nil
+}
+
+type davFile struct {
+	fs   *davFS
+	ctx  context.Context
+	info davInfo
+	body *objectReadSeeker // reading a file
+	dir  []os.FileInfo     // Readdir results not yet returned
+	read bool              // dir was filled
+	// writing
+	spool  *os.File
+	hasher hash.Hash
+	junk   bool // Finder metadata, thrown away
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.body == nil { return 0, os.ErrInvalid }
+	return f.body.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.body == nil { return 0, os.ErrInvalid }
+	return f.body.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	switch {
+	case f.junk:
+	case f.spool != nil:
+		n, err := f.spool.Write(p)
+		f.hasher.Write(p[:n])
+		f.info.size += int64(n)
+		return n, err
+	default:
+		return 0, os.ErrPermission
+	}
+	f.info.size += int64(len(p))
+	return len(p), nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.dir { return nil, os.ErrInvalid }
+	if !f.read {
+		infos, err := f.fs.readdir(f.ctx, f.info.name)
+		if err != nil { return nil, err }
+		f.dir, f.read = infos, true
+	}
+	if count <= 0 {
+		infos := f.dir
+		f.dir = nil
+		return infos, nil
+	}
+	if len(f.dir) == 0 { return nil, io.EOF }
+	n := min(count, len(f.dir))
+	infos := f.dir[:n]
+	f.dir = f.dir[n:]
+	return infos, nil
+}
+
+// Close stores a written file like an upload, thumbnail and all.
+func (f *davFile) Close() error {
+	if f.body != nil { return f.body.Close() }
+	if f.spool == nil { return nil }
+	local := f.spool.Name()
+	defer os.Remove(local)
+	if err := f.spool.Close(); err != nil { return err }
+	f.spool = nil
+	if err := f.fs.body.err; err != nil { return fmt.Errorf("upload of %s interrupted: %w", f.info.name, err) }
+
+	hold, err := holdQuota(f.fs.user, f.info.size)
+	if err != nil { return err }
+	defer hold()
+	// The client has sent everything; storing it shouldn't depend on it staying
+	res := storeLocal(context.WithoutCancel(f.ctx), local, f.info.size, hex.EncodeToString(f.hasher.Sum(nil)), f.info.name, false, nil)
+	if res.Error != "" { return errors.New(res.Error) }
+	delete(f.fs.seen, f.info.name)
+	log.Printf("📁 DAV stored %s (%s)", f.info.name, res.Size)
+	chargeUploads(f.fs.user, res)
+	notifyUploads(f.fs.origin, f.fs.user, res)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== METADATA DB ==========
+// Local bbolt file (META_DB, default memories.db) for state that doesn't
+// belong in B2 itself. Values are stored as JSON.
+
+var db *bolt.DB
+
+func openDB() {
+	dbPath := os.Getenv("META_DB")
+	if dbPath == "" { dbPath = "memories.db" }
+
+	var err error
+	db, err = bolt.Open(dbPath, 0600, &bolt.Options{ Timeout: time.Second })
+	if err != nil { log.Fatal("Metadata DB error:", err) }
+}
+
+// dbGet decodes bucket/key into v. It reports false if the key doesn't exist.
+func dbGet(bucket, key string, v any) (bool, error) {
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil { return nil }
+		data := b.Get([]byte(key))
+		if data == nil { return nil }
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
+
+func dbPut(bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil { return err }
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil { return err }
+		return b.Put([]byte(key), data)
+	})
+}
+
+// dbEach calls fn for every key in bucket, in key order.
+func dbEach(bucket string, fn func(key string, data []byte) error) error {
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil { return nil }
+		return b.ForEach(func(k, v []byte) error { return fn(string(k), v) })
+	})
+}
+
+func dbDelete(bucket, key string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil { return nil }
+		return b.Delete([]byte(key))
+	})
+}
+
+// dbMissing reports whether a bucket has never been created.
+func dbMissing(bucket string) bool {
+	missing := true
+	db.View(func(tx *bolt.Tx) error {
+		missing = tx.Bucket([]byte(bucket)) == nil
+		return nil
+	})
+	return missing
+}
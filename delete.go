@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ========== DELETE ==========
+// DELETE /delete/{name} moves the file to the trash (see trash.go);
+// ?permanent=1 skips it. A permanent delete removes the original plus
+// everything derived from it: the thumb/ object, the sidecar, cached
+// thumbnails and DB references. In CAS mode the blob is only removed once no
+// other name (or trashed item) points at it.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
+	name := strings.TrimPrefix(r.URL.Path, "/delete/")
+	if name == "" || !isLibraryFile(name) { http.NotFound(w, r); return }
+
+	if err := removeFile(context.WithoutCancel(r.Context()), name, r.URL.Query().Get("permanent") == "1"); err != nil {
+		log.Printf("Delete %s failed: %v", name, err)
+		http.Error(w, "delete failed", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeFile trashes name, or deletes it outright when permanent is set.
+func removeFile(ctx context.Context, name string, permanent bool) error {
+	if permanent {
+		if err := deleteFile(ctx, name); err != nil { return err }
+		log.Printf("🗑️ Deleted %s", name)
+		return nil
+	}
+	if _, err := trashFile(ctx, name); err != nil { return err }
+	log.Printf("🗑️ Moved %s to the trash", name)
+	return nil
+}
+
+func deleteFile(ctx context.Context, name string) error {
+	key := storageKey(name)
+	removeBlob := true
+
+	if casMode {
+		if e, ok := casLookup(name); ok {
+			if err := dbDelete("cas_names", name); err != nil { return err }
+			removeBlob = !casReferenced(e.Hash, "")
+		}
+	}
+
+	if removeBlob {
+		if err := deleteForGood(ctx, key); err != nil { return err }
+		removeThumbs(ctx, key)
+		if needsTranscode(name) { store.Delete(ctx, transcodedKey(key)) }
+		if isVideo(name) { deleteHLS(ctx, key) }
+	}
+
+	// Sidecars are per name, not per blob
+	if objectExists(ctx, sidecarKey(name)) {
+		if err := deleteForGood(ctx, sidecarKey(name)); err != nil {
+			log.Printf("Failed to delete sidecar for %s: %v", name, err)
+		}
+	}
+
+	forgetFile(name)
+	return nil
+}
+
+// forgetFile drops DB references to a deleted name.
+func forgetFile(name string) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+	catalogDelete(name)
+	disownFile(name)
+	dbDelete("tags", name)
+	dbDelete("geo", name)
+	dbDelete("taken", name)
+	dbDelete("captions", name)
+	dbDelete("details", name)
+	dbDelete("videos", name)
+	dbDelete("weather", name)
+	forEachShare(name, func(s shareLink) { dbDelete("shares", s.ID) })
+
+	folder := path.Dir(name)
+	if folder == "." { folder = "" }
+	var cover string
+	if found, _ := dbGet("covers", folder, &cover); found && cover == name { dbDelete("covers", folder) }
+
+	for _, a := range allAlbums() {
+		if slices.Contains(a.Items, name) {
+			a.Items = slices.DeleteFunc(a.Items, func(n string) bool { return n == name })
+			if a.Cover == name { a.Cover = "" }
+			saveAlbum(a)
+		}
+	}
+	for _, e := range journalEntries("", "") {
+		if slices.Contains(e.Photos, name) {
+			e.Photos = slices.DeleteFunc(e.Photos, func(n string) bool { return n == name })
+			dbPut("journal", e.ID, e)
+		}
+	}
+}
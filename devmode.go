@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ========== DEVELOPMENT MODE ==========
+// Templates are parsed once at startup. With DEV_MODE=1 they are parsed
+// again from templates/ on every render instead, so an edit to the HTML
+// shows on the next reload without a restart; a template that doesn't parse
+// puts the error in the page (and the log) rather than stopping the server.
+// Every response is also sent with Cache-Control: no-store, overriding what
+// the handler chose, so the browser never shows a stale page, thumbnail or
+// /static/ file. It costs a parse per page view: don't run it in
+// production.
+
+var devMode = os.Getenv("DEV_MODE") == "1"
+
+// templateSet is what pages render through: the templates parsed at startup,
+// or in development mode fresh ones every time.
+type templateSet struct{ parsed *template.Template }
+
+func parseTemplates() (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"base":      func() string { return basePath },
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": hasSuffix,
+		"join":      strings.Join,
+	}).ParseGlob("templates/*.html")
+}
+
+func loadTemplates() *templateSet {
+	if devMode { log.Println("🛠️ DEV_MODE: templates are re-read on every render and nothing is cached") }
+	return &templateSet{ parsed: template.Must(parseTemplates()) }
+}
+
+func (s *templateSet) ExecuteTemplate(w io.Writer, name string, data any) error {
+	if !devMode { return s.parsed.ExecuteTemplate(w, name, data) }
+	t, err := parseTemplates()
+	if err != nil {
+		log.Printf("⚠️ Templates: %v", err)
+		fmt.Fprintf(w, "<pre>%s</pre>", template.HTMLEscapeString(err.Error()))
+		return err
+	}
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("⚠️ Template %s: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+// noStoreWriter marks a response uncacheable however the handler set it.
+type noStoreWriter struct{ http.ResponseWriter }
+
+func (w noStoreWriter) WriteHeader(code int) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w noStoreWriter) Write(p []byte) (int, error) {
+	// Headers set after the first write are ignored, so this only counts once
+	w.Header().Set("Cache-Control", "no-store")
+	return w.ResponseWriter.Write(p)
+}
+
+func (w noStoreWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// devNoStore returns h, sending no-store on everything in development mode.
+func devNoStore(h http.Handler) http.Handler {
+	if !devMode { return h }
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { h.ServeHTTP(noStoreWriter{ w }, r) })
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/kurin/blazer/base"
+)
+
+// ========== DIRECT-FROM-B2 DOWNLOADS ==========
+// /download streams every byte through the server. With
+// DOWNLOAD_REDIRECT_MB=100 a download of a file of at least 100MB is
+// answered with a redirect to B2 instead: a URL carrying a download
+// authorization for that one file (so it works on private buckets) and the
+// attachment name, good for DOWNLOAD_URL_TTL (default 15m). Whoever has the
+// URL can fetch the file until then, which is no more than the signed-in
+// or public-read user it went to could do anyway.
+//
+// A redirected download leaves the server at once, so DOWNLOAD_RATE_KB
+// doesn't slow it, and it is counted as egress in full, since B2 bills it
+// like any other. Other backends, and B2 when the authorization fails,
+// stream as before.
+
+// redirectDownload answers a download of name (stored at key) with a
+// redirect to B2 when it should; false means it didn't.
+func redirectDownload(w http.ResponseWriter, r *http.Request, name, key string, attrs *objectAttrs) bool {
+	mb := envInt("DOWNLOAD_REDIRECT_MB", 0)
+	if mb <= 0 || attrs.Size < int64(mb)<<20 { return false }
+	b, key, ok := directBackend(key)
+	if !ok { return false }
+	target, err := b.authorizedURL(r.Context(), key, contentDisposition("attachment", path.Base(name)), envDuration("DOWNLOAD_URL_TTL", 15*time.Minute))
+	if err != nil { log.Printf("Download %s: no B2 authorization, streaming it: %v", name, err); return false }
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+	egress.Add("download", attrs.Size)
+	return true
+}
+
+// authorizedURL is a download URL for key that works without a session for
+// valid, served with the Content-Disposition given.
+func (s *b2Storage) authorizedURL(ctx context.Context, key, disposition string, valid time.Duration) (string, error) {
+	token, err := s.listBucket.GetDownloadAuthorization(ctx, key, valid, disposition)
+	if err != nil && base.Action(err) == base.ReAuthenticate {
+		if err := s.reauthorize(ctx); err != nil { return "", err }
+		token, err = s.listBucket.GetDownloadAuthorization(ctx, key, valid, disposition)
+	}
+	if err != nil { return "", err }
+	q := url.Values{ "Authorization": {token}, "b2ContentDisposition": {disposition} }
+	return keyInfo.currentSession().DownloadURL + "/file/" + url.PathEscape(s.bucket.Name()) + "/" + b2EncodeName(key) + "?" + q.Encode(), nil
+}
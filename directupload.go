@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== DIRECT-TO-B2 UPLOADS ==========
+// Proxied uploads cross the server's link twice. With DIRECT_UPLOAD_MB=200
+// the upload page sends files of at least 200MB from the browser straight
+// to B2 instead, with upload URLs and tokens the server asks B2 for. Only
+// the name, collision policy and the final registration go through here:
+//
+//	POST   /upload/direct                {name, folder, size, collision} -> {id, name, mode, ...}
+//	POST   /upload/direct/{id}/part-url  -> {upload_url, authorization}, for mode "parts"
+//	POST   /upload/direct/{id}           {parts: [sha1...]} -> the upload result
+//	DELETE /upload/direct/{id}           abort
+//
+// A file that fits in one part of DIRECT_UPLOAD_PART_MB (default 64, at
+// least 5) is mode "file": one b2_upload_file to upload_url with file_name.
+// Bigger ones are mode "parts": a B2 large file the server starts, whose
+// parts the browser sends with their SHA-1s (B2 needs them to finish it).
+// The last call finishes the large file, checks that B2 holds the size
+// announced, and answers at once; the thumbnail, EXIF and video probe are
+// made afterwards in the background from a copy read back from B2.
+//
+// The bucket needs a CORS rule letting the app's origin make b2_upload_file
+// and b2_upload_part calls with the Authorization, Content-Type and X-Bz-*
+// headers. An upload token is good for any name in the bucket for 24h, so
+// only signed-in users get one, as with every other upload. Files go
+// through the server as before on other backends, in content-addressed mode
+// (the name depends on the bytes), and from browsers that can't hash.
+//
+// The name is claimed (uploadname.go), and the size held against the
+// user's quota (quota.go), from the first call to the last;
+// uploads not finished within UPLOAD_SESSION_TTL are cancelled by the
+// upload sweep.
+
+type directUpload struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Mode        string    `json:"mode"`                  // "file" or "parts"
+	FileName    string    `json:"file_name"`             // the name in the bucket, URL-encoded for X-Bz-File-Name
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	PartSize    int64     `json:"part_size,omitempty"`
+	FileID      string    `json:"file_id,omitempty"`     // the large file
+	UploadURL   string    `json:"upload_url,omitempty"`  // mode "file"
+	Token       string    `json:"authorization,omitempty"`
+	User        string    `json:"-"`
+	Created     time.Time `json:"created"`
+}
+
+// directClaims release the names of uploads in flight, by upload id.
+var directClaims sync.Map
+
+// directMB is the size from which the upload page sends files straight to
+// B2; 0 when it can't.
+func directMB() int {
+	mb := envInt("DIRECT_UPLOAD_MB", 0)
+	if mb <= 0 || casMode { return 0 }
+	if _, _, ok := directBackend(""); !ok { return 0 }
+	return mb
+}
+
+// directBackend is the B2 bucket name is stored in and name's key there.
+func directBackend(name string) (*b2Storage, string, bool) {
+	s, key := backendOf(name)
+	b, ok := s.(*b2Storage)
+	return b, key, ok
+}
+
+func directUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == "" { apiError(w, 401, "login required"); return }
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/upload/direct"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost { apiError(w, http.StatusMethodNotAllowed, "method not allowed"); return }
+		startDirectUpload(w, r, user)
+		return
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	var u directUpload
+	if found, _ := dbGet("direct_uploads", id, &u); !found || u.User != user { apiError(w, 404, "no such upload"); return }
+
+	switch {
+	case action == "part-url" && r.Method == http.MethodPost:
+		b, _, ok := directBackend(u.Name)
+		if !ok || u.FileID == "" { apiError(w, 400, "this upload has no parts"); return }
+		uploadURL, token, err := b.partUploadURL(r.Context(), u.FileID)
+		if err != nil { log.Printf("Direct upload %s: part URL failed: %v", u.Name, err); apiError(w, 502, "B2 refused an upload URL"); return }
+		writeJSON(w, 200, map[string]string{ "upload_url": uploadURL, "authorization": token })
+	case action == "" && r.Method == http.MethodPost:
+		finishDirectUpload(w, r, u)
+	case action == "" && r.Method == http.MethodDelete:
+		dropDirectUpload(r.Context(), u)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func startDirectUpload(w http.ResponseWriter, r *http.Request, user string) {
+	var req struct {
+		Name      string `json:"name"`
+		Folder    string `json:"folder"`
+		Size      int64  `json:"size"`
+		Collision string `json:"collision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apiError(w, 400, "bad json"); return }
+	if directMB() == 0 { apiError(w, http.StatusNotImplemented, "direct uploads are off"); return }
+	if req.Size <= 0 { apiError(w, 400, "size must be positive"); return }
+	name, err := cleanUploadName(req.Folder, req.Name)
+	if err != nil { apiError(w, 400, err.Error()); return }
+	policy, err := collisionPolicy(req.Collision)
+	if err != nil { apiError(w, 400, err.Error()); return }
+	// The bytes never pass through here, so the quota is held from the start
+	hold, err := holdQuota(user, req.Size)
+	if err != nil { apiError(w, http.StatusRequestEntityTooLarge, err.Error()); return }
+	name, claim, err := claimUploadName(r.Context(), name, policy)
+	if err != nil { hold(); apiError(w, http.StatusConflict, err.Error()); return }
+	release := func() { claim(); hold() }
+
+	b, key, _ := directBackend(name)
+	u := directUpload{
+		ID:          newID(),
+		Name:        name,
+		FileName:    b2EncodeName(key),
+		ContentType: detectContentType(name),
+		Size:        req.Size,
+		PartSize:    int64(max(envInt("DIRECT_UPLOAD_PART_MB", 64), 5)) << 20,
+		User:        user,
+		Created:     time.Now(),
+	}
+	if u.Size <= u.PartSize {
+		u.Mode, u.PartSize = "file", 0
+		u.UploadURL, u.Token, err = b.uploadURL(r.Context())
+	} else {
+		u.Mode = "parts"
+		u.FileID, err = b.startLargeFile(r.Context(), key, u.ContentType)
+	}
+	if err != nil {
+		release()
+		log.Printf("Direct upload %s: B2 refused: %v", name, err)
+		apiError(w, 502, "B2 refused the upload")
+		return
+	}
+	if err := dbPut("direct_uploads", u.ID, u); err != nil { release(); apiError(w, 500, "could not start upload"); return }
+	directClaims.Store(u.ID, release)
+	log.Printf("⏫ Direct upload %s: %s (%s) by %s", u.ID, u.Name, humanReadableSize(u.Size), user)
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// b2EncodeName encodes key for X-Bz-File-Name and download URLs, where a
+// "+" would be read as a space.
+func b2EncodeName(key string) string {
+	return strings.NewReplacer("%2F", "/", "+", "%2B").Replace(url.PathEscape(key))
+}
+
+func finishDirectUpload(w http.ResponseWriter, r *http.Request, u directUpload) {
+	var req struct {
+		Parts []string `json:"parts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { apiError(w, 400, "bad json"); return }
+	ctx := context.WithoutCancel(r.Context())
+	if u.FileID != "" {
+		b, _, ok := directBackend(u.Name)
+		if !ok { apiError(w, 500, "storage changed since the upload started"); return }
+		// A failure leaves the large file open, so the client can try again
+		if err := b.finishLargeFile(ctx, u.FileID, req.Parts); err != nil {
+			log.Printf("Direct upload %s: finishing failed: %v", u.Name, err)
+			apiError(w, 502, "B2 could not finish the file: "+err.Error())
+			return
+		}
+	}
+	attrs, err := store.Attrs(ctx, u.Name)
+	if u.FileID == "" && (err != nil || attrs.Modified.Before(u.Created.Add(-time.Minute))) {
+		apiError(w, http.StatusConflict, "B2 doesn't have the file yet, upload it first")
+		return
+	}
+	if err != nil || attrs.Size != u.Size {
+		log.Printf("Direct upload %s: B2 doesn't hold the announced %d bytes (%v)", u.Name, u.Size, err)
+		dropDirectUpload(ctx, u)
+		apiError(w, http.StatusUnprocessableEntity, "B2 doesn't hold the file that was announced, upload it again")
+		return
+	}
+	res := uploadResult{ Name: u.Name, Size: humanReadableSize(attrs.Size), bytes: attrs.Size }
+	if attrs.SHA1 != "none" { res.SHA1 = attrs.SHA1 }
+	if dupes := namesWithHash(res.SHA1, u.Name); len(dupes) > 0 { res.DuplicateOf = dupes[0] }
+	catalogPut(catalogEntry{ Name: u.Name, Size: attrs.Size, Modified: attrs.Modified, ContentType: u.ContentType, Version: sourceVersion(attrs) })
+	chargeUploads(u.User, res)
+	dbDelete("direct_uploads", u.ID)
+	if release, ok := directClaims.LoadAndDelete(u.ID); ok { release.(func())() }
+	go processDirectUpload(shutdownCtx, u.Name, sourceVersion(attrs))
+	log.Printf("✅ Direct upload %s complete: %s", u.ID, u.Name)
+	notifyUploads(requestOrigin(r), u.User, res)
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// processDirectUpload reads a file sent straight to B2 back and does what
+// an upload through the server does as it passes: thumbnail, EXIF, probe.
+func processDirectUpload(ctx context.Context, name, version string) {
+	local, err := downloadTemp(ctx, name, filepath.Ext(name))
+	if err != nil { log.Printf("Direct upload %s: reading it back failed: %v", name, err); return }
+	defer os.Remove(local)
+	size, _, _ := hashLocal(local)
+
+	var thumbData []byte
+	if err := acquireThumbSlot(ctx); err == nil {
+		rctx, cancel := renderContext(ctx)
+		if f, err := os.Open(local); err == nil {
+			thumbData, _ = thumbnailer.GenerateThumbnail(rctx, f, name, thumbnailer.Options{ Width: thumbWidth, Quality: thumbQuality, Frame: defaultFramePick() })
+			f.Close()
+		}
+		cancel()
+		releaseThumbSlot()
+	}
+	var info *exifInfo
+	if hasEXIF(name) {
+		if x, ok := readEXIF(local); ok { info = &x }
+	}
+	completeUpload(ctx, name, name, version, size, false, thumbData, info)
+	if isVideo(name) {
+		rctx, cancel := renderContext(ctx)
+		probeAndSave(rctx, name, local)
+		cancel()
+	}
+}
+
+// dropDirectUpload forgets u, cancelling its large file.
+func dropDirectUpload(ctx context.Context, u directUpload) {
+	if b, _, ok := directBackend(u.Name); ok && u.FileID != "" {
+		if err := b.cancelLargeFile(ctx, u.FileID); err != nil && !isNotFound(err) { log.Printf("Direct upload %s: cancelling failed: %v", u.Name, err) }
+	}
+	dbDelete("direct_uploads", u.ID)
+	if release, ok := directClaims.LoadAndDelete(u.ID); ok { release.(func())() }
+}
+
+// sweepDirectUploads drops direct uploads older than ttl.
+func sweepDirectUploads(ttl time.Duration) {
+	var stale []directUpload
+	dbEach("direct_uploads", func(k string, v []byte) error {
+		var u directUpload
+		if json.Unmarshal(v, &u) == nil && time.Since(u.Created) > ttl { stale = append(stale, u) }
+		return nil
+	})
+	for _, u := range stale {
+		log.Printf("🧹 Dropping abandoned direct upload %s (%s)", u.ID, u.Name)
+		dropDirectUpload(shutdownCtx, u)
+	}
+}
+
+// ========== B2 UPLOAD CALLS ==========
+// blazer makes these itself but keeps the URLs and tokens to itself.
+
+func (s *b2Storage) uploadURL(ctx context.Context) (uploadURL, token string, err error) {
+	var resp struct {
+		UploadURL string `json:"uploadUrl"`
+		Token     string `json:"authorizationToken"`
+	}
+	err = s.b2Call(ctx, "b2_get_upload_url", map[string]any{ "bucketId": s.listBucket.ID }, &resp)
+	return resp.UploadURL, resp.Token, err
+}
+
+func (s *b2Storage) startLargeFile(ctx context.Context, key, contentType string) (string, error) {
+	var resp struct {
+		FileID string `json:"fileId"`
+	}
+	err := s.b2Call(ctx, "b2_start_large_file", map[string]any{ "bucketId": s.listBucket.ID, "fileName": key, "contentType": contentType }, &resp)
+	return resp.FileID, err
+}
+
+func (s *b2Storage) partUploadURL(ctx context.Context, fileID string) (uploadURL, token string, err error) {
+	var resp struct {
+		UploadURL string `json:"uploadUrl"`
+		Token     string `json:"authorizationToken"`
+	}
+	err = s.b2Call(ctx, "b2_get_upload_part_url", map[string]any{ "fileId": fileID }, &resp)
+	return resp.UploadURL, resp.Token, err
+}
+
+func (s *b2Storage) finishLargeFile(ctx context.Context, fileID string, partSHA1s []string) error {
+	if partSHA1s == nil { partSHA1s = []string{} }
+	return s.b2Call(ctx, "b2_finish_large_file", map[string]any{ "fileId": fileID, "partSha1Array": partSHA1s }, nil)
+}
+
+func (s *b2Storage) cancelLargeFile(ctx context.Context, fileID string) error {
+	return s.b2Call(ctx, "b2_cancel_large_file", map[string]any{ "fileId": fileID }, nil)
+}
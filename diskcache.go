@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ========== DISK THUMBNAIL CACHE ==========
+// Second tier behind the RAM LRU: THUMB_CACHE_DIR (default ./cache/thumbs),
+// capped at THUMB_DISK_CACHE_MB (default 2048, 0 disables). Survives restarts,
+// so a warm server never reads thumbnails from B2. File names hash the key and
+// version together, so a stale version is simply never looked up again and
+// ages out under the size cap.
+
+type diskFile struct {
+	size    int64
+	lastUse time.Time
+}
+
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	files    map[string]*diskFile // file name -> info
+
+	hits, misses, evictions int64
+}
+
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	if maxBytes <= 0 { return nil }
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("⚠️ Disk thumbnail cache disabled:", err)
+		return nil
+	}
+	d := &diskCache{ dir: dir, maxBytes: maxBytes, files: map[string]*diskFile{} }
+
+	// Pick up what a previous run left behind
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() { continue }
+		d.files[e.Name()] = &diskFile{ size: info.Size(), lastUse: info.ModTime() }
+		d.size += info.Size()
+	}
+	d.evict()
+	return d
+}
+
+func diskName(key, version string) string {
+	sum := sha256.Sum256([]byte(key + "\x00" + version))
+	return hex.EncodeToString(sum[:]) + ".jpg"
+}
+
+func (d *diskCache) Get(key, version string) ([]byte, bool) {
+	name := diskName(key, version)
+	d.mu.Lock()
+	f, ok := d.files[name]
+	if ok { f.lastUse = time.Now() }
+	d.mu.Unlock()
+
+	if ok {
+		data, err := os.ReadFile(filepath.Join(d.dir, name))
+		if err == nil {
+			// mtime doubles as last use for the next startup scan
+			os.Chtimes(filepath.Join(d.dir, name), time.Now(), time.Now())
+			d.mu.Lock()
+			d.hits++
+			d.mu.Unlock()
+			return data, true
+		}
+		d.mu.Lock()
+		d.drop(name)
+		d.mu.Unlock()
+	}
+	d.mu.Lock()
+	d.misses++
+	d.mu.Unlock()
+	return nil, false
+}
+
+func (d *diskCache) Put(key, version string, data []byte) {
+	if int64(len(data)) > d.maxBytes { return }
+	name := diskName(key, version)
+
+	// Write then rename so readers never see a partial file
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil { return }
+	_, werr := tmp.Write(data)
+	cerr := tmp.Close()
+	if werr != nil || cerr != nil || os.Rename(tmp.Name(), filepath.Join(d.dir, name)) != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.files[name]; ok { d.size -= old.size }
+	d.files[name] = &diskFile{ size: int64(len(data)), lastUse: time.Now() }
+	d.size += int64(len(data))
+	d.evict()
+}
+
+// drop forgets a file and removes it. Caller holds d.mu.
+func (d *diskCache) drop(name string) {
+	if f, ok := d.files[name]; ok {
+		d.size -= f.size
+		delete(d.files, name)
+	}
+	os.Remove(filepath.Join(d.dir, name))
+}
+
+// evict removes least recently used files until under the cap. Caller holds
+// d.mu (or owns d exclusively).
+func (d *diskCache) evict() {
+	if d.size <= d.maxBytes { return }
+	names := make([]string, 0, len(d.files))
+	for name := range d.files { names = append(names, name) }
+	sort.Slice(names, func(i, j int) bool { return d.files[names[i]].lastUse.Before(d.files[names[j]].lastUse) })
+	for _, name := range names {
+		if d.size <= d.maxBytes { break }
+		d.drop(name)
+		d.evictions++
+	}
+}
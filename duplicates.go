@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// ========== DUPLICATES ==========
+// GET /duplicates groups library files holding the same bytes (by the SHA1
+// computed at upload, from the catalog's hash index), biggest waste first.
+// In CAS mode such names already share one blob, so nothing is wasted and
+// the page is just a list of aliases.
+
+type duplicateGroup struct {
+	Hash   string
+	Size   string
+	Wasted int64
+	Files  []map[string]any
+}
+
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var groups []duplicateGroup
+	var total int64
+	user := currentUser(r)
+	for sha, names := range duplicateGroups() {
+		// Only the copies the user can see make a group for them
+		names = readableNames(user, names)
+		sort.Strings(names)
+		g := duplicateGroup{ Hash: sha }
+		var size int64
+		for _, name := range names {
+			e, ok := catalogGet(name)
+			if !ok { continue }
+			size = e.Size
+			g.Files = append(g.Files, e.fileEntry())
+		}
+		if len(g.Files) < 2 { continue }
+		g.Size = humanReadableSize(size)
+		if !casMode { g.Wasted = size * int64(len(g.Files)-1) }
+		total += g.Wasted
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted { return groups[i].Wasted > groups[j].Wasted }
+		return groups[i].Hash < groups[j].Hash
+	})
+
+	tpls.ExecuteTemplate(w, "duplicates.html", map[string]any{
+		"BucketName": bktName,
+		"Groups":     groups,
+		"Wasted":     humanReadableSize(total),
+		"CAS":        casMode,
+		"Indexing":   !catalogReady(),
+	})
+}
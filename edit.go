@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== PHOTO EDITS ==========
+// POST /edit (name, op) rotates, flips or crops a JPEG or PNG on the server
+// and stores the result as the file's new version:
+//
+//	op=rotate-left, rotate-right   90° either way
+//	op=flip-h, flip-v              mirror left-right, top-bottom
+//	op=crop, x, y, w, h            keep this part, in fractions of the photo
+//	op=revert                      go back to the photo as uploaded
+//
+// The photo is edited as it is shown, EXIF rotation applied, and re-encoded
+// without EXIF; what was read from it at upload stays in the sidecar. The
+// first edit keeps the bytes as uploaded under originals/ (in
+// content-addressed mode the old blob already stays), and the sidecar points
+// there until a revert. Thumbnails, previews and the catalog version follow
+// the new bytes, so every cached size is rendered again.
+
+const originalsFolder = "originals"
+
+var editOps = []string{ "rotate-left", "rotate-right", "flip-h", "flip-v", "crop", "revert" }
+
+func isEditable(name string) bool { return hasSuffix(name, ".jpg", ".jpeg", ".png") }
+
+func editHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	name := strings.Trim(r.FormValue("name"), "/")
+	op := r.FormValue("op")
+	if !isEditable(name) || !isLibraryFile(name) { http.Error(w, "only JPEG and PNG photos can be edited", 400); return }
+	if !slices.Contains(editOps, op) { http.Error(w, "op must be one of "+strings.Join(editOps, ", "), 400); return }
+	if _, ok := apiStat(r.Context(), name); !ok { missingFile(w, r, name); return }
+	if op == "revert" {
+		if sc, _ := readSidecar(r.Context(), name); sc.Original == "" { http.Error(w, "this photo hasn't been edited", 400); return }
+	}
+	ctx := context.WithoutCancel(r.Context())
+
+	var crop [4]float64
+	if op == "crop" {
+		for i, field := range []string{ "x", "y", "w", "h" } {
+			v, err := strconv.ParseFloat(r.FormValue(field), 64)
+			if err != nil || v < 0 || v > 1 { http.Error(w, "x, y, w and h must be fractions from 0 to 1", 400); return }
+			crop[i] = v
+		}
+	}
+
+	var err error
+	if op == "revert" {
+		err = revertEdit(ctx, name)
+	} else {
+		err = editPhoto(ctx, name, op, crop)
+	}
+	if err != nil {
+		log.Printf("Edit %s (%s) failed: %v", name, op, err)
+		if strings.Contains(r.Header.Get("Accept"), "application/json") { apiError(w, 500, err.Error()); return }
+		http.Error(w, "edit failed: "+err.Error(), 500)
+		return
+	}
+	log.Printf("✂️ Edited %s: %s", name, op)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, 200, map[string]any{ "name": name, "op": op })
+		return
+	}
+	http.Redirect(w, r, "/viewer/"+name, http.StatusSeeOther)
+}
+
+// editPhoto applies one edit to name and stores the result.
+func editPhoto(ctx context.Context, name, op string, crop [4]float64) error {
+	rc, err := getObject(ctx, storageKey(name))
+	if err != nil { return err }
+	img, err := imaging.Decode(rc, imaging.AutoOrientation(true))
+	rc.Close()
+	if err != nil { return fmt.Errorf("decode failed: %w", err) }
+
+	switch op {
+	case "rotate-left":
+		img = imaging.Rotate90(img)
+	case "rotate-right":
+		img = imaging.Rotate270(img)
+	case "flip-h":
+		img = imaging.FlipH(img)
+	case "flip-v":
+		img = imaging.FlipV(img)
+	case "crop":
+		b := img.Bounds()
+		w, h := float64(b.Dx()), float64(b.Dy())
+		rect := image.Rect(int(crop[0]*w), int(crop[1]*h), int((crop[0]+crop[2])*w), int((crop[1]+crop[3])*h)).Add(b.Min).Intersect(b)
+		if rect.Dx() < 16 || rect.Dy() < 16 { return errors.New("the crop is too small") }
+		img = imaging.Crop(img, rect)
+	}
+
+	format, err := imaging.FormatFromFilename(name)
+	if err != nil { return err }
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, format, imaging.JPEGQuality(92)); err != nil { return err }
+
+	sc, _ := readSidecar(ctx, name)
+	if sc.Original == "" {
+		if sc.Original, err = keepOriginal(ctx, name); err != nil { return fmt.Errorf("keeping the original failed: %w", err) }
+	}
+	if sc.EXIF != nil { sc.EXIF.Orientation = 0 } // applied to the pixels now
+	return storeEdited(ctx, name, buf.Bytes(), sc)
+}
+
+// keepOriginal saves the bytes name holds now for a revert and returns where.
+func keepOriginal(ctx context.Context, name string) (string, error) {
+	key := storageKey(name)
+	if casMode { return key, nil } // blobs are never overwritten
+	dest := path.Join(originalsFolder, name)
+	rc, err := getObject(ctx, key)
+	if err != nil { return "", err }
+	defer rc.Close()
+	attrs, _ := store.Attrs(ctx, key)
+	put := objectAttrs{ ContentType: detectContentType(name) }
+	if attrs != nil { put.SHA1 = attrs.SHA1 }
+	if err := store.Put(ctx, dest, rc, put); err != nil { return "", err }
+	return dest, nil
+}
+
+// revertEdit puts the photo as uploaded back.
+func revertEdit(ctx context.Context, name string) error {
+	sc, _ := readSidecar(ctx, name)
+	if sc.Original == "" { return errors.New("this photo hasn't been edited") }
+	rc, err := getObject(ctx, sc.Original)
+	if err != nil { return err }
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil { return err }
+	kept := sc.Original
+	sc.Original = ""
+	if sc.EXIF != nil {
+		if x, ok := decodeEXIF(bytes.NewReader(data)); ok { sc.EXIF.Orientation = x.Orientation }
+	}
+	if err := storeEdited(ctx, name, data, sc); err != nil { return err }
+	if !casMode { deleteIfExists(ctx, kept) }
+	return nil
+}
+
+// storeEdited stores data as name's new version, with its sidecar, and
+// renders the thumbnail again.
+func storeEdited(ctx context.Context, name string, data []byte, sc sidecar) error {
+	sum := sha1.Sum(data)
+	sha := hex.EncodeToString(sum[:])
+	contentType := detectContentType(name)
+	storeKey := name
+	if casMode { storeKey = casKey(sha) }
+
+	if !casMode || !casExists(ctx, sha) {
+		if err := store.Put(ctx, storeKey, bytes.NewReader(data), objectAttrs{ ContentType: contentType, SHA1: sha }); err != nil { return err }
+	}
+	version := sha
+	if casMode {
+		old, replaced := casLookup(name)
+		if err := casPut(name, casEntry{ Hash: sha, Size: int64(len(data)), ContentType: contentType, Uploaded: time.Now() }); err != nil { return err }
+		// The object kept for a revert stays; an earlier edit's goes
+		if replaced && old.Hash != sha && casKey(old.Hash) != sc.Original { casReplaced(ctx, name, old) }
+	} else {
+		if attrs, err := store.Attrs(ctx, storeKey); err == nil { version = sourceVersion(attrs) }
+		// Other blobs' thumbnails may be shared in CAS mode; here they're only this file's
+		removeThumbs(ctx, storeKey)
+	}
+	if err := writeSidecar(ctx, name, sc); err != nil { return err }
+
+	rctx, cancel := renderContext(ctx)
+	defer cancel()
+	thumbData, _ := thumbnailer.GenerateThumbnail(rctx, bytes.NewReader(data), name, thumbnailer.Options{ Width: thumbWidth, Quality: thumbQuality })
+	completeUpload(ctx, name, storeKey, version, int64(len(data)), false, thumbData, nil)
+	return nil
+}
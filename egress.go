@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== EGRESS TRACKING ==========
+// Bytes served per route per day, kept in memory and merged into the
+// "egress" DB bucket (key "2006-01-02", value {"view": n, ...}) every minute.
+
+var egressRoutes = []string{"view", "download", "thumb"}
+
+type egressTracker struct {
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // day -> route -> bytes not yet flushed
+
+	pricePerGB float64 // USD per GB (B2 bills decimal GB)
+	freeGB     float64 // free egress per month
+	alertGB    float64 // month-to-date threshold for an alert, 0 = off
+}
+
+var egress *egressTracker
+
+func newEgressTracker() *egressTracker {
+	return &egressTracker{
+		pending:    map[string]map[string]int64{},
+		pricePerGB: envFloat("EGRESS_PRICE_PER_GB", 0.01),
+		freeGB:     envFloat("EGRESS_FREE_GB", 0),
+		alertGB:    envFloat("EGRESS_ALERT_GB", 0),
+	}
+}
+
+func (t *egressTracker) Add(route string, n int64) {
+	if n == 0 { return }
+	day := time.Now().Format("2006-01-02")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending[day] == nil { t.pending[day] = map[string]int64{} }
+	t.pending[day][route] += n
+}
+
+func (t *egressTracker) flush() {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[string]map[string]int64{}
+	t.mu.Unlock()
+	if len(pending) == 0 { return }
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("egress"))
+		if err != nil { return err }
+		for day, routes := range pending {
+			counts := map[string]int64{}
+			if data := b.Get([]byte(day)); data != nil { json.Unmarshal(data, &counts) }
+			for route, n := range routes { counts[route] += n }
+			data, _ := json.Marshal(counts)
+			if err := b.Put([]byte(day), data); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil { log.Println("Failed to persist egress counters:", err) }
+
+	t.checkAlert()
+}
+
+func (t *egressTracker) run() {
+	for range time.Tick(time.Minute) { t.flush() }
+}
+
+// Day returns the counters for a single day, including unflushed bytes.
+func (t *egressTracker) Day(day string) map[string]int64 {
+	counts := map[string]int64{}
+	dbGet("egress", day, &counts)
+	t.mu.Lock()
+	for route, n := range t.pending[day] { counts[route] += n }
+	t.mu.Unlock()
+	return counts
+}
+
+// MonthToDate sums all routes from the 1st of the current month until today.
+func (t *egressTracker) MonthToDate() int64 {
+	now := time.Now()
+	var total int64
+	for d := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()); !d.After(now); d = d.AddDate(0, 0, 1) {
+		for _, n := range t.Day(d.Format("2006-01-02")) { total += n }
+	}
+	return total
+}
+
+// Cost estimates the bill for the given bytes after the free allowance.
+func (t *egressTracker) Cost(bytes int64) float64 {
+	gb := float64(bytes)/1e9 - t.freeGB
+	if gb < 0 { return 0 }
+	return gb * t.pricePerGB
+}
+
+// checkAlert logs (and emails, if configured) once per month when the
+// month-to-date egress crosses EGRESS_ALERT_GB.
+func (t *egressTracker) checkAlert() {
+	if t.alertGB <= 0 { return }
+	month := time.Now().Format("2006-01")
+	var alerted bool
+	if found, _ := dbGet("egress_alerts", month, &alerted); found { return }
+
+	total := t.MonthToDate()
+	if float64(total)/1e9 < t.alertGB { return }
+
+	msg := fmt.Sprintf("Egress for %s reached %s (threshold %.1f GB), estimated cost $%.2f", month, humanReadableSize(total), t.alertGB, t.Cost(total))
+	log.Println("⚠️", msg)
+	if err := sendEmail("memories: egress alert", msg); err != nil {
+		log.Println("Failed to send egress alert:", err)
+	}
+	dbPut("egress_alerts", month, true)
+}
+
+// ========== COUNTING MIDDLEWARE ==========
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+func trackEgress(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ ResponseWriter: w }
+		h(cw, r)
+		egress.Add(route, cw.n)
+	}
+}
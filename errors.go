@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// ========== ERROR PAGES ==========
+// Every route goes through errorPages (see server.go), which gives failed
+// requests an answer in the form the client asked for:
+//
+//	a browser (Accept: text/html)   error.html, styled like the other pages
+//	Accept: application/json        {"error": "…"}, like the API's
+//	anything else (curl, scripts)   the plain text message as before
+//
+// Handlers keep answering with http.Error and http.NotFound: an answer with
+// their text/plain, nosniff headers and a 4xx/5xx status is held back and
+// rewritten here, so the hundreds of call sites need no change. Handlers
+// with a page of their own (notfound.html, share links) set other headers
+// and go through untouched.
+//
+// A panicking handler is logged with its stack and answered with a 500 page
+// instead of a dropped connection; if it had already started the response
+// the connection is cut, since there is no well-formed way to finish it.
+
+const errorBodyMax = 4 << 10
+
+// errorPage answers with status and msg in the form r asked for.
+func errorPage(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	switch {
+	case strings.Contains(r.Header.Get("Accept"), "text/html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		tpls.ExecuteTemplate(w, "error.html", map[string]any{
+			"BucketName": bktName,
+			"Status":     status,
+			"Title":      http.StatusText(status),
+			"Message":    msg,
+			"LoggedIn":   currentUser(r) != "",
+		})
+	case strings.Contains(r.Header.Get("Accept"), "application/json"):
+		apiError(w, status, msg)
+	default:
+		http.Error(w, msg, status)
+	}
+}
+
+// errorWriter holds back an http.Error answer so errorPages can restyle it.
+type errorWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	status int  // of the held-back answer, 0 if none
+	wrote  bool // the response has started
+	body   bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(code int) {
+	if ew.wrote { ew.ResponseWriter.WriteHeader(code); return }
+	ew.wrote = true
+	h := ew.Header()
+	if code >= 400 && h.Get("Content-Type") == "text/plain; charset=utf-8" && h.Get("X-Content-Type-Options") == "nosniff" {
+		ew.status = code
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	if !ew.wrote { ew.WriteHeader(http.StatusOK) }
+	if ew.status == 0 { return ew.ResponseWriter.Write(p) }
+	if ew.body.Len() < errorBodyMax { ew.body.Write(p) }
+	return len(p), nil
+}
+
+// Unwrap lets http.ResponseController reach the connection through the
+// wrapper.
+func (ew *errorWriter) Unwrap() http.ResponseWriter { return ew.ResponseWriter }
+
+// reset drops the headers the held-back answer set.
+func (ew *errorWriter) reset() {
+	for _, k := range []string{ "Content-Type", "Content-Length", "X-Content-Type-Options" } { ew.Header().Del(k) }
+}
+
+func errorPages(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ ResponseWriter: w, r: r }
+		defer func() {
+			v := recover()
+			if v == http.ErrAbortHandler { panic(v) }
+			if v != nil {
+				log.Printf("💥 Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				if ew.wrote && ew.status == 0 { panic(http.ErrAbortHandler) }
+				ew.reset()
+				errorPage(w, r, http.StatusInternalServerError, "Something went wrong on the server. It has been logged; try again in a moment.")
+				return
+			}
+			if ew.status != 0 {
+				ew.reset()
+				errorPage(w, r, ew.status, strings.TrimSpace(ew.body.String()))
+			}
+		}()
+		h.ServeHTTP(ew, r)
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ========== EVENTS & REMINDERS ==========
+// Recurring dates (birthdays, anniversaries, "first day at the new house")
+// kept in the "events" DB bucket. Each recurs yearly on its month and day and
+// is surfaced as a home-page banner, in the daily reminder digest email, and
+// optionally as a JSON POST to REMINDER_WEBHOOK_URL.
+
+type event struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Date  string `json:"date"` // original date, 2006-01-02
+	Kind  string `json:"kind"` // birthday, anniversary, event
+}
+
+// nextOccurrence returns the event's next anniversary on or after today.
+func (e event) nextOccurrence(now time.Time) time.Time {
+	orig, _ := time.Parse("2006-01-02", e.Date)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	next := time.Date(now.Year(), orig.Month(), orig.Day(), 0, 0, 0, 0, time.Local)
+	if next.Before(today) { next = next.AddDate(1, 0, 0) }
+	return next
+}
+
+// Years is how many years the next occurrence marks (e.g. 10th anniversary).
+func (e event) Years(now time.Time) int {
+	orig, _ := time.Parse("2006-01-02", e.Date)
+	return e.nextOccurrence(now).Year() - orig.Year()
+}
+
+func allEvents() []event {
+	var events []event
+	dbEach("events", func(key string, data []byte) error {
+		var e event
+		if json.Unmarshal(data, &e) == nil { events = append(events, e) }
+		return nil
+	})
+	sort.Slice(events, func(i, j int) bool {
+		now := time.Now()
+		return events[i].nextOccurrence(now).Before(events[j].nextOccurrence(now))
+	})
+	return events
+}
+
+// upcomingEvents returns events occurring within the next `days` days.
+func upcomingEvents(now time.Time, days int) []event {
+	var out []event
+	limit := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, days)
+	for _, e := range allEvents() {
+		if e.nextOccurrence(now).Before(limit) { out = append(out, e) }
+	}
+	return out
+}
+
+func (e *event) validate() string {
+	e.Title = strings.TrimSpace(e.Title)
+	if e.Title == "" { return "title is required" }
+	if _, err := time.Parse("2006-01-02", e.Date); err != nil { return "date must be YYYY-MM-DD" }
+	if e.Kind == "" { e.Kind = "event" }
+	return ""
+}
+
+// eventBanners builds the home-page banner for events happening in the next
+// week, each with files from the same day in earlier years.
+func eventBanners(files []map[string]any) []map[string]any {
+	now := time.Now()
+	var banners []map[string]any
+	for _, e := range upcomingEvents(now, 7) {
+		next := e.nextOccurrence(now)
+		var photos []map[string]any
+		for _, f := range files {
+			t := f["Uploaded"].(time.Time)
+			if f["IsMedia"] == true && t.Month() == next.Month() && t.Day() == next.Day() && t.Year() < now.Year() {
+				photos = append(photos, f)
+				if len(photos) == 6 { break }
+			}
+		}
+		when := next.Format("Mon 02 Jan")
+		if days := int(next.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)).Hours() / 24); days == 0 {
+			when = "Today"
+		} else if days == 1 {
+			when = "Tomorrow"
+		}
+		banners = append(banners, map[string]any{ "Event": e, "When": when, "Years": e.Years(now), "Photos": photos })
+	}
+	return banners
+}
+
+// ========== DAILY DIGEST ==========
+// Once a day (after REMINDER_HOUR, default 8) today's events go out by email
+// and webhook. The last sent day is stored so restarts don't resend.
+func runReminders() {
+	hour := envInt("REMINDER_HOUR", 8)
+	for {
+		now := time.Now()
+		today := now.Format("2006-01-02")
+		var lastSent string
+		dbGet("reminders", "last_sent", &lastSent)
+
+		if now.Hour() >= hour && lastSent != today {
+			sendDigest(now)
+			dbPut("reminders", "last_sent", today)
+		}
+		time.Sleep(15 * time.Minute)
+	}
+}
+
+func sendDigest(now time.Time) {
+	todays := upcomingEvents(now, 1)
+	if len(todays) == 0 { return }
+
+	var body strings.Builder
+	for _, e := range todays {
+		fmt.Fprintf(&body, "• %s (%s, %d years)\n", e.Title, e.Kind, e.Years(now))
+	}
+	if err := sendEmail("memories: today's reminders", body.String()); err != nil {
+		log.Println("Failed to send reminder digest:", err)
+	}
+
+	if hook := os.Getenv("REMINDER_WEBHOOK_URL"); hook != "" {
+		payload, _ := json.Marshal(map[string]any{ "date": now.Format("2006-01-02"), "events": todays })
+		resp, err := http.Post(hook, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Println("Reminder webhook failed:", err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	log.Printf("📅 Sent reminders for %d event(s)", len(todays))
+}
+
+// ========== EVENT HANDLERS ==========
+// GET/POST /events             page (POST adds, or deletes with delete=id)
+// GET/POST /api/v1/events      list / create
+// DELETE   /api/v1/events/{id} delete
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if currentUser(r) == "" { http.Redirect(w, r, "/login", http.StatusSeeOther); return }
+		if id := r.FormValue("delete"); id != "" {
+			dbDelete("events", id)
+		} else {
+			e := event{ ID: newID(), Title: r.FormValue("title"), Date: r.FormValue("date"), Kind: r.FormValue("kind") }
+			if msg := e.validate(); msg != "" { http.Error(w, msg, 400); return }
+			dbPut("events", e.ID, e)
+		}
+		http.Redirect(w, r, "/events", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	var rows []map[string]any
+	for _, e := range allEvents() {
+		rows = append(rows, map[string]any{ "Event": e, "Next": e.nextOccurrence(now).Format("Mon 02 Jan 2006"), "Years": e.Years(now) })
+	}
+	tpls.ExecuteTemplate(w, "events.html", map[string]any{ "BucketName": bktName, "LoggedIn": currentUser(r) != "", "Events": rows })
+}
+
+func eventsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/events"), "/")
+	if r.Method != http.MethodGet && currentUser(r) == "" {
+		writeJSON(w, 401, map[string]string{ "error": "login required" }); return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, 200, allEvents())
+	case id == "" && r.Method == http.MethodPost:
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil { writeJSON(w, 400, map[string]string{ "error": "bad json" }); return }
+		if msg := e.validate(); msg != "" { writeJSON(w, 400, map[string]string{ "error": msg }); return }
+		e.ID = newID()
+		if err := dbPut("events", e.ID, e); err != nil { writeJSON(w, 500, map[string]string{ "error": "save failed" }); return }
+		writeJSON(w, 201, e)
+	case id != "" && r.Method == http.MethodDelete:
+		dbDelete("events", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, 405, map[string]string{ "error": "method not allowed" })
+	}
+}
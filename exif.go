@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ========== EXIF ==========
+// Camera metadata is read once at upload and kept in the file's sidecar, so
+// the viewer never has to download the original to show it. The capture time
+// and GPS position also seed the sidecar's CaptureTime/Location (which in turn
+// drive weather enrichment) unless those were already set by hand.
+
+type exifInfo struct {
+	Camera      string     `json:"camera,omitempty"` // "Apple iPhone 13"
+	Lens        string     `json:"lens,omitempty"`
+	Taken       *time.Time `json:"taken,omitempty"`
+	GPS         *geoPoint  `json:"gps,omitempty"`
+	Orientation int        `json:"orientation,omitempty"` // 1-8, see EXIF spec
+	Exposure    string     `json:"exposure,omitempty"`    // "1/120s f/1.6 ISO 50"
+}
+
+// hasEXIF reports whether name is a format EXIF is read from: JPEG, TIFF and
+// the TIFF-based RAW formats.
+func hasEXIF(name string) bool { return hasSuffix(name, ".jpg", ".jpeg") || isTIFF(name) || isRAW(name) }
+
+// readEXIF parses EXIF from a local image file. ok is false when the file has
+// none (PNG, GIF, most screenshots).
+func readEXIF(file string) (info exifInfo, ok bool) {
+	f, err := os.Open(file)
+	if err != nil { return info, false }
+	defer f.Close()
+	return decodeEXIF(f)
+}
+
+// decodeEXIF parses EXIF from the start of an image.
+func decodeEXIF(r io.Reader) (info exifInfo, ok bool) {
+	x, err := exif.Decode(r)
+	if err != nil { return info, false }
+
+	maker, _ := tagString(x, exif.Make)
+	model, _ := tagString(x, exif.Model)
+	if model != "" && !strings.HasPrefix(model, maker) { model = strings.TrimSpace(maker + " " + model) }
+	info.Camera = model
+	info.Lens, _ = tagString(x, exif.LensModel)
+
+	if t, err := x.DateTime(); err == nil { info.Taken = &t }
+	if lat, lon, err := x.LatLong(); err == nil && (lat != 0 || lon != 0) {
+		info.GPS = &geoPoint{ Lat: lat, Lon: lon }
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if v, err := tag.Int(0); err == nil { info.Orientation = v }
+	}
+
+	var parts []string
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 {
+			if den > num { parts = append(parts, fmt.Sprintf("1/%ds", den/num)) } else { parts = append(parts, fmt.Sprintf("%gs", float64(num)/float64(den))) }
+		}
+	}
+	if tag, err := x.Get(exif.FNumber); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den > 0 { parts = append(parts, fmt.Sprintf("f/%.1f", float64(num)/float64(den))) }
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if v, err := tag.Int(0); err == nil { parts = append(parts, fmt.Sprintf("ISO %d", v)) }
+	}
+	info.Exposure = strings.Join(parts, " ")
+	return info, true
+}
+
+func tagString(x *exif.Exif, name exif.FieldName) (string, bool) {
+	tag, err := x.Get(name)
+	if err != nil { return "", false }
+	s, err := tag.StringVal()
+	if err != nil { return "", false }
+	return strings.TrimSpace(strings.Trim(s, "\x00")), true
+}
+
+// saveEXIF merges upload-time EXIF into the name's sidecar.
+func saveEXIF(ctx context.Context, name string, info exifInfo) {
+	sc, _ := readSidecar(ctx, name)
+	sc.EXIF = &info
+	if sc.CaptureTime == nil { sc.CaptureTime = info.Taken }
+	if sc.Location == nil { sc.Location = info.GPS }
+	enrichWeather(ctx, name, &sc)
+
+	if err := writeSidecar(ctx, name, sc); err != nil {
+		log.Printf("Failed to save EXIF for %s: %v", name, err)
+	}
+}
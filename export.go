@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== EXPORTS ==========
+// Selections too large to zip while the browser waits are packaged in the
+// background instead. An export job zips the files into exports/<id>/ in the
+// bucket, starting a new archive every EXPORT_PART_MB (default 4096) of
+// content, and the archives can be downloaded (resumably) until
+// EXPORT_RETENTION (default 72h) after they're ready. Jobs run one at a time
+// in the order they were asked for and are kept in the "exports" bucket, so
+// a restart picks up where the queue was; one cut off halfway starts over.
+// NOTIFY_WEBHOOKS and NOTIFY_EMAIL_TO hear when a job is done.
+//
+// GET  /exports                    your exports (refreshes while one runs)
+// POST /exports                    name=a.jpg&name=b.mp4, or prefix=photos/2023
+// GET  /exports/{id}               status as JSON, to poll
+// GET  /exports/{id}/{archive}.zip download
+// POST /exports/{id}/delete        cancel, or remove the archives early
+
+type exportJob struct {
+	ID       string       `json:"id"`
+	User     string       `json:"user"`
+	Title    string       `json:"title"`
+	Prefix   string       `json:"prefix,omitempty"`
+	Names    []string     `json:"names,omitempty"`
+	Origin   string       `json:"origin,omitempty"` // "https://host", for links in notifications
+	Status   string       `json:"status"`           // queued, running, ready, failed
+	Files    int          `json:"files"`
+	Done     int          `json:"done"`
+	Bytes    int64        `json:"bytes"` // of the files packaged so far
+	Parts    []exportPart `json:"parts,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Created  time.Time    `json:"created"`
+	Finished time.Time    `json:"finished,omitzero"`
+	Expires  time.Time    `json:"expires,omitzero"`
+}
+
+type exportPart struct {
+	Name  string `json:"name"` // "2023.zip", "2023-2.zip"
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+func (j exportJob) dir() string { return "exports/" + j.ID + "/" }
+
+func saveExport(j exportJob) error { return dbPut("exports", j.ID, j) }
+
+func loadExport(id string) (exportJob, bool) {
+	var j exportJob
+	found, _ := dbGet("exports", id, &j)
+	return j, found
+}
+
+// exportJobs returns all jobs, oldest first.
+func exportJobs() []exportJob {
+	var jobs []exportJob
+	dbEach("exports", func(key string, data []byte) error {
+		var j exportJob
+		if json.Unmarshal(data, &j) == nil { jobs = append(jobs, j) }
+		return nil
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs
+}
+
+// exportRunner wakes the worker when a job is queued and cancels the one
+// running when it is deleted.
+var exportRunner = struct {
+	sync.Mutex
+	wake    chan struct{}
+	running string
+	cancel  context.CancelFunc
+}{ wake: make(chan struct{}, 1) }
+
+func wakeExports() {
+	select {
+	case exportRunner.wake <- struct{}{}:
+	default:
+	}
+}
+
+// initExports requeues jobs a restart cut off and starts the worker and the
+// sweeper for expired archives.
+func initExports() {
+	for _, j := range exportJobs() {
+		if j.Status == "running" { j.Status = "queued"; saveExport(j) }
+	}
+	go runExports()
+	go sweepExports()
+}
+
+func runExports() {
+	for {
+		var next *exportJob
+		for _, j := range exportJobs() {
+			if j.Status == "queued" { next = &j; break }
+		}
+		if next == nil {
+			select {
+			case <-exportRunner.wake:
+				continue
+			case <-shutdownCtx.Done():
+				return
+			}
+		}
+		ctx, cancel := context.WithCancel(shutdownCtx)
+		exportRunner.Lock()
+		exportRunner.running, exportRunner.cancel = next.ID, cancel
+		exportRunner.Unlock()
+		runExport(ctx, *next)
+		exportRunner.Lock()
+		exportRunner.running, exportRunner.cancel = "", nil
+		exportRunner.Unlock()
+		cancel()
+		if shutdownCtx.Err() != nil { return }
+	}
+}
+
+// runExport packages one job. A job stopped by shutdown stays "running" and
+// is requeued on the next start; one deleted meanwhile is gone from the DB.
+func runExport(ctx context.Context, j exportJob) {
+	j.Status, j.Done, j.Bytes, j.Parts, j.Error = "running", 0, 0, nil, ""
+	saveExport(j)
+	removeExportFiles(context.WithoutCancel(ctx), j) // what a cut-off run left
+
+	err := packageExport(ctx, &j)
+	if ctx.Err() != nil {
+		if shutdownCtx.Err() == nil { // deleted
+			dbDelete("exports", j.ID) // in case progress was saved after all
+			removeExportFiles(context.Background(), j)
+		}
+		return
+	}
+	j.Finished = time.Now()
+	if err != nil {
+		j.Status, j.Error = "failed", err.Error()
+		removeExportFiles(ctx, j)
+		j.Parts = nil
+		log.Printf("📦 Export %s failed: %v", j.Title, err)
+	} else {
+		j.Status, j.Expires = "ready", j.Finished.Add(envDuration("EXPORT_RETENTION", 72*time.Hour))
+		log.Printf("📦 Exported %d file(s) as %s in %d archive(s)", j.Files, j.Title, len(j.Parts))
+	}
+	if _, still := loadExport(j.ID); !still { return }
+	saveExport(j)
+	notifyExport(j)
+}
+
+// exportItems resolves a job to the files it covers that its user may read.
+func exportItems(ctx context.Context, j exportJob) ([]zipItem, error) {
+	var items []zipItem
+	if len(j.Names) == 0 {
+		listPrefix := keyPrefix
+		if j.Prefix != "" { listPrefix = j.Prefix + "/" }
+		all, err := zipItemsUnder(ctx, listPrefix)
+		if err != nil { return nil, fmt.Errorf("listing failed: %w", err) }
+		items = all
+	} else {
+		for _, name := range j.Names {
+			attrs, err := store.Attrs(ctx, storageKey(name))
+			if err != nil { log.Printf("Export %s: %s is gone, skipping it", j.Title, name); continue }
+			items = append(items, zipItem{ name, attrs.Size, attrs.Modified })
+		}
+	}
+	return slices.DeleteFunc(items, func(it zipItem) bool { return !canRead(j.User, it.name) }), nil
+}
+
+func packageExport(ctx context.Context, j *exportJob) error {
+	items, err := exportItems(ctx, *j)
+	if err != nil { return err }
+	if len(items) == 0 { return fmt.Errorf("nothing to export") }
+	j.Files = len(items)
+	saveExport(*j)
+
+	// Split greedily by size; a single file bigger than a part gets its own
+	limit := int64(envInt("EXPORT_PART_MB", 4096)) << 20
+	var parts [][]zipItem
+	var partSize int64
+	for _, it := range items {
+		if len(parts) == 0 || (partSize > 0 && partSize+it.size > limit) {
+			parts = append(parts, nil)
+			partSize = 0
+		}
+		parts[len(parts)-1] = append(parts[len(parts)-1], it)
+		partSize += it.size
+	}
+
+	base := zipBase(items)
+	for i, part := range parts {
+		name := j.Title + ".zip"
+		if len(parts) > 1 { name = fmt.Sprintf("%s-%d.zip", j.Title, i+1) }
+		key := j.dir() + name
+
+		pr, pw := io.Pipe()
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			zw := zip.NewWriter(pw)
+			for _, it := range part {
+				if err := addZipEntry(ctx, zw, base, it); err != nil {
+					pw.CloseWithError(fmt.Errorf("%s: %w", it.name, err))
+					return
+				}
+				j.Done++
+				j.Bytes += it.size
+				if ctx.Err() == nil { saveExport(*j) }
+			}
+			pw.CloseWithError(zw.Close())
+		}()
+		err := store.Put(ctx, key, pr, objectAttrs{ ContentType: "application/zip" })
+		pr.CloseWithError(err) // stops the writer if the upload gave up first
+		<-written
+		if err != nil { return err }
+
+		attrs, err := store.Attrs(ctx, key)
+		if err != nil { return err }
+		j.Parts = append(j.Parts, exportPart{ Name: name, Files: len(part), Size: attrs.Size })
+		saveExport(*j)
+	}
+	return nil
+}
+
+// removeExportFiles deletes a job's archives from the bucket.
+func removeExportFiles(ctx context.Context, j exportJob) {
+	var keys []string
+	if err := listAll(ctx, j.dir(), func(f *objectAttrs) { keys = append(keys, f.Name) }); err != nil {
+		log.Printf("Export %s: listing its archives failed: %v", j.ID, err)
+		return
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil { log.Printf("Export %s: deleting %s failed: %v", j.ID, key, err) }
+	}
+}
+
+// deleteExport removes a job, cancelling it if it is running.
+func deleteExport(ctx context.Context, j exportJob) {
+	dbDelete("exports", j.ID)
+	exportRunner.Lock()
+	running := exportRunner.running == j.ID
+	if running { exportRunner.cancel() }
+	exportRunner.Unlock()
+	// A running job cleans up after itself once it notices
+	if !running { removeExportFiles(ctx, j) }
+}
+
+// sweepExports drops finished jobs past their expiry, hourly.
+func sweepExports() {
+	for {
+		for _, j := range exportJobs() {
+			expired := j.Status == "ready" && time.Now().After(j.Expires)
+			if j.Status == "failed" { expired = time.Since(j.Finished) > envDuration("EXPORT_RETENTION", 72*time.Hour) }
+			if expired {
+				deleteExport(context.Background(), j)
+				log.Printf("📦 Export %s expired", j.Title)
+			}
+		}
+		select {
+		case <-time.After(time.Hour):
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+// notifyExport tells the upload notification targets a job is done.
+func notifyExport(j exportJob) {
+	var links []string
+	for _, p := range j.Parts { links = append(links, j.Origin+"/exports/"+j.ID+"/"+pathURL(p.Name)) }
+	for _, url := range splitList(os.Getenv("NOTIFY_WEBHOOKS")) {
+		if err := postWebhook(url, map[string]any{ "event": "export", "export": j, "links": links }); err != nil {
+			log.Printf("⚠️ Export webhook %s: %v", url, err)
+		}
+	}
+	if to := os.Getenv("NOTIFY_EMAIL_TO"); to != "" {
+		var body strings.Builder
+		if j.Status == "ready" {
+			fmt.Fprintf(&body, "%d file(s) (%s) are ready to download until %s:\n\n", j.Files, humanReadableSize(j.Bytes), j.Expires.Format("Mon 02 Jan 15:04"))
+			for _, l := range links { fmt.Fprintln(&body, l) }
+		} else {
+			fmt.Fprintf(&body, "The export failed: %s\n", j.Error)
+		}
+		if err := sendEmailTo(to, "memories: export "+j.Title+" "+j.Status, body.String()); err != nil {
+			log.Println("⚠️ Export email failed:", err)
+		}
+	}
+}
+
+// ========== EXPORT HANDLERS ==========
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/exports"), "/")
+	if rest == "" {
+		if r.Method == http.MethodPost { createExport(w, r, user); return }
+		exportsPage(w, r, user)
+		return
+	}
+
+	id, file, _ := strings.Cut(rest, "/")
+	j, ok := loadExport(id)
+	if !ok || j.User != user { http.NotFound(w, r); return }
+	switch {
+	case file == "" && r.Method == http.MethodGet:
+		writeJSON(w, 200, j)
+	case file == "delete" && r.Method == http.MethodPost:
+		deleteExport(context.WithoutCancel(r.Context()), j)
+		http.Redirect(w, r, "/exports", http.StatusSeeOther)
+	case file != "" && r.Method == http.MethodGet:
+		if !slices.ContainsFunc(j.Parts, func(p exportPart) bool { return p.Name == file }) || j.Status != "ready" { http.NotFound(w, r); return }
+		trackEgress("download", limitTransfer(func(w http.ResponseWriter, r *http.Request) { serveExportPart(w, r, j, file) }))(w, r)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func createExport(w http.ResponseWriter, r *http.Request, user string) {
+	r.ParseForm()
+	j := exportJob{ ID: newID(), User: user, Origin: requestOrigin(r), Status: "queued", Created: time.Now() }
+	for _, name := range r.PostForm["name"] {
+		if name = strings.Trim(name, "/"); name != "" && !slices.Contains(j.Names, name) { j.Names = append(j.Names, name) }
+	}
+	j.Prefix = strings.Trim(r.PostFormValue("prefix"), "/")
+	switch {
+	case len(j.Names) > 0:
+		j.Title = bktName + "-selection"
+		if j.Prefix != "" { j.Title = path.Base(j.Prefix) + "-selection" }
+		j.Prefix = ""
+	case j.Prefix != "":
+		j.Title = path.Base(j.Prefix)
+	default:
+		j.Title = bktName
+	}
+	j.Title += "-" + j.Created.Format("20060102-1504")
+	for _, name := range j.Names {
+		if !allowRead(w, r, name) { return }
+	}
+	if len(j.Names) == 0 && !allowRead(w, r, j.Prefix) { return }
+
+	if err := saveExport(j); err != nil { http.Error(w, "could not queue the export", 500); return }
+	wakeExports()
+	log.Printf("📦 Export %s queued by %s", j.Title, user)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") { writeJSON(w, 202, j); return }
+	http.Redirect(w, r, "/exports", http.StatusSeeOther)
+}
+
+func serveExportPart(w http.ResponseWriter, r *http.Request, j exportJob, file string) {
+	key := j.dir() + file
+	attrs, err := store.Attrs(r.Context(), key)
+	if err != nil { http.NotFound(w, r); return }
+	body := &objectReadSeeker{ ctx: r.Context(), key: key, size: attrs.Size }
+	defer body.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", file))
+	setETag(w, attrs)
+	http.ServeContent(w, r, file, attrs.Modified, body)
+}
+
+func exportsPage(w http.ResponseWriter, r *http.Request, user string) {
+	var rows []map[string]any
+	active := false
+	jobs := exportJobs()
+	for i := len(jobs) - 1; i >= 0; i-- {
+		j := jobs[i]
+		if j.User != user { continue }
+		if j.Status == "queued" || j.Status == "running" { active = true }
+		var parts []map[string]any
+		for _, p := range j.Parts {
+			parts = append(parts, map[string]any{ "Name": p.Name, "URL": appURL("/exports/" + j.ID + "/" + pathURL(p.Name)), "Files": p.Files, "Size": humanReadableSize(p.Size) })
+		}
+		percent := 0
+		if j.Files > 0 { percent = j.Done * 100 / j.Files }
+		rows = append(rows, map[string]any{ "Job": j, "Size": humanReadableSize(j.Bytes), "Percent": percent, "Parts": parts })
+	}
+	tpls.ExecuteTemplate(w, "exports.html", map[string]any{ "BucketName": bktName, "Exports": rows, "Active": active })
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== FACE GROUPING ==========
+// Off unless FACE_DETECTOR names a detector, which is where photos go to
+// have their faces found; point it at something on this machine and they
+// never leave it:
+//
+//	FACE_DETECTOR=http://localhost:8701/detect     a service, sent a POST
+//	FACE_DETECTOR=python3 /opt/faces/detect.py     a command, fed stdin
+//
+// Either gets a photo as a JPEG FACE_SCAN_WIDTH (default 1024) pixels wide
+// and answers with
+//
+//	{"faces": [{"box": [x, y, w, h], "score": 0.98, "embedding": [0.12, ...]}]}
+//
+// the box in fractions of the width and height, the embedding the model's
+// vector for the face (any length, as long as it's always the same). A small
+// ONNX detector and embedder (RetinaFace and ArcFace, say) behind a script
+// is a fully local setup; other detectors only need to implement
+// faceDetector.
+//
+// Every FACE_SCAN_INTERVAL (default 15m) the catalog's photos not yet
+// scanned at their current version are sent, one at a time. Faces scoring
+// under FACE_MIN_SCORE (default 0.8) are dropped; each other face joins the
+// group whose mean embedding is most like it (cosine similarity at least
+// FACE_MATCH, default 0.5) or starts a new one. The "faces" bucket keeps each
+// photo's faces, "face_crops" a small JPEG of each and "face_clusters" the
+// groups. /people lists the groups, biggest first; naming one labels it, and
+// giving a second group the same name merges the two.
+
+type faceDetector interface {
+	Detect(ctx context.Context, photo []byte) ([]detectedFace, error)
+}
+
+type detectedFace struct {
+	Box       [4]float64 `json:"box"` // x, y, w, h as fractions of the photo
+	Score     float64    `json:"score"`
+	Embedding []float64  `json:"embedding"`
+}
+
+// photoFaces is a photo's "faces" record: the version it was scanned at and
+// what was found, in order (a face is referred to as "i/name").
+type photoFaces struct {
+	Version string      `json:"version"`
+	Faces   []photoFace `json:"faces,omitempty"`
+}
+
+type photoFace struct {
+	Box       [4]float64 `json:"box"`
+	Embedding []float64  `json:"embedding"` // unit length
+	Cluster   string     `json:"cluster"`
+}
+
+// faceCluster is a group of faces thought to be one person. Sum is the sum
+// of their embeddings, so its direction is the group's mean.
+type faceCluster struct {
+	ID      string    `json:"id"`
+	Label   string    `json:"label,omitempty"`
+	Members []string  `json:"members"` // face refs, "i/name"
+	Sum     []float64 `json:"sum"`
+}
+
+func faceRef(i int, name string) string { return strconv.Itoa(i) + "/" + name }
+
+// faceRefName is the photo a face ref belongs to.
+func faceRefName(ref string) string {
+	_, name, _ := strings.Cut(ref, "/")
+	return name
+}
+
+var (
+	faceSource faceDetector
+	// faceGroups is every cluster; mu also guards the "faces" records, which
+	// point back at them
+	faceGroups = struct {
+		sync.Mutex
+		m map[string]*faceCluster
+	}{ m: map[string]*faceCluster{} }
+	faceScanState = struct {
+		sync.Mutex
+		waiting, scanned, failed int
+		last                     time.Time
+		err                      string
+	}{}
+)
+
+func initFaces() {
+	spec := strings.TrimSpace(os.Getenv("FACE_DETECTOR"))
+	if spec == "" { return }
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		faceSource = httpFaceDetector{ spec }
+	} else {
+		faceSource = commandFaceDetector{ strings.Fields(spec) }
+	}
+	dbEach("face_clusters", func(key string, data []byte) error {
+		var c faceCluster
+		if json.Unmarshal(data, &c) == nil { faceGroups.m[key] = &c }
+		return nil
+	})
+	log.Printf("🙂 Face grouping via %s (%d groups)", spec, len(faceGroups.m))
+	go runFaceScan()
+}
+
+// ========== DETECTORS ==========
+
+type httpFaceDetector struct{ url string }
+
+func (d httpFaceDetector) Detect(ctx context.Context, photo []byte) ([]detectedFace, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(photo))
+	if err != nil { return nil, err }
+	req.Header.Set("Content-Type", "image/jpeg")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil { return nil, err }
+	if resp.StatusCode != http.StatusOK { return nil, fmt.Errorf("detector answered %s: %.200s", resp.Status, body) }
+	return parseFaces(body)
+}
+
+type commandFaceDetector struct{ args []string }
+
+func (d commandFaceDetector) Detect(ctx context.Context, photo []byte) ([]detectedFace, error) {
+	cmd := exec.CommandContext(ctx, d.args[0], d.args[1:]...)
+	cmd.Stdin = bytes.NewReader(photo)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil { return nil, fmt.Errorf("%v: %.200s", err, strings.TrimSpace(stderr.String())) }
+	return parseFaces(out)
+}
+
+func parseFaces(data []byte) ([]detectedFace, error) {
+	var answer struct {
+		Faces []detectedFace `json:"faces"`
+	}
+	if err := json.Unmarshal(data, &answer); err != nil { return nil, fmt.Errorf("bad detector answer: %w", err) }
+	return answer.Faces, nil
+}
+
+// ========== SCAN ==========
+
+func runFaceScan() {
+	every := envDuration("FACE_SCAN_INTERVAL", 15*time.Minute)
+	for {
+		wait := every
+		if !catalogReady() {
+			wait = time.Minute // the catalog is how photos are found
+		} else if n, err := scanFaces(shutdownCtx); err != nil {
+			log.Printf("Face scan: %v", err)
+		} else if n > 0 {
+			log.Printf("🙂 Face scan: %d photo(s) scanned", n)
+		}
+		select {
+		case <-shutdownCtx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func isFacePhoto(name string) bool { return thumbnailer.IsImage(name) || isRAW(name) }
+
+// scanFaces scans the photos that are new or changed since they were last
+// scanned and forgets the faces of those no longer in the library.
+func scanFaces(ctx context.Context) (int, error) {
+	scannedAt := map[string]string{}
+	dbEach("faces", func(key string, data []byte) error {
+		var pf struct{ Version string `json:"version"` }
+		json.Unmarshal(data, &pf)
+		scannedAt[key] = pf.Version
+		return nil
+	})
+	var todo []catalogEntry
+	inLibrary := map[string]bool{}
+	dbEach("catalog", func(_ string, data []byte) error {
+		var e catalogEntry
+		if json.Unmarshal(data, &e) != nil || !isFacePhoto(e.Name) { return nil }
+		inLibrary[e.Name] = true
+		if v, ok := scannedAt[e.Name]; !ok || v != e.Version { todo = append(todo, e) }
+		return nil
+	})
+	for name := range scannedAt {
+		if !inLibrary[name] { forgetPhotoFaces(name) }
+	}
+
+	faceScanState.Lock()
+	faceScanState.waiting, faceScanState.err = len(todo), ""
+	faceScanState.Unlock()
+	scanned := 0
+	for _, e := range todo {
+		if ctx.Err() != nil { break }
+		err := scanPhotoFaces(ctx, e)
+		faceScanState.Lock()
+		faceScanState.waiting--
+		if err != nil {
+			faceScanState.failed++
+			faceScanState.err = e.Name + ": " + err.Error()
+		} else {
+			faceScanState.scanned++
+		}
+		faceScanState.last = time.Now()
+		faceScanState.Unlock()
+		if err != nil {
+			// A detector that's down fails every photo; try again next time
+			if errors.Is(err, context.Canceled) || isDetectorDown(err) { return scanned, err }
+			log.Printf("Face scan %s: %v", e.Name, err)
+			continue
+		}
+		scanned++
+	}
+	return scanned, nil
+}
+
+func isDetectorDown(err error) bool {
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) || errors.Is(err, exec.ErrNotFound)
+}
+
+// scanPhotoFaces sends one photo to the detector and files its faces.
+func scanPhotoFaces(ctx context.Context, e catalogEntry) error {
+	rc, err := getObject(ctx, storageKey(e.Name))
+	if err != nil { return err }
+	photo, err := thumbnailer.GenerateThumbnail(ctx, rc, e.Name, thumbnailer.Options{ Width: envInt("FACE_SCAN_WIDTH", 1024) })
+	rc.Close()
+	if err != nil {
+		// Not tried again until the file changes
+		if ctx.Err() == nil { fileFaces(e.Name, photoFaces{ Version: e.Version }) }
+		return err
+	}
+	found, err := faceSource.Detect(ctx, photo)
+	if err != nil { return err }
+	img, err := jpeg.Decode(bytes.NewReader(photo))
+	if err != nil { return err }
+
+	minScore := envFloat("FACE_MIN_SCORE", 0.8)
+	pf := photoFaces{ Version: e.Version }
+	crops := map[string][]byte{}
+	for _, f := range found {
+		if f.Score > 0 && f.Score < minScore { continue }
+		embedding := unitVector(f.Embedding)
+		crop := faceCrop(img, f.Box)
+		if embedding == nil || crop == nil { continue }
+		crops[faceRef(len(pf.Faces), e.Name)] = crop
+		pf.Faces = append(pf.Faces, photoFace{ Box: f.Box, Embedding: embedding })
+	}
+	for ref, crop := range crops { dbPut("face_crops", ref, crop) }
+	return fileFaces(e.Name, pf)
+}
+
+// faceCrop is a square JPEG of the face in box, with some room around it.
+func faceCrop(img image.Image, box [4]float64) []byte {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	side := math.Max(box[2]*w, box[3]*h) * 1.4
+	cx, cy := (box[0]+box[2]/2)*w, (box[1]+box[3]/2)*h
+	rect := image.Rect(int(cx-side/2), int(cy-side/2), int(cx+side/2), int(cy+side/2)).Add(b.Min).Intersect(b)
+	if rect.Dx() < 8 || rect.Dy() < 8 { return nil }
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Fill(imaging.Crop(img, rect), 160, 160, imaging.Center, imaging.Lanczos), &jpeg.Options{ Quality: 85 }); err != nil { return nil }
+	return buf.Bytes()
+}
+
+func unitVector(v []float64) []float64 {
+	var norm float64
+	for _, x := range v { norm += x * x }
+	if norm == 0 { return nil }
+	norm = math.Sqrt(norm)
+	u := make([]float64, len(v))
+	for i, x := range v { u[i] = x / norm }
+	return u
+}
+
+// similarity is the cosine similarity of a unit vector and a cluster's mean.
+func (c *faceCluster) similarity(u []float64) float64 {
+	if len(c.Sum) != len(u) { return -1 }
+	var dot, norm float64
+	for i, x := range c.Sum {
+		dot += x * u[i]
+		norm += x * x
+	}
+	if norm == 0 { return -1 }
+	return dot / math.Sqrt(norm)
+}
+
+func (c *faceCluster) add(u []float64, sign float64) {
+	if len(c.Sum) == 0 { c.Sum = make([]float64, len(u)) }
+	if len(c.Sum) != len(u) { return }
+	for i, x := range u { c.Sum[i] += sign * x }
+}
+
+func (c *faceCluster) save() {
+	if len(c.Members) == 0 {
+		delete(faceGroups.m, c.ID)
+		dbDelete("face_clusters", c.ID)
+		return
+	}
+	if err := dbPut("face_clusters", c.ID, c); err != nil { log.Printf("Face group %s save failed: %v", c.ID, err) }
+}
+
+// fileFaces replaces name's faces with pf's, putting each in a cluster.
+func fileFaces(name string, pf photoFaces) error {
+	faceGroups.Lock()
+	defer faceGroups.Unlock()
+	changed := dropPhotoFaces(name)
+	match := envFloat("FACE_MATCH", 0.5)
+	for i := range pf.Faces {
+		f := &pf.Faces[i]
+		var best *faceCluster
+		bestScore := match
+		for _, c := range faceGroups.m {
+			if s := c.similarity(f.Embedding); s >= bestScore { best, bestScore = c, s }
+		}
+		if best == nil {
+			best = &faceCluster{ ID: newID() }
+			faceGroups.m[best.ID] = best
+		}
+		ref := faceRef(i, name)
+		best.Members = append(best.Members, ref)
+		best.add(f.Embedding, 1)
+		f.Cluster = best.ID
+		changed[best] = true
+	}
+	for c := range changed { c.save() }
+	return dbPut("faces", name, pf)
+}
+
+// dropPhotoFaces takes name's faces out of their clusters and returns the
+// clusters changed. faceGroups must be locked.
+func dropPhotoFaces(name string) map[*faceCluster]bool {
+	changed := map[*faceCluster]bool{}
+	var old photoFaces
+	if found, _ := dbGet("faces", name, &old); !found { return changed }
+	for i, f := range old.Faces {
+		c := faceGroups.m[f.Cluster]
+		if c == nil { continue }
+		ref := faceRef(i, name)
+		for j, m := range c.Members {
+			if m == ref { c.Members = append(c.Members[:j], c.Members[j+1:]...); break }
+		}
+		c.add(f.Embedding, -1)
+		changed[c] = true
+		dbDelete("face_crops", ref)
+	}
+	return changed
+}
+
+func forgetPhotoFaces(name string) {
+	faceGroups.Lock()
+	defer faceGroups.Unlock()
+	for c := range dropPhotoFaces(name) { c.save() }
+	dbDelete("faces", name)
+}
+
+// labelCluster names a cluster; a label another cluster has merges the two.
+// It returns the cluster that ends up with the label.
+func labelCluster(id, label string) (string, error) {
+	faceGroups.Lock()
+	defer faceGroups.Unlock()
+	c := faceGroups.m[id]
+	if c == nil { return "", errNotFound }
+	var into *faceCluster
+	for _, other := range faceGroups.m {
+		if other != c && label != "" && strings.EqualFold(other.Label, label) { into = other; break }
+	}
+	if into == nil {
+		c.Label = label
+		c.save()
+		return c.ID, nil
+	}
+
+	// Point the merged faces at their new cluster
+	byPhoto := map[string]bool{}
+	for _, ref := range c.Members { byPhoto[faceRefName(ref)] = true }
+	for name := range byPhoto {
+		var pf photoFaces
+		if found, _ := dbGet("faces", name, &pf); !found { continue }
+		for i := range pf.Faces {
+			if pf.Faces[i].Cluster == c.ID { pf.Faces[i].Cluster = into.ID }
+		}
+		dbPut("faces", name, pf)
+	}
+	into.Members = append(into.Members, c.Members...)
+	for i, x := range c.Sum {
+		if i < len(into.Sum) { into.Sum[i] += x }
+	}
+	into.Label = label
+	c.Members = nil
+	c.save()
+	into.save()
+	return into.ID, nil
+}
+
+// ========== PEOPLE PAGE ==========
+// GET /people lists the face groups, GET /people/{id} one group's photos,
+// POST /people/{id} (label=...) names it and GET /people/face/{i}/{name}
+// is the crop of one face.
+func peopleHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/people"), "/")
+	user := currentUser(r)
+	if ref, ok := strings.CutPrefix(rest, "face/"); ok {
+		if !canRead(user, faceRefName(ref)) { http.NotFound(w, r); return }
+		var crop []byte
+		if found, _ := dbGet("face_crops", ref, &crop); !found { http.NotFound(w, r); return }
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Write(crop)
+		return
+	}
+
+	data := map[string]any{ "BucketName": bktName, "Enabled": faceSource != nil }
+	faceScanState.Lock()
+	data["Waiting"], data["Scanned"], data["Failed"], data["ScanError"] = faceScanState.waiting, faceScanState.scanned, faceScanState.failed, faceScanState.err
+	data["LastScan"] = ""
+	if !faceScanState.last.IsZero() { data["LastScan"] = faceScanState.last.Format("02 Jan 15:04") }
+	faceScanState.Unlock()
+
+	if rest == "" {
+		data["People"] = peopleCards(user)
+		tpls.ExecuteTemplate(w, "people.html", data)
+		return
+	}
+	if r.Method == http.MethodPost {
+		id, err := labelCluster(rest, strings.TrimSpace(r.FormValue("label")))
+		if err != nil { http.NotFound(w, r); return }
+		http.Redirect(w, r, "/people/"+id, http.StatusSeeOther)
+		return
+	}
+	faceGroups.Lock()
+	c := faceGroups.m[rest]
+	var person faceCluster
+	if c != nil { person = *c; person.Members = append([]string(nil), c.Members...) }
+	faceGroups.Unlock()
+	if c == nil { http.NotFound(w, r); return }
+
+	var files []map[string]any
+	seen := map[string]bool{}
+	for _, ref := range person.Members {
+		name := faceRefName(ref)
+		if seen[name] || !canRead(user, name) { continue }
+		seen[name] = true
+		if e, ok := catalogGet(name); ok {
+			f := e.fileEntry()
+			f["FaceURL"] = appURL("/people/face/" + ref)
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i]["Uploaded"].(time.Time).After(files[j]["Uploaded"].(time.Time)) })
+	data["Person"] = map[string]any{ "ID": person.ID, "Label": person.Label, "Faces": len(person.Members), "CoverURL": appURL("/people/face/" + person.Members[0]) }
+	data["Files"] = files
+	tpls.ExecuteTemplate(w, "people.html", data)
+}
+
+// peopleCards are the groups with a face the user may see, named ones
+// first, then by size.
+func peopleCards(user string) []map[string]any {
+	faceGroups.Lock()
+	defer faceGroups.Unlock()
+	var groups []*faceCluster
+	for _, c := range faceGroups.m { groups = append(groups, c) }
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if (a.Label != "") != (b.Label != "") { return a.Label != "" }
+		if len(a.Members) != len(b.Members) { return len(a.Members) > len(b.Members) }
+		return a.ID < b.ID
+	})
+	var cards []map[string]any
+	for _, c := range groups {
+		cover, photos := "", map[string]bool{}
+		for _, ref := range c.Members {
+			if !canRead(user, faceRefName(ref)) { continue }
+			if cover == "" { cover = ref }
+			photos[faceRefName(ref)] = true
+		}
+		if cover == "" { continue }
+		cards = append(cards, map[string]any{ "ID": c.ID, "Label": c.Label, "Photos": len(photos), "CoverURL": appURL("/people/face/" + cover) })
+	}
+	return cards
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ========== ATOM FEED ==========
+// GET /feed.xml is an Atom feed of the newest FEED_SIZE (default 50)
+// uploads, each with its thumbnail, caption and a link to the viewer, so
+// family members can follow new memories in a feed reader. ?folder=a/b
+// narrows it to one folder. Feed readers can't log in through the form, so
+// the feed also takes HTTP Basic credentials; without any it lists what is
+// readable logged out (PUBLIC_READ or public folders) and asks for a login
+// when that is nothing. Links are absolute, built from the request's host
+// (and X-Forwarded-Proto/Host with TRUST_PROXY set).
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated time.Time   `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated time.Time   `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// requestOrigin is the app's root, "scheme://host" and BASE_PATH, as the
+// client sees this server.
+func requestOrigin(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil { scheme = "https" }
+	if os.Getenv("TRUST_PROXY") != "" {
+		if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" { scheme = p }
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" { host = h }
+	}
+	return scheme + "://" + host + basePath
+}
+
+// pathURL escapes a library name for use in a URL path.
+func pathURL(name string) string {
+	return (&url.URL{ Path: name }).EscapedPath()
+}
+
+var feedEntryHTML = template.Must(template.New("entry").Parse(
+	`<p><a href="{{.Viewer}}"><img src="{{.Thumb}}" alt="{{.Name}}"></a></p>{{with .Caption}}<p>{{.}}</p>{{end}}{{with .Folder}}<p>{{.}}</p>{{end}}`))
+
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == "" {
+		if _, _, ok := r.BasicAuth(); ok {
+			var valid bool
+			if user, valid = basicUser(r); !valid { feedLogin(w); return }
+		}
+	}
+	folder := strings.Trim(r.URL.Query().Get("folder"), "/")
+	if user == "" && !canRead("", folder) && !publicFolderUnder(folder) { feedLogin(w); return }
+	prefix := keyPrefix
+	if folder != "" { prefix = folder + "/" }
+
+	origin := requestOrigin(r)
+	self := origin + "/feed.xml"
+	title := bktName
+	if folder != "" { self += "?folder=" + url.QueryEscape(folder); title += " / " + folder }
+	feed := atomFeed{
+		Title: title,
+		ID:    self,
+		Links: []atomLink{ { Rel: "self", Type: "application/atom+xml", Href: self }, { Href: origin + "/" } },
+	}
+	size := envInt("FEED_SIZE", 50)
+	for _, e := range catalogSearch(prefix, "", "newest", "all", 0) {
+		if len(feed.Entries) >= size { break }
+		if !isLibraryFile(e.Name) || !canRead(user, e.Name) { continue }
+		f := e.fileEntry()
+		viewer := origin + "/viewer/" + pathURL(e.Name)
+		thumb := origin + "/static/file-icon.png"
+		if f["IsMedia"] == true { thumb = origin + "/thumb/" + pathURL(e.Name) + "?v=" + url.QueryEscape(e.Version) }
+		caption := fileCaption(e.Name)
+		var body strings.Builder
+		feedEntryHTML.Execute(&body, map[string]any{ "Viewer": viewer, "Thumb": thumb, "Name": e.Name, "Caption": caption, "Folder": parentFolder(e.Name) })
+
+		entryTitle := path.Base(e.Name)
+		if caption != "" { entryTitle = caption }
+		if title := fileTitle(e.Name); title != "" { entryTitle = title }
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   entryTitle,
+			ID:      viewer + "?v=" + url.QueryEscape(e.Version),
+			Updated: e.Modified.UTC(),
+			Links:   []atomLink{ { Href: viewer } },
+			Content: atomContent{ Type: "html", Body: body.String() },
+		})
+		if e.Modified.After(feed.Updated) { feed.Updated = e.Modified.UTC() }
+	}
+	if feed.Updated.IsZero() { feed.Updated = time.Now().UTC() }
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+func feedLogin(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="memories", charset="UTF-8"`)
+	http.Error(w, "login required", http.StatusUnauthorized)
+}
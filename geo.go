@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ========== MAP ==========
+// Positions come from the sidecar (a hand-set Location, else the EXIF GPS
+// read at upload or backfill) and are indexed in the "geo" bucket
+// (name -> geoPoint) alongside the tag index, so the map never reads
+// sidecars.
+//
+// GET /map                                   Leaflet map page
+// GET /api/v1/map?bbox=minLon,minLat,maxLon,maxLat  files inside the box
+
+type mapPoint struct {
+	Name     string  `json:"name"`
+	Title    string  `json:"title,omitempty"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	ThumbURL string  `json:"thumb_url"`
+	ViewURL  string  `json:"view_url"`
+}
+
+// sidecarPosition is where a file was taken, if known.
+func sidecarPosition(sc sidecar) *geoPoint {
+	if sc.Location != nil { return sc.Location }
+	if sc.EXIF != nil { return sc.EXIF.GPS }
+	return nil
+}
+
+func indexGeo(name string, sc sidecar) {
+	if p := sidecarPosition(sc); p != nil { dbPut("geo", name, *p); return }
+	dbDelete("geo", name)
+}
+
+// parseBBox parses "minLon,minLat,maxLon,maxLat" (Leaflet's toBBoxString).
+func parseBBox(s string) (minLon, minLat, maxLon, maxLat float64, ok bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 { return 0, 0, 0, 0, false }
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil { return 0, 0, 0, 0, false }
+		v[i] = f
+	}
+	return v[0], v[1], v[2], v[3], v[1] <= v[3]
+}
+
+// pointsIn lists the indexed files user can see inside the box, up to limit.
+// A box with minLon > maxLon crosses the antimeridian.
+func pointsIn(user string, minLon, minLat, maxLon, maxLat float64, limit int) (points []mapPoint, truncated bool) {
+	points = []mapPoint{}
+	dbEach("geo", func(name string, data []byte) error {
+		var p geoPoint
+		if json.Unmarshal(data, &p) != nil || p.Lat < minLat || p.Lat > maxLat { return nil }
+		if minLon <= maxLon && (p.Lon < minLon || p.Lon > maxLon) { return nil }
+		if minLon > maxLon && p.Lon < minLon && p.Lon > maxLon { return nil }
+		if !canRead(user, name) { return nil }
+		if len(points) == limit { truncated = true; return nil }
+		mp := mapPoint{ Name: name, Title: fileTitle(name), Lat: p.Lat, Lon: p.Lon, ThumbURL: appURL("/static/file-icon.png"), ViewURL: appURL("/viewer/" + name) }
+		if isThumbable(name) {
+			mp.ThumbURL = appURL("/thumb/" + name)
+			if e, ok := catalogGet(name); ok { mp.ThumbURL += "?v=" + e.Version }
+		}
+		points = append(points, mp)
+		return nil
+	})
+	return points, truncated
+}
+
+// ========== MAP HANDLERS ==========
+func mapHandler(w http.ResponseWriter, r *http.Request) {
+	tpls.ExecuteTemplate(w, "map.html", map[string]any{ "BucketName": bktName })
+}
+
+func mapAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet { apiError(w, http.StatusMethodNotAllowed, "method not allowed"); return }
+	minLon, minLat, maxLon, maxLat := -180.0, -90.0, 180.0, 90.0
+	if v := r.URL.Query().Get("bbox"); v != "" {
+		var ok bool
+		if minLon, minLat, maxLon, maxLat, ok = parseBBox(v); !ok { apiError(w, 400, "bad bbox (want minLon,minLat,maxLon,maxLat)"); return }
+	}
+	points, truncated := pointsIn(currentUser(r), minLon, minLat, maxLon, maxLat, envInt("MAP_LIMIT", 2000))
+	writeJSON(w, 200, map[string]any{ "points": points, "truncated": truncated })
+}
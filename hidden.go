@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ========== HIDDEN FILES & VIEWS ==========
+// A file or folder can be hidden from the folder pages with POST /hide
+// name=, on=1|0 (login required; a folder's name ends in "/"). A file's flag
+// is in its sidecar and indexed in the "tags" bucket next to its favorite
+// flag; folders have no sidecar, so theirs are the "hidden_folders" bucket
+// (folder -> true). Hidden files, and anything in a hidden folder, are also
+// left out of the home page's recent and on-this-day strips. Hiding only
+// tidies the pages: a hidden file is still there by link, search, album and
+// the API's file lookup, and on WebDAV. Folder rules (acl.go) are what keeps
+// things private.
+//
+// Folder pages and GET /api/v1/files take ?view= next to ?sort= and ?type=:
+//
+//	visible    everything that isn't hidden (default)
+//	favorites  favorite files only
+//	hidden     hidden files and folders only, to find and unhide them
+//	all        everything, hidden or not (for sync clients, say)
+//
+// Favorites and hidden are read from the catalog and paged by ?offset= like
+// the other orders (see sort.go), so every page is full. The default view in
+// name order leaves hidden entries out of each page as listed, as the folder
+// rules do.
+
+var listViews = []string{ "visible", "favorites", "hidden", "all" }
+
+// listView reads ?view=, falling back to visible.
+func listView(r *http.Request) string {
+	view := r.URL.Query().Get("view")
+	if !slices.Contains(listViews, view) { view = "visible" }
+	return view
+}
+
+// needsCatalog reports whether view picks files the listing can't.
+func needsCatalog(view string) bool { return view == "favorites" || view == "hidden" }
+
+// viewQuery is the base query (see orderQuery) that keeps view on links.
+func viewQuery(view string) url.Values {
+	if view == "visible" { return nil }
+	return url.Values{ "view": { view } }
+}
+
+// viewTabs is the template data for a folder page's view toggles; the
+// hidden view is only offered to signed-in users, who can unhide.
+func viewTabs(pageURL, sortBy, kind, view string, loggedIn bool) []map[string]any {
+	var tabs []map[string]any
+	for _, v := range []struct{ View, Label string }{ { "favorites", "★ Favorites" }, { "hidden", "Hidden" } } {
+		if v.View == "hidden" && !loggedIn { continue }
+		// A toggle: the active view's tab goes back to the default
+		to := v.View
+		if view == v.View { to = "visible" }
+		tabs = append(tabs, map[string]any{ "Label": v.Label, "URL": pageURL + orderQuery(viewQuery(to), sortBy, kind, 0), "Active": view == v.View })
+	}
+	return tabs
+}
+
+// viewMarks is what views filter on.
+type viewMarks struct {
+	hidden, favorite, hiddenFolders map[string]bool
+}
+
+// loadViewMarks reads the hidden and favorite flags from the DB.
+func loadViewMarks() viewMarks {
+	m := viewMarks{ map[string]bool{}, map[string]bool{}, map[string]bool{} }
+	dbEach("tags", func(key string, data []byte) error {
+		var e tagEntry
+		if json.Unmarshal(data, &e) != nil { return nil }
+		if e.Hidden { m.hidden[key] = true }
+		if e.Favorite { m.favorite[key] = true }
+		return nil
+	})
+	dbEach("hidden_folders", func(key string, _ []byte) error {
+		m.hiddenFolders[key] = true
+		return nil
+	})
+	return m
+}
+
+func (m viewMarks) keepFile(view, name string) bool {
+	switch view {
+	case "favorites": return m.favorite[name]
+	case "hidden": return m.hidden[name]
+	case "all": return true
+	}
+	return !m.hidden[name]
+}
+
+// Favorites are files, so that view has no folders.
+func (m viewMarks) keepFolder(view, folder string) bool {
+	switch view {
+	case "favorites": return false
+	case "hidden": return m.hiddenFolders[folder]
+	case "all": return true
+	}
+	return !m.hiddenFolders[folder]
+}
+
+// hides reports whether name is hidden, itself or by a folder above it.
+func (m viewMarks) hides(name string) bool {
+	if m.hidden[name] { return true }
+	for folder := parentFolder(name); folder != ""; folder = parentFolder(folder) {
+		if m.hiddenFolders[folder] { return true }
+	}
+	return false
+}
+
+// filterView applies view to a listing page.
+func filterView(l folderListing, view string) folderListing {
+	if view == "all" { return l }
+	m := loadViewMarks()
+	out := folderListing{}
+	for _, f := range l.Files {
+		if name, _ := f["Name"].(string); m.keepFile(view, name) { out.Files = append(out.Files, f) }
+	}
+	for _, folder := range l.Folders {
+		if m.keepFolder(view, folder) { out.Folders = append(out.Folders, folder) }
+	}
+	return out
+}
+
+func folderHidden(folder string) bool {
+	found, _ := dbGet("hidden_folders", folder, new(bool))
+	return found
+}
+
+// hideHandler hides or shows the posted file or folder again.
+func hideHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	on := r.FormValue("on") == "1"
+	folder, isFolder := strings.CutSuffix(r.FormValue("name"), "/")
+	if !isFolder {
+		editSidecar(w, r, func(sc *sidecar) { sc.Hidden = on })
+		return
+	}
+	folder = strings.Trim(folder, "/")
+	if folder == "" || !isLibraryFile(folder) { http.Error(w, "no such folder", 404); return }
+	var err error
+	if on { err = dbPut("hidden_folders", folder, true) } else { err = dbDelete("hidden_folders", folder) }
+	if err != nil { http.Error(w, "save failed", 500); return }
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, 200, map[string]any{ "folder": folder, "hidden": on })
+		return
+	}
+	http.Redirect(w, r, "/browse/"+folder+"/", http.StatusSeeOther)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ========== HLS STREAMING ==========
+// Videos of HLS_MIN_MB (default 200, 0 for every video) or more are cut into
+// ~6s H.264/AAC segments under hls/<key without ext>/, so the player fetches
+// only what it plays instead of the whole file going through /view. The
+// transcode workers do the segmenting; until the playlist exists the viewer
+// plays the original (or waits, for formats browsers can't play).
+//
+// GET /hls/{name}/index.m3u8
+// GET /hls/{name}/seg00000.ts
+
+// hlsDir maps an original's storage key to its segment folder.
+func hlsDir(key string) string {
+	return path.Join("hls", strings.TrimSuffix(key, path.Ext(key)))
+}
+
+// wantsHLS reports whether a video is big enough to stream in segments.
+func wantsHLS(name string, size int64) bool {
+	return isVideo(name) && size >= int64(envInt("HLS_MIN_MB", 200))<<20
+}
+
+func segmentHLS(ctx context.Context, name, key string) error {
+	src, err := downloadTemp(ctx, key, filepath.Ext(name))
+	if err != nil { return err }
+	defer os.Remove(src)
+	dir, err := mkdirTemp("hls-*")
+	if err != nil { return err }
+	defer os.RemoveAll(dir)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", src,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k",
+		"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"), filepath.Join(dir, "index.m3u8"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("FFmpeg failed: %s", string(output))
+		return err
+	}
+
+	// Segments first: a playlist in the bucket means the set is complete
+	files, err := os.ReadDir(dir)
+	if err != nil { return err }
+	prefix := hlsDir(key) + "/"
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".ts") { continue }
+		if err := uploadHLSFile(ctx, filepath.Join(dir, f.Name()), prefix+f.Name(), "video/mp2t"); err != nil {
+			deleteHLS(ctx, key)
+			return fmt.Errorf("segment upload failed: %w", err)
+		}
+	}
+	if err := uploadHLSFile(ctx, filepath.Join(dir, "index.m3u8"), prefix+"index.m3u8", "application/vnd.apple.mpegurl"); err != nil {
+		deleteHLS(ctx, key)
+		return fmt.Errorf("playlist upload failed: %w", err)
+	}
+	return nil
+}
+
+func uploadHLSFile(ctx context.Context, local, key, contentType string) error {
+	f, err := os.Open(local)
+	if err != nil { return err }
+	defer f.Close()
+	return store.Put(ctx, key, f, objectAttrs{ ContentType: contentType })
+}
+
+// deleteHLS removes a video's playlist and segments, if it has any.
+func deleteHLS(ctx context.Context, key string) {
+	var names []string
+	if err := listAll(ctx, hlsDir(key)+"/", func(f *objectAttrs) { names = append(names, f.Name) }); err != nil {
+		log.Printf("Listing HLS segments for %s failed: %v", key, err)
+		return
+	}
+	for _, name := range names {
+		if err := store.Delete(ctx, name); err != nil { log.Printf("HLS %s left behind: %v", name, err) }
+	}
+}
+
+// ========== HLS HANDLER ==========
+// Segments never change once written, so they're cached for good; the
+// playlist is small and revalidated so a re-upload shows up.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	name, file := path.Split(strings.TrimPrefix(r.URL.Path, "/hls/"))
+	name = strings.TrimSuffix(name, "/")
+	switch {
+	case file == "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".ts") && !strings.ContainsAny(file, "/\\"):
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		http.NotFound(w, r); return
+	}
+	if name == "" { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+
+	rc, err := getObject(r.Context(), hlsDir(storageKey(name))+"/"+file)
+	if err != nil { w.Header().Del("Cache-Control"); http.NotFound(w, r); return }
+	defer rc.Close()
+	if n, err := io.Copy(w, rc); err != nil && n == 0 {
+		w.Header().Del("Cache-Control")
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ========== JOURNAL ==========
+// Short diary entries attached to a calendar date, optionally linking photos.
+// Stored in the "journal" DB bucket keyed by entry ID.
+
+type journalEntry struct {
+	ID      string    `json:"id"`
+	Date    string    `json:"date"` // 2006-01-02
+	Text    string    `json:"text"`
+	Photos  []string  `json:"photos,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (e *journalEntry) validate() string {
+	if _, err := time.Parse("2006-01-02", e.Date); err != nil { return "date must be YYYY-MM-DD" }
+	e.Text = strings.TrimSpace(e.Text)
+	if e.Text == "" { return "text is required" }
+	return ""
+}
+
+// journalEntries returns entries with from <= date <= to ("" = unbounded),
+// newest date first.
+func journalEntries(from, to string) []journalEntry {
+	var entries []journalEntry
+	dbEach("journal", func(key string, data []byte) error {
+		var e journalEntry
+		if json.Unmarshal(data, &e) != nil { return nil }
+		if (from == "" || e.Date >= from) && (to == "" || e.Date <= to) { entries = append(entries, e) }
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Date != entries[j].Date { return entries[i].Date > entries[j].Date }
+		return entries[i].Created.After(entries[j].Created)
+	})
+	return entries
+}
+
+// onThisDay returns entries from the same month and day in earlier years.
+func onThisDay(now time.Time) []journalEntry {
+	md := now.Format("-01-02")
+	var out []journalEntry
+	for _, e := range journalEntries("", "") {
+		if strings.HasSuffix(e.Date, md) && e.Date[:4] < now.Format("2006") { out = append(out, e) }
+	}
+	return out
+}
+
+// readableJournal is entries with the photos user can't see left out.
+func readableJournal(user string, entries []journalEntry) []journalEntry {
+	if len(folderRules) == 0 { return entries }
+	out := make([]journalEntry, len(entries))
+	for i, e := range entries {
+		e.Photos = readableNames(user, e.Photos)
+		out[i] = e
+	}
+	return out
+}
+
+// ========== JOURNAL API ==========
+// GET    /api/v1/journal?from=&to=   list
+// POST   /api/v1/journal             create
+// GET    /api/v1/journal/{id}        read
+// PUT    /api/v1/journal/{id}        update
+// DELETE /api/v1/journal/{id}        delete
+func journalAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/journal"), "/")
+
+	if r.Method != http.MethodGet && currentUser(r) == "" {
+		writeJSON(w, 401, map[string]string{ "error": "login required" }); return
+	}
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			writeJSON(w, 200, readableJournal(currentUser(r), journalEntries(q.Get("from"), q.Get("to"))))
+		case http.MethodPost:
+			var e journalEntry
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil { writeJSON(w, 400, map[string]string{ "error": "bad json" }); return }
+			if msg := e.validate(); msg != "" { writeJSON(w, 400, map[string]string{ "error": msg }); return }
+			e.ID = newID()
+			e.Created, e.Updated = time.Now(), time.Now()
+			if err := dbPut("journal", e.ID, e); err != nil { writeJSON(w, 500, map[string]string{ "error": "save failed" }); return }
+			writeJSON(w, 201, e)
+		default:
+			writeJSON(w, 405, map[string]string{ "error": "method not allowed" })
+		}
+		return
+	}
+
+	var e journalEntry
+	if found, _ := dbGet("journal", id, &e); !found { writeJSON(w, 404, map[string]string{ "error": "not found" }); return }
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, 200, readableJournal(currentUser(r), []journalEntry{ e })[0])
+	case http.MethodPut:
+		var upd journalEntry
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil { writeJSON(w, 400, map[string]string{ "error": "bad json" }); return }
+		if msg := upd.validate(); msg != "" { writeJSON(w, 400, map[string]string{ "error": msg }); return }
+		e.Date, e.Text, e.Photos, e.Updated = upd.Date, upd.Text, upd.Photos, time.Now()
+		if err := dbPut("journal", e.ID, e); err != nil { writeJSON(w, 500, map[string]string{ "error": "save failed" }); return }
+		writeJSON(w, 200, e)
+	case http.MethodDelete:
+		if err := dbDelete("journal", id); err != nil { writeJSON(w, 500, map[string]string{ "error": "delete failed" }); return }
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, 405, map[string]string{ "error": "method not allowed" })
+	}
+}
+
+// ========== JOURNAL PAGE ==========
+// GET /journal renders the timeline; POST adds an entry or (with delete=id)
+// removes one, for browsers without JS.
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if currentUser(r) == "" { http.Redirect(w, r, "/login", http.StatusSeeOther); return }
+		if id := r.FormValue("delete"); id != "" {
+			dbDelete("journal", id)
+		} else {
+			e := journalEntry{ Date: r.FormValue("date"), Text: r.FormValue("text"), Photos: splitList(r.FormValue("photos")) }
+			if msg := e.validate(); msg != "" { http.Error(w, msg, 400); return }
+			e.ID = newID()
+			e.Created, e.Updated = time.Now(), time.Now()
+			dbPut("journal", e.ID, e)
+		}
+		http.Redirect(w, r, "/journal", http.StatusSeeOther)
+		return
+	}
+
+	// Group by date for the timeline
+	var days []map[string]any
+	user := currentUser(r)
+	for _, e := range readableJournal(user, journalEntries("", "")) {
+		if len(days) == 0 || days[len(days)-1]["Date"] != e.Date {
+			t, _ := time.Parse("2006-01-02", e.Date)
+			days = append(days, map[string]any{ "Date": e.Date, "Label": t.Format("Monday, 02 Jan 2006"), "Entries": []journalEntry{} })
+		}
+		last := days[len(days)-1]
+		last["Entries"] = append(last["Entries"].([]journalEntry), e)
+	}
+
+	tpls.ExecuteTemplate(w, "journal.html", map[string]any{
+		"BucketName": bktName,
+		"LoggedIn":   currentUser(r) != "",
+		"Today":      time.Now().Format("2006-01-02"),
+		"Days":       days,
+		"OnThisDay":  readableJournal(user, onThisDay(time.Now())),
+	})
+}
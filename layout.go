@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ========== GALLERY LAYOUT ==========
+// The grid of the folder, search and tag pages comes in three sizes (small,
+// medium, large), three shapes (card: the 4:3 tiles; square: square crops,
+// which thumbHandler renders as their own variant under /thumb/square/;
+// masonry: columns of thumbnails at their own height) and three themes (auto
+// follows the browser, or light or dark). GALLERY_GRID, GALLERY_LAYOUT and
+// GALLERY_THEME set the defaults (medium, card, auto).
+//
+// The layout menu posts to /layout. A signed-in user's choice is kept in the
+// "layouts" bucket and follows them to other browsers; everyone's is also
+// kept in a cookie, so visitors get theirs back too. The page is rendered
+// with it, dark theme included, so nothing jumps once the page has loaded.
+
+const layoutCookie = "layout"
+
+var (
+	layoutGrids  = []string{ "small", "medium", "large" }
+	layoutShapes = []string{ "card", "square", "masonry" }
+	layoutThemes = []string{ "auto", "light", "dark" }
+)
+
+type galleryLayout struct {
+	Grid  string `json:"grid"`
+	Shape string `json:"shape"`
+	Theme string `json:"theme"`
+}
+
+func defaultLayout() galleryLayout {
+	return galleryLayout{
+		Grid:  envChoice("GALLERY_GRID", layoutGrids, "medium"),
+		Shape: envChoice("GALLERY_LAYOUT", layoutShapes, "card"),
+		Theme: envChoice("GALLERY_THEME", layoutThemes, "auto"),
+	}
+}
+
+// envChoice is key if it is one of choices, else def.
+func envChoice(key string, choices []string, def string) string {
+	if v := os.Getenv(key); slices.Contains(choices, v) { return v }
+	return def
+}
+
+// with is l with whatever of grid, shape and theme is valid put in.
+func (l galleryLayout) with(grid, shape, theme string) galleryLayout {
+	if slices.Contains(layoutGrids, grid) { l.Grid = grid }
+	if slices.Contains(layoutShapes, shape) { l.Shape = shape }
+	if slices.Contains(layoutThemes, theme) { l.Theme = theme }
+	return l
+}
+
+// layoutFor is the layout r's page is rendered with: the user's, else the
+// cookie's, else the defaults.
+func layoutFor(r *http.Request) galleryLayout {
+	l := defaultLayout()
+	var saved galleryLayout
+	if user := currentUser(r); user != "" {
+		if found, _ := dbGet("layouts", user, &saved); found { return l.with(saved.Grid, saved.Shape, saved.Theme) }
+	}
+	if c, err := r.Cookie(layoutCookie); err == nil {
+		if v, err := url.QueryUnescape(c.Value); err == nil && json.Unmarshal([]byte(v), &saved) == nil { l = l.with(saved.Grid, saved.Shape, saved.Theme) }
+	}
+	return l
+}
+
+// POST /layout with any of grid, shape and theme changes them and goes back
+// to back; without back (the theme toggle) it answers 204.
+func layoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+	l := layoutFor(r).with(r.FormValue("grid"), r.FormValue("shape"), r.FormValue("theme"))
+	if user := currentUser(r); user != "" { dbPut("layouts", user, l) }
+	data, _ := json.Marshal(l)
+	http.SetCookie(w, &http.Cookie{
+		Name:     layoutCookie,
+		Value:    url.QueryEscape(string(data)),
+		Path:     appURL("/"),
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	if r.FormValue("back") == "" { w.WriteHeader(http.StatusNoContent); return }
+	http.Redirect(w, r, localPath(r.FormValue("back")), http.StatusSeeOther)
+}
+
+// GridClass is the classes of the grid's container.
+func (l galleryLayout) GridClass() string {
+	cols := map[string]string{
+		"small":  "grid-cols-3 sm:grid-cols-4 md:grid-cols-6 lg:grid-cols-8 xl:grid-cols-10 gap-3",
+		"medium": "grid-cols-2 sm:grid-cols-3 md:grid-cols-4 lg:grid-cols-5 xl:grid-cols-6 gap-6",
+		"large":  "grid-cols-1 sm:grid-cols-2 lg:grid-cols-3 gap-8",
+	}[l.Grid]
+	if l.Shape != "masonry" { return "grid " + cols }
+	// columns-N for grid-cols-N, with the items spaced by their margins
+	return strings.ReplaceAll(cols, "grid-cols-", "columns-")
+}
+
+// ItemClass is the extra classes of each tile.
+func (l galleryLayout) ItemClass() string {
+	if l.Shape != "masonry" { return "" }
+	return map[string]string{ "small": "break-inside-avoid mb-3", "medium": "break-inside-avoid mb-6", "large": "break-inside-avoid mb-8" }[l.Grid]
+}
+
+// FrameClass shapes a tile's thumbnail: "" leaves it its own height.
+func (l galleryLayout) FrameClass() string {
+	return map[string]string{ "card": "aspect-card", "square": "aspect-square" }[l.Shape]
+}
+
+// Sizes is the <img sizes> of a tile at this grid size.
+func (l galleryLayout) Sizes() string {
+	return map[string]string{
+		"small":  "(min-width: 1280px) 10vw, (min-width: 1024px) 12vw, (min-width: 768px) 16vw, (min-width: 640px) 25vw, 33vw",
+		"medium": "(min-width: 1280px) 16vw, (min-width: 1024px) 20vw, (min-width: 768px) 25vw, (min-width: 640px) 33vw, 50vw",
+		"large":  "(min-width: 1024px) 33vw, (min-width: 640px) 50vw, 100vw",
+	}[l.Grid]
+}
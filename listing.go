@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== FOLDER LISTING ==========
+// B2 has no real directories, but listing with a "/" delimiter returns the
+// direct children of a prefix plus one placeholder per sub-"folder". The home
+// page lists the root this way and /browse/{prefix}/ lists one folder, a page
+// at a time (see listPage). A listing carries each file's size, date and
+// version, so files cost no lookups of their own; a sub-folder's card needs
+// a listing of that folder until the catalog is built, and those run
+// LIST_WORKERS (default 8) at a time (see inParallel).
+
+// folderListing is one level of the bucket.
+type folderListing struct {
+	Files   []map[string]any
+	Folders []string // full paths without trailing slash
+}
+
+// folderSample is how many objects are looked at per folder card to count
+// items and pick an automatic cover.
+const folderSample = 100
+
+// folderCard builds the template data for a sub-folder: its cover (manual
+// pick, else the newest media file) and an item count. Without the catalog
+// only the first folderSample objects are looked at.
+func folderCard(ctx context.Context, folder string) map[string]any {
+	count := 0
+	var newest map[string]any
+	var newestTime time.Time
+
+	if catalogReady() {
+		n, e := catalogFolder(folder)
+		count = n
+		if e != nil { newest = e.fileEntry() }
+		return folderCardData(folder, count, false, newest)
+	}
+
+	objects, _, _ := store.List(ctx, folder+"/", "", "", folderSample)
+	for i := range objects {
+		obj := &objects[i]
+		if isSidecar(obj.Name) { continue }
+		count++
+		f := fileEntry(obj.Name, obj.Size, obj.Modified, sourceVersion(obj))
+		if f["IsMedia"] == true && obj.Modified.After(newestTime) { newest, newestTime = f, obj.Modified }
+	}
+
+	if casMode {
+		entries, names := casEntries()
+		for _, name := range names {
+			if !strings.HasPrefix(name, folder+"/") || count >= folderSample { continue }
+			count++
+			e := entries[name]
+			if f := fileEntry(name, e.Size, e.Uploaded, e.Hash); f["IsMedia"] == true && e.Uploaded.After(newestTime) {
+				newest, newestTime = f, e.Uploaded
+			}
+		}
+	}
+
+	return folderCardData(folder, count, count >= folderSample, newest)
+}
+
+// folderCards builds the cards of folders, in order. From the catalog they
+// are DB reads, not worth a goroutine each.
+func folderCards(ctx context.Context, folders []string) []map[string]any {
+	cards := make([]map[string]any, len(folders))
+	if catalogReady() {
+		for i, f := range folders { cards[i] = folderCard(ctx, f) }
+		return cards
+	}
+	inParallel(len(folders), func(i int) { cards[i] = folderCard(ctx, folders[i]) })
+	return cards
+}
+
+// inParallel calls fn(0) ... fn(n-1), LIST_WORKERS at a time, for storage
+// lookups a page makes one per item. fn writes its own slot of a result.
+func inParallel(n int, fn func(i int)) {
+	slots := make(chan struct{}, max(envInt("LIST_WORKERS", 8), 1))
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+func folderCardData(folder string, count int, more bool, newest map[string]any) map[string]any {
+	coverURL := appURL("/static/file-icon.png")
+	if name := folderCover(folder); name != "" {
+		coverURL = appURL("/thumb/" + name)
+	} else if newest != nil {
+		coverURL = newest["ThumbURL"].(string)
+	}
+
+	return map[string]any{
+		"Path":     folder,
+		"Name":     path.Base(folder),
+		"Count":    count,
+		"More":     more,
+		"CoverURL": coverURL,
+	}
+}
+
+// breadcrumbs returns one {Name, Path} per segment of folder.
+func breadcrumbs(folder string) []map[string]string {
+	var crumbs []map[string]string
+	if folder == "" { return crumbs }
+	parts := strings.Split(folder, "/")
+	for i, p := range parts {
+		crumbs = append(crumbs, map[string]string{ "Name": p, "Path": strings.Join(parts[:i+1], "/") })
+	}
+	return crumbs
+}
+
+// ========== BROWSE HANDLER ==========
+// GET / and GET /browse/{prefix}/ render one folder level.
+func browseHandler(w http.ResponseWriter, r *http.Request) {
+	folder := strings.Trim(strings.TrimPrefix(r.URL.Path, "/browse"), "/")
+	renderFolder(w, r, folder)
+}
+
+func renderFolder(w http.ResponseWriter, r *http.Request, folder string) {
+	if !allowRead(w, r, folder) { return }
+	ctx := r.Context()
+	listPrefix := keyPrefix
+	if folder != "" { listPrefix = folder + "/" }
+
+	pageURL := appURL("/")
+	if folder != "" { pageURL = appURL("/browse/" + folder + "/") }
+	pageSize := envInt("PAGE_SIZE", 100)
+	sortBy, kind := listOrder(r)
+	view := listView(r)
+	ordered := sortBy != "name" || kind != "all" || needsCatalog(view)
+
+	var l folderListing
+	nextURL, prevURL := "", ""
+	if ordered && catalogReady() {
+		// Other orders need the whole folder, which only the catalog has
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		offset = max(offset, 0)
+		var more bool
+		l, more = catalogSortedPage(listPrefix, sortBy, kind, view, offset, pageSize)
+		if more { nextURL = pageURL + orderQuery(viewQuery(view), sortBy, kind, offset+pageSize) }
+		if offset > 0 { prevURL = pageURL + orderQuery(viewQuery(view), sortBy, kind, max(offset-pageSize, 0)) }
+	} else {
+		tok := decodePageToken(r.URL.Query().Get("page"))
+		var next string
+		var err error
+		l, next, err = listPage(ctx, listPrefix, tok.Start, pageSize)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if next != "" { nextURL = pageURL + "?page=" + tok.next(next) }
+		if prev, ok := tok.prev(); ok {
+			prevURL = pageURL
+			if prev != "" { prevURL += "?page=" + prev }
+		}
+		l = filterView(l, view)
+	}
+
+	l = visibleListing(currentUser(r), l)
+	if kind != "video" { l.Files = pairLivePhotos(l.Files) }
+	folders := folderCards(ctx, l.Folders)
+	// The library root's first page leads with On this day, the newest
+	// uploads and the top-level albums
+	var albums, recent, memories []map[string]any
+	if folder == "" && prevURL == "" && view == "visible" {
+		for _, a := range childAlbums("") { albums = append(albums, albumCard(currentUser(r), a)) }
+		recent = recentlyAdded(currentUser(r), envInt("RECENT_COUNT", 12))
+		memories = onThisDayPhotos(currentUser(r), time.Now(), envInt("ON_THIS_DAY_COUNT", 12))
+	}
+
+	tpls.ExecuteTemplate(w, "index.html", map[string]any{
+		"BucketName":  bktName,
+		"Buckets":     bucketChoices(folder),
+		"Files":       l.Files,
+		"Folder":      folder,
+		"Breadcrumbs": breadcrumbs(folder),
+		"Folders":     folders,
+		"Albums":      albums,
+		"Events":      eventBanners(l.Files),
+		"Recent":      recent,
+		"OnThisDay":   memories,
+		"NextURL":     nextURL,
+		"PrevURL":     prevURL,
+		"Sort":        sortBy,
+		"Type":        kind,
+		"View":        view,
+		"Kinds":       kindTabs(pageURL, viewQuery(view), sortBy, kind),
+		"Views":       viewTabs(pageURL, sortBy, kind, view, currentUser(r) != ""),
+		"ViewQuery":   orderQuery(viewQuery(view), sortBy, kind, 0),
+		"Hidden":      folder != "" && folderHidden(folder),
+		"Indexing":    ordered && !catalogReady(),
+		"TagList":     topTags(envInt("TAG_CHIPS", 12)),
+		"LoggedIn":    currentUser(r) != "",
+		"Layout":      layoutFor(r),
+		"Back":        r.URL.RequestURI(),
+	})
+}
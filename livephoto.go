@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ========== LIVE PHOTOS ==========
+// An iPhone live photo is two files side by side, IMG_1234.HEIC and a short
+// IMG_1234.MOV (an .MP4 in a Takeout export). Nothing special happens at
+// upload: both halves are stored as usual, and wherever they're listed
+// together the grid shows the still as one "live" card playing the video on
+// hover or press-and-hold; the viewer does the same. A still's video is looked
+// for among the files listed with it, then in the catalog, so a pair split
+// across two pages still counts. Videos longer than liveMaxSeconds are taken
+// to be a clip of their own, not the motion of a photo.
+
+var (
+	liveStillExts  = []string{ ".heic", ".heif", ".jpg", ".jpeg" }
+	liveMotionExts = []string{ ".mov", ".mp4" }
+)
+
+const liveMaxSeconds = 10
+
+func isLiveStill(name string) bool  { return hasSuffix(name, liveStillExts...) }
+func isLiveMotion(name string) bool { return hasSuffix(name, liveMotionExts...) }
+
+// liveCandidates are the names the other half of name could have: same
+// folder and stem, one of exts in lower or upper case.
+func liveCandidates(name string, exts []string) []string {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	var names []string
+	for _, ext := range exts { names = append(names, stem+ext, stem+strings.ToUpper(ext)) }
+	return names
+}
+
+// shortEnough reports whether video may be the motion of a live photo: its
+// length is unknown or under liveMaxSeconds.
+func shortEnough(video string) bool {
+	var info videoInfo
+	if found, _ := dbGet("videos", video, &info); found && info.Duration > liveMaxSeconds { return false }
+	return true
+}
+
+// livePartner is the other half of name among listed, else in the catalog;
+// "" if it has none.
+func livePartner(name string, listed map[string]bool) string {
+	motion, exts := isLiveMotion(name), liveMotionExts
+	if motion { exts = liveStillExts }
+	candidates := liveCandidates(name, exts)
+	found := func(c string) bool {
+		if c == name { return false }
+		if listed[c] { return true }
+		if !catalogReady() { return false }
+		_, ok := catalogGet(c)
+		return ok
+	}
+	for _, c := range candidates {
+		if !found(c) { continue }
+		video := c
+		if motion { video = name }
+		if shortEnough(video) { return c }
+		return ""
+	}
+	return ""
+}
+
+// pairLivePhotos turns the stills of a listing with a video beside them into
+// live cards and drops those videos.
+func pairLivePhotos(files []map[string]any) []map[string]any {
+	listed := map[string]bool{}
+	for _, f := range files { listed[f["Name"].(string)] = true }
+	var paired []map[string]any
+	for _, f := range files {
+		name := f["Name"].(string)
+		switch {
+		case isLiveStill(name):
+			if video := livePartner(name, listed); video != "" { makeLive(f, video) }
+		case isLiveMotion(name):
+			// Shown with its still, here or on the still's page
+			if livePartner(name, listed) != "" { continue }
+		}
+		paired = append(paired, f)
+	}
+	return paired
+}
+
+// makeLive adds a still's video to its grid card; a still browsers can't
+// show (HEIC) takes its thumbnail from the video.
+func makeLive(f map[string]any, video string) {
+	f["LiveURL"] = appURL("/view/" + video + "?raw=true")
+	f["LiveVideo"] = video
+	if f["IsMedia"] == true { return }
+	version := ""
+	if e, ok := catalogGet(video); ok { version = e.Version }
+	f["ThumbURL"] = appURL("/thumb/" + video + "?v=" + version)
+	f["ThumbSrcset"] = thumbSrcset(video, version)
+	f["SquareURL"], f["SquareSrcset"] = appURL("/thumb/square/"+video+"?v="+version), squareSrcset(video, version)
+	f["IsMedia"] = true
+}
+
+// findLiveVideo is the viewer's lookup of a still's video: in the catalog,
+// or straight from storage until it is built.
+func findLiveVideo(ctx context.Context, name string) string {
+	if !isLiveStill(name) { return "" }
+	if catalogReady() { return livePartner(name, nil) }
+	for _, c := range liveCandidates(name, liveMotionExts) {
+		if _, err := store.Attrs(ctx, storageKey(c)); err == nil && shortEnough(c) { return c }
+	}
+	return ""
+}
+
+// liveViewerData sets the viewer's LiveURL (the video, transcoded when
+// browsers can't play it) and LiveStill for a live photo.
+func liveViewerData(r *http.Request, name string, data map[string]any) {
+	data["LiveURL"], data["LiveStill"] = "", ""
+	video := findLiveVideo(r.Context(), name)
+	if video == "" { return }
+	data["LiveURL"] = appURL("/view/" + video + "?raw=true")
+	if needsTranscode(video) {
+		if ready, _ := transcodes.Prepare(r, video, renditionMP4); ready { data["LiveURL"] = appURL("/transcoded/" + video) }
+	}
+	switch {
+	case data["IsImage"] == true && data["PreviewURL"] != "":
+		data["LiveStill"] = data["PreviewURL"]
+	case data["IsImage"] == true:
+		data["LiveStill"] = appURL("/view/" + name + "?raw=true")
+	default:
+		// No browser but Safari shows HEIC, so the still is a frame of the video
+		width := thumbWidth
+		if len(thumbSizes) > 0 { width = thumbSizes[len(thumbSizes)-1] }
+		data["LiveStill"] = appURL("/thumb/" + strconv.Itoa(width) + "/" + video)
+	}
+}
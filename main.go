@@ -3,10 +3,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"html/template"
 	"path" // Used for B2 paths (forward slashes)
 	
 	// Image decoders
@@ -21,67 +22,164 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath" // Used for local OS file paths
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/disintegration/imaging"
+	"github.com/ishushreyas/memories/config"
+	"github.com/ishushreyas/memories/thumbnailer"
 	"github.com/joho/godotenv"
-	"github.com/kurin/blazer/b2"
 )
 
 var (
-	client  *b2.Client
-	bkt     *b2.Bucket
-	tpls    *template.Template
+	tpls    *templateSet
 	bktName string
 )
 
 func main() {
-	// 1. Load Env
+	// `memories <command>`; plain `memories` is `memories serve`
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 { cmd, args = args[0], args[1:] }
+	c, ok := findCommand(cmd)
+	if !ok { usage(); os.Exit(2) }
+
+	// 1. Load Env, then the config file for what the environment leaves unset
 	if err := godotenv.Load(); err != nil {
 		log.Println("⚠️ No .env file found, using system environment variables")
 	}
-	appKeyID := os.Getenv("B2_KEY_ID")
-	appKey := os.Getenv("B2_APP_KEY")
-	bktName = os.Getenv("B2_BUCKET_NAME")
-
-	if appKeyID == "" || appKey == "" || bktName == "" {
-		log.Fatal("Set B2_KEY_ID, B2_APP_KEY, and B2_BUCKET_NAME env vars")
+	cfgErr := config.Load()
+	if c.name == "config" { os.Exit(configCommand(args, cfgErr)) }
+	if cfgErr != nil { log.Fatalf("❌ Config error in %s:\n%v", config.File, cfgErr) }
+	// The agent needs no storage, DB or FFmpeg of its own
+	if c.name == "agent" { os.Exit(runCommand(c, args)) }
+	if config.File != "" { log.Printf("⚙️ Settings from %s", config.File) }
+	for _, p := range config.Check() {
+		if p.Error { log.Println("⚠️ Config:", p.Msg) }
 	}
-
 	// 2. Check for FFmpeg
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
 		log.Fatal("❌ FFmpeg is not installed. Please install it to generate video thumbnails.")
 	}
 
-	// 3. Connect to B2
-	var err error
-	client, err = b2.NewClient(context.Background(), appKeyID, appKey)
-	if err != nil {
-		log.Fatal("B2 auth error:", err)
-	}
+	// 3. Connect to storage (B2 unless STORAGE_BACKEND says otherwise)
+	b2calls = newB2CallTracker()
+	initStorage(context.Background())
+	initRAW()
+	initSVG()
+	initVideoInfo()
 
-	bkt, err = client.Bucket(context.Background(), bktName)
-	if err != nil {
-		log.Fatal("Bucket error:", err)
-	}
+	// 4. Metadata DB and what uploads and thumbnails need
+	openDB()
+	initCAS()
+	initWeather()
+	initCatalog()
+	transcodes = newTranscoder()
+	initThumbSizes()
+	initThumbFormats()
+	initAnimThumbs()
+	initThumbPool()
+	initScratch()
+	thumbs = newThumbCache(int64(envInt("THUMB_CACHE_MB", 256)) << 20)
+	thumbDir := os.Getenv("THUMB_CACHE_DIR")
+	if thumbDir == "" { thumbDir = filepath.Join("cache", "thumbs") }
+	thumbs.disk = newDiskCache(thumbDir, int64(envInt("THUMB_DISK_CACHE_MB", 2048)) << 20)
 
-	// 4. Templates & Routes
-	tpls = template.Must(template.New("").Funcs(template.FuncMap{
-		"hasPrefix": strings.HasPrefix,
-		"hasSuffix": hasSuffix,
-	}).ParseGlob("templates/*.html"))
+	// Commands other than serve run once and exit (the server must be
+	// stopped, since it holds the DB lock)
+	if c.name != "serve" { os.Exit(runCommand(c, args)) }
+
+	// 5. Auth & background jobs
+	initAuth()
+	initAPITokens()
+	throttle = newLoginThrottle()
+	go throttle.runSweeper()
+	egress = newEgressTracker()
+	transfers = newTransferLimits()
+	go egress.run()
+	go b2calls.run()
+	go runReminders()
+	initSpool()
+	go sweepScratch()
+	go sweepUploads()
+	go runTrashPurge()
+	go runCatalogSync()
+	initWatch()
+	initExports()
+	initFaces()
+	if os.Getenv("BACKFILL_ON_START") == "1" { backfill.Start(false) }
+
+	// 6. Templates & Routes
+	tpls = loadTemplates() // re-read on every render with DEV_MODE=1, see devmode.go
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	// Reads are open only in public-read mode; writes always need a login
+	// Routes for one file or folder check folder access themselves (acl.go)
 	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/view/", viewHandler)
+	http.HandleFunc("/browse/", browseHandler)
+	http.HandleFunc("/b/", bucketRouteHandler)
+	http.HandleFunc("/view/", trackEgress("view", limitTransfer(viewHandler)))
 	http.HandleFunc("/viewer/", viewerHandler)
-	http.HandleFunc("/download/", downloadHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/thumb/", thumbHandler)
+	http.HandleFunc("/download/", trackEgress("download", limitTransfer(downloadHandler)))
+	http.HandleFunc("/transcoded/", trackEgress("view", limitTransfer(transcodedHandler)))
+	http.HandleFunc("/hls/", trackEgress("view", hlsHandler))
+	http.HandleFunc("/download-zip", trackEgress("download", limitTransfer(zipHandler)))
+	http.HandleFunc("/exports", requireLogin(exportsHandler))
+	http.HandleFunc("/exports/", requireLogin(exportsHandler))
+	http.HandleFunc("/people", requireLogin(peopleHandler))
+	http.HandleFunc("/people/", requireLogin(peopleHandler))
+	http.HandleFunc("/edit", requireLogin(editHandler))
+	http.HandleFunc("/versions/", requireLogin(trackEgress("download", versionsHandler)))
+	http.HandleFunc("/move", requireLogin(moveHandler))
+	http.HandleFunc("/share", requireLogin(createShareHandler))
+	http.HandleFunc("/share/", withShare(shareHandler))
+	http.HandleFunc("/trash", requireLogin(trashHandler))
+	http.HandleFunc("/trash/", requireLogin(trashHandler))
+	http.HandleFunc("/upload", requireLogin(uploadHandler))
+	http.HandleFunc("/upload/progress/", requireLogin(uploadProgressHandler))
+	http.HandleFunc("/upload/url", requireLogin(urlUploadHandler))
+	http.HandleFunc("/upload/chunk", uploadChunkHandler)
+	http.HandleFunc("/upload/chunk/", uploadChunkHandler)
+	http.HandleFunc("/upload/direct", directUploadHandler)
+	http.HandleFunc("/upload/direct/", directUploadHandler)
+	http.HandleFunc("/delete/", requireLogin(deleteHandler))
+	http.HandleFunc("/thumb/", trackEgress("thumb", thumbHandler))
+	http.HandleFunc("/thumb/regenerate", requireLogin(thumbRegenerateHandler))
+	http.HandleFunc("/preview/", trackEgress("view", previewHandler))
+	http.HandleFunc("/thumb-anim/", trackEgress("thumb", animThumbHandler))
+	http.HandleFunc("/admin", requireLogin(adminHandler))
+	http.HandleFunc("/admin/backfill", requireLogin(backfillHandler))
+	http.HandleFunc("/admin/resync", requireLogin(resyncHandler))
+	http.HandleFunc("/admin/stats", requireLogin(statsHandler))
+	http.HandleFunc("/search", requireRead(searchHandler))
+	http.HandleFunc("/feed.xml", feedHandler)
+	http.HandleFunc("/tags/", requireRead(tagListHandler))
+	http.HandleFunc("/favorites", requireRead(favoritesHandler))
+	http.HandleFunc("/tag", requireLogin(tagEditHandler))
+	http.HandleFunc("/favorite", requireLogin(favoriteHandler))
+	http.HandleFunc("/hide", requireLogin(hideHandler))
+	http.HandleFunc("/duplicates", requireLogin(duplicatesHandler))
+	http.HandleFunc("/map", requireRead(mapHandler))
+	http.HandleFunc("/api/v1/map", requireRead(mapAPIHandler))
+	http.HandleFunc("/meta/", metaHandler)
+	http.HandleFunc("/cover", requireLogin(coverHandler))
+	http.HandleFunc("/albums", requireRead(albumsHandler))
+	http.HandleFunc("/albums/", requireRead(albumsHandler))
+	http.HandleFunc("/journal", requireRead(journalHandler))
+	http.HandleFunc("/api/v1/journal", requireRead(journalAPIHandler))
+	http.HandleFunc("/api/v1/journal/", requireRead(journalAPIHandler))
+	http.HandleFunc("/events", requireRead(eventsHandler))
+	http.HandleFunc("/review", requireRead(reviewHandler))
+	http.HandleFunc("/api/v1/events", requireRead(eventsAPIHandler))
+	http.HandleFunc("/api/v1/events/", requireRead(eventsAPIHandler))
+	http.HandleFunc("/api/v1/", apiHandler)
+	if os.Getenv("WEBDAV") != "off" { http.HandleFunc("/dav/", trackEgress("download", davHandler())) }
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/layout", layoutHandler)
 
-	fmt.Println("🚀 Server running at :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	serve(listenAddr())
 }
 
 // ========== HELPER FUNCTIONS ==========
@@ -94,31 +192,90 @@ func getThumbPath(originalPath string) string {
 	return path.Join("thumb", nameWithoutExt+".jpg")
 }
 
-func generateVideoThumbnail(videoPath string) ([]byte, error) {
-	tmpImg, err := os.CreateTemp("", "vid-thumb-*.jpg")
-	if err != nil { return nil, err }
-	tmpImgName := tmpImg.Name()
-	tmpImg.Close()
-	defer os.Remove(tmpImgName)
+// thumbWidth is the default thumbnail width, THUMB_WIDTH (default 300),
+// stored at getThumbPath. Larger ones for high-DPI screens are listed in
+// THUMB_SIZES (default "600,1200"), rendered on demand at
+// /thumb/{size}/{name} and stored under thumb-{size}/. THUMB_QUALITY sets
+// the JPEG quality of them all (1-100, default imaging's 95). Thumbnails
+// already stored keep the settings they were rendered with until the
+// "Regenerate all" backfill on /admin renders them again.
+var thumbWidth = 300
+
+var (
+	thumbSizes   = []int{ 600, 1200 }
+	thumbQuality = 0 // imaging's default
+)
 
-	// FFmpeg: Seek to 1s, grab 1 frame
-	cmd := exec.Command("ffmpeg", "-y", "-i", videoPath, "-ss", "00:00:01.000", "-vframes", "1", "-f", "image2", tmpImgName)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("FFmpeg failed: %s", string(out))
-		return nil, err
+func initThumbSizes() {
+	if n := envInt("THUMB_WIDTH", thumbWidth); n >= 16 && n <= 4096 { thumbWidth = n }
+	if q := envInt("THUMB_QUALITY", 0); q >= 1 && q <= 100 { thumbQuality = q }
+	v := os.Getenv("THUMB_SIZES")
+	if v == "" { return }
+	thumbSizes = nil
+	for _, s := range strings.Split(v, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n > 0 && n != thumbWidth && n <= 4096 { thumbSizes = append(thumbSizes, n) }
 	}
+	slices.Sort(thumbSizes)
+	thumbSizes = slices.Compact(thumbSizes)
+}
 
-	imgData, err := os.ReadFile(tmpImgName)
-	if err != nil { return nil, err }
+// getSizedThumbPath is getThumbPath for a given width and format:
+// "thumb-600/folder/video.webp". Square crops (for the square gallery
+// layout, see layout.go) go under thumb-square/ and thumb-square-600/.
+func getSizedThumbPath(originalPath string, width int, f thumbFormat, square bool) string {
+	p := strings.TrimSuffix(getThumbPath(originalPath), ".jpg") + f.ext
+	dir := "thumb"
+	if square { dir = "thumb-square" }
+	if width != thumbWidth { dir = fmt.Sprintf("%s-%d", dir, width) }
+	return dir + strings.TrimPrefix(p, "thumb")
+}
 
-	// Resize
-	img, err := imaging.Decode(bytes.NewReader(imgData))
-	if err != nil { return imgData, nil }
-	resized := imaging.Resize(img, 300, 0, imaging.Lanczos) // 300px width
-	
-	buf := new(bytes.Buffer)
-	err = imaging.Encode(buf, resized, imaging.JPEG)
-	return buf.Bytes(), err
+// splitThumbSize parses "600/photos/a.jpg" into (600, "photos/a.jpg") and
+// "square/600/photos/a.jpg" the same for the square crop. A library folder
+// named like a size (or "square") still wins when the catalog knows the file.
+func splitThumbSize(rest string) (width int, name string, square bool) {
+	if _, known := catalogGet(rest); known { return thumbWidth, rest, false }
+	if sq, ok := strings.CutPrefix(rest, "square/"); ok { rest, square = sq, true }
+	first, name, ok := strings.Cut(rest, "/")
+	if !ok { return thumbWidth, rest, square }
+	n, err := strconv.Atoi(first)
+	if err != nil || !slices.Contains(thumbSizes, n) { return thumbWidth, rest, square }
+	if _, known := catalogGet(rest); known { return thumbWidth, rest, square }
+	return n, name, square
+}
+
+// thumbSrcset lists every size of name's thumbnail for an <img srcset>.
+func thumbSrcset(name, version string) string { return srcsetUnder("/thumb/", name, version) }
+
+// squareSrcset is thumbSrcset for the square crops.
+func squareSrcset(name, version string) string { return srcsetUnder("/thumb/square/", name, version) }
+
+func srcsetUnder(prefix, name, version string) string {
+	parts := []string{ fmt.Sprintf("%s%s%s?v=%s %dw", basePath, prefix, name, version, thumbWidth) }
+	for _, n := range thumbSizes {
+		parts = append(parts, fmt.Sprintf("%s%s%d/%s?v=%s %dw", basePath, prefix, n, name, version, n))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// removeThumbs deletes all sizes and formats of an original's thumbnail, its
+// viewer preview and upright copy and its animated preview.
+func removeThumbs(ctx context.Context, originalKey string) {
+	thumbKey := getThumbPath(originalKey)
+	if err := store.Delete(ctx, thumbKey); err != nil { log.Printf("No thumbnail removed for %s: %v", originalKey, err) }
+	thumbs.Remove(thumbKey)
+	removeThumbVariants(ctx, originalKey)
+	deleteIfExists(ctx, previewKey(originalKey))
+	deleteIfExists(ctx, uprightKey(originalKey))
+	for _, f := range knownAnimFormats { deleteIfExists(ctx, animKey(originalKey, f)) }
+}
+
+// removeThumbVariants deletes everything but the default JPEG thumbnail.
+func removeThumbVariants(ctx context.Context, originalKey string) {
+	for _, key := range thumbVariantPaths(originalKey) {
+		deleteIfExists(ctx, key)
+		thumbs.Remove(key)
+	}
 }
 
 func hasSuffix(name string, suffixes ...string) bool {
@@ -133,7 +290,12 @@ func detectContentType(name string) string {
 	ext := filepath.Ext(name)
 	ct := mime.TypeByExtension(ext)
 	if ct != "" { return ct }
-	switch ext {
+	switch strings.ToLower(ext) {
+	case ".heic": return "image/heic"
+	case ".heif": return "image/heif"
+	case ".tif", ".tiff": return "image/tiff"
+	case ".bmp": return "image/bmp"
+	case ".svg": return "image/svg+xml"
 	case ".mp4": return "video/mp4"
 	case ".mov": return "video/quicktime"
 	case ".webm": return "video/webm"
@@ -142,6 +304,35 @@ func detectContentType(name string) string {
 	}
 }
 
+
+// newID returns a random 16-char hex identifier.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil { return v }
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil { return v }
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil { return v }
+	return def
+}
+
 func humanReadableSize(size int64) string {
 	const ( _ = iota; KB float64 = 1 << (10 * iota); MB; GB )
 	s := float64(size)
@@ -155,227 +346,706 @@ func humanReadableSize(size int64) string {
 
 // ========== INDEX HANDLER ==========
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	iter := bkt.List(context.Background())
-	var files []map[string]any
-
-	for iter.Next() {
-		obj := iter.Object()
-		name := obj.Name()
-
-		// NEW: Hide the entire "thumb/" directory from the main list
-		if strings.HasPrefix(name, "thumb/") { 
-			continue 
-		}
+	// "/" also catches every path no other route claims
+	if r.URL.Path != "/" { http.NotFound(w, r); return }
+	// Old ?folder= links now live under /browse/
+	if folder := strings.Trim(r.URL.Query().Get("folder"), "/"); folder != "" {
+		http.Redirect(w, r, "/browse/"+folder+"/", http.StatusMovedPermanently)
+		return
+	}
+	renderFolder(w, r, "")
+}
 
-		attrs, err := obj.Attrs(context.Background())
-		if err != nil { continue }
+// fileEntry is the template data for one grid card.
+func fileEntry(name string, size int64, uploaded time.Time, version string) map[string]any {
+	isMedia := isThumbable(name)
+	thumbURL, srcset, squareURL, squareSet := "", "", "", ""
 
-		isMedia := hasSuffix(name, ".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4", ".mov", ".mkv", ".webm")
-		thumbURL := ""
-		
-		if isMedia {
-			// URL still points to /thumb/originalName
-			// The handler will figure out the mapping
-			thumbURL = "/thumb/" + name
-		} else {
-			thumbURL = "/static/file-icon.png"
-		}
+	if isMedia {
+		// URL still points to /thumb/originalName
+		// The handler will figure out the mapping
+		// ?v= changes whenever the original does, busting browser caches
+		thumbURL = appURL("/thumb/" + name + "?v=" + version)
+		srcset = thumbSrcset(name, version)
+		squareURL, squareSet = appURL("/thumb/square/"+name+"?v="+version), squareSrcset(name, version)
+	} else {
+		thumbURL = appURL("/static/file-icon.png")
+		squareURL = thumbURL
+	}
 
-		files = append(files, map[string]any{
-			"Name":        name,
-			"Size":        humanReadableSize(attrs.Size),
-			"Time":        attrs.UploadTimestamp.Format("02 Jan"),
-			"ContentType": detectContentType(name),
-			"ThumbURL":    thumbURL,
-		})
+	entry := map[string]any{
+		"Name":        name,
+		"Bytes":       size,
+		"Version":     version,
+		"Size":        humanReadableSize(size),
+		"Time":        uploaded.Format("02 Jan"),
+		"Uploaded":    uploaded,
+		"ContentType": detectContentType(name),
+		"ThumbURL":    thumbURL,
+		"ThumbSrcset": srcset,
+		"SquareURL":    squareURL,
+		"SquareSrcset": squareSet,
+		"AnimURL":     animURL(name, version),
+		"IsMedia":     isMedia,
 	}
-	if err := iter.Err(); err != nil { http.Error(w, err.Error(), 500); return }
-	tpls.ExecuteTemplate(w, "index.html", map[string]any{ "BucketName": bktName, "Files": files })
+	if isVideo(name) { entry["Duration"] = videoDuration(name) }
+	return entry
+}
+
+// parentFolder returns "a/b" for "a/b/c" and "" for top-level folders.
+func parentFolder(folder string) string {
+	if i := strings.LastIndex(folder, "/"); i >= 0 { return folder[:i] }
+	return ""
 }
 
 // ========== THUMB HANDLER (Logic Updated for thumb/ folder) ==========
 func thumbHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Get the Original Name from URL
-	// Request: /thumb/photos/vacation.jpg
-	originalName := strings.TrimPrefix(r.URL.Path, "/thumb/")
+	// 1. Get the Original Name (and size) from URL
+	// Request: /thumb/photos/vacation.jpg or /thumb/600/photos/vacation.jpg
+	width, originalName, square := splitThumbSize(strings.TrimPrefix(r.URL.Path, "/thumb/"))
 	if originalName == "" { http.NotFound(w, r); return }
+	if !allowRead(w, r, originalName) { return }
+
+	// ?refresh=1 (or POST) regenerates from the current original. Logged-in only.
+	refresh := r.Method == http.MethodPost || r.URL.Query().Get("refresh") == "1"
+	if refresh && currentUser(r) == "" { http.Error(w, "login required", 401); return }
+
+	// WebP/AVIF when the browser takes them. A refresh renders the JPEG and
+	// drops the other variants so they're encoded again from it.
+	format := negotiateThumbFormat(r.Header.Get("Accept"))
+	if refresh { format = jpegThumb }
+	w.Header().Set("Vary", "Accept")
 
 	// 2. Calculate where the thumbnail *should* be in B2
 	// Original: photos/vacation.jpg -> B2 Thumb: thumb/photos/vacation.jpg
 	// Original: videos/trip.mp4     -> B2 Thumb: thumb/videos/trip.jpg
-	thumbB2Path := getThumbPath(originalName)
+	// Content-addressed: objects/ab/cd/<sha1> -> thumb/objects/ab/cd/<sha1>.jpg
+	// Other sizes:      photos/vacation.jpg -> thumb-600/photos/vacation.jpg
+	// Other formats:    photos/vacation.jpg -> thumb/photos/vacation.webp
+	// Square crops:     photos/vacation.jpg -> thumb-square/photos/vacation.jpg
+	originalKey := storageKey(originalName)
+	thumbB2Path := getSizedThumbPath(originalKey, width, format, square)
 
-	ctx := context.Background()
-	thumbObj := bkt.Object(thumbB2Path)
-
-	// 3. Check if thumbnail exists in "thumb/" folder
-	if _, err := thumbObj.Attrs(ctx); err != nil {
-		// --- GENERATE MISSING THUMBNAIL ---
-		log.Printf("Generating missing thumbnail: %s -> %s", originalName, thumbB2Path)
-
-		// Download Original
-		originalObj := bkt.Object(originalName)
-		rc := originalObj.NewReader(ctx)
-		if rc == nil { http.NotFound(w, r); return }
-		defer rc.Close()
+	ctx := r.Context()
+	wantVersion := r.URL.Query().Get("v")
 
-		tmpOriginal, err := os.CreateTemp("", "orig-*"+filepath.Ext(originalName))
-		if err != nil { http.Error(w, "temp error", 500); return }
-		defer os.Remove(tmpOriginal.Name())
+	// Versioned URLs can be answered straight from RAM
+	if wantVersion != "" && !refresh {
+		if data, ok := thumbs.Get(thumbB2Path, wantVersion); ok {
+			serveThumb(w, r, data, format, wantVersion, thumbCacheControl(wantVersion, wantVersion), time.Time{})
+			return
+		}
+	}
 
-		if _, err := io.Copy(tmpOriginal, rc); err != nil {
-			http.Error(w, "download failed", 500); return
+	// 3. Check if thumbnail exists in "thumb/" folder and still matches the original.
+	// Each thumb records the version of the original it was rendered from; when the
+	// URL's ?v= already matches it we can skip looking up the original.
+	srcVersion := ""
+	stale := false
+	thumbAttrs, err := store.Attrs(ctx, thumbB2Path)
+	if err == nil && !refresh {
+		thumbVersion := thumbAttrs.Info["src_version"]
+		if wantVersion == "" || thumbVersion != wantVersion {
+			if origAttrs, err := store.Attrs(ctx, originalKey); err == nil {
+				srcVersion = sourceVersion(origAttrs)
+				stale = thumbVersion != srcVersion
+			}
 		}
-		tmpOriginal.Close()
+	}
 
-		var thumbData []byte
-		
-		if hasSuffix(originalName, ".mp4", ".mov", ".mkv", ".webm") {
-			thumbData, err = generateVideoThumbnail(tmpOriginal.Name())
-			if err != nil {
-				log.Println("Video thumb failed:", err)
+	if err != nil && !isNotFound(err) { storageFailure(w, r, originalName, err); return }
+	if err != nil {
+		// No thumbnail yet: make sure there is something to render it from
+		origAttrs, err := store.Attrs(ctx, originalKey)
+		if err != nil { storageFailure(w, r, originalName, err); return }
+		srcVersion = sourceVersion(origAttrs)
+	}
+
+	if err != nil || refresh || stale {
+		// --- GENERATE MISSING (OR STALE) THUMBNAIL ---
+		// Concurrent requests for it share one render (see thumbpool.go)
+		flightKey := thumbB2Path
+		if refresh { flightKey += "#refresh" }
+		t, err := thumbFlights.Do(ctx, flightKey, func(ctx context.Context) (renderedThumb, error) {
+			if refresh {
+				log.Printf("Refreshing thumbnail: %s -> %s", originalName, thumbB2Path)
+			} else if stale {
+				log.Printf("Original changed, regenerating thumbnail: %s -> %s", originalName, thumbB2Path)
+			} else {
+				log.Printf("Generating missing thumbnail: %s -> %s", originalName, thumbB2Path)
+			}
+			return renderThumb(ctx, originalName, width, square, format, srcVersion, refresh)
+		})
+		if err != nil {
+			log.Println("Thumb failed:", err)
+			if isVideo(originalName) || isRAW(originalName) || isSVG(originalName) {
 				http.Redirect(w, r, "/static/file-icon.png", 302)
 				return
 			}
-		} else {
-			f, _ := os.Open(tmpOriginal.Name())
-			srcImage, err := imaging.Decode(f)
-			f.Close()
-			if err != nil { http.Error(w, "decode failed", 500); return }
-			
-			thumbImg := imaging.Resize(srcImage, 300, 0, imaging.Lanczos)
-			buf := new(bytes.Buffer)
-			imaging.Encode(buf, thumbImg, imaging.JPEG)
-			thumbData = buf.Bytes()
+			http.Error(w, "thumbnail failed", 500); return
 		}
+		thumbData, format, srcVersion := t.data, t.format, t.version
 
-		// Upload to "thumb/" folder
-		thumbWr := thumbObj.NewWriter(ctx)
-		if _, err := thumbWr.Write(thumbData); err != nil {
-			log.Println("Failed to save thumb:", err)
+		if r.Method == http.MethodPost {
+			http.Redirect(w, r, "/viewer/"+originalName, http.StatusSeeOther)
+			return
 		}
-		thumbWr.Close()
 
-		w.Header().Set("Content-Type", "image/jpeg")
-		w.Header().Set("Cache-Control", "public, max-age=604800")
-		w.Write(thumbData)
+		cacheControl := thumbCacheControl(wantVersion, srcVersion)
+		if refresh { cacheControl = "no-store" }
+		serveThumb(w, r, thumbData, format, srcVersion, cacheControl, time.Now())
 		return
 	}
 
 	// --- SERVE EXISTING THUMBNAIL ---
-	rc := thumbObj.NewReader(ctx)
-	if rc == nil { http.Error(w, "failed", 500); return }
-	defer rc.Close()
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Header().Set("Cache-Control", "public, max-age=604800")
-	io.Copy(w, rc)
+	thumbVersion := thumbAttrs.Info["src_version"]
+	data, ok := thumbs.Get(thumbB2Path, thumbVersion)
+	if !ok {
+		rc, err := getObject(ctx, thumbB2Path)
+		if err != nil { http.Error(w, "failed", 500); return }
+		defer rc.Close()
+		data, err = io.ReadAll(rc)
+		if err != nil { http.Error(w, "failed", 500); return }
+		thumbs.Put(thumbB2Path, thumbVersion, data)
+	}
+	serveThumb(w, r, data, format, thumbVersion, thumbCacheControl(wantVersion, thumbVersion), thumbAttrs.Modified)
+}
+
+// serveThumb writes a thumbnail with an ETag derived from the version of the
+// original it was rendered from (and the format) and, when known, the time it
+// was stored as Last-Modified, answering If-None-Match and If-Modified-Since
+// with a 304.
+func serveThumb(w http.ResponseWriter, r *http.Request, data []byte, f thumbFormat, version, cacheControl string, modified time.Time) {
+	w.Header().Set("Cache-Control", cacheControl)
+	if version != "" {
+		etag := `"` + version + `"`
+		if f.name != jpegThumb.name { etag = `"` + version + "-" + f.name + `"` }
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+}
+
+// thumbCacheControl only allows long-lived caching for versioned URLs, since an
+// unversioned /thumb/ URL can start pointing at different bytes.
+func thumbCacheControl(wantVersion, servedVersion string) string {
+	if wantVersion != "" && wantVersion == servedVersion {
+		return "public, max-age=31536000, immutable"
+	}
+	return "public, max-age=3600"
+}
+
+// writeThumb stores a thumbnail tagged with the version of its original. The
+// content type follows the key's extension.
+func writeThumb(ctx context.Context, thumbKey string, data []byte, srcVersion string) error {
+	attrs := objectAttrs{ ContentType: detectContentType(thumbKey) }
+	if srcVersion != "" { attrs.Info = map[string]string{ "src_version": srcVersion } }
+	return store.Put(ctx, thumbKey, bytes.NewReader(data), attrs)
+}
+
+// serveDerived answers with the file rendered from the original at key and
+// stored at derivedKey (a RAW preview, an animated thumbnail), rendering and
+// storing it first when it's missing or was made from an older version.
+func serveDerived(w http.ResponseWriter, r *http.Request, key, derivedKey, contentType string, render func(ctx context.Context) ([]byte, error)) {
+	ctx := r.Context()
+	attrs, err := store.Attrs(ctx, key)
+	if err != nil { http.NotFound(w, r); return }
+	version := sourceVersion(attrs)
+	w.Header().Set("Cache-Control", thumbCacheControl(r.URL.Query().Get("v"), version))
+
+	if da, err := store.Attrs(ctx, derivedKey); err == nil && da.Info["src_version"] == version {
+		if rc, err := getObject(ctx, derivedKey); err == nil {
+			defer rc.Close()
+			w.Header().Set("Content-Type", contentType)
+			io.Copy(w, rc)
+			return
+		}
+	}
+
+	rctx, cancel := renderContext(ctx)
+	data, err := render(rctx)
+	cancel()
+	if err != nil { log.Printf("Rendering %s failed: %v", derivedKey, err); http.Error(w, "render failed", 500); return }
+	if err := writeThumb(context.WithoutCancel(ctx), derivedKey, data, version); err != nil { log.Printf("Failed to store %s: %v", derivedKey, err) }
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// renderThumb renders and stores one size, shape and format of
+// originalName's thumbnail, tagged with srcVersion (looked up if ""). A
+// format ffmpeg can't encode falls back to JPEG.
+func renderThumb(ctx context.Context, originalName string, width int, square bool, format thumbFormat, srcVersion string, refresh bool) (renderedThumb, error) {
+	originalKey := storageKey(originalName)
+	thumbData, err := buildThumbnail(ctx, originalName, width, square)
+	if err != nil { return renderedThumb{}, err }
+	if format.name != jpegThumb.name {
+		if data, err := encodeThumb(ctx, thumbData, format); err == nil {
+			thumbData = data
+		} else {
+			format = jpegThumb
+		}
+	}
+	thumbKey := getSizedThumbPath(originalKey, width, format, square)
+
+	// A rendered thumbnail is kept even if the client has gone meanwhile
+	ctx = context.WithoutCancel(ctx)
+	if refresh { removeThumbVariants(ctx, originalKey) }
+
+	// Upload to "thumb/" folder, tagged with the original's version
+	if srcVersion == "" {
+		if origAttrs, err := store.Attrs(ctx, originalKey); err == nil { srcVersion = sourceVersion(origAttrs) }
+	}
+	if err := writeThumb(ctx, thumbKey, thumbData, srcVersion); err != nil {
+		log.Println("Failed to save thumb:", err)
+	}
+	thumbs.Put(thumbKey, srcVersion, thumbData)
+	if width == thumbWidth && format.name == jpegThumb.name && !square { catalogMarkThumb(originalName) }
+	return renderedThumb{ thumbData, format, srcVersion }, nil
+}
+
+// renderContext bounds one render of a thumbnail or preview (download plus
+// ffmpeg or dcraw) by RENDER_TIMEOUT (default 2m).
+func renderContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, envDuration("RENDER_TIMEOUT", 2*time.Minute))
+}
+
+// buildThumbnail downloads the original and renders a JPEG of the given
+// width (and as tall, if square), once one of the THUMB_WORKERS render slots
+// is free.
+func buildThumbnail(ctx context.Context, originalName string, width int, square bool) ([]byte, error) {
+	if err := acquireThumbSlot(ctx); err != nil { return nil, err }
+	defer releaseThumbSlot()
+	ctx, cancel := renderContext(ctx)
+	defer cancel()
+	local, err := downloadTemp(ctx, storageKey(originalName), filepath.Ext(originalName))
+	if err != nil { return nil, err }
+	defer os.Remove(local)
+	f, err := os.Open(local)
+	if err != nil { return nil, err }
+	defer f.Close()
+	return thumbnailer.GenerateThumbnail(ctx, f, originalName, thumbnailer.Options{ Width: width, Quality: thumbQuality, Frame: framePickFor(ctx, originalName), Square: square })
 }
 
 // ========== UPLOAD HANDLER ==========
+// The form may carry several "file" parts (multi-select or a whole folder).
+// Folder uploads send one "relpath" per file with its path inside the picked
+// folder, since multipart strips directories from filenames. Files are stored
+// concurrently by UPLOAD_WORKERS (default 4) workers.
+
+type uploadResult struct {
+	Name    string `json:"name"`
+	Size    string `json:"size,omitempty"`
+	SHA1    string `json:"sha1,omitempty"`
+	Deduped bool   `json:"deduped,omitempty"`
+	// Same bytes as this existing file; with duplicates=skip nothing was stored
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	Skipped     bool   `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	bytes int64 // stored, for quotas
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		tpls.ExecuteTemplate(w, "upload.html", map[string]any{ "BucketName": bktName, "Message": "" })
+		tpls.ExecuteTemplate(w, "upload.html", map[string]any{ "BucketName": bktName, "Message": "", "DirectMB": directMB(), "OrganizeByDate": organizeDefault(), "Quota": quotaView(currentUser(r)) })
 		return
 	}
 
-	// 1. Get File
-	file, header, err := r.FormFile("file")
-	if err != nil { http.Error(w, "read error", 400); return }
-	defer file.Close()
+	results, err := receiveUploads(r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	answerUploads(w, r, results)
+}
 
-	// 2. Determine Path (Folder + Custom Name)
-	folder := r.FormValue("folder")
-	customName := r.FormValue("custom_name")
-	if customName == "" { customName = header.Filename }
-	
-	objectPath := customName
-	if folder != "" {
-		objectPath = path.Join(folder, customName)
+// answerUploads reports the outcome of a form upload: JSON to clients that
+// ask for it, else the upload page with a summary.
+func answerUploads(w http.ResponseWriter, r *http.Request, results []uploadResult) {
+	failed := 0
+	for _, res := range results {
+		if res.Error != "" { failed++ }
 	}
+	status := http.StatusOK
+	if failed == len(results) { status = http.StatusInternalServerError }
 
-	// 3. Temp File
-	tmpFile, err := os.CreateTemp("", "upload-*"+filepath.Ext(objectPath))
-	if err != nil { http.Error(w, "temp error", 500); return }
-	defer os.Remove(tmpFile.Name())
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, status, results)
+		return
+	}
 
-	hasher := sha1.New()
-	size, err := io.Copy(io.MultiWriter(tmpFile, hasher), file)
-	if err != nil { http.Error(w, "copy error", 500); return }
-	
-	log.Println("SHA1:", hex.EncodeToString(hasher.Sum(nil)))
+	msg := fmt.Sprintf("✅ Uploaded %s (%s)", results[0].Name, results[0].Size)
+	if results[0].Deduped { msg += " – identical content already stored, linked instead" }
+	if results[0].Skipped { msg = fmt.Sprintf("⏭️ Skipped %s – same content as %s", results[0].Name, results[0].DuplicateOf) }
+	if len(results) > 1 || failed > 0 { msg = fmt.Sprintf("Uploaded %d of %d files", len(results)-failed, len(results)) }
+	if len(results) == 1 && failed == 1 { msg = fmt.Sprintf("❌ %s: %s", results[0].Name, results[0].Error) }
+	w.WriteHeader(status)
+	tpls.ExecuteTemplate(w, "upload.html", map[string]any{
+		"BucketName":     bktName,
+		"Message":        msg,
+		"Results":        results,
+		"Failed":         failed == len(results),
+		"DirectMB":       directMB(),
+		"OrganizeByDate": organizeDefault(),
+		"Quota":          quotaView(currentUser(r)),
+	})
+}
 
-	// 4. Upload Original
-	tmpFile.Seek(0, 0)
-	obj := bkt.Object(objectPath)
-	wr := obj.NewWriter(context.Background())
-	if _, err = io.Copy(wr, tmpFile); err != nil { http.Error(w, "upload failed", 500); return }
-	wr.Close()
+// receiveUploads stores every "file" part of a multipart request, reading
+// the body as it arrives. Fields (folder, custom_name, duplicates, collision,
+// organize, relpath) must come before the files they apply to. Normally each file is streamed
+// straight into B2 (see streamUpload); content-addressed mode and
+// duplicates=skip need the SHA1 before anything is stored, and organize=date
+// the capture date (see organize.go), so there files are spooled to a temp
+// file first. Thumbnails, sidecars and the spooled
+// uploads are finished by UPLOAD_WORKERS (default 4) workers while the next
+// file is read. The error is only for a malformed request; per-file
+// failures are in the results.
+func receiveUploads(r *http.Request) ([]uploadResult, error) {
+	prog := trackUpload(r)
+	defer prog.finish()
+	mr, err := r.MultipartReader()
+	if err != nil { return nil, fmt.Errorf("read error") }
 
-	// 5. Generate Thumbnail (to thumb/ folder)
+	// Files are read under the request's context, but one fully received is
+	// stored and processed even if the client goes away
+	ctx := r.Context()
+	bg := context.WithoutCancel(ctx)
+	user := currentUser(r)
+	fields := map[string][]string{}
+	var results []*uploadResult
+	var holds []func() // quota held until the results are charged
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(envInt("UPLOAD_WORKERS", 4), 1))
+	finish := func(fn func()) {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			fn()
+		}()
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF { break }
+		if err != nil { wg.Wait(); return nil, fmt.Errorf("read error") }
+		if part.FormName() != "file" {
+			v, _ := io.ReadAll(io.LimitReader(part, 1<<20))
+			fields[part.FormName()] = append(fields[part.FormName()], string(v))
+			continue
+		}
+		if part.FileName() == "" { continue } // empty file input
+
+		objectPath, err := uploadPath(fields, part.FileName(), len(results))
+		res := &uploadResult{ Name: path.Join(formField(fields, "folder"), part.FileName()) }
+		results = append(results, res)
+		var policy string
+		dated := false
+		release := func() {}
+		if err == nil { policy, err = collisionPolicy(formField(fields, "collision")) }
+		if err == nil { dated, err = organizeByDate(formField(fields, "organize"), objectPath) }
+		// A dated upload is named once its capture date is known
+		if err == nil && !dated { objectPath, release, err = claimUploadName(ctx, objectPath, policy) }
+		if err != nil {
+			log.Printf("Upload %s: %v", res.Name, err)
+			res.Error = err.Error()
+			continue
+		}
+		res.Name = objectPath
+		skipDupes := formField(fields, "duplicates") == "skip"
+		room, limited := quotaRoom(user)
+		if !casMode && !skipDupes && !dated && !limited {
+			*res = streamUpload(ctx, part, objectPath, prog.addFile(objectPath, "storing"), finish)
+			release()
+			continue
+		}
+
+		fp := prog.addFile(objectPath, "receiving")
+		var src io.Reader = part
+		// One byte past the room left is enough to know it doesn't fit
+		if limited { src = io.LimitReader(part, room+1) }
+		local, size, sha, err := spoolUpload(src, objectPath)
+		if err != nil {
+			log.Printf("Upload %s: copy error: %v", objectPath, err)
+			res.Error = "copy error"
+			fp.setStage("failed")
+			release()
+			continue
+		}
+		hold, err := holdQuota(user, size)
+		if err != nil {
+			log.Printf("Upload %s by %s: %v", objectPath, user, err)
+			res.Error = err.Error()
+			fp.setStage("failed")
+			release()
+			os.Remove(local)
+			continue
+		}
+		holds = append(holds, hold)
+		if dated {
+			if objectPath, release, err = claimUploadName(ctx, datedName(objectPath, local), policy); err != nil {
+				log.Printf("Upload %s: %v", res.Name, err)
+				res.Error = err.Error()
+				fp.setStage("failed")
+				os.Remove(local)
+				continue
+			}
+			res.Name = objectPath
+		}
+		finish(func() {
+			defer os.Remove(local)
+			defer release()
+			fp.setStage("storing")
+			*res = storeLocal(bg, local, size, sha, objectPath, skipDupes, fp)
+		})
+	}
+	wg.Wait()
+	if len(results) == 0 { return nil, fmt.Errorf("no file") }
+
+	out := make([]uploadResult, len(results))
+	for i, res := range results { out[i] = *res }
+	chargeUploads(user, out...)
+	for _, hold := range holds { hold() }
+	notifyUploads(requestOrigin(r), user, out...)
+	return out, nil
+}
+
+func formField(fields map[string][]string, name string) string {
+	if v := fields[name]; len(v) > 0 { return v[0] }
+	return ""
+}
+
+// uploadPath is where the nth file of a request goes: the custom name (first
+// file only), else its path inside a picked folder, else its filename, all
+// under folder, cleaned as in uploadname.go.
+func uploadPath(fields map[string][]string, filename string, n int) (string, error) {
+	name := filename
+	relPaths := fields["relpath"]
+	switch {
+	case n == 0 && formField(fields, "custom_name") != "":
+		name = formField(fields, "custom_name")
+	case n < len(relPaths) && relPaths[n] != "":
+		name = relPaths[n]
+	}
+	return cleanUploadName(formField(fields, "folder"), name)
+}
+
+// spoolUpload copies one file part to a temp file, hashing it on the way. The
+// caller removes the file.
+func spoolUpload(part io.Reader, objectPath string) (local string, size int64, sha string, err error) {
+	tmpFile, err := createTemp("upload-*"+filepath.Ext(objectPath))
+	if err != nil { return "", 0, "", err }
+	hasher := sha1.New()
+	size, err = io.Copy(io.MultiWriter(tmpFile, hasher), part)
 	tmpFile.Close()
-	
-	var thumbData []byte
-	var genErr error
-	shouldGen := false
-
-	if hasSuffix(objectPath, ".mp4", ".mov", ".mkv", ".webm") {
-		thumbData, genErr = generateVideoThumbnail(tmpFile.Name())
-		if genErr == nil { shouldGen = true }
-	} else if hasSuffix(objectPath, ".jpg", ".jpeg", ".png", ".gif", ".webp") {
-		f, _ := os.Open(tmpFile.Name())
-		srcImage, err := imaging.Decode(f)
-		f.Close()
-		if err == nil {
-			thumbImg := imaging.Resize(srcImage, 300, 0, imaging.Lanczos)
-			buf := new(bytes.Buffer)
-			imaging.Encode(buf, thumbImg, imaging.JPEG)
-			thumbData = buf.Bytes()
-			shouldGen = true
+	if err != nil { os.Remove(tmpFile.Name()); return "", 0, "", err }
+	return tmpFile.Name(), size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// streamUpload copies one file part straight into storage, which holds
+// UPLOAD_CHUNK_MB (default 16) per part in flight. The first THUMB_BUFFER_MB
+// (default 32) are kept to render the thumbnail and read EXIF from: an image
+// bigger than that, or a video ffmpeg can't read from its start, gets its
+// thumbnail on first view instead. On B2, large files (over one chunk) are
+// stored without large_file_sha1, since the hash is only known at the end, so
+// their version is the upload time as for any other file B2 has no SHA1 for.
+// The rest of the work is handed to finish.
+func streamUpload(ctx context.Context, part io.Reader, objectPath string, fp *fileProgress, finish func(func())) uploadResult {
+	res := uploadResult{ Name: objectPath }
+	fail := func(msg string, err error) uploadResult {
+		log.Printf("Upload %s: %s: %v", objectPath, msg, err)
+		fp.setStage("failed")
+		res.Error = msg
+		return res
+	}
+
+	hasher := sha1.New()
+	head := &headBuffer{ limit: envInt("THUMB_BUFFER_MB", 32) << 20 }
+	counter := &countingReader{ r: io.TeeReader(fp.reader(part), io.MultiWriter(hasher, head)) }
+	if err := store.Put(ctx, objectPath, counter, objectAttrs{ ContentType: detectContentType(objectPath) }); err != nil { return fail("upload failed", err) }
+	// Stored: the rest happens even if the client goes away now
+	ctx = context.WithoutCancel(ctx)
+	size := counter.n
+	sha := hex.EncodeToString(hasher.Sum(nil))
+	log.Println("SHA1:", sha)
+
+	version := sha
+	if attrs, err := store.Attrs(ctx, objectPath); err == nil { version = sourceVersion(attrs) }
+	res.Size, res.SHA1, res.bytes = humanReadableSize(size), sha, size
+	if dupes := namesWithHash(sha, objectPath); len(dupes) > 0 { res.DuplicateOf = dupes[0] }
+
+	fp.setStage("processing")
+	finish(func() {
+		defer fp.setStage("done")
+		rctx, cancel := renderContext(ctx)
+		defer cancel()
+		// A truncated photo doesn't decode; ffmpeg gets by with the start of a video
+		var thumbData []byte
+		if !head.overflow || isVideo(objectPath) {
+			thumbData, _ = thumbnailer.GenerateThumbnail(rctx, bytes.NewReader(head.buf.Bytes()), objectPath, thumbnailer.Options{ Width: thumbWidth, Quality: thumbQuality, Frame: defaultFramePick() })
+		}
+		var info *exifInfo
+		if hasEXIF(objectPath) {
+			if x, ok := decodeEXIF(bytes.NewReader(head.buf.Bytes())); ok { info = &x }
+		}
+		completeUpload(ctx, objectPath, objectPath, version, size, false, thumbData, info)
+		if isVideo(objectPath) { probeHead(rctx, objectPath, head.buf.Bytes()) }
+	})
+	return res
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// headBuffer keeps the first limit bytes written to it and drops the rest.
+type headBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.limit - h.buf.Len(); room < len(p) {
+		h.overflow = true
+		h.buf.Write(p[:max(room, 0)])
+	} else {
+		h.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// storeLocal uploads a file already spooled to disk (with its size and SHA1)
+// and generates its thumbnail and sidecar. Files above the writer's chunk
+// size go through B2's large-file API in parallel parts. With skipDupes, a
+// file whose bytes are already in the library under another name is not
+// stored at all.
+func storeLocal(ctx context.Context, local string, size int64, sha, objectPath string, skipDupes bool, fp *fileProgress) uploadResult {
+	res := uploadResult{ Name: objectPath, Size: humanReadableSize(size), SHA1: sha, bytes: size }
+	fail := func(msg string, err error) uploadResult {
+		log.Printf("Upload %s: %s: %v", objectPath, msg, err)
+		fp.setStage("failed")
+		res.Error = msg
+		return res
+	}
+	defer func() {
+		if res.Error == "" { fp.setStage("done") }
+	}()
+	log.Println("SHA1:", sha)
+	if dupes := namesWithHash(sha, objectPath); len(dupes) > 0 {
+		res.DuplicateOf = dupes[0]
+		if skipDupes {
+			res.Skipped = true
+			log.Printf("Upload %s: skipped, same content as %s", objectPath, dupes[0])
+			return res
 		}
 	}
 
-	if shouldGen {
+	tmpFile, err := os.Open(local)
+	if err != nil { return fail("read error", err) }
+	defer tmpFile.Close()
+
+	// Upload Original (SHA1 passed along so large files keep it too).
+	// In content-addressed mode identical bytes are only stored once.
+	storeKey := objectPath
+	if casMode { storeKey = casKey(sha) }
+	res.Deduped = casMode && casExists(ctx, sha)
+
+	if !res.Deduped {
+		// Parts are read straight from the temp file (io.ReaderAt), not buffered
+		if err := store.Put(ctx, storeKey, fp.reader(tmpFile), objectAttrs{ ContentType: detectContentType(objectPath), SHA1: sha }); err != nil { return fail("upload failed", err) }
+	}
+	// Versions follow what the backend reports (S3 has no SHA1 to report)
+	version := sha
+	if !casMode {
+		if attrs, err := store.Attrs(ctx, storeKey); err == nil { version = sourceVersion(attrs) }
+	}
+	if casMode {
+		old, replaced := casLookup(objectPath)
+		entry := casEntry{ Hash: sha, Size: size, ContentType: detectContentType(objectPath), Uploaded: time.Now() }
+		if err := casPut(objectPath, entry); err != nil { return fail("metadata error", err) }
+		if replaced && old.Hash != sha { casReplaced(ctx, objectPath, old) }
+	}
+
+	// Generate Thumbnail (to thumb/ folder); a deduplicated blob already has one
+	fp.setStage("processing")
+	rctx, cancel := renderContext(ctx)
+	defer cancel()
+	var thumbData []byte
+	if !res.Deduped {
+		tmpFile.Seek(0, io.SeekStart)
+		thumbData, _ = thumbnailer.GenerateThumbnail(rctx, tmpFile, objectPath, thumbnailer.Options{ Width: thumbWidth, Quality: thumbQuality, Frame: defaultFramePick() })
+	}
+	var info *exifInfo
+	if hasEXIF(objectPath) {
+		if x, ok := readEXIF(local); ok { info = &x }
+	}
+	completeUpload(ctx, objectPath, storeKey, version, size, res.Deduped, thumbData, info)
+	if isVideo(objectPath) { probeAndSave(rctx, objectPath, local) }
+	return res
+}
+
+// completeUpload does everything after the original is stored: the thumbnail
+// (when one was rendered), the catalog entry, video renditions and the EXIF
+// sidecar.
+func completeUpload(ctx context.Context, objectPath, storeKey, version string, size int64, deduped bool, thumbData []byte, info *exifInfo) {
+	if thumbData != nil {
 		// Use helper to determine thumb path
-		thumbName := getThumbPath(objectPath)
+		thumbName := getThumbPath(storeKey)
 
-		thumbObj := bkt.Object(thumbName)
-		thumbWr := thumbObj.NewWriter(context.Background())
-		thumbWr.Write(thumbData)
-		thumbWr.Close()
+		writeThumb(ctx, thumbName, thumbData, version)
 		log.Println("✅ Generated Thumbnail:", thumbName)
 	}
+	catalogPut(catalogEntry{ Name: objectPath, Size: size, Modified: time.Now(), ContentType: detectContentType(objectPath), Version: version, Thumb: thumbData != nil || deduped })
 
-	tpls.ExecuteTemplate(w, "upload.html", map[string]any{
-		"BucketName": bktName,
-		"Message":    fmt.Sprintf("✅ Uploaded %s (%s)", objectPath, humanReadableSize(size)),
-	})
+	// Browser-friendly rendition; a by-name key may hold one of older bytes
+	if isVideo(objectPath) && !deduped {
+		if !casMode { transcodes.Invalidate(ctx, storeKey) }
+		if os.Getenv("TRANSCODE_ON_UPLOAD") == "1" {
+			if wantsHLS(objectPath, size) {
+				transcodes.Enqueue(objectPath, renditionHLS, true)
+			} else if needsTranscode(objectPath) {
+				transcodes.Enqueue(objectPath, renditionMP4, true)
+			}
+		}
+	}
+
+	// Camera metadata goes into the sidecar (per name, so also for dedups)
+	if info != nil { saveEXIF(ctx, objectPath, *info) }
 }
 
 // ... viewHandler, viewerHandler, downloadHandler remain exactly the same ...
 func viewHandler(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/view/")
-	if name == "" { http.NotFound(w, r); return }
-	obj := bkt.Object(name)
-	rc := obj.NewReader(context.Background())
-	if rc == nil { http.Error(w, "failed", 500); return }
-	defer rc.Close()
-	if r.URL.Query().Get("raw") == "true" {
-		w.Header().Set("Content-Type", detectContentType(name))
-		io.Copy(w, rc)
-		return
+	// Generated copies (previews, thumbnails, trash) are only served through
+	// the routes that check their original's folder
+	if name == "" || !isLibraryFile(name) { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	key, attrs, ok := statOriginal(w, r, name)
+	if !ok { return }
+	body := &objectReadSeeker{ ctx: r.Context(), key: key, size: attrs.Size }
+	defer body.Close()
+	// A content-addressed key never changes, so a URL pinned to its hash can be cached forever
+	if v := r.URL.Query().Get("v"); casMode && v != "" && key == casKey(v) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 	}
-	tmpFile, err := os.CreateTemp("", "view-*")
-	if err != nil { http.Error(w, "temp error", 500); return }
-	defer os.Remove(tmpFile.Name())
-	io.Copy(tmpFile, rc)
-	tmpFile.Seek(0, 0)
-	http.ServeContent(w, r, name, time.Now(), tmpFile)
+	if r.URL.Query().Get("raw") == "true" { w.Header().Set("Content-Type", detectContentType(name)) }
+	sandboxSVG(w, name)
+	setETag(w, attrs)
+	http.ServeContent(w, r, name, attrs.Modified, body)
 }
 
 func viewerHandler(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/viewer/")
-	obj := bkt.Object(name)
-	attrs, err := obj.Attrs(context.Background())
+	if !isLibraryFile(name) { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	attrs, err := store.Attrs(r.Context(), storageKey(name))
+	if isNotFound(err) { missingFile(w, r, name); return }
 	if err != nil { log.Println("Error getting attrs:", err) }
 	size := "Unknown size"
 	if attrs != nil { size = humanReadableSize(attrs.Size) }
@@ -384,18 +1054,120 @@ func viewerHandler(w http.ResponseWriter, r *http.Request) {
 		"FileName":    name,
 		"FileSize":    size,
 		"ContentType": detectContentType(name),
-		"IsImage":     hasSuffix(name, ".jpg", ".jpeg", ".png", ".gif", ".webp"),
-		"IsVideo":     hasSuffix(name, ".mp4", ".mov", ".mkv", ".webm"),
+		"IsImage":     thumbnailer.IsImage(name) || isSVG(name),
+		"IsTIFF":      isTIFF(name),
+		"IsVideo":     isVideo(name),
 		"IsPDF":       hasSuffix(name, ".pdf"),
+		"IsRAW":       isRAW(name),
+		"Folder":      parentFolder(name),
+		"LoggedIn":    currentUser(r) != "",
+		"Version":     "",
+	}
+	if currentUser(r) != "" {
+		data["Albums"] = albumChoices()
+		data["Shares"] = sharesFor(name)
+	}
+	if e, ok := casLookup(name); casMode && ok { data["Version"] = e.Hash }
+	meta, _ := readSidecar(r.Context(), name)
+	data["Meta"] = meta
+	// Big or rotated photos are shown from a preview, see preview.go
+	data["PreviewURL"] = ""
+	orientation := 0
+	if meta.EXIF != nil { orientation = meta.EXIF.Orientation }
+	if attrs != nil && wantsPreview(name, attrs.Size, orientation) {
+		data["PreviewURL"] = appURL("/preview/" + name)
+		if data["Version"] != "" { data["PreviewURL"] = data["PreviewURL"].(string) + "?v=" + data["Version"].(string) }
+	}
+	// "Load original" of a rotated JPEG loads it upright at full size
+	data["OriginalURL"] = appURL("/view/" + name + "?raw=true")
+	if needsUpright(name, orientation) { data["OriginalURL"] = appURL("/preview/" + name + "?full=1") }
+	data["CaptureInput"] = ""
+	if meta.CaptureTime != nil { data["CaptureInput"] = meta.CaptureTime.Local().Format("2006-01-02T15:04") }
+	data["LocationInput"] = ""
+	if meta.Location != nil { data["LocationInput"] = fmt.Sprintf("%.5f, %.5f", meta.Location.Lat, meta.Location.Lon) }
+
+	// Large videos stream as HLS; others browsers can't play are shown from
+	// their MP4 rendition
+	data["PlayURL"] = appURL("/view/" + name + "?raw=true")
+	if data["Version"] != "" { data["PlayURL"] = data["PlayURL"].(string) + "&v=" + data["Version"].(string) }
+	data["PlayType"] = detectContentType(name)
+	data["HLSURL"] = ""
+	data["Transcoding"] = ""
+	if attrs != nil && wantsHLS(name, attrs.Size) {
+		ready, state := transcodes.Prepare(r, name, renditionHLS)
+		if ready {
+			data["HLSURL"] = appURL("/hls/" + name + "/index.m3u8")
+		} else if needsTranscode(name) {
+			data["Transcoding"] = state
+		}
+	} else if needsTranscode(name) {
+		ready, state := transcodes.Prepare(r, name, renditionMP4)
+		if ready {
+			data["PlayURL"], data["PlayType"] = appURL("/transcoded/"+name), "video/mp4"
+		} else {
+			data["Transcoding"] = state
+		}
 	}
+	data["Editable"] = currentUser(r) != "" && isEditable(name)
+
+	// Notes, Markdown and code are shown as text, see textpreview.go
+	data["IsText"] = false
+	if isText(name) && attrs != nil {
+		if text, truncated, ok := readTextPreview(r.Context(), storageKey(name)); ok {
+			data["IsText"], data["Text"], data["TextTruncated"], data["TextLanguage"] = true, text, truncated, textLanguage(name)
+		}
+	}
+	_, _, versioned := versionsOf(storageKey(name))
+	data["Versioned"] = currentUser(r) != "" && versioned && !casMode
+	liveViewerData(r, name, data)
 	tpls.ExecuteTemplate(w, "view.html", data)
 }
 
+// downloadHandler sends the original as an attachment. HEAD, Range and
+// If-Modified-Since are answered by http.ServeContent from the stored
+// attributes, so only the requested bytes are read from storage.
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/download/")
-	obj := bkt.Object(name)
-	rc := obj.NewReader(context.Background())
-	defer rc.Close()
-	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(name))
-	io.Copy(w, rc)
+	if !isLibraryFile(name) { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	key, attrs, ok := statOriginal(w, r, name)
+	if !ok { return }
+	if redirectDownload(w, r, name, key, attrs) { return }
+	body := &objectReadSeeker{ ctx: r.Context(), key: key, size: attrs.Size }
+	defer body.Close()
+
+	w.Header().Set("Content-Type", detectContentType(name))
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(name)))
+	setETag(w, attrs)
+	http.ServeContent(w, r, name, attrs.Modified, body)
+}
+
+// setETag tags a response with the original's SHA1 (or, on backends without
+// one, its version), which http.ServeContent matches If-None-Match and
+// If-Range against, next to the Last-Modified it derives from the modtime.
+func setETag(w http.ResponseWriter, attrs *objectAttrs) {
+	w.Header().Set("ETag", `"`+sourceVersion(attrs)+`"`)
+}
+
+// contentDisposition builds a Content-Disposition header that keeps unicode
+// file names intact: an ASCII fallback for old clients plus the RFC 5987
+// filename* form.
+func contentDisposition(disposition, filename string) string {
+	fallback := strings.Map(func(c rune) rune {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' { return '_' }
+		return c
+	}, filename)
+	v := disposition + `; filename="` + fallback + `"`
+	if fallback == filename { return v }
+
+	const attrChars = "!#$&+-.^_`|~"
+	var enc strings.Builder
+	for _, b := range []byte(filename) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte(attrChars, b) >= 0 {
+			enc.WriteByte(b)
+		} else {
+			fmt.Fprintf(&enc, "%%%02X", b)
+		}
+	}
+	return v + "; filename*=UTF-8''" + enc.String()
 }
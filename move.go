@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== MOVE / RENAME ==========
+// POST /move  from=<name> to=<name or folder/>
+//
+// B2 has no rename, so the original (then thumbnail and sidecar) is copied
+// to the new key and only once everything is in place is the old object
+// deleted. If any required step fails, the copies made so far are removed
+// again and the old name is left untouched. In CAS mode names live in the DB,
+// so a move is just a DB update plus the sidecar.
+
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	from := strings.Trim(r.FormValue("from"), "/")
+	to := r.FormValue("to")
+	// "photos/2023/" means "into that folder, same file name"
+	if strings.HasSuffix(to, "/") || to == "" { to = path.Join(to, path.Base(from)) }
+	to = strings.Trim(path.Clean("/"+to), "/")
+
+	status := 200
+	var err error
+	if user := currentUser(r); !canRead(user, from) || !canRead(user, to) {
+		// Out of or into a folder closed to the user: it isn't there for them
+		err = moveError{ 404, "not found" }
+	} else {
+		// A move is copy then delete; stopping halfway would leave both copies
+		err = moveFile(context.WithoutCancel(r.Context()), from, to)
+	}
+	if err != nil {
+		status = http.StatusBadGateway
+		if me, ok := err.(moveError); ok { status = me.status }
+		log.Printf("Move %s -> %s failed: %v", from, to, err)
+	} else {
+		log.Printf("🚚 Moved %s -> %s", from, to)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if err != nil { writeJSON(w, status, map[string]string{ "error": err.Error() }); return }
+		writeJSON(w, 200, map[string]string{ "name": to })
+		return
+	}
+	if err != nil { http.Error(w, err.Error(), status); return }
+	http.Redirect(w, r, "/viewer/"+to, http.StatusSeeOther)
+}
+
+// moveError is a failure caused by the request rather than by B2.
+type moveError struct {
+	status int
+	msg    string
+}
+
+func (e moveError) Error() string { return e.msg }
+
+func moveFile(ctx context.Context, from, to string) error {
+	if from == "" || to == "" || !isLibraryFile(from) || !isLibraryFile(to) { return moveError{ 400, "invalid name" } }
+	if from == to { return nil }
+	if _, ok := apiStat(ctx, to); ok { return moveError{ 409, to + " already exists" } }
+
+	if casMode {
+		if e, ok := casLookup(from); ok {
+			if err := casPut(to, e); err != nil { return err }
+			if err := moveSidecar(ctx, from, to); err != nil { dbDelete("cas_names", to); return err }
+			dbDelete("cas_names", from)
+			renameRefs(from, to)
+			return nil
+		}
+	}
+
+	if !objectExists(ctx, from) { return moveError{ 404, from + " not found" } }
+	if err := moveObjects(ctx, from, to); err != nil { return err }
+	renameRefs(from, to)
+	return nil
+}
+
+// moveObjects moves a by-name original with its thumbnail and sidecar,
+// rolling back on failure. DB references are the caller's business.
+func moveObjects(ctx context.Context, from, to string) error {
+	// 1. Original
+	var created []string
+	rollback := func(err error) error {
+		for _, key := range created {
+			if derr := store.Delete(ctx, key); derr != nil { log.Printf("Move rollback: %s left behind: %v", key, derr) }
+		}
+		return err
+	}
+	if err := copyObject(ctx, from, to); err != nil { return rollback(fmt.Errorf("copy failed: %w", err)) }
+	created = append(created, to)
+
+	// 2. Thumbnail: copy it, or render a fresh one. Not worth failing over.
+	oldThumb, newThumb := getThumbPath(from), getThumbPath(to)
+	if err := copyObject(ctx, oldThumb, newThumb); err == nil {
+		created = append(created, newThumb)
+	} else if isThumbable(to) {
+		if data, err := buildThumbnail(ctx, to, thumbWidth, false); err == nil {
+			version := ""
+			if attrs, err := store.Attrs(ctx, to); err == nil { version = sourceVersion(attrs) }
+			if writeThumb(ctx, newThumb, data, version) == nil { created = append(created, newThumb) }
+		}
+	}
+
+	// Rendition (if any) comes along; it can always be made again
+	if needsTranscode(from) && needsTranscode(to) {
+		if err := copyObject(ctx, transcodedKey(from), transcodedKey(to)); err == nil { created = append(created, transcodedKey(to)) }
+	}
+
+	// 3. Sidecar
+	if objectExists(ctx, sidecarKey(from)) {
+		if err := copyObject(ctx, sidecarKey(from), sidecarKey(to)); err != nil { return rollback(fmt.Errorf("sidecar copy failed: %w", err)) }
+		created = append(created, sidecarKey(to))
+	}
+
+	// 4. Everything is in place: drop the old name, every version of it, or
+	// an overwritten file would turn up at its old path again
+	if err := deleteForGood(ctx, from); err != nil { return rollback(fmt.Errorf("delete failed: %w", err)) }
+	for _, key := range []string{ oldThumb, sidecarKey(from), transcodedKey(from), previewKey(from), uprightKey(from) } {
+		if !objectExists(ctx, key) { continue }
+		if err := deleteForGood(ctx, key); err != nil { log.Printf("Move %s: stale %s left behind: %v", from, key, err) }
+	}
+	thumbs.Remove(oldThumb)
+	// Other sizes and formats are rendered again on demand
+	removeThumbVariants(ctx, from)
+	for _, f := range knownAnimFormats { deleteIfExists(ctx, animKey(from, f)) }
+	// HLS segments are too many to copy; they're cut again on the next view
+	if isVideo(from) { deleteHLS(ctx, from) }
+	return nil
+}
+
+// copyObject streams src to dst, keeping content type and file info (so
+// large_file_sha1 and src_version carry over).
+func copyObject(ctx context.Context, src, dst string) error {
+	attrs, err := store.Attrs(ctx, src)
+	if err != nil { return err }
+	out := objectAttrs{ ContentType: attrs.ContentType, Info: attrs.Info }
+	if attrs.SHA1 != "none" { out.SHA1 = attrs.SHA1 }
+
+	rc, err := getObject(ctx, src)
+	if err != nil { return err }
+	defer rc.Close()
+	return store.Put(ctx, dst, rc, out)
+}
+
+func moveSidecar(ctx context.Context, from, to string) error {
+	if !objectExists(ctx, sidecarKey(from)) { return nil }
+	if err := copyObject(ctx, sidecarKey(from), sidecarKey(to)); err != nil { return err }
+	if err := deleteForGood(ctx, sidecarKey(from)); err != nil { log.Printf("Move %s: stale sidecar left behind: %v", from, err) }
+	return nil
+}
+
+// refsMu serializes read-modify-write updates of DB references, which batch
+// operations make from several goroutines at once.
+var refsMu sync.Mutex
+
+// renameRefs points DB references (catalog, owners, shares, tags, map,
+// capture dates, weather, covers, albums, journal) at the new name.
+func renameRefs(from, to string) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+	catalogRename(from, to)
+	renameOwner(from, to)
+	forEachShare(from, func(s shareLink) { s.Name = to; dbPut("shares", s.ID, s) })
+
+	var tags tagEntry
+	if found, _ := dbGet("tags", from, &tags); found {
+		dbPut("tags", to, tags)
+		dbDelete("tags", from)
+	}
+	var at geoPoint
+	if found, _ := dbGet("geo", from, &at); found {
+		dbPut("geo", to, at)
+		dbDelete("geo", from)
+	}
+	var taken time.Time
+	if found, _ := dbGet("taken", from, &taken); found {
+		dbPut("taken", to, taken)
+		dbDelete("taken", from)
+	}
+	var caption string
+	if found, _ := dbGet("captions", from, &caption); found {
+		dbPut("captions", to, caption)
+		dbDelete("captions", from)
+	}
+	var details fileDetails
+	if found, _ := dbGet("details", from, &details); found {
+		dbPut("details", to, details)
+		dbDelete("details", from)
+	}
+	var video videoInfo
+	if found, _ := dbGet("videos", from, &video); found {
+		dbPut("videos", to, video)
+		dbDelete("videos", from)
+	}
+
+	var rec weatherRecord
+	if found, _ := dbGet("weather", from, &rec); found {
+		rec.Name = to
+		dbPut("weather", to, rec)
+		dbDelete("weather", from)
+	}
+
+	folder := path.Dir(from)
+	if folder == "." { folder = "" }
+	var cover string
+	if found, _ := dbGet("covers", folder, &cover); found && cover == from {
+		// A rename within the folder keeps it as the cover
+		if parentFolder(to) == folder { dbPut("covers", folder, to) } else { dbDelete("covers", folder) }
+	}
+
+	for _, a := range allAlbums() {
+		if i := slices.Index(a.Items, from); i >= 0 {
+			a.Items[i] = to
+			if a.Cover == from { a.Cover = to }
+			saveAlbum(a)
+		}
+	}
+	for _, e := range journalEntries("", "") {
+		if i := slices.Index(e.Photos, from); i >= 0 {
+			e.Photos[i] = to
+			dbPut("journal", e.ID, e)
+		}
+	}
+}
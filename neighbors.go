@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== VIEWER NEIGHBORS ==========
+// The viewer steps through a folder with the arrow keys. It asks
+// GET /api/v1/neighbors/{name}?sort=&type=&view= which files come before and
+// after name, in the order and under the filters of the folder page it was
+// opened from (the grid passes its query on), skipping what the user
+// can't read and the videos of live photos, as the grid does. Each neighbor
+// carries the URL its viewer page shows, so the page can prefetch both.
+//
+// Any order is read from the catalog. Until it is built only name order
+// works, by listing the folder up to the file and one past it; other orders
+// answer 503.
+
+// apiNeighbor is a file next to the one being viewed.
+type apiNeighbor struct {
+	apiFile
+	ViewerURL  string `json:"viewer_url"`
+	DisplayURL string `json:"display_url,omitempty"` // the image its viewer shows, if any
+}
+
+func neighborsHandler(w http.ResponseWriter, r *http.Request, name string) {
+	if !isLibraryFile(name) { apiError(w, 404, "not found"); return }
+	sortBy, kind := listOrder(r)
+	view := listView(r)
+	if (sortBy != "name" || kind != "all" || needsCatalog(view)) && !catalogReady() { apiError(w, http.StatusServiceUnavailable, "index is still being built"); return }
+	files, err := folderOrder(r.Context(), currentUser(r), name, sortBy, kind, view)
+	if err != nil { apiError(w, 502, "listing failed"); return }
+	at := -1
+	for i, f := range files {
+		if f["Name"] == name { at = i; break }
+	}
+	if at < 0 { apiError(w, 404, "not in this folder's listing"); return }
+
+	query := orderQuery(viewQuery(view), sortBy, kind, 0)
+	resp := map[string]any{ "name": name, "sort": sortBy, "type": kind, "view": view, "prev": nil, "next": nil }
+	if catalogReady() { resp["position"], resp["total"] = at+1, len(files) }
+	if at > 0 { resp["prev"] = neighbor(r.Context(), files[at-1], query) }
+	if at+1 < len(files) { resp["next"] = neighbor(r.Context(), files[at+1], query) }
+	writeJSON(w, 200, resp)
+}
+
+// folderOrder lists the files of name's folder that user sees in view,
+// ordered by sortBy. Without the catalog (name order only) it stops one past
+// name.
+func folderOrder(ctx context.Context, user, name, sortBy, kind, view string) ([]map[string]any, error) {
+	prefix := keyPrefix
+	if folder := parentFolder(name); folder != "" { prefix = folder + "/" }
+	var l folderListing
+	if catalogReady() {
+		l, _ = catalogSortedPage(prefix, sortBy, kind, view, 0, math.MaxInt)
+	} else {
+		start, found := "", false
+		for {
+			page, next, err := listPage(ctx, prefix, start, 1000)
+			if err != nil { return nil, err }
+			for _, f := range page.Files {
+				l.Files = append(l.Files, f)
+				if found { return pairedFiles(user, filterView(l, view), kind), nil }
+				found = f["Name"] == name
+			}
+			if next == "" { break }
+			start = next
+		}
+		l = filterView(l, view)
+	}
+	return pairedFiles(user, l, kind), nil
+}
+
+// pairedFiles is what the folder grid shows of l's files.
+func pairedFiles(user string, l folderListing, kind string) []map[string]any {
+	files := visibleListing(user, l).Files
+	if kind != "video" { files = pairLivePhotos(files) }
+	return files
+}
+
+func neighbor(ctx context.Context, f map[string]any, query string) apiNeighbor {
+	n := apiNeighbor{ apiFile: apiFileFrom(f) }
+	n.ViewerURL = appURL("/viewer/" + n.Name + query)
+	if !thumbnailer.IsImage(n.Name) && !isSVG(n.Name) && !isRAW(n.Name) { return n }
+	orientation := 0
+	if meta, ok := readSidecar(ctx, n.Name); ok && meta.EXIF != nil { orientation = meta.EXIF.Orientation }
+	if wantsPreview(n.Name, n.Size, orientation) {
+		n.DisplayURL = appURL("/preview/" + n.Name)
+	} else {
+		n.DisplayURL = n.ViewURL
+		if casMode { n.DisplayURL += "&v=" + n.Version }
+	}
+	return n
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// ========== MISSING FILES ==========
+// /view/, /viewer/, /download/ and /thumb/ look the name up before serving
+// anything, so a link to a file that was moved, deleted or never existed gets
+// a 404 page (pointing at its folder, a search for it and, for the signed in,
+// the trash if that's where it went) instead of a 500 or a hung response.
+// Storage being unreachable is a 502 rather than a 404.
+
+// statOriginal looks up the object behind name. When it can't be served the
+// response has been written and ok is false.
+func statOriginal(w http.ResponseWriter, r *http.Request, name string) (key string, attrs *objectAttrs, ok bool) {
+	key = storageKey(name)
+	attrs, err := store.Attrs(r.Context(), key)
+	if err != nil {
+		storageFailure(w, r, name, err)
+		return key, nil, false
+	}
+	return key, attrs, true
+}
+
+// storageFailure answers a failed lookup: 404 for a missing object, 502
+// otherwise.
+func storageFailure(w http.ResponseWriter, r *http.Request, name string, err error) {
+	if isNotFound(err) { missingFile(w, r, name); return }
+	log.Printf("Storage lookup %s failed: %v", name, err)
+	errorPage(w, r, http.StatusBadGateway, "The storage backend didn't answer. Try again in a moment.")
+}
+
+func missingFile(w http.ResponseWriter, r *http.Request, name string) {
+	folder := parentFolder(name)
+	folderURL := appURL("/")
+	if folder != "" { folderURL = appURL("/browse/" + pathURL(folder) + "/") }
+	var trashed any
+	if currentUser(r) != "" {
+		for _, it := range trashItems() {
+			if it.Name == name { trashed = it.Deleted; break }
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNotFound)
+	tpls.ExecuteTemplate(w, "notfound.html", map[string]any{
+		"BucketName": bktName,
+		"Name":       name,
+		"Folder":     folder,
+		"FolderURL":  folderURL,
+		"SearchURL":  appURL("/search?q=" + url.QueryEscape(path.Base(name))),
+		"Trashed":    trashed,
+	})
+}
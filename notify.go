@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== UPLOAD NOTIFICATIONS ==========
+// New files can be announced to webhooks and by email:
+//
+//	NOTIFY_WEBHOOKS=https://a,https://b  POST a JSON summary to each URL
+//	NOTIFY_WEBHOOK_SECRET=s              sign it: X-Memories-Signature is
+//	                                     "sha256=" + hex HMAC of the body
+//	NOTIFY_EMAIL_TO=a@x,b@y              mail a summary (SMTP_* as for alerts)
+//
+// Uploads are gathered for NOTIFY_DELAY (default 1m) after the first one and
+// go out together, so a folder of 200 photos is one notification rather than
+// 200, whether it came through the upload page, the API, chunked uploads or
+// WebDAV. Pending uploads are sent right away on shutdown.
+
+type uploadNotice struct {
+	Name     string    `json:"name"`
+	Size     string    `json:"size,omitempty"`
+	SHA1     string    `json:"sha1,omitempty"`
+	User     string    `json:"user,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	ThumbURL string    `json:"thumb_url,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+type uploadNotifier struct {
+	mu      sync.Mutex
+	pending []uploadNotice
+}
+
+var notifier = &uploadNotifier{}
+
+func notifyEnabled() bool {
+	return os.Getenv("NOTIFY_WEBHOOKS") != "" || os.Getenv("NOTIFY_EMAIL_TO") != ""
+}
+
+// notifyUploads queues the files stored by an upload for the next
+// notification. origin ("https://host") makes the links absolute.
+func notifyUploads(origin, user string, results ...uploadResult) {
+	if !notifyEnabled() { return }
+	var notices []uploadNotice
+	for _, res := range results {
+		if res.Error != "" || res.Skipped { continue }
+		n := uploadNotice{ Name: res.Name, Size: res.Size, SHA1: res.SHA1, User: user, Uploaded: time.Now() }
+		if origin != "" {
+			n.URL = origin + "/viewer/" + pathURL(res.Name)
+			if isThumbable(res.Name) { n.ThumbURL = origin + "/thumb/" + pathURL(res.Name) }
+		}
+		notices = append(notices, n)
+	}
+	if len(notices) > 0 { notifier.Add(notices) }
+}
+
+// Add queues notices, starting the NOTIFY_DELAY wait if none were pending.
+func (n *uploadNotifier) Add(notices []uploadNotice) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) == 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			select {
+			case <-time.After(envDuration("NOTIFY_DELAY", time.Minute)):
+			case <-shutdownCtx.Done():
+			}
+			n.flush()
+		}()
+	}
+	n.pending = append(n.pending, notices...)
+}
+
+func (n *uploadNotifier) flush() {
+	n.mu.Lock()
+	notices := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(notices) == 0 { return }
+
+	var uploaders, folders []string
+	for _, u := range notices {
+		if u.User != "" && !slices.Contains(uploaders, u.User) { uploaders = append(uploaders, u.User) }
+		if f := parentFolder(u.Name); !slices.Contains(folders, f) { folders = append(folders, f) }
+	}
+	for _, url := range splitList(os.Getenv("NOTIFY_WEBHOOKS")) {
+		if err := postWebhook(url, map[string]any{ "event": "upload", "count": len(notices), "users": uploaders, "folders": folders, "files": notices }); err != nil {
+			log.Printf("⚠️ Upload webhook %s: %v", url, err)
+		}
+	}
+	if to := os.Getenv("NOTIFY_EMAIL_TO"); to != "" {
+		subject, body := uploadSummary(notices, uploaders, folders)
+		if err := sendEmailTo(to, subject, body); err != nil { log.Println("⚠️ Upload email failed:", err) }
+	}
+	log.Printf("📣 Announced %d upload(s)", len(notices))
+}
+
+var webhookClient = &http.Client{ Timeout: 15 * time.Second }
+
+func postWebhook(url string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil { return err }
+	ctx, cancel := context.WithTimeout(context.Background(), webhookClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "memories")
+	if secret := os.Getenv("NOTIFY_WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(data)
+		req.Header.Set("X-Memories-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil { return err }
+	resp.Body.Close()
+	if resp.StatusCode >= 300 { return fmt.Errorf("status %s", resp.Status) }
+	return nil
+}
+
+// uploadSummaryLimit caps the files listed in an email.
+const uploadSummaryLimit = 25
+
+func uploadSummary(notices []uploadNotice, uploaders, folders []string) (subject, body string) {
+	for i, f := range folders {
+		if f == "" { folders[i] = "the library root" }
+	}
+	if len(notices) == 1 {
+		subject = "memories: new file " + notices[0].Name
+	} else {
+		subject = fmt.Sprintf("memories: %d new files", len(notices))
+	}
+	var b strings.Builder
+	who := "Someone"
+	if len(uploaders) > 0 { who = strings.Join(uploaders, ", ") }
+	fmt.Fprintf(&b, "%s added %d file(s) to %s.\n\n", who, len(notices), strings.Join(folders, ", "))
+	for i, u := range notices {
+		if i == uploadSummaryLimit {
+			fmt.Fprintf(&b, "... and %d more\n", len(notices)-i)
+			break
+		}
+		fmt.Fprintf(&b, "%s (%s)\n", u.Name, u.Size)
+		if u.URL != "" { fmt.Fprintf(&b, "  %s\n", u.URL) }
+	}
+	return subject, b.String()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// ========== RECENTLY ADDED & ON THIS DAY ==========
+// The library root's first page opens with two strips: the newest uploads
+// (RECENT_COUNT, default 12, from the catalog) and "On this day", the photos
+// and videos captured on today's date in earlier years, one row per year
+// (ON_THIS_DAY_COUNT per year, default 12), each with the journal entries
+// written for that date (journal.go). Capture dates come from the "taken"
+// index, so files without one never show up there; on 28 February of a
+// non-leap year, 29 February counts too. Hidden files (hidden.go) are left
+// out of both.
+
+// recentlyAdded returns the n newest media files user may see.
+func recentlyAdded(user string, n int) []map[string]any {
+	if n <= 0 { return nil }
+	marks := loadViewMarks()
+	var newest []catalogEntry // newest first, at most n
+	dbEach("catalog", func(_ string, data []byte) error {
+		var e catalogEntry
+		if json.Unmarshal(data, &e) != nil || !isThumbable(e.Name) || !isLibraryFile(e.Name) { return nil }
+		if len(newest) == n && !e.Modified.After(newest[n-1].Modified) { return nil }
+		if !canRead(user, e.Name) || marks.hides(e.Name) { return nil }
+		i, _ := slices.BinarySearchFunc(newest, e, func(a, b catalogEntry) int { return b.Modified.Compare(a.Modified) })
+		newest = slices.Insert(newest, i, e)
+		if len(newest) > n { newest = newest[:n] }
+		return nil
+	})
+	var files []map[string]any
+	for _, e := range newest { files = append(files, e.fileEntry()) }
+	return files
+}
+
+// onThisDayPhotos groups the media user may see that was captured on now's month
+// and day in earlier years, and the journal entries of those days, newest
+// year first. A year with only entries or only photos gets a group too.
+func onThisDayPhotos(user string, now time.Time, perYear int) []map[string]any {
+	leapDay := now.Month() == time.February && now.Day() == 28 && time.Date(now.Year(), time.February, 29, 0, 0, 0, 0, time.Local).Day() != 29
+	sameDay := func(t time.Time) bool {
+		if t.Month() != now.Month() { return false }
+		return t.Day() == now.Day() || leapDay && t.Day() == 29
+	}
+
+	marks := loadViewMarks()
+	byYear := map[int][]catalogEntry{}
+	taken := map[string]time.Time{}
+	for name, t := range takenTimes() {
+		if t.Year() >= now.Year() || !sameDay(t) || !isThumbable(name) || !canRead(user, name) || marks.hides(name) { continue }
+		var e catalogEntry
+		if found, _ := dbGet("catalog", name, &e); !found { continue }
+		byYear[t.Year()] = append(byYear[t.Year()], e)
+		taken[name] = t
+	}
+	journal := map[int][]journalEntry{}
+	for _, e := range readableJournal(user, onThisDay(now)) {
+		t, _ := time.Parse("2006-01-02", e.Date)
+		journal[t.Year()] = append(journal[t.Year()], e)
+	}
+
+	var years []int
+	for y := range byYear { years = append(years, y) }
+	for y := range journal {
+		if _, ok := byYear[y]; !ok { years = append(years, y) }
+	}
+	slices.Sort(years)
+	slices.Reverse(years)
+
+	var groups []map[string]any
+	for _, y := range years {
+		entries := byYear[y]
+		slices.SortFunc(entries, func(a, b catalogEntry) int { return taken[a.Name].Compare(taken[b.Name]) })
+		var files []map[string]any
+		for _, e := range entries[:min(len(entries), perYear)] { files = append(files, e.fileEntry()) }
+		groups = append(groups, map[string]any{ "Years": now.Year() - y, "Year": y, "Files": files, "More": len(entries) - len(files), "Journal": journal[y] })
+	}
+	return groups
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ========== AUTO-ORGANIZE BY DATE ==========
+// An upload sent with organize=date (a form field, or "organize" in a
+// resumable upload) goes into a dated folder under the one it was sent to,
+// by the capture date in its EXIF: a photo taken in July 2023 sent to trips
+// lands in trips/2023/07. ORGANIZE_LAYOUT is the folder as a Go time layout
+// (default 2006/01). UPLOAD_ORGANIZE=date makes it the default for uploads
+// that don't say, so the API and sync clients follow the same policy without
+// changes; organize=none opts out.
+//
+// Only files EXIF is read from (JPEG, TIFF, RAW) have a date to go by; the
+// rest, and photos without one, stay where they were sent. The date is only
+// known once the bytes are in, so these uploads are spooled first and the
+// collision policy is applied to the dated name. A file already in its dated
+// folder isn't moved down another level, so re-uploading an organized tree
+// keeps its shape. Direct-to-B2 uploads are named before the server sees
+// any bytes and are not organized.
+
+// organizePolicy reads the organize field, falling back to UPLOAD_ORGANIZE.
+func organizePolicy(field string) (string, error) {
+	if field == "" { field = os.Getenv("UPLOAD_ORGANIZE") }
+	switch field {
+	case "", "none": return "none", nil
+	case "date": return "date", nil
+	}
+	return "", fmt.Errorf("organize must be date or none")
+}
+
+// organizeDefault reports whether uploads are organized unless they say.
+func organizeDefault() bool {
+	policy, _ := organizePolicy("")
+	return policy == "date"
+}
+
+// organizeByDate reports whether name, uploaded under the organize policy
+// given, is to be put into a dated folder once its bytes are in.
+func organizeByDate(field, name string) (bool, error) {
+	policy, err := organizePolicy(field)
+	return policy == "date" && hasEXIF(name), err
+}
+
+// datedName is where name goes by the capture date of its bytes (in local),
+// or name itself when they have none.
+func datedName(name, local string) string {
+	info, ok := readEXIF(local)
+	if !ok || info.Taken == nil { return name }
+	layout := os.Getenv("ORGANIZE_LAYOUT")
+	if layout == "" { layout = "2006/01" }
+	dated := info.Taken.Format(layout)
+	folder := parentFolder(name)
+	if folder == dated || strings.HasSuffix(folder, "/"+dated) { return name }
+	organized, err := cleanUploadName(folder, path.Join(dated, path.Base(name)))
+	if err != nil { return name }
+	return organized
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// ========== PAGED LISTING ==========
+// Pages come from one Storage.List call each (on B2 that's one
+// b2_list_file_names request with names, sizes, SHA1s and timestamps), so no
+// per-object Attrs calls are needed and a page costs the same no matter how
+// large the bucket is.
+//
+// The cursor is just the first name of the page. Since names are all that's
+// needed, DB-only names (CAS mode) merge into the same ordered stream. Once
+// the catalog is built, pages come from it instead, with the same cursors.
+
+// pageToken is the opaque ?page= value: where this page starts, plus the
+// starts of earlier pages so "Previous" works without listing backwards.
+type pageToken struct {
+	Start string   `json:"s,omitempty"`
+	Back  []string `json:"b,omitempty"`
+}
+
+// maxBack caps how many earlier pages a token remembers (URL length).
+const maxBack = 50
+
+func (t pageToken) encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(s string) pageToken {
+	var t pageToken
+	if data, err := base64.RawURLEncoding.DecodeString(s); err == nil { json.Unmarshal(data, &t) }
+	return t
+}
+
+// next returns the token for the page starting at start.
+func (t pageToken) next(start string) string {
+	back := append(append([]string{}, t.Back...), t.Start)
+	if len(back) > maxBack { back = back[len(back)-maxBack:] }
+	return pageToken{ Start: start, Back: back }.encode()
+}
+
+// prev returns the token for the previous page, or "" on the first page.
+func (t pageToken) prev() (string, bool) {
+	if len(t.Back) == 0 { return "", t.Start != "" }
+	last := len(t.Back) - 1
+	return pageToken{ Start: t.Back[last], Back: t.Back[:last] }.encode(), true
+}
+
+// listPage lists one page of the level under prefix starting at start. It
+// returns the name the next page starts at, or "" if this is the last one.
+func listPage(ctx context.Context, prefix, start string, size int) (folderListing, string, error) {
+	if catalogReady() {
+		l, next := catalogPage(prefix, start, size)
+		return l, next, nil
+	}
+	var l folderListing
+	type item struct {
+		name  string
+		entry map[string]any // nil for folders
+	}
+	var items []item
+
+	files, storeNext, err := store.List(ctx, prefix, "/", start, size)
+	if err != nil { return l, "", err }
+	for i := range files {
+		f := &files[i]
+		if f.Folder {
+			folder := strings.TrimSuffix(f.Name, "/")
+			if isInternalFolder(folder) { continue }
+			items = append(items, item{ name: f.Name })
+			continue
+		}
+		// Sidecars ("x.jpg.json") are shown in the viewer of their original
+		if isSidecar(f.Name) { continue }
+		items = append(items, item{ f.Name, fileEntry(f.Name, f.Size, f.Modified, sourceVersion(f)) })
+	}
+
+	// Content-addressed names only exist in the DB
+	if casMode {
+		entries, names := casEntries()
+		seen := map[string]bool{}
+		for _, it := range items { seen[it.name] = true }
+		taken := 0
+		for _, name := range names {
+			if name < start || !strings.HasPrefix(name, prefix) { continue }
+			if taken > size { break }
+			rest := strings.TrimPrefix(name, prefix)
+			if top, _, nested := strings.Cut(rest, "/"); nested {
+				if folder := prefix + top + "/"; !seen[folder] && folder >= start {
+					seen[folder] = true
+					items = append(items, item{ name: folder })
+					taken++
+				}
+				continue
+			}
+			e := entries[name]
+			items = append(items, item{ name, fileEntry(name, e.Size, e.Uploaded, e.Hash) })
+			taken++
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	}
+
+	// Everything past the store's continuation belongs to a later page, otherwise
+	// DB names beyond it would be shown twice.
+	next := storeNext
+	if next != "" {
+		cut := sort.Search(len(items), func(i int) bool { return items[i].name >= next })
+		items = items[:cut]
+	}
+	if len(items) > size {
+		next = items[size].name
+		items = items[:size]
+	}
+
+	for _, it := range items {
+		if it.entry == nil {
+			l.Folders = append(l.Folders, strings.TrimSuffix(it.name, "/"))
+		} else {
+			l.Files = append(l.Files, it.entry)
+		}
+	}
+	return l, next, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== PREVIEWS ==========
+// The viewer doesn't load big originals: it shows a JPEG preview at most
+// PREVIEW_WIDTH (default 2048) px on its long side, rendered on first view
+// and stored under preview/ until the original changes, with a "Load
+// original" button for the full file. Previews are made for
+//
+//	RAWs   always, since a browser can't show them at all (see raw.go;
+//	       RAW_PREVIEW_WIDTH overrides the width)
+//	TIFFs  always, since only Safari shows them
+//	JPEGs  over PREVIEW_MIN_KB (default 1024), or whose EXIF orientation
+//	       isn't 1
+//	BMPs   over PREVIEW_MIN_KB, since they are stored uncompressed
+//
+// Cameras and phones store a portrait shot as landscape pixels plus an EXIF
+// Orientation tag (1 is upright, 2-8 flip and/or rotate). Previews apply it
+// like thumbnails do (imageThumbnail), so photos are upright whatever the
+// browser makes of the tag. For such a JPEG "Load original" loads an upright
+// copy at full size too, rendered on first use and stored under upright/
+// like a preview. /view/ and /download/ still send the original bytes
+// untouched.
+//
+// GET /preview/{name}[?v=version]        the JPEG preview of a RAW, TIFF, JPEG or BMP
+// GET /preview/{name}?full=1[&v=version] the full-size upright copy of a rotated JPEG
+
+// previewKey maps an original's storage key to its JPEG preview. A RAW's
+// drops the extension; a JPEG's keeps it, so a.jpg next to a.cr2 can't clash.
+func previewKey(key string) string {
+	if isRAW(key) { return path.Join("preview", strings.TrimSuffix(key, path.Ext(key))+".jpg") }
+	return path.Join("preview", key) + ".jpg"
+}
+
+// uprightKey maps an original's storage key to its full-size upright copy.
+func uprightKey(key string) string { return path.Join("upright", key) + ".jpg" }
+
+// needsUpright reports whether name's original is shown from an upright
+// copy, given the orientation its EXIF recorded (0 if none).
+func needsUpright(name string, orientation int) bool {
+	return hasSuffix(name, ".jpg", ".jpeg") && orientation > 1 && orientation <= 8
+}
+
+func isTIFF(name string) bool { return hasSuffix(name, ".tif", ".tiff") }
+
+// hasPreview reports whether name is a type previews are made of.
+func hasPreview(name string) bool { return isRAW(name) || isTIFF(name) || hasSuffix(name, ".jpg", ".jpeg", ".bmp") }
+
+// wantsPreview reports whether the viewer shows name from its preview, given
+// the original's size and the orientation its EXIF recorded (0 if none).
+func wantsPreview(name string, size int64, orientation int) bool {
+	if isRAW(name) || isTIFF(name) { return true }
+	if !hasPreview(name) { return false }
+	return size > int64(envInt("PREVIEW_MIN_KB", 1024))<<10 || (orientation > 1 && orientation <= 8)
+}
+
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/preview/")
+	if name == "" || !hasPreview(name) { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	key := storageKey(name)
+	if r.URL.Query().Get("full") == "1" {
+		orientation := 0
+		if meta, ok := readSidecar(r.Context(), name); ok && meta.EXIF != nil { orientation = meta.EXIF.Orientation }
+		if !needsUpright(name, orientation) { http.NotFound(w, r); return }
+		serveDerived(w, r, key, uprightKey(key), "image/jpeg", func(ctx context.Context) ([]byte, error) {
+			log.Printf("Rendering upright copy: %s", name)
+			return renderPhoto(ctx, key, 0, envInt("UPRIGHT_QUALITY", 92))
+		})
+		return
+	}
+	serveDerived(w, r, key, previewKey(key), "image/jpeg", func(ctx context.Context) ([]byte, error) {
+		if !isRAW(name) {
+			log.Printf("Rendering preview: %s", name)
+			return renderPhoto(ctx, key, envInt("PREVIEW_WIDTH", 2048), envInt("PREVIEW_QUALITY", 85))
+		}
+		rc, err := getObject(ctx, key)
+		if err != nil { return nil, fmt.Errorf("download failed: %w", err) }
+		defer rc.Close()
+		log.Printf("Rendering RAW preview: %s", name)
+		return thumbnailer.GenerateThumbnail(ctx, rc, name, thumbnailer.Options{ Width: envInt("RAW_PREVIEW_WIDTH", envInt("PREVIEW_WIDTH", 2048)) })
+	})
+}
+
+// renderPhoto decodes the photo at key upright and scales it down to fit
+// width (0 keeps its size). It takes a THUMB_WORKERS slot, since a decoded
+// photo is large.
+func renderPhoto(ctx context.Context, key string, width, quality int) ([]byte, error) {
+	if err := acquireThumbSlot(ctx); err != nil { return nil, err }
+	defer releaseThumbSlot()
+	rc, err := getObject(ctx, key)
+	if err != nil { return nil, fmt.Errorf("download failed: %w", err) }
+	defer rc.Close()
+
+	img, err := imaging.Decode(rc, imaging.AutoOrientation(true))
+	if err != nil { return nil, fmt.Errorf("decode failed: %w", err) }
+	if b := img.Bounds(); width > 0 && (b.Dx() > width || b.Dy() > width) { img = imaging.Fit(img, width, width, imaging.Lanczos) }
+	buf := new(bytes.Buffer)
+	if err := imaging.Encode(buf, img, imaging.JPEG, imaging.JPEGQuality(quality)); err != nil { return nil, err }
+	return buf.Bytes(), nil
+}
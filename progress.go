@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ========== UPLOAD PROGRESS ==========
+// A POST to /upload or /api/v1/files with ?upload_id=<id> (any client-chosen
+// token) is tracked while it runs, and GET /upload/progress/<id> streams its
+// state as server-sent events until it finishes:
+//
+//	data: {"received": 1048576, "total": 52428800, "done": false, "files": [
+//	        {"name": "trip/a.mov", "stage": "storing", "stored": 1048576}]}
+//
+// received/total are request body bytes (total is -1 if the client didn't
+// say); each file goes receiving (spooled to disk, content-addressed or
+// duplicate-checked uploads only) -> storing (pushed to storage) ->
+// processing (thumbnail, EXIF, catalog) -> done or failed. The state is kept
+// for a minute after the upload ends, so a late subscriber still sees the
+// outcome. Only the user who uploads can follow it; to anyone else the ID
+// isn't there.
+
+type fileProgress struct {
+	name   string
+	stage  atomic.Value // string
+	stored atomic.Int64
+}
+
+type uploadProgress struct {
+	id       string
+	user     string
+	total    int64
+	received atomic.Int64
+	done     atomic.Bool
+
+	mu    sync.Mutex
+	files []*fileProgress
+}
+
+type fileProgressJSON struct {
+	Name   string `json:"name"`
+	Stage  string `json:"stage"`
+	Stored int64  `json:"stored"`
+}
+
+var (
+	uploadsMu      sync.Mutex
+	uploadsRunning = map[string]*uploadProgress{}
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// trackUpload starts tracking r under its ?upload_id=, counting body bytes as
+// they are read. It returns nil (on which every method is a no-op) when the
+// request didn't ask to be tracked; the caller calls finish when done.
+func trackUpload(r *http.Request) *uploadProgress {
+	id := r.URL.Query().Get("upload_id")
+	if !uploadIDPattern.MatchString(id) { return nil }
+	p := &uploadProgress{ id: id, user: currentUser(r), total: r.ContentLength }
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	// Another user's ID stays theirs until it expires
+	if old := uploadsRunning[id]; old != nil && old.user != p.user { return nil }
+	uploadsRunning[id] = p
+	r.Body = &progressBody{ ReadCloser: r.Body, n: &p.received }
+	return p
+}
+
+func (p *uploadProgress) finish() {
+	if p == nil { return }
+	p.done.Store(true)
+	time.AfterFunc(time.Minute, func() {
+		uploadsMu.Lock()
+		if uploadsRunning[p.id] == p { delete(uploadsRunning, p.id) }
+		uploadsMu.Unlock()
+	})
+}
+
+// addFile starts tracking one file of the upload.
+func (p *uploadProgress) addFile(name, stage string) *fileProgress {
+	if p == nil { return nil }
+	f := &fileProgress{ name: name }
+	f.stage.Store(stage)
+	p.mu.Lock()
+	p.files = append(p.files, f)
+	p.mu.Unlock()
+	return f
+}
+
+func (f *fileProgress) setStage(stage string) {
+	if f != nil { f.stage.Store(stage) }
+}
+
+// reader counts what storage reads from r as stored. A temp file stays
+// seekable and readable at offsets, so B2 can still send parts from it in
+// parallel without buffering.
+func (f *fileProgress) reader(r io.Reader) io.Reader {
+	if f == nil { return r }
+	if file, ok := r.(readSeekerAt); ok { return &storedReaderAt{ storedReader{ r, &f.stored }, file } }
+	return &storedReader{ r, &f.stored }
+}
+
+func (p *uploadProgress) MarshalJSON() ([]byte, error) {
+	p.mu.Lock()
+	files := make([]fileProgressJSON, len(p.files))
+	for i, f := range p.files { files[i] = fileProgressJSON{ f.name, f.stage.Load().(string), f.stored.Load() } }
+	p.mu.Unlock()
+	return json.Marshal(map[string]any{ "received": p.received.Load(), "total": p.total, "done": p.done.Load(), "files": files })
+}
+
+type progressBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+type storedReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (s *storedReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n.Add(int64(n))
+	return n, err
+}
+
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+type storedReaderAt struct {
+	storedReader
+	f readSeekerAt
+}
+
+func (s *storedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.f.ReadAt(p, off)
+	s.n.Add(int64(n))
+	return n, err
+}
+
+func (s *storedReaderAt) Seek(offset int64, whence int) (int64, error) { return s.f.Seek(offset, whence) }
+
+// ========== PROGRESS HANDLER ==========
+// GET /upload/progress/{id} sends the state every UPLOAD_PROGRESS_INTERVAL
+// (default 500ms) while it changes. The stream may be opened before the
+// upload starts; it waits up to 30s for it to appear.
+func uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/upload/progress/")
+	if !uploadIDPattern.MatchString(id) { http.NotFound(w, r); return }
+	user := currentUser(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	// Progress streams outlive the server's write timeout on long uploads
+	rc.SetWriteDeadline(time.Time{})
+
+	tick := time.NewTicker(envDuration("UPLOAD_PROGRESS_INTERVAL", 500*time.Millisecond))
+	defer tick.Stop()
+	deadline := time.Now().Add(30 * time.Second)
+	var last []byte
+	for {
+		uploadsMu.Lock()
+		p := uploadsRunning[id]
+		uploadsMu.Unlock()
+		if p != nil && p.user != user {
+			// Nothing is sent while waiting, so it can still be a plain 404
+			if last == nil { http.NotFound(w, r) }
+			return
+		}
+
+		if p == nil && time.Now().After(deadline) {
+			fmt.Fprint(w, "event: gone\ndata: {}\n\n")
+			rc.Flush()
+			return
+		}
+		if p != nil {
+			data, _ := json.Marshal(p)
+			if string(data) != string(last) {
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				if err := rc.Flush(); err != nil { return }
+				last = data
+			}
+			if p.done.Load() { return }
+		}
+
+		select {
+		case <-tick.C:
+		case <-r.Context().Done():
+			return
+		case <-shutdownCtx.Done():
+			return
+		}
+	}
+}
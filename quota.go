@@ -0,0 +1,187 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ========== UPLOAD QUOTAS ==========
+// Each account's uploads count against a quota: UPLOAD_QUOTA_MB for everyone
+// (default 0, no limit), or per user in USER_QUOTAS ("alice=2000,bob=0", in
+// MB, 0 for no limit). The "owners" bucket records who uploaded each file
+// and how big it was, and the "usage" bucket each user's total, so checking
+// an upload is a lookup. A file counts while it is in the library: deleting
+// or trashing it gives its bytes back (restoring charges them again), a move
+// keeps them with the same user, and an upload replacing a file takes the old
+// one's bytes off whoever uploaded it.
+//
+// An upload that doesn't fit is refused before it is stored: a resumable or
+// direct upload when it starts, by the size it announces, and again when it
+// ends; a form, URL or WebDAV upload once it is spooled (form uploads by a
+// user with a quota are spooled, not streamed, and never past the room
+// left). Uploads in flight hold their size until they are charged, so
+// parallel ones can't overshoot together.
+//
+// Files that came in without an account (WATCH_DIR, imports, uploads from
+// before quotas) belong to no one and count against nobody. The upload page
+// shows the signed-in user's usage, the admin page everyone's.
+
+var errOverQuota = errors.New("over your upload quota")
+
+// fileOwner is a file's row in the "owners" bucket.
+type fileOwner struct {
+	User string `json:"user"`
+	Size int64  `json:"size"`
+}
+
+// quotaUsage is a user's row in the "usage" bucket.
+type quotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+var (
+	quotaMu   sync.Mutex // guards the usage bucket and quotaHeld
+	quotaHeld = map[string]int64{} // user -> bytes of uploads in flight
+)
+
+// userQuota is user's quota in bytes, 0 for none.
+func userQuota(user string) int64 {
+	mb := envInt("UPLOAD_QUOTA_MB", 0)
+	for _, entry := range splitList(os.Getenv("USER_QUOTAS")) {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.TrimSpace(name) != user { continue }
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil { mb = n }
+	}
+	return int64(max(mb, 0)) << 20
+}
+
+func usageOf(user string) quotaUsage {
+	var u quotaUsage
+	dbGet("usage", user, &u)
+	return u
+}
+
+// quotaRoom is how many more bytes user may upload; limited is false when
+// there is no quota to keep to.
+func quotaRoom(user string) (room int64, limited bool) {
+	quota := userQuota(user)
+	if user == "" || quota == 0 { return 0, false }
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	return max(quota-usageOf(user).Bytes-quotaHeld[user], 0), true
+}
+
+// holdQuota sets size bytes of user's room aside for an upload in flight,
+// or fails with errOverQuota when they don't fit. release gives them back,
+// once the upload is charged or has failed.
+func holdQuota(user string, size int64) (release func(), err error) {
+	quota := userQuota(user)
+	if user == "" || quota == 0 { return func() {}, nil }
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	used := usageOf(user).Bytes + quotaHeld[user]
+	if used+size > quota { return func() {}, fmt.Errorf("%w (%s of %s used)", errOverQuota, humanReadableSize(used), humanReadableSize(quota)) }
+	quotaHeld[user] += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaMu.Lock()
+			defer quotaMu.Unlock()
+			if quotaHeld[user] -= size; quotaHeld[user] <= 0 { delete(quotaHeld, user) }
+		})
+	}, nil
+}
+
+// fitsQuota checks an upload of size by user before it starts.
+func fitsQuota(user string, size int64) error {
+	release, err := holdQuota(user, size)
+	release()
+	return err
+}
+
+// chargeUploads records user as the owner of the stored results.
+func chargeUploads(user string, results ...uploadResult) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for _, res := range results {
+		if res.Error != "" || res.Skipped { continue }
+		disownLocked(res.Name)
+		if user == "" { continue }
+		dbPut("owners", res.Name, fileOwner{ user, res.bytes })
+		u := usageOf(user)
+		u.Bytes, u.Files = u.Bytes+res.bytes, u.Files+1
+		dbPut("usage", user, u)
+	}
+}
+
+// ownerOf is who uploaded name, nil for no one.
+func ownerOf(name string) *fileOwner {
+	var o fileOwner
+	if found, _ := dbGet("owners", name, &o); !found { return nil }
+	return &o
+}
+
+// disownFile gives name's bytes back to whoever uploaded it.
+func disownFile(name string) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	disownLocked(name)
+}
+
+func disownLocked(name string) {
+	o := ownerOf(name)
+	if o == nil { return }
+	dbDelete("owners", name)
+	u := usageOf(o.User)
+	u.Bytes, u.Files = max(u.Bytes-o.Size, 0), max(u.Files-1, 0)
+	dbPut("usage", o.User, u)
+}
+
+// renameOwner keeps a moved file charged to the same user.
+func renameOwner(from, to string) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	o := ownerOf(from)
+	if o == nil { return }
+	disownLocked(to)
+	dbPut("owners", to, *o)
+	dbDelete("owners", from)
+}
+
+// quotaView is the template data for user's usage, nil without an account.
+func quotaView(user string) map[string]any {
+	if user == "" { return nil }
+	u, quota := usageOf(user), userQuota(user)
+	v := map[string]any{ "User": user, "Used": humanReadableSize(u.Bytes), "Files": u.Files, "Quota": "", "Percent": 0, "Full": false }
+	if quota > 0 {
+		v["Quota"] = humanReadableSize(quota)
+		v["Percent"] = min(int(u.Bytes*100/quota), 100)
+		v["Full"] = u.Bytes >= quota
+	}
+	return v
+}
+
+// quotaViews is every account's usage for the admin page, biggest first.
+func quotaViews() []map[string]any {
+	used := map[string]int64{}
+	for name := range users { used[name] = 0 }
+	dbEach("usage", func(key string, data []byte) error {
+		var u quotaUsage
+		if json.Unmarshal(data, &u) == nil { used[key] = u.Bytes }
+		return nil
+	})
+	names := slices.Collect(maps.Keys(used))
+	slices.SortFunc(names, func(a, b string) int { return cmp.Or(cmp.Compare(used[b], used[a]), strings.Compare(a, b)) })
+	var views []map[string]any
+	for _, name := range names { views = append(views, quotaView(name)) }
+	return views
+}
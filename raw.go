@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== RAW PHOTOS ==========
+// Camera RAW files (.cr2, .nef, .dng) are decoded by shelling out to dcraw,
+// or whatever dcraw-compatible command RAW_DECODER names (see the
+// thumbnailer package). A RAW can't be shown by a browser, so the viewer
+// shows its JPEG preview (see preview.go), stored at
+// preview/<key without ext>.jpg. The original is never touched.
+
+func isRAW(name string) bool { return thumbnailer.IsRAW(name) }
+
+func initRAW() {
+	if cmd := os.Getenv("RAW_DECODER"); cmd != "" { thumbnailer.RAWDecoder = cmd }
+	if _, err := exec.LookPath(thumbnailer.RAWDecoder); err != nil {
+		log.Printf("⚠️ %s is not installed, RAW photos get no thumbnails or previews", thumbnailer.RAWDecoder)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== SCRATCH FILES ==========
+// Uploads being hashed, originals downloaded for ffmpeg or dcraw, WebDAV
+// writes and renders in progress all go through temp files. They are made in
+// one scratch dir, SCRATCH_DIR (default cache/tmp), rather than the system's
+// temp dir, so what a crash or an aborted request leaves behind can be
+// found and is bounded:
+//
+//   - it is emptied at startup (the DB lock means no other instance is using it)
+//   - every SCRATCH_SWEEP (default 15m) files and dirs untouched for
+//     SCRATCH_MAX_AGE (default 24h) are removed; nothing should live that long
+//   - with SCRATCH_MAX_MB set, a new temp file is refused while the dir holds
+//     that much, so a burst of big uploads fails with an error instead of
+//     filling the disk
+//
+// Emptying and sweeping only happen in a dir this made: one that already
+// held other files (SCRATCH_DIR=/tmp, say) is used but never cleaned or
+// limited.
+//
+// createTemp and mkdirTemp stand in for os.CreateTemp and os.MkdirTemp; the
+// thumbnailer package is told the dir too.
+
+const scratchMarker = ".memories-scratch"
+
+var (
+	scratchDir   string
+	scratchOwned bool // the dir has scratchMarker, so its contents are ours
+)
+
+var errScratchFull = errors.New("scratch space is full (SCRATCH_MAX_MB), try again later")
+
+func initScratch() {
+	scratchDir = os.Getenv("SCRATCH_DIR")
+	if scratchDir == "" { scratchDir = filepath.Join("cache", "tmp") }
+	if err := os.MkdirAll(scratchDir, 0o700); err != nil {
+		log.Printf("⚠️ Scratch dir %s unusable, using the system temp dir: %v", scratchDir, err)
+		scratchDir = ""
+		return
+	}
+	thumbnailer.TempDir = scratchDir
+	marker := filepath.Join(scratchDir, scratchMarker)
+	if entries, _ := os.ReadDir(scratchDir); len(entries) == 0 { os.WriteFile(marker, nil, 0o600) }
+	if _, err := os.Stat(marker); err != nil {
+		log.Printf("⚠️ Scratch dir %s holds other files, so leftovers in it won't be cleaned up", scratchDir)
+		return
+	}
+	scratchOwned = true
+	if _, removed := scratchUsage(time.Now()); removed > 0 { log.Printf("🧹 Removed %d scratch file(s) left by the last run", removed) }
+}
+
+// scratchFull reports whether the dir holds SCRATCH_MAX_MB already.
+func scratchFull() bool {
+	limit := int64(envInt("SCRATCH_MAX_MB", 0)) << 20
+	if limit <= 0 || !scratchOwned { return false }
+	n, _ := scratchUsage(time.Time{})
+	return n >= limit
+}
+
+func createTemp(pattern string) (*os.File, error) {
+	if scratchFull() { return nil, errScratchFull }
+	return os.CreateTemp(scratchDir, pattern)
+}
+
+func mkdirTemp(pattern string) (string, error) {
+	if scratchFull() { return "", errScratchFull }
+	return os.MkdirTemp(scratchDir, pattern)
+}
+
+// scratchUsage adds up the size of the scratch dir, removing the top-level
+// entries last modified before staleBefore (none for the zero time).
+func scratchUsage(staleBefore time.Time) (total int64, removed int) {
+	entries, _ := os.ReadDir(scratchDir)
+	for _, e := range entries {
+		if e.Name() == scratchMarker { continue }
+		p := filepath.Join(scratchDir, e.Name())
+		var size int64
+		newest := time.Time{}
+		filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil { return nil }
+			if info, err := d.Info(); err == nil {
+				if !d.IsDir() { size += info.Size() }
+				if info.ModTime().After(newest) { newest = info.ModTime() }
+			}
+			return nil
+		})
+		if !staleBefore.IsZero() && newest.Before(staleBefore) {
+			if os.RemoveAll(p) == nil { removed++; continue }
+		}
+		total += size
+	}
+	return total, removed
+}
+
+func sweepScratch() {
+	if !scratchOwned { return }
+	for {
+		time.Sleep(envDuration("SCRATCH_SWEEP", 15*time.Minute))
+		total, removed := scratchUsage(time.Now().Add(-envDuration("SCRATCH_MAX_AGE", 24*time.Hour)))
+		if removed > 0 { log.Printf("🧹 Removed %d stale scratch file(s), %s left in %s", removed, humanReadableSize(total), scratchDir) }
+	}
+}
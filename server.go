@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ========== SERVER LIFECYCLE ==========
+// Listens on LISTEN_ADDR (e.g. "127.0.0.1:9000"), else ":$PORT", else ":8080"
+// (":443" when serving HTTPS, see tls.go).
+// On SIGINT/SIGTERM it stops accepting connections and waits up to
+// SHUTDOWN_TIMEOUT (default 2m) for in-flight requests (uploads, on-demand
+// thumbnails) and background work such as a backfill run to finish.
+//
+// Read/write timeouts default to 30m since a single-POST upload or a large
+// download can legitimately take that long; chunked uploads don't need it.
+// Every route goes through accessLog (see accesslog.go), withBasePath (see
+// basepath.go), errorPages (see errors.go) and, with DEV_MODE=1, devNoStore
+// (see devmode.go).
+
+var (
+	shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+	background                 sync.WaitGroup // work outside a request that shutdown waits for
+)
+
+func listenAddr() string {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" { return addr }
+	if port := os.Getenv("PORT"); port != "" { return ":" + port }
+	if isTLSConfigured() { return ":443" }
+	return ":8080"
+}
+
+func serve(addr string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           accessLog(withBasePath(errorPages(devNoStore(http.DefaultServeMux)))),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Minute),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 30*time.Minute),
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		s := <-sig
+		log.Printf("🛑 %v received, finishing in-flight work (send again to force)", s)
+		signal.Reset()
+		beginShutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 2*time.Minute))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil { log.Println("⚠️ Shutdown:", err) }
+
+		idle := make(chan struct{})
+		go func() { background.Wait(); close(idle) }()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			log.Println("⚠️ Shutdown timed out waiting for background work")
+		}
+		close(done)
+	}()
+
+	log.Println("🚀 Server running at", addr)
+	var err error
+	if t := tlsFromEnv(); t != nil {
+		t.startRedirect(srv, addr)
+		err = t.listen(srv)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) { log.Fatal(err) }
+	<-done
+
+	// The last minute of counters, which the periodic flushes haven't saved
+	egress.flush()
+	b2calls.flush()
+	if err := db.Close(); err != nil { log.Println("⚠️ Metadata DB close:", err) }
+	log.Println("👋 Stopped")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== SHARE LINKS ==========
+// A share link gives one file to someone without an account:
+//
+// POST /share                   name, expires (e.g. "24h", "7d"), max_downloads
+// GET  /share/{token}           preview page
+// GET  /share/{token}/thumb     thumbnail
+// GET  /share/{token}/download  the original (counts towards max_downloads)
+// POST /share/{token}/revoke    logged-in only
+//
+// Tokens are "<id|expiry>.<hmac>" signed with SESSION_SECRET, so a tampered
+// or expired link is rejected without a DB lookup. The "shares" bucket holds
+// the download count and makes links revocable. Without SESSION_SECRET links
+// stop working on restart, like sessions do.
+
+type shareLink struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	User         string    `json:"user"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"` // 0 = unlimited
+	Downloads    int       `json:"downloads"`
+}
+
+func (s shareLink) Token() string {
+	payload := s.ID + "|" + strconv.FormatInt(s.Expires.Unix(), 10)
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s shareLink) URL() string { return appURL("/share/" + s.Token()) }
+
+func (s shareLink) Remaining() int { return s.MaxDownloads - s.Downloads }
+
+// usable reports why a stored link can no longer be used, or "".
+func (s shareLink) usable(now time.Time) string {
+	if now.After(s.Expires) { return "This link has expired." }
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads { return "This link has reached its download limit." }
+	return ""
+}
+
+// shareMu serializes download counting.
+var shareMu sync.Mutex
+
+// parseShareToken checks the signature and expiry and returns the link ID.
+func parseShareToken(token string) (string, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok { return "", false }
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil { return "", false }
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write(payload)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(sig)) { return "", false }
+
+	id, exp, ok := strings.Cut(string(payload), "|")
+	if !ok { return "", false }
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix { return "", false }
+	return id, true
+}
+
+// parseExpiry accepts Go durations plus whole days ("7d").
+func parseExpiry(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 { return 0, fmt.Errorf("bad expiry %q", s) }
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 { return 0, fmt.Errorf("bad expiry %q", s) }
+	return d, nil
+}
+
+// sharesFor lists the unexpired links to name, newest first.
+func sharesFor(name string) []shareLink {
+	var links []shareLink
+	now := time.Now()
+	dbEach("shares", func(key string, data []byte) error {
+		var s shareLink
+		if json.Unmarshal(data, &s) == nil && s.Name == name && now.Before(s.Expires) { links = append(links, s) }
+		return nil
+	})
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.After(links[j].Created) })
+	return links
+}
+
+// forEachShare calls fn for every stored link to name.
+func forEachShare(name string, fn func(s shareLink)) {
+	var links []shareLink
+	dbEach("shares", func(key string, data []byte) error {
+		var s shareLink
+		if json.Unmarshal(data, &s) == nil && s.Name == name { links = append(links, s) }
+		return nil
+	})
+	for _, s := range links { fn(s) }
+}
+
+// ========== SHARE MIDDLEWARE ==========
+// withShare validates the token in /share/{token}[/action] and hands the
+// link to h. Invalid, revoked and used-up links get the share page's error.
+func withShare(h func(w http.ResponseWriter, r *http.Request, s shareLink, action string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/share/"), "/")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Robots-Tag", "noindex")
+
+		id, ok := parseShareToken(token)
+		var s shareLink
+		if ok {
+			found, _ := dbGet("shares", id, &s)
+			ok = found
+		}
+		if !ok { shareError(w, http.StatusNotFound, "This link is invalid or has expired."); return }
+		h(w, r, s, action)
+	}
+}
+
+func shareError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	tpls.ExecuteTemplate(w, "share.html", map[string]any{ "BucketName": bktName, "Error": msg })
+}
+
+// ========== SHARE HANDLERS ==========
+func createShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	name := strings.Trim(r.FormValue("name"), "/")
+	// A link opens the file to anyone, so only who may see it can make one
+	if !canRead(currentUser(r), name) { http.Error(w, "no such file", 404); return }
+	if _, ok := apiStat(r.Context(), name); !ok || !isLibraryFile(name) { http.Error(w, "no such file", 404); return }
+
+	expiry := r.FormValue("expires")
+	if expiry == "" { expiry = os.Getenv("SHARE_DEFAULT_EXPIRY") }
+	if expiry == "" { expiry = "7d" }
+	ttl, err := parseExpiry(expiry)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	maxDownloads, _ := strconv.Atoi(r.FormValue("max_downloads"))
+
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	now := time.Now()
+	s := shareLink{ ID: hex.EncodeToString(raw), Name: name, User: currentUser(r), Created: now, Expires: now.Add(ttl), MaxDownloads: max(maxDownloads, 0) }
+	if err := dbPut("shares", s.ID, s); err != nil { http.Error(w, "could not save link", 500); return }
+	log.Printf("🔗 %s shared %s until %s", s.User, name, s.Expires.Format(time.RFC3339))
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusCreated, map[string]any{ "url": s.URL(), "expires": s.Expires, "max_downloads": s.MaxDownloads })
+		return
+	}
+	http.Redirect(w, r, "/viewer/"+name+"#shares", http.StatusSeeOther)
+}
+
+func shareHandler(w http.ResponseWriter, r *http.Request, s shareLink, action string) {
+	switch action {
+	case "":
+		if msg := s.usable(time.Now()); msg != "" { shareError(w, http.StatusGone, msg); return }
+		tpls.ExecuteTemplate(w, "share.html", map[string]any{
+			"BucketName": bktName,
+			"Share":      s,
+			"FileName":   path.Base(s.Name),
+			"IsMedia":    isThumbable(s.Name),
+		})
+
+	case "thumb":
+		if msg := s.usable(time.Now()); msg != "" { http.Error(w, msg, http.StatusGone); return }
+		serveShareThumb(w, r, s.Name)
+
+	case "download":
+		shareMu.Lock()
+		var fresh shareLink
+		found, _ := dbGet("shares", s.ID, &fresh)
+		msg := "This link has been revoked."
+		if found { msg = fresh.usable(time.Now()) }
+		if msg == "" {
+			fresh.Downloads++
+			dbPut("shares", s.ID, fresh)
+		}
+		shareMu.Unlock()
+		if msg != "" { shareError(w, http.StatusGone, msg); return }
+
+		rc, err := getObject(r.Context(), storageKey(s.Name))
+		if err != nil { shareError(w, http.StatusNotFound, "This file is no longer available."); return }
+		defer rc.Close()
+		w.Header().Set("Content-Type", detectContentType(s.Name))
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(s.Name)))
+		if attrs, err := store.Attrs(r.Context(), storageKey(s.Name)); err == nil { w.Header().Set("Content-Length", strconv.FormatInt(attrs.Size, 10)) }
+		n, _ := io.Copy(w, rc)
+		egress.Add("download", n)
+		log.Printf("🔗 Share %s: %s downloaded (%d/%d)", s.ID, s.Name, fresh.Downloads, s.MaxDownloads)
+
+	case "revoke":
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if currentUser(r) == "" { loginTarget(w, r); return }
+		dbDelete("shares", s.ID)
+		log.Printf("🔗 Share %s for %s revoked", s.ID, s.Name)
+		http.Redirect(w, r, "/viewer/"+s.Name+"#shares", http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveShareThumb sends the stored thumbnail, or the generic icon.
+func serveShareThumb(w http.ResponseWriter, r *http.Request, name string) {
+	thumbKey := getThumbPath(storageKey(name))
+	rc, err := getObject(r.Context(), thumbKey)
+	if err != nil { http.Redirect(w, r, "/static/file-icon.png", http.StatusFound); return }
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil { http.Redirect(w, r, "/static/file-icon.png", http.StatusFound); return }
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(data)
+	egress.Add("thumb", int64(len(data)))
+}
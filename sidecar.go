@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== JSON SIDECARS ==========
+// Per-file metadata lives next to the original as "<name>.json" (the same
+// convention Google Takeout uses), so it survives losing the local DB and is
+// readable by other tools.
+
+type sidecar struct {
+	Title       string     `json:"title,omitempty"`
+	Caption     string     `json:"caption,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Favorite    bool       `json:"favorite,omitempty"`
+	Hidden      bool       `json:"hidden,omitempty"` // left out of folder pages, see hidden.go
+	People      []string   `json:"people,omitempty"`
+	CaptureTime *time.Time `json:"capture_time,omitempty"`
+	Location    *geoPoint  `json:"location,omitempty"`
+	Weather     *weather   `json:"weather,omitempty"`
+	EXIF        *exifInfo  `json:"exif,omitempty"` // from the original at upload
+	VideoFrame  *framePick `json:"video_frame,omitempty"` // thumbnail frame picked at /thumb/regenerate
+	Video       *videoInfo `json:"video,omitempty"`       // from ffprobe at upload
+	Original    string     `json:"original,omitempty"`    // the bytes as uploaded, kept by the first edit
+}
+
+// sameMoment reports whether two sidecars share capture time and location, so
+// previously fetched weather still applies.
+func (sc sidecar) sameMoment(o sidecar) bool {
+	if sc.CaptureTime == nil || o.CaptureTime == nil || sc.Location == nil || o.Location == nil { return false }
+	return sc.CaptureTime.Equal(*o.CaptureTime) && *sc.Location == *o.Location
+}
+
+func sidecarKey(name string) string { return name + ".json" }
+
+// isSidecar reports whether an object name is a sidecar ("x.jpg.json"), as
+// opposed to a plain JSON document ("notes.json").
+func isSidecar(name string) bool {
+	return strings.HasSuffix(name, ".json") && path.Ext(strings.TrimSuffix(name, ".json")) != ""
+}
+
+func readSidecar(ctx context.Context, name string) (sidecar, bool) {
+	var sc sidecar
+	if !objectExists(ctx, sidecarKey(name)) { return sc, false }
+
+	rc, err := getObject(ctx, sidecarKey(name))
+	if err != nil { return sc, false }
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil { return sc, false }
+	if err := json.Unmarshal(data, &sc); err != nil {
+		log.Printf("Bad sidecar %s: %v", sidecarKey(name), err)
+		return sc, false
+	}
+	return sc, true
+}
+
+func writeSidecar(ctx context.Context, name string, sc sidecar) error {
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil { return err }
+	if err := store.Put(ctx, sidecarKey(name), bytes.NewReader(data), objectAttrs{ ContentType: "application/json" }); err != nil { return err }
+	indexSidecar(name, sc)
+	return nil
+}
+
+// indexSidecar updates the DB indexes built from sidecars (tags, map,
+// capture dates, captions, titles and descriptions, video metadata).
+func indexSidecar(name string, sc sidecar) {
+	indexTags(name, sc)
+	indexGeo(name, sc)
+	indexTaken(name, sc)
+	indexCaption(name, sc)
+	indexDetails(name, sc)
+	indexVideo(name, sc)
+}
+
+// sidecarIndexMissing reports whether an index has never been built.
+func sidecarIndexMissing() bool {
+	return dbMissing("tags") || dbMissing("geo") || dbMissing("taken") || dbMissing("captions") || dbMissing("details") || dbMissing("videos")
+}
+
+// rebuildSidecarIndex reads the given sidecars back into the indexes.
+func rebuildSidecarIndex(ctx context.Context, names []string) {
+	db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{ "tags", "geo", "taken", "captions", "details", "videos" } {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil { return err }
+		}
+		return nil
+	})
+	for _, name := range names {
+		if ctx.Err() != nil { return }
+		if sc, ok := readSidecar(ctx, name); ok { indexSidecar(name, sc) }
+	}
+	log.Printf("🏷️ Sidecar index rebuilt from %d sidecar(s)", len(names))
+}
+
+// splitList turns "a, b,,c" into ["a" "b" "c"].
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" { out = append(out, part) }
+	}
+	return out
+}
+
+// parseLatLon parses "51.5074, -0.1278".
+func parseLatLon(s string) (float64, float64, bool) {
+	a, b, ok := strings.Cut(s, ",")
+	if !ok { return 0, 0, false }
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 { return 0, 0, false }
+	return lat, lon, true
+}
+
+// ========== META HANDLER ==========
+// GET  /meta/{name} -> sidecar JSON
+// POST /meta/{name} -> replace sidecar (JSON body or viewer form), login required
+func metaHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/meta/")
+	if name == "" { http.NotFound(w, r); return }
+	if !allowRead(w, r, name) { return }
+	ctx := r.Context()
+	if r.Method != http.MethodGet { ctx = context.WithoutCancel(ctx) }
+
+	if r.Method == http.MethodGet {
+		sc, _ := readSidecar(ctx, name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sc)
+		return
+	}
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if currentUser(r) == "" { http.Error(w, "login required", 401); return }
+
+	var sc sidecar
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil { http.Error(w, "bad json", 400); return }
+	} else {
+		sc.Title = strings.TrimSpace(r.FormValue("title"))
+		sc.Caption = strings.TrimSpace(r.FormValue("caption"))
+		sc.Description = strings.TrimSpace(r.FormValue("description"))
+		sc.Tags = splitList(r.FormValue("tags"))
+		sc.People = splitList(r.FormValue("people"))
+		if v := r.FormValue("capture_time"); v != "" {
+			t, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local)
+			if err != nil { http.Error(w, "bad capture time", 400); return }
+			sc.CaptureTime = &t
+		}
+		if v := r.FormValue("location"); v != "" {
+			lat, lon, ok := parseLatLon(v)
+			if !ok { http.Error(w, "bad location (want \"lat, lon\")", 400); return }
+			sc.Location = &geoPoint{ Lat: lat, Lon: lon }
+		}
+	}
+
+	if old, ok := readSidecar(ctx, name); ok {
+		if sc.Weather == nil && sc.sameMoment(old) { sc.Weather = old.Weather }
+		// EXIF comes from the file, not the editor; the form has no star
+		// or hide toggle
+		if sc.EXIF == nil { sc.EXIF = old.EXIF }
+		if !isJSON { sc.Favorite, sc.Hidden = old.Favorite, old.Hidden }
+		// Nor does it know the video metadata, the picked frame or a kept original
+		if sc.Video == nil { sc.Video = old.Video }
+		if sc.VideoFrame == nil { sc.VideoFrame = old.VideoFrame }
+		if sc.Original == "" { sc.Original = old.Original }
+	}
+	enrichWeather(ctx, name, &sc)
+
+	if err := writeSidecar(ctx, name, sc); err != nil {
+		log.Println("Failed to write sidecar:", err)
+		http.Error(w, "save failed", 500); return
+	}
+
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sc)
+		return
+	}
+	http.Redirect(w, r, "/viewer/"+name, http.StatusSeeOther)
+}
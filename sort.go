@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ========== SORTING & FILTERING ==========
+// Folder pages, search and GET /api/v1/files take ?sort= and ?type=:
+//
+//	sort  name (default), newest / oldest (upload time), largest / smallest,
+//	      taken / taken-oldest (capture date; files without one count by
+//	      upload time)
+//	type  all (default), image, video, other
+//
+// Folder pages and the API's listing also take ?view= (visible, favorites,
+// hidden, all; see hidden.go). Name order over all types in the default view
+// pages by cursor as before. Any other view is
+// ordered from the catalog, so it covers the whole folder rather than one
+// page of it, and is paged by ?offset=; subfolders are shown on its first
+// page. Capture dates come from the "taken" bucket (name -> time), indexed
+// from sidecars alongside tags and map positions.
+
+var sortOrders = []string{ "name", "newest", "oldest", "largest", "smallest", "taken", "taken-oldest" }
+
+var fileKinds = []struct{ Kind, Label string }{
+	{ "all", "All Files" }, { "image", "Images" }, { "video", "Videos" }, { "other", "Documents" },
+}
+
+// listOrder reads ?sort= and ?type=, falling back to name and all.
+func listOrder(r *http.Request) (sortBy, kind string) {
+	sortBy, kind = r.URL.Query().Get("sort"), r.URL.Query().Get("type")
+	if !slices.Contains(sortOrders, sortBy) { sortBy = "name" }
+	switch kind {
+	case "image", "video", "other":
+	default: kind = "all"
+	}
+	return sortBy, kind
+}
+
+// fileKind sorts a file into image, video or other for ?type=.
+func fileKind(name, contentType string) string {
+	switch {
+	case isVideo(name): return "video"
+	case strings.HasPrefix(contentType, "image/") || isRAW(name): return "image"
+	default: return "other"
+	}
+}
+
+// indexTaken records when name was captured, per its sidecar.
+func indexTaken(name string, sc sidecar) {
+	t := sc.CaptureTime
+	if t == nil && sc.EXIF != nil { t = sc.EXIF.Taken }
+	if t == nil { dbDelete("taken", name); return }
+	dbPut("taken", name, *t)
+}
+
+// takenTimes loads the capture date index.
+func takenTimes() map[string]time.Time {
+	taken := map[string]time.Time{}
+	dbEach("taken", func(key string, data []byte) error {
+		var t time.Time
+		if json.Unmarshal(data, &t) == nil { taken[key] = t }
+		return nil
+	})
+	return taken
+}
+
+// sortEntries orders catalog entries by sortBy. Ties keep name order.
+func sortEntries(entries []catalogEntry, sortBy string) {
+	var less func(a, b catalogEntry) bool
+	switch sortBy {
+	case "newest": less = func(a, b catalogEntry) bool { return a.Modified.After(b.Modified) }
+	case "oldest": less = func(a, b catalogEntry) bool { return a.Modified.Before(b.Modified) }
+	case "largest": less = func(a, b catalogEntry) bool { return a.Size > b.Size }
+	case "smallest": less = func(a, b catalogEntry) bool { return a.Size < b.Size }
+	case "taken", "taken-oldest":
+		taken := takenTimes()
+		at := func(e catalogEntry) time.Time {
+			if t, ok := taken[e.Name]; ok { return t }
+			return e.Modified
+		}
+		if sortBy == "taken" {
+			less = func(a, b catalogEntry) bool { return at(a).After(at(b)) }
+		} else {
+			less = func(a, b catalogEntry) bool { return at(a).Before(at(b)) }
+		}
+	default:
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+}
+
+// catalogSortedPage lists the files directly under prefix of the given kind
+// that view keeps, ordered by sortBy, from offset on. more reports whether a
+// later page exists.
+func catalogSortedPage(prefix, sortBy, kind, view string, offset, size int) (l folderListing, more bool) {
+	var files []catalogEntry
+	marks := loadViewMarks()
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("catalog"))
+		if b == nil { return nil }
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); {
+			name := string(k)
+			if top, _, nested := strings.Cut(name[len(prefix):], "/"); nested {
+				folder := prefix + top
+				if offset == 0 && marks.keepFolder(view, folder) { l.Folders = append(l.Folders, folder) }
+				k, v = c.Seek([]byte(folder + "0"))
+				continue
+			}
+			var e catalogEntry
+			if json.Unmarshal(v, &e) == nil && (kind == "all" || fileKind(e.Name, e.ContentType) == kind) && marks.keepFile(view, e.Name) { files = append(files, e) }
+			k, v = c.Next()
+		}
+		return nil
+	})
+	sortEntries(files, sortBy)
+	offset = min(max(offset, 0), len(files))
+	end := min(offset+size, len(files))
+	for _, e := range files[offset:end] { l.Files = append(l.Files, e.fileEntry()) }
+	return l, end < len(files)
+}
+
+// orderQuery is the query string for a sorted or filtered page, on top of
+// base (nil for none).
+func orderQuery(base url.Values, sortBy, kind string, offset int) string {
+	q := url.Values{}
+	for k, v := range base { q[k] = v }
+	if sortBy != "name" { q.Set("sort", sortBy) }
+	if kind != "all" { q.Set("type", kind) }
+	if offset > 0 { q.Set("offset", strconv.Itoa(offset)) }
+	if len(q) == 0 { return "" }
+	return "?" + q.Encode()
+}
+
+// kindTabs is the template data for the type filter tabs of a page.
+func kindTabs(pageURL string, base url.Values, sortBy, kind string) []map[string]any {
+	var tabs []map[string]any
+	for _, k := range fileKinds {
+		tabs = append(tabs, map[string]any{ "Label": k.Label, "URL": pageURL + orderQuery(base, sortBy, k.Kind, 0), "Active": k.Kind == kind })
+	}
+	return tabs
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== STORAGE STATS ==========
+// The admin page's storage section: library size per top-level folder and
+// per file type, thumbnail coverage, the largest files, recent uploads and
+// orphaned thumbnails (thumb/ objects whose original is gone, e.g. deleted
+// outside the app). Files come from the catalog; thumbnails need one listing
+// of thumb/ and the thumb-{size}/ folders, so the result is kept in the
+// "stats" bucket and only computed again from the Refresh button
+// (POST /admin/stats), or on the first visit when there is none yet.
+
+type statRow struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type storageStats struct {
+	Computed   time.Time      `json:"computed"`
+	Files      int            `json:"files"`
+	Bytes      int64          `json:"bytes"`
+	Folders    []statRow      `json:"folders"` // by size, largest first
+	Types      []statRow      `json:"types"`   // by extension, largest first
+	Thumbable  int            `json:"thumbable"`
+	Thumbed    int            `json:"thumbed"` // thumbable files with a thumb/ object
+	Thumbs     statRow        `json:"thumbs"`  // every stored thumbnail, all sizes and formats
+	Orphans    statRow        `json:"orphans"`
+	OrphanKeys []string       `json:"orphan_keys,omitempty"` // the first statsListSize of them
+	Largest    []catalogEntry `json:"largest"`
+	Recent     []catalogEntry `json:"recent"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// statsListSize caps the largest, recent and orphan lists.
+const statsListSize = 10
+
+type statsRunner struct {
+	mu      sync.Mutex
+	running bool
+}
+
+var storageStatsJob = &statsRunner{}
+
+func (s *statsRunner) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Start computes the stats in the background. It reports false if a run is
+// already in progress.
+func (s *statsRunner) Start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running { return false }
+	s.running = true
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		st := computeStats(shutdownCtx)
+		if err := dbPut("stats", "storage", st); err != nil { log.Println("Saving storage stats failed:", err) }
+		log.Printf("📊 Storage stats: %d file(s), %s, %d orphaned thumbnail(s)", st.Files, humanReadableSize(st.Bytes), st.Orphans.Files)
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+// savedStats is the last computed result, if any.
+func savedStats() (storageStats, bool) {
+	var st storageStats
+	found, _ := dbGet("stats", "storage", &st)
+	return st, found
+}
+
+func computeStats(ctx context.Context) storageStats {
+	st := storageStats{ Computed: time.Now() }
+	var entries []catalogEntry
+	dbEach("catalog", func(_ string, data []byte) error {
+		var e catalogEntry
+		if json.Unmarshal(data, &e) == nil { entries = append(entries, e) }
+		return nil
+	})
+
+	folders, types := map[string]*statRow{}, map[string]*statRow{}
+	add := func(rows map[string]*statRow, name string, size int64) {
+		if rows[name] == nil { rows[name] = &statRow{ Name: name } }
+		rows[name].Files++
+		rows[name].Bytes += size
+	}
+	for _, e := range entries {
+		st.Files++
+		st.Bytes += e.Size
+		folder, _, nested := strings.Cut(e.Name, "/")
+		if !nested { folder = "(top level)" }
+		add(folders, folder, e.Size)
+		ext := strings.ToLower(path.Ext(e.Name))
+		if ext == "" { ext = "(none)" }
+		add(types, ext, e.Size)
+	}
+	st.Folders, st.Types = sortedRows(folders), sortedRows(types)
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	st.Largest = append([]catalogEntry{}, entries[:min(statsListSize, len(entries))]...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Modified.After(entries[j].Modified) })
+	st.Recent = append([]catalogEntry{}, entries[:min(statsListSize, len(entries))]...)
+
+	// Thumbnails are matched to originals by their name without extension
+	// ("a/b" for thumb/a/b.jpg and thumb-600/a/b.webp), like getThumbPath
+	originals := map[string]bool{}
+	var cas map[string]casEntry
+	if casMode { cas, _ = casEntries() }
+	thumbStem := func(key string) string { return strings.TrimSuffix(strings.TrimPrefix(getThumbPath(key), "thumb/"), ".jpg") }
+	for _, e := range entries {
+		key := e.Name
+		if c, ok := cas[e.Name]; ok { key = casKey(c.Hash) }
+		originals[thumbStem(key)] = true
+	}
+	// Trashed files keep their thumbnails under trash/, not thumb/
+	thumbed := map[string]bool{}
+	for _, prefix := range thumbPrefixes() {
+		err := listAll(ctx, prefix, func(f *objectAttrs) {
+			rest := strings.TrimPrefix(f.Name, prefix)
+			stem := strings.TrimSuffix(rest, path.Ext(rest))
+			st.Thumbs.Files++
+			st.Thumbs.Bytes += f.Size
+			if originals[stem] {
+				if prefix == "thumb/" && path.Ext(rest) == ".jpg" { thumbed[stem] = true }
+				return
+			}
+			st.Orphans.Files++
+			st.Orphans.Bytes += f.Size
+			if len(st.OrphanKeys) < statsListSize { st.OrphanKeys = append(st.OrphanKeys, f.Name) }
+		})
+		if err != nil { st.Error = "listing " + prefix + " failed: " + err.Error(); break }
+	}
+	for _, e := range entries {
+		if !isThumbable(e.Name) { continue }
+		st.Thumbable++
+		key := e.Name
+		if c, ok := cas[e.Name]; ok { key = casKey(c.Hash) }
+		if thumbed[thumbStem(key)] { st.Thumbed++ }
+	}
+	return st
+}
+
+// thumbPrefixes lists the folders thumbnails of every size are stored in.
+func thumbPrefixes() []string {
+	prefixes := []string{ "thumb/" }
+	for _, width := range thumbSizes {
+		prefixes = append(prefixes, fmt.Sprintf("thumb-%d/", width))
+	}
+	return prefixes
+}
+
+func sortedRows(rows map[string]*statRow) []statRow {
+	var out []statRow
+	for _, r := range rows { out = append(out, *r) }
+	sort.Slice(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes || (out[i].Bytes == out[j].Bytes && out[i].Name < out[j].Name) })
+	return out
+}
+
+// statsView is the template data for the storage section.
+func statsView() map[string]any {
+	st, found := savedStats()
+	if !found && catalogReady() { storageStatsJob.Start() }
+	rows := func(in []statRow) []map[string]any {
+		var out []map[string]any
+		for _, r := range in {
+			share := 0.0
+			if st.Bytes > 0 { share = float64(r.Bytes) * 100 / float64(st.Bytes) }
+			out = append(out, map[string]any{ "Name": r.Name, "Files": r.Files, "Size": humanReadableSize(r.Bytes), "Share": share })
+		}
+		return out
+	}
+	files := func(in []catalogEntry) []map[string]any {
+		var out []map[string]any
+		for _, e := range in { out = append(out, map[string]any{ "Name": e.Name, "Size": humanReadableSize(e.Size), "Time": e.Modified.Format("02 Jan 2006 15:04") }) }
+		return out
+	}
+	coverage := 100.0
+	if st.Thumbable > 0 { coverage = float64(st.Thumbed) * 100 / float64(st.Thumbable) }
+	return map[string]any{
+		"Found":       found,
+		"Running":     storageStatsJob.Running(),
+		"Computed":    st.Computed,
+		"Files":       st.Files,
+		"Size":        humanReadableSize(st.Bytes),
+		"Folders":     rows(st.Folders),
+		"Types":       rows(st.Types),
+		"Thumbable":   st.Thumbable,
+		"Thumbed":     st.Thumbed,
+		"Coverage":    coverage,
+		"Thumbs":      st.Thumbs.Files,
+		"ThumbsSize":  humanReadableSize(st.Thumbs.Bytes),
+		"Orphans":     st.Orphans.Files,
+		"OrphansSize": humanReadableSize(st.Orphans.Bytes),
+		"OrphanKeys":  st.OrphanKeys,
+		"Largest":     files(st.Largest),
+		"Recent":      files(st.Recent),
+		"Error":       st.Error,
+	}
+}
+
+// ========== STATS HANDLER ==========
+// GET  /admin/stats -> the last computed stats as JSON
+// POST /admin/stats -> compute them again (form posts redirect back to /admin)
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		started := storageStatsJob.Start()
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			return
+		}
+		status := http.StatusAccepted
+		if !started { status = http.StatusConflict }
+		writeJSON(w, status, map[string]bool{ "running": true })
+		return
+	}
+	st, found := savedStats()
+	if !found { apiError(w, 404, "not computed yet"); return }
+	writeJSON(w, 200, st)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ========== STORAGE BACKENDS ==========
+// Everything the app keeps outside the DB (originals, thumbnails, sidecars,
+// renditions) goes through a Storage. STORAGE_BACKEND picks one:
+//
+//	b2    (default) Backblaze B2: B2_KEY_ID, B2_APP_KEY, B2_BUCKET_NAME, or
+//	      B2_BUCKETS=photos,docs for several buckets (see buckets.go);
+//	      B2_PREFIX=memories to stay inside that folder of a shared bucket
+//	s3    any S3-compatible store (MinIO, Wasabi, AWS): S3_ENDPOINT, S3_BUCKET,
+//	      S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY, S3_REGION (default
+//	      us-east-1), S3_PATH_STYLE=0 for virtual-hosted buckets
+//	local a directory (a NAS mount, say): LOCAL_STORAGE_DIR
+//
+// Keys are slash-separated names as in B2. Listings are in name order and
+// resume from a name: start is the first name to return and next the first
+// name of the following page, so cursors mean the same on every backend.
+
+type Storage interface {
+	// List returns up to count objects under prefix from start on. With
+	// delimiter "/" deeper names are collapsed into folders ("a/b/").
+	List(ctx context.Context, prefix, delimiter, start string, count int) (objects []objectAttrs, next string, err error)
+	// Get reads length bytes from offset, or to the end if length < 0.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Put stores r under key. Nothing is stored if reading r fails.
+	Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error
+	// Delete removes key for good: on a backend that keeps versions, all of
+	// them, so no older one comes back under the name.
+	Delete(ctx context.Context, key string) error
+	Attrs(ctx context.Context, key string) (*objectAttrs, error)
+}
+
+// objectAttrs describes a stored object. On Put only ContentType, SHA1 and
+// Info are used.
+type objectAttrs struct {
+	Name        string
+	Size        int64
+	ContentType string
+	SHA1        string // "" if the backend doesn't know it
+	Modified    time.Time
+	Info        map[string]string // small string metadata, e.g. src_version
+	Folder      bool              // a collapsed folder in a delimited listing
+}
+
+var store Storage
+
+// errNotFound is wrapped in what Get and Attrs return for a key that isn't
+// stored, so handlers can answer 404 rather than 500. On B2 a Get for a
+// missing key fails on the first Read instead.
+var errNotFound = errors.New("not found")
+
+func isNotFound(err error) bool { return errors.Is(err, errNotFound) }
+
+// initStorage connects the backend STORAGE_BACKEND names and sets bktName.
+func initStorage(ctx context.Context) {
+	var err error
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "b2":
+		store, err = newB2Storage(ctx)
+	case "s3":
+		store, err = newS3Storage()
+	case "local":
+		store, err = newLocalStorage()
+	default:
+		err = fmt.Errorf("unknown STORAGE_BACKEND %q (want b2, s3 or local)", backend)
+	}
+	if err != nil { log.Fatal("Storage error: ", err) }
+	store = timeoutStorage{ store, envDuration("STORAGE_TIMEOUT", 30*time.Second) }
+}
+
+// timeoutStorage gives each List, Attrs and Delete call STORAGE_TIMEOUT
+// (default 30s) on top of the caller's context. Get and Put stream whole
+// files, so they are only bounded by the caller's context.
+type timeoutStorage struct {
+	Storage
+	timeout time.Duration
+}
+
+func (s timeoutStorage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Storage.List(ctx, prefix, delimiter, start, count)
+}
+
+func (s timeoutStorage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Storage.Attrs(ctx, key)
+}
+
+func (s timeoutStorage) Delete(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.Storage.Delete(ctx, key)
+}
+
+// backendOf sees through the wrappers around store (timeouts, B2_PREFIX,
+// mounted buckets) to the backend key is stored in, and key's name there.
+func backendOf(key string) (Storage, string) {
+	s := store
+	for {
+		switch w := s.(type) {
+		case timeoutStorage:
+			s = w.Storage
+		case prefixStorage:
+			s, key = w.Storage, w.prefix+key
+		case *mountedStorage:
+			s, key, _ = w.route(key)
+		default:
+			return s, key
+		}
+	}
+}
+
+// sourceVersion is what thumbnails and ?v= URLs are keyed on: the SHA1 when
+// the backend has one, otherwise the last-modified time.
+func sourceVersion(attrs *objectAttrs) string {
+	if attrs.SHA1 != "" && attrs.SHA1 != "none" { return attrs.SHA1 }
+	return strconv.FormatInt(attrs.Modified.UnixMilli(), 10)
+}
+
+// getObject reads a whole object.
+func getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return store.Get(ctx, key, 0, -1)
+}
+
+// objectExists reports whether key is stored.
+func objectExists(ctx context.Context, key string) bool {
+	_, err := store.Attrs(ctx, key)
+	return err == nil
+}
+
+// deleteForGood removes key and makes sure nothing is left under the name:
+// an older version a backend kept would show the file again, with its old
+// bytes, after it was trashed, deleted or moved away.
+func deleteForGood(ctx context.Context, key string) error {
+	if err := store.Delete(ctx, key); err != nil { return err }
+	if objectExists(ctx, key) { return fmt.Errorf("%s: an older version is still stored under the name", key) }
+	return nil
+}
+
+// deleteIfExists removes key if it is stored.
+func deleteIfExists(ctx context.Context, key string) {
+	if objectExists(ctx, key) { store.Delete(ctx, key) }
+}
+
+// listAll calls fn for every file under prefix, 1000 names per request.
+func listAll(ctx context.Context, prefix string, fn func(f *objectAttrs)) error {
+	start := ""
+	for {
+		files, next, err := store.List(ctx, prefix, "", start, 1000)
+		if err != nil { return err }
+		for i := range files { fn(&files[i]) }
+		if next == "" { return nil }
+		start = next
+	}
+}
+
+// objectReadSeeker reads an object lazily, opening a range read at the
+// current offset on the first Read after a Seek.
+type objectReadSeeker struct {
+	ctx  context.Context
+	key  string
+	size int64
+	off  int64
+	r    io.ReadCloser
+}
+
+func (s *objectReadSeeker) Read(p []byte) (int, error) {
+	if s.off >= s.size { return 0, io.EOF }
+	if s.r == nil {
+		r, err := store.Get(s.ctx, s.key, s.off, s.size-s.off)
+		if err != nil { return 0, err }
+		s.r = r
+	}
+	n, err := s.r.Read(p)
+	s.off += int64(n)
+	return n, err
+}
+
+func (s *objectReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent: offset += s.off
+	case io.SeekEnd: offset += s.size
+	}
+	if offset < 0 { return 0, fmt.Errorf("seek before start") }
+	if offset != s.off { s.Close() }
+	s.off = offset
+	return offset, nil
+}
+
+func (s *objectReadSeeker) Close() error {
+	if s.r == nil { return nil }
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
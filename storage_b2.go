@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/base"
+)
+
+// ========== B2 STORAGE ==========
+// Objects go through blazer's bucket API. Listings use the base API instead:
+// blazer's iterator hides B2's list cursor, while b2_list_file_names with
+// startFileName returns one page (names, sizes, SHA1s and timestamps) per
+// request, so no per-object Attrs calls are needed and a page costs the same
+// no matter how large the bucket is.
+
+type b2Storage struct {
+	bucket     *b2.Bucket
+	api        *base.B2
+	listBucket *base.Bucket
+	creds      [2]string
+}
+
+// namePrefix is B2_PREFIX as a folder ("memories/"), "" when unset.
+var namePrefix string
+
+// newB2Storage opens B2_BUCKET_NAME, or every bucket in B2_BUCKETS with the
+// first as the primary (see buckets.go).
+func newB2Storage(ctx context.Context) (Storage, error) {
+	if p := strings.Trim(os.Getenv("B2_PREFIX"), "/"); p != "" { namePrefix = p + "/" }
+	appKeyID := os.Getenv("B2_KEY_ID")
+	appKey := os.Getenv("B2_APP_KEY")
+	names := strings.FieldsFunc(os.Getenv("B2_BUCKETS"), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(names) == 0 && os.Getenv("B2_BUCKET_NAME") != "" { names = []string{ os.Getenv("B2_BUCKET_NAME") } }
+	if appKeyID == "" || appKey == "" || len(names) == 0 {
+		return nil, fmt.Errorf("set B2_KEY_ID, B2_APP_KEY, and B2_BUCKET_NAME (or B2_BUCKETS) env vars")
+	}
+	bktName = names[0]
+
+	client, err := b2.NewClient(ctx, appKeyID, appKey, b2.Transport(keyInfo))
+	if err != nil { return nil, fmt.Errorf("B2 auth error: %w", err) }
+	checkKeyCapabilities()
+	if len(names) > 1 && keyInfo.allowance().BucketID != "" {
+		return nil, fmt.Errorf("B2_BUCKETS needs a key that isn't restricted to one bucket")
+	}
+	api, err := base.AuthorizeAccount(ctx, appKeyID, appKey, base.Transport(keyInfo))
+	if err != nil { return nil, err }
+	visible, err := api.ListBuckets(ctx)
+	if err != nil { return nil, err }
+
+	open := func(name string) (Storage, error) {
+		s := &b2Storage{ api: api, creds: [2]string{ appKeyID, appKey } }
+		if s.bucket, err = client.Bucket(ctx, name); err != nil { return nil, fmt.Errorf("bucket %s error: %w", name, err) }
+		for _, b := range visible {
+			if b.Name != name { continue }
+			s.listBucket = b
+			if namePrefix != "" { return prefixStorage{ s, namePrefix }, nil }
+			return s, nil
+		}
+		return nil, fmt.Errorf("bucket %q not visible to this key", name)
+	}
+	if namePrefix != "" { log.Printf("🪣 Keeping everything under %s in each bucket (B2_PREFIX)", namePrefix) }
+	primary, err := open(bktName)
+	if err != nil || len(names) == 1 { return primary, err }
+
+	mounts := map[string]Storage{}
+	for _, name := range names[1:] {
+		if mounts[name], err = open(name); err != nil { return nil, err }
+		log.Printf("🪣 Bucket %s is mounted at %s/", name, name)
+	}
+	return newMountedStorage(ctx, primary, names[1:], mounts), nil
+}
+
+// ========== B2_PREFIX ==========
+// B2_PREFIX=memories keeps the app to memories/ in a bucket shared with other
+// tools: every key it uses, thumb/ and trash/ included, gets the prefix on
+// the way in and loses it on the way out, so the rest of the bucket is never
+// listed, written or deleted.
+
+type prefixStorage struct {
+	Storage
+	prefix string
+}
+
+func (s prefixStorage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	if start != "" { start = s.prefix + start }
+	objs, next, err := s.Storage.List(ctx, s.prefix+prefix, delimiter, start, count)
+	if err != nil { return nil, "", err }
+	for i := range objs { objs[i].Name = strings.TrimPrefix(objs[i].Name, s.prefix) }
+	return objs, strings.TrimPrefix(next, s.prefix), nil
+}
+
+func (s prefixStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.Storage.Get(ctx, s.prefix+key, offset, length)
+}
+
+func (s prefixStorage) Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error {
+	return s.Storage.Put(ctx, s.prefix+key, r, attrs)
+}
+
+func (s prefixStorage) Delete(ctx context.Context, key string) error {
+	return s.Storage.Delete(ctx, s.prefix+key)
+}
+
+func (s prefixStorage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	attrs, err := s.Storage.Attrs(ctx, s.prefix+key)
+	if err != nil { return nil, err }
+	attrs.Name = strings.TrimPrefix(attrs.Name, s.prefix)
+	return attrs, nil
+}
+
+// listFileNames wraps b2_list_file_names, re-authorizing once if the token
+// has expired (they last 24h).
+func (s *b2Storage) listFileNames(ctx context.Context, count int, start, prefix, delimiter string) ([]*base.File, string, error) {
+	files, next, err := s.listBucket.ListFileNames(ctx, count, start, prefix, delimiter)
+	if err != nil && base.Action(err) == base.ReAuthenticate {
+		fresh, aerr := base.AuthorizeAccount(ctx, s.creds[0], s.creds[1], base.Transport(keyInfo))
+		if aerr != nil { return nil, "", aerr }
+		s.api.Update(fresh)
+		files, next, err = s.listBucket.ListFileNames(ctx, count, start, prefix, delimiter)
+	}
+	return files, next, err
+}
+
+func (s *b2Storage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	files, next, err := s.listFileNames(ctx, count, start, prefix, delimiter)
+	if err != nil { return nil, "", err }
+	var objects []objectAttrs
+	for _, f := range files {
+		switch f.Status {
+		case "folder":
+			objects = append(objects, objectAttrs{ Name: f.Name, Folder: true })
+		case "upload":
+			o := objectAttrs{ Name: f.Name, Size: f.Size, Modified: f.Timestamp }
+			if f.Info != nil {
+				o.SHA1, o.ContentType, o.Info = f.Info.SHA1, f.Info.ContentType, f.Info.Info
+				if sha, ok := f.Info.Info["large_file_sha1"]; ok { o.SHA1 = sha }
+			}
+			objects = append(objects, o)
+		}
+	}
+	return objects, next, nil
+}
+
+// Get reads lazily: a missing object shows up as an error from Read.
+func (s *b2Storage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if offset == 0 && length < 0 { return b2Reader{ s.bucket.Object(key).NewReader(ctx), key }, nil }
+	return b2Reader{ s.bucket.Object(key).NewRangeReader(ctx, offset, length), key }, nil
+}
+
+// b2Reader reports a missing object as errNotFound, on the first Read.
+type b2Reader struct {
+	*b2.Reader
+	key string
+}
+
+func (r b2Reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if b2.IsNotExist(err) { err = fmt.Errorf("%s: %w", r.key, errNotFound) }
+	return n, err
+}
+
+// Put sends files above the writer's chunk size through B2's large-file API
+// in UPLOAD_PART_WORKERS (default 4) parallel parts. Parts are read straight
+// from an io.ReaderAt (a temp file); other readers are buffered
+// UPLOAD_CHUNK_MB (default 16) per part instead of blazer's 100MB.
+func (s *b2Storage) Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error {
+	// Cancelling the writer's context abandons a half-sent file, where Close
+	// would commit it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wr := s.bucket.Object(key).NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{ ContentType: attrs.ContentType, SHA1: attrs.SHA1, Info: attrs.Info }))
+	wr.ConcurrentUploads = envInt("UPLOAD_PART_WORKERS", 4)
+	if _, ok := r.(io.ReaderAt); !ok { wr.ChunkSize = envInt("UPLOAD_CHUNK_MB", 16) << 20 }
+	if _, err := io.Copy(wr, r); err != nil { cancel(); wr.Close(); return err }
+	return wr.Close()
+}
+
+// Delete drops every version of key, hide markers included: blazer's
+// Object.Delete drops only the newest, and the one before it would take its
+// place. Oldest go first, so a delete that fails halfway still leaves the
+// name as it was.
+func (s *b2Storage) Delete(ctx context.Context, key string) error {
+	versions, err := s.Versions(ctx, key)
+	if err != nil { return err }
+	if len(versions) == 0 { return fmt.Errorf("%s: %w", key, errNotFound) }
+	for i := len(versions) - 1; i >= 0; i-- {
+		if err := s.DeleteVersion(ctx, key, versions[i].ID); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *b2Storage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	a, err := s.bucket.Object(key).Attrs(ctx)
+	if b2.IsNotExist(err) { return nil, fmt.Errorf("%s: %w", key, errNotFound) }
+	if err != nil { return nil, err }
+	return &objectAttrs{ Name: key, Size: a.Size, ContentType: a.ContentType, SHA1: a.SHA1, Modified: a.UploadTimestamp, Info: a.Info }, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ========== LOCAL STORAGE ==========
+// Objects are plain files under LOCAL_STORAGE_DIR, laid out by key, so the
+// library stays browsable from the NAS itself. What a file can't hold (content
+// type, SHA1, info such as src_version) is kept in .meta/<key>.json, which is
+// also where uploads are written before being renamed into place.
+
+const localMetaDir = ".meta"
+
+type localStorage struct {
+	root string
+}
+
+type localMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	SHA1        string            `json:"sha1,omitempty"`
+	Info        map[string]string `json:"info,omitempty"`
+}
+
+func newLocalStorage() (*localStorage, error) {
+	root := os.Getenv("LOCAL_STORAGE_DIR")
+	if root == "" { return nil, fmt.Errorf("set LOCAL_STORAGE_DIR") }
+	root, err := filepath.Abs(root)
+	if err != nil { return nil, err }
+	if err := os.MkdirAll(filepath.Join(root, localMetaDir), 0o755); err != nil { return nil, err }
+	bktName = filepath.Base(root)
+	return &localStorage{ root: root }, nil
+}
+
+// file maps a key to its path; keys can't climb out of the root.
+func (s *localStorage) file(key string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if clean == "" || clean != key || clean == localMetaDir || strings.HasPrefix(clean, localMetaDir+"/") { return "", fmt.Errorf("invalid key %q: %w", key, errNotFound) }
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *localStorage) metaFile(key string) string {
+	return filepath.Join(s.root, localMetaDir, filepath.FromSlash(key)+".json")
+}
+
+func (s *localStorage) attrs(key string, fi fs.FileInfo) objectAttrs {
+	a := objectAttrs{ Name: key, Size: fi.Size(), Modified: fi.ModTime(), ContentType: detectContentType(key) }
+	if data, err := os.ReadFile(s.metaFile(key)); err == nil {
+		var m localMeta
+		if json.Unmarshal(data, &m) == nil {
+			if m.ContentType != "" { a.ContentType = m.ContentType }
+			a.SHA1, a.Info = m.SHA1, m.Info
+		}
+	}
+	return a
+}
+
+// List reads only the prefix's folder with delimiter "/", and walks the
+// whole subtree without one. Names are sorted as keys, not as paths, since
+// "a.jpg" sorts before "a/b.jpg".
+func (s *localStorage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	dirKey := prefix[:strings.LastIndex(prefix, "/")+1]
+	dir := filepath.Join(s.root, filepath.FromSlash(dirKey))
+	type entry struct {
+		name string
+		info fs.FileInfo
+	}
+	var entries []entry
+	add := func(name string, d fs.DirEntry) {
+		if !strings.HasPrefix(name, prefix) || name < start { return }
+		if name == localMetaDir+"/" || strings.HasPrefix(name, localMetaDir+"/") { return }
+		var info fs.FileInfo
+		if !d.IsDir() {
+			var err error
+			if info, err = d.Info(); err != nil { return }
+		}
+		entries = append(entries, entry{ name, info })
+	}
+
+	if delimiter == "/" {
+		des, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) { return nil, "", err }
+		for _, d := range des {
+			if d.IsDir() { add(dirKey+d.Name()+"/", d) } else if d.Type().IsRegular() { add(dirKey+d.Name(), d) }
+		}
+	} else {
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == dir { return filepath.SkipDir }
+				return err
+			}
+			if ctx.Err() != nil { return ctx.Err() }
+			rel, _ := filepath.Rel(s.root, p)
+			name := filepath.ToSlash(rel)
+			if d.IsDir() {
+				if name == localMetaDir { return filepath.SkipDir }
+				return nil
+			}
+			if d.Type().IsRegular() { add(name, d) }
+			return nil
+		})
+		if err != nil { return nil, "", err }
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	next := ""
+	if len(entries) > count {
+		next = entries[count].name
+		entries = entries[:count]
+	}
+	objects := make([]objectAttrs, 0, len(entries))
+	for _, e := range entries {
+		if e.info == nil { objects = append(objects, objectAttrs{ Name: e.name, Folder: true }); continue }
+		objects = append(objects, s.attrs(e.name, e.info))
+	}
+	return objects, next, nil
+}
+
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (l limitedFile) Close() error { return l.f.Close() }
+
+func (s *localStorage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := s.file(key)
+	if err != nil { return nil, err }
+	f, err := os.Open(p)
+	if os.IsNotExist(err) { return nil, fmt.Errorf("%s: %w", key, errNotFound) }
+	if err != nil { return nil, err }
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil { f.Close(); return nil, err }
+	}
+	if length < 0 { return f, nil }
+	return limitedFile{ io.LimitReader(f, length), f }, nil
+}
+
+// Put writes to a temp file and renames it into place, so readers never see
+// a partial file. The SHA1 is computed on the way unless given.
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error {
+	p, err := s.file(key)
+	if err != nil { return err }
+	tmp, err := os.CreateTemp(filepath.Join(s.root, localMetaDir), "put-*")
+	if err != nil { return err }
+	defer os.Remove(tmp.Name())
+	hasher := sha1.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), r)
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err != nil { return err }
+
+	m := localMeta{ ContentType: attrs.ContentType, SHA1: attrs.SHA1, Info: attrs.Info }
+	if m.SHA1 == "" || m.SHA1 == "none" { m.SHA1 = hex.EncodeToString(hasher.Sum(nil)) }
+	data, _ := json.Marshal(m)
+	if err := os.MkdirAll(filepath.Dir(s.metaFile(key)), 0o755); err != nil { return err }
+	if err := os.WriteFile(s.metaFile(key), data, 0o644); err != nil { return err }
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { return err }
+	return os.Rename(tmp.Name(), p)
+}
+
+// Delete also removes folders it leaves empty, since B2 has no empty folders.
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.file(key)
+	if err != nil { return err }
+	if err := os.Remove(p); err != nil { return err }
+	os.Remove(s.metaFile(key))
+	for _, base := range []string{ s.root, filepath.Join(s.root, localMetaDir) } {
+		for dir := filepath.Dir(filepath.Join(base, filepath.FromSlash(key))); dir != base && strings.HasPrefix(dir, base); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil { break }
+		}
+	}
+	return nil
+}
+
+func (s *localStorage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	p, err := s.file(key)
+	if err != nil { return nil, err }
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) { return nil, fmt.Errorf("%s: %w", key, errNotFound) }
+	if err != nil { return nil, err }
+	if fi.IsDir() { return nil, fmt.Errorf("%s is a folder: %w", key, errNotFound) }
+	a := s.attrs(key, fi)
+	return &a, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ========== S3 STORAGE ==========
+// A small S3 client (SigV4, path-style by default) covering what Storage
+// needs, so MinIO and friends work without an SDK. Bodies are sent in
+// UPLOAD_CHUNK_MB (default 16) parts: anything that fits one part is a plain
+// PUT, the rest a multipart upload. S3 listings carry no user metadata, so
+// objects have no SHA1 here and versions are modification times (to the
+// second, which is all HEAD reports). Info is stored as x-amz-meta-* headers.
+
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newS3Storage() (*s3Storage, error) {
+	s := &s3Storage{
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    os.Getenv("S3_REGION"),
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		pathStyle: os.Getenv("S3_PATH_STYLE") != "0",
+		client:    &http.Client{ Transport: http.DefaultTransport },
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" || s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("set S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	if !strings.Contains(endpoint, "://") { endpoint = "https://" + endpoint }
+	u, err := url.Parse(endpoint)
+	if err != nil { return nil, fmt.Errorf("bad S3_ENDPOINT: %w", err) }
+	s.endpoint = u
+	if s.region == "" { s.region = "us-east-1" }
+	bktName = s.bucket
+	return s, nil
+}
+
+// s3Error is a non-2xx response.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string { return fmt.Sprintf("s3: %d %s %s", e.Status, e.Code, e.Message) }
+
+func (e *s3Error) Is(target error) bool { return target == errNotFound && e.Status == http.StatusNotFound }
+
+// do sends one signed request. body may be nil.
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil { return nil, err }
+	if len(body) == 0 { req.Body, req.GetBody = http.NoBody, nil }
+	for k, v := range header { req.Header[k] = v }
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil { return nil, err }
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{ Status: resp.StatusCode }
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header, signing the
+// host, Range and every x-amz-* header.
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{ "host": req.URL.Host }
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" { headers[lk] = strings.TrimSpace(strings.Join(v, ",")) }
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers { names = append(names, k) }
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names { canonHeaders.WriteString(k + ":" + headers[k] + "\n") }
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{ req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonHeaders.String(), signed, payloadHash }, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{ now.Format("20060102"), s.region, "s3", "aws4_request" } { key = hmacSHA256(key, part) }
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters (and "/"
+// unless escapeSlash), as SigV4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical (sorted, fully escaped) query string.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q { keys = append(keys, k) }
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] { parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true)) }
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List asks for names after start minus its last character, since S3's
+// start-after is exclusive, and drops the few that sort before start. One
+// name past the page is fetched to become next.
+func (s *s3Storage) List(ctx context.Context, prefix, delimiter, start string, count int) ([]objectAttrs, string, error) {
+	q := url.Values{ "list-type": { "2" }, "prefix": { prefix } }
+	if delimiter != "" { q.Set("delimiter", delimiter) }
+	if start != "" {
+		_, size := utf8.DecodeLastRuneInString(start)
+		q.Set("start-after", start[:len(start)-size])
+	}
+
+	var objects []objectAttrs
+	for len(objects) <= count {
+		q.Set("max-keys", strconv.Itoa(min(count+1-len(objects), 1000)))
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil { return nil, "", err }
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil { return nil, "", err }
+
+		var page []objectAttrs
+		for _, c := range res.Contents {
+			page = append(page, objectAttrs{ Name: c.Key, Size: c.Size, Modified: c.LastModified.Truncate(time.Second), ContentType: detectContentType(c.Key) })
+		}
+		for _, p := range res.CommonPrefixes { page = append(page, objectAttrs{ Name: p.Prefix, Folder: true }) }
+		sort.Slice(page, func(i, j int) bool { return page[i].Name < page[j].Name })
+		for _, o := range page {
+			if o.Name >= start { objects = append(objects, o) }
+		}
+		if !res.IsTruncated { break }
+		q.Del("start-after")
+		q.Set("continuation-token", res.NextContinuationToken)
+	}
+
+	next := ""
+	if len(objects) > count {
+		next = objects[count].Name
+		objects = objects[:count]
+	}
+	return objects, next, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	h := http.Header{}
+	switch {
+	case length == 0:
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	case length > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, h, nil)
+	if err != nil { return nil, err }
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, attrs objectAttrs) error {
+	h := http.Header{}
+	if attrs.ContentType != "" { h.Set("Content-Type", attrs.ContentType) }
+	for k, v := range attrs.Info { h.Set("X-Amz-Meta-"+k, v) }
+
+	partSize := envInt("UPLOAD_CHUNK_MB", 16) << 20
+	part := make([]byte, partSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(ctx, http.MethodPut, key, nil, h, part[:n])
+		if err != nil { return err }
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil { return err }
+
+	// Multipart: aborted on any error so no parts are left billed
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{ "uploads": { "" } }, h, nil)
+	if err != nil { return err }
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil { return err }
+	abort := func(err error) error {
+		if resp, aerr := s.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{ "uploadId": { created.UploadID } }, nil, nil); aerr == nil { resp.Body.Close() }
+		return err
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	for num := 1; n > 0; num++ {
+		q := url.Values{ "partNumber": { strconv.Itoa(num) }, "uploadId": { created.UploadID } }
+		resp, err := s.do(ctx, http.MethodPut, key, q, nil, part[:n])
+		if err != nil { return abort(err) }
+		resp.Body.Close()
+		parts = append(parts, completedPart{ num, resp.Header.Get("ETag") })
+
+		n, err = io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF { return abort(err) }
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{ Parts: parts })
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{ "uploadId": { created.UploadID } }, nil, body)
+	if err != nil { return abort(err) }
+	defer resp.Body.Close()
+	// A 200 can still carry an error document
+	data, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{ Status: resp.StatusCode }
+		xml.Unmarshal(data, e)
+		return abort(e)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil { return err }
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Attrs(ctx context.Context, key string) (*objectAttrs, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil { return nil, err }
+	resp.Body.Close()
+	a := &objectAttrs{ Name: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type") }
+	a.Modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for k, v := range resp.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-meta-") && len(v) > 0 {
+			if a.Info == nil { a.Info = map[string]string{} }
+			a.Info[strings.TrimPrefix(lk, "x-amz-meta-")] = v[0]
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== SVG DRAWINGS ==========
+// SVGs get thumbnails rasterized by rsvg-convert, or whatever compatible
+// command SVG_RASTERIZER names (see the thumbnailer package), and the viewer
+// shows the original itself: a browser draws an SVG at any size.
+//
+// An SVG is a document that can carry scripts, and one opened straight from
+// /view/ would run them with the library's cookies. Originals are served
+// with a policy that sandboxes them and lets them load nothing, so it's only
+// ever a picture; an <img> never runs scripts anyway.
+
+const svgPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+func isSVG(name string) bool { return thumbnailer.IsSVG(name) }
+
+func initSVG() {
+	if cmd := os.Getenv("SVG_RASTERIZER"); cmd != "" { thumbnailer.SVGRasterizer = cmd }
+	if _, err := exec.LookPath(thumbnailer.SVGRasterizer); err != nil {
+		log.Printf("⚠️ %s is not installed, SVGs get no thumbnails", thumbnailer.SVGRasterizer)
+	}
+}
+
+// sandboxSVG sets the policy on a response serving the original of name
+// inline, if it is an SVG.
+func sandboxSVG(w http.ResponseWriter, name string) {
+	if isSVG(name) { w.Header().Set("Content-Security-Policy", svgPolicy) }
+}
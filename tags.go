@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ========== TAGS & FAVORITES ==========
+// Tags and the favorite flag live in the sidecar like the rest of a file's
+// metadata; the "tags" bucket is an index of them (name -> tagEntry) so
+// /tags/{tag}, /favorites and the index's tag chips don't read every sidecar.
+// writeSidecar keeps it current, and the first catalog sync after the bucket
+// goes missing rebuilds it from the sidecars in B2 (see rebuildSidecarIndex).
+//
+// GET  /tags/{tag}   files with that tag (case-insensitive)
+// GET  /favorites    favorite files
+// POST /tag          name, add or remove (login required)
+// POST /favorite     name, on=1|0 (login required)
+
+type tagEntry struct {
+	Tags     []string `json:"tags,omitempty"`
+	Favorite bool     `json:"favorite,omitempty"`
+	Hidden   bool     `json:"hidden,omitempty"` // see hidden.go
+}
+
+type tagCount struct {
+	Tag   string
+	Count int
+}
+
+// indexTags records name's tags, favorite and hidden flags from its sidecar.
+func indexTags(name string, sc sidecar) {
+	if len(sc.Tags) == 0 && !sc.Favorite && !sc.Hidden { dbDelete("tags", name); return }
+	if err := dbPut("tags", name, tagEntry{ sc.Tags, sc.Favorite, sc.Hidden }); err != nil { log.Printf("Tag index update %s failed: %v", name, err) }
+}
+
+// taggedNames lists the names matching keep, sorted.
+func taggedNames(keep func(e tagEntry) bool) []string {
+	var names []string
+	dbEach("tags", func(key string, data []byte) error {
+		var e tagEntry
+		if json.Unmarshal(data, &e) == nil && keep(e) { names = append(names, key) }
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func hasTag(e tagEntry, tag string) bool {
+	return slices.ContainsFunc(e.Tags, func(t string) bool { return strings.EqualFold(t, tag) })
+}
+
+// topTags counts tags across the library, most used first. Tags differing
+// only in case are counted together under the first spelling seen.
+func topTags(limit int) []tagCount {
+	counts := map[string]*tagCount{}
+	dbEach("tags", func(key string, data []byte) error {
+		var e tagEntry
+		if json.Unmarshal(data, &e) != nil { return nil }
+		for _, t := range e.Tags {
+			k := strings.ToLower(t)
+			if counts[k] == nil { counts[k] = &tagCount{ Tag: t } }
+			counts[k].Count++
+		}
+		return nil
+	})
+	var tags []tagCount
+	for _, c := range counts { tags = append(tags, *c) }
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count { return tags[i].Count > tags[j].Count }
+		return strings.ToLower(tags[i].Tag) < strings.ToLower(tags[j].Tag)
+	})
+	if limit > 0 && len(tags) > limit { tags = tags[:limit] }
+	return tags
+}
+
+// ========== TAG HANDLERS ==========
+func tagListHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/")
+	if tag == "" { http.Redirect(w, r, "/", http.StatusSeeOther); return }
+	renderTagged(w, r, "#"+tag, taggedNames(func(e tagEntry) bool { return hasTag(e, tag) }))
+}
+
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	renderTagged(w, r, "★ Favorites", taggedNames(func(e tagEntry) bool { return e.Favorite }))
+}
+
+func renderTagged(w http.ResponseWriter, r *http.Request, title string, names []string) {
+	names = readableNames(currentUser(r), names)
+	entries := make([]map[string]any, len(names))
+	var unknown []int // not in the catalog yet, looked up in storage
+	for i, name := range names {
+		if e, ok := catalogGet(name); ok { entries[i] = e.fileEntry() } else { unknown = append(unknown, i) }
+	}
+	inParallel(len(unknown), func(j int) {
+		i := unknown[j]
+		if f, ok := apiStat(r.Context(), names[i]); ok { entries[i] = fileEntry(names[i], f.Size, f.Uploaded, f.Version) }
+	})
+	var files []map[string]any
+	for _, f := range entries {
+		if f != nil { files = append(files, f) }
+	}
+	tpls.ExecuteTemplate(w, "index.html", map[string]any{
+		"BucketName": bktName,
+		"Files":      files,
+		"Tag":        title,
+		"TagList":    topTags(envInt("TAG_CHIPS", 12)),
+		"LoggedIn":   currentUser(r) != "",
+
+		"Layout":     layoutFor(r),
+		"Back":       r.URL.RequestURI(),
+	})
+}
+
+// POST /tag adds or removes one tag, keeping the rest of the sidecar.
+func tagEditHandler(w http.ResponseWriter, r *http.Request) {
+	editSidecar(w, r, func(sc *sidecar) {
+		if add := strings.TrimSpace(r.FormValue("add")); add != "" {
+			for _, t := range splitList(add) {
+				if !hasTag(tagEntry{ Tags: sc.Tags }, t) { sc.Tags = append(sc.Tags, t) }
+			}
+		}
+		if remove := strings.TrimSpace(r.FormValue("remove")); remove != "" {
+			sc.Tags = slices.DeleteFunc(sc.Tags, func(t string) bool { return strings.EqualFold(t, remove) })
+		}
+	})
+}
+
+// POST /favorite sets or clears the favorite flag.
+func favoriteHandler(w http.ResponseWriter, r *http.Request) {
+	editSidecar(w, r, func(sc *sidecar) { sc.Favorite = r.FormValue("on") == "1" })
+}
+
+func editSidecar(w http.ResponseWriter, r *http.Request, edit func(sc *sidecar)) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	name := strings.Trim(r.FormValue("name"), "/")
+	if _, ok := apiStat(r.Context(), name); !ok || !isLibraryFile(name) { http.Error(w, "no such file", 404); return }
+
+	sc, _ := readSidecar(r.Context(), name)
+	edit(&sc)
+	if err := writeSidecar(r.Context(), name, sc); err != nil {
+		log.Println("Failed to write sidecar:", err)
+		http.Error(w, "save failed", 500); return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, 200, tagEntry{ sc.Tags, sc.Favorite, sc.Hidden })
+		return
+	}
+	http.Redirect(w, r, "/viewer/"+name, http.StatusSeeOther)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ========== GOOGLE TAKEOUT IMPORT ==========
+//	memories import-takeout ARCHIVE... FOLDER/
+//
+// ARCHIVE is a Takeout zip (takeout-…-001.zip; pass every part of a split
+// export, a file's JSON can end up in another part than the file) or the
+// directory one was unpacked to. Only "Google Photos" is read:
+//
+//	Photos from 2019/IMG_1.jpg  ->  FOLDER/2019/IMG_1.jpg
+//	Trip/IMG_1.jpg              ->  item of the album "Trip" (no second copy)
+//	Trip/IMG_2.jpg              ->  FOLDER/Trip/IMG_2.jpg, item of "Trip"
+//
+// Album folders repeat the photos of the year folders, so a file whose bytes
+// are already in the library joins the album under its stored name (and
+// keeps that copy's metadata) instead of being uploaded again. The title and
+// description of each album come from its metadata.json. The "<file>.json"
+// Google writes next to each file (also as .supplemental-metadata.json, cut
+// short for long names) gives the caption, capture time, location, people
+// and favourite, which go into the file's sidecar and so into search, the
+// map and date sorting. Files already stored with the same SHA1 only get
+// their metadata applied, so an interrupted import can be run again.
+
+type takeoutFile struct {
+	name  string // path inside Google Photos, "Trip/IMG_1.jpg"
+	local string // for unpacked directories
+	zf    *zip.File
+}
+
+func (f takeoutFile) open() (io.ReadCloser, error) {
+	if f.zf != nil { return f.zf.Open() }
+	return os.Open(f.local)
+}
+
+// takeoutMeta is the part of Google's per-file and album JSON used here.
+type takeoutMeta struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"` // Unix seconds
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeo `json:"geoData"`
+	GeoDataExif takeoutGeo `json:"geoDataExif"`
+	People      []struct {
+		Name string `json:"name"`
+	} `json:"people"`
+	Favorited bool `json:"favorited"`
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// takeoutJob is one media file and where it goes.
+type takeoutJob struct {
+	file  takeoutFile
+	name  string // library name it is stored under
+	album string // album folder it was found in, "" for year folders
+	meta  *takeoutMeta
+}
+
+var takeoutYearFolder = regexp.MustCompile(`^Photos from (\d{4})$`)
+
+func importTakeoutCommand(ctx context.Context, args []string) error {
+	if len(args) < 2 { return usageError("import-takeout takes one or more archives and a folder") }
+	archives, folder := args[:len(args)-1], strings.Trim(args[len(args)-1], "/")
+
+	files, closeAll, err := readTakeout(archives)
+	defer closeAll()
+	if err != nil { return err }
+
+	// Google's JSON, by the path it describes
+	metas := map[string]takeoutFile{}
+	for _, f := range files {
+		if strings.HasSuffix(f.name, ".json") { metas[takeoutMetaKey(f.name)] = f }
+	}
+	var years, albumFiles []takeoutJob
+	albumDirs := map[string]bool{}
+	for _, f := range files {
+		base := path.Base(f.name)
+		if strings.HasSuffix(base, ".json") || strings.HasSuffix(base, ".html") || strings.HasPrefix(base, ".") { continue }
+		job := takeoutJob{ file: f }
+		if m, ok := matchTakeoutMeta(f.name, metas); ok { job.meta = &m }
+		dir := path.Dir(f.name)
+		switch y := takeoutYearFolder.FindStringSubmatch(dir); {
+		case dir == ".":
+			job.name = path.Join(folder, base)
+			years = append(years, job)
+		case y != nil:
+			job.name = path.Join(folder, y[1], base)
+			years = append(years, job)
+		default:
+			job.name, job.album = path.Join(folder, strings.ReplaceAll(dir, "/", " - "), base), dir
+			albumDirs[dir] = true
+			albumFiles = append(albumFiles, job)
+		}
+	}
+	if len(years)+len(albumFiles) == 0 { return fmt.Errorf("no Google Photos files found in %s", strings.Join(archives, ", ")) }
+	fmt.Printf("📥 Importing %d file(s) and %d album(s) to %s/\n", len(years)+len(albumFiles), len(albumDirs), folder)
+
+	// Year folders first, so the album copies find their bytes stored
+	var stats takeoutStats
+	runTakeoutJobs(ctx, years, &stats)
+	stored := runTakeoutJobs(ctx, albumFiles, &stats)
+
+	dirs := make([]string, 0, len(albumDirs))
+	for dir := range albumDirs { dirs = append(dirs, dir) }
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		var items []string
+		for i, job := range albumFiles {
+			if job.album == dir && stored[i] != "" { items = append(items, stored[i]) }
+		}
+		title, description := path.Base(dir), ""
+		if f, ok := metas[takeoutMetaKey(dir+"/metadata.json")]; ok {
+			if m, err := readTakeoutMeta(f); err == nil {
+				if m.Title != "" { title = m.Title }
+				description = m.Description
+			}
+		}
+		if err := importTakeoutAlbum(title, description, items); err != nil {
+			log.Printf("Takeout album %s: %v", title, err)
+			stats.failed.Add(1)
+		}
+	}
+
+	fmt.Printf("📥 Import finished: %d stored, %d already there, %d linked to albums, %d failed\n", stats.stored.Load(), stats.unchanged.Load(), stats.linked.Load(), stats.failed.Load())
+	if stats.failed.Load() > 0 { return fmt.Errorf("%d file(s) failed", stats.failed.Load()) }
+	return nil
+}
+
+// readTakeout lists the Google Photos files of every archive. closeAll
+// closes the zips once their files aren't needed any more.
+func readTakeout(archives []string) (files []takeoutFile, closeAll func(), err error) {
+	var zips []*zip.ReadCloser
+	closeAll = func() {
+		for _, z := range zips { z.Close() }
+	}
+	var all []takeoutFile
+	for _, archive := range archives {
+		st, err := os.Stat(archive)
+		if err != nil { return nil, closeAll, err }
+		if !st.IsDir() {
+			z, err := zip.OpenReader(archive)
+			if err != nil { return nil, closeAll, fmt.Errorf("%s: %w", archive, err) }
+			zips = append(zips, z)
+			for _, zf := range z.File {
+				if !zf.FileInfo().IsDir() { all = append(all, takeoutFile{ name: zf.Name, zf: zf }) }
+			}
+			continue
+		}
+		err = filepath.WalkDir(archive, func(p string, d fs.DirEntry, err error) error {
+			if err != nil { return err }
+			if !d.Type().IsRegular() { return nil }
+			rel, err := filepath.Rel(archive, p)
+			if err != nil { return err }
+			all = append(all, takeoutFile{ name: filepath.ToSlash(rel), local: p })
+			return nil
+		})
+		if err != nil { return nil, closeAll, err }
+	}
+
+	// Paths start at "Takeout/Google Photos/" in a fresh export; an archive
+	// without that folder is taken to be the Google Photos folder itself
+	const root = "Google Photos/"
+	hasRoot := slices.ContainsFunc(all, func(f takeoutFile) bool { return strings.Contains(f.name, root) })
+	for _, f := range all {
+		if _, rest, ok := strings.Cut(f.name, root); ok {
+			f.name = rest
+		} else if hasRoot {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, closeAll, nil
+}
+
+// takeoutMetaKey is the file a Takeout JSON describes: "a/IMG.jpg" for
+// "a/IMG.jpg.json", "a/IMG.jpg.supplemental-metadata.json" or one cut short
+// ("a/IMG.jpg.supplemen.json"), and "a/IMG.jpg(1)" for the numbered forms.
+func takeoutMetaKey(name string) string {
+	key := strings.TrimSuffix(name, ".json")
+	num := ""
+	if i := strings.LastIndex(key, "("); i > 0 && strings.HasSuffix(key, ")") {
+		if _, err := strconv.Atoi(key[i+1 : len(key)-1]); err == nil { key, num = key[:i], key[i:] }
+	}
+	const supplemental = ".supplemental-metadata"
+	for n := len(supplemental); n > 0; n-- {
+		if strings.HasSuffix(key, supplemental[:n]) { key = strings.TrimSuffix(key, supplemental[:n]); break }
+	}
+	return key + num
+}
+
+// matchTakeoutMeta finds the JSON for a media file. Google numbers clashing
+// names as "IMG(1).jpg" with "IMG.jpg(1).json", gives "IMG-edited.jpg" the
+// JSON of "IMG.jpg", and cuts long JSON names short, so the longest key the
+// name starts with is the last resort.
+func matchTakeoutMeta(name string, metas map[string]takeoutFile) (takeoutMeta, bool) {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	candidates := []string{ name, dir + strings.TrimSuffix(stem, "-edited") + ext }
+	if i := strings.LastIndex(stem, "("); i > 0 && strings.HasSuffix(stem, ")") {
+		candidates = append(candidates, dir+stem[:i]+ext+stem[i:])
+	}
+	for _, c := range candidates {
+		if f, ok := metas[c]; ok {
+			if m, err := readTakeoutMeta(f); err == nil { return m, true }
+		}
+	}
+	best := ""
+	for key := range metas {
+		if len(path.Base(key)) >= 40 && path.Dir(key) == path.Dir(name) && strings.HasPrefix(name, key) && len(key) > len(best) { best = key }
+	}
+	if best == "" { return takeoutMeta{}, false }
+	m, err := readTakeoutMeta(metas[best])
+	return m, err == nil
+}
+
+func readTakeoutMeta(f takeoutFile) (takeoutMeta, error) {
+	var m takeoutMeta
+	rc, err := f.open()
+	if err != nil { return m, err }
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&m)
+	return m, err
+}
+
+type takeoutStats struct {
+	stored, unchanged, linked, failed atomic.Int64
+}
+
+// runTakeoutJobs imports jobs with SYNC_WORKERS workers and returns the
+// library name each one ended up as ("" when it failed).
+func runTakeoutJobs(ctx context.Context, jobs []takeoutJob, stats *takeoutStats) []string {
+	names := make([]string, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for n := envInt("SYNC_WORKERS", 4); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				name, err := importTakeoutFile(ctx, jobs[i], stats)
+				if err != nil { log.Printf("Takeout %s: %v", jobs[i].file.name, err); stats.failed.Add(1); continue }
+				names[i] = name
+			}
+		}()
+	}
+	for i := range jobs { queue <- i }
+	close(queue)
+	wg.Wait()
+	return names
+}
+
+func importTakeoutFile(ctx context.Context, job takeoutJob, stats *takeoutStats) (string, error) {
+	local, size, sha, err := takeoutLocal(job.file)
+	if err != nil { return "", err }
+	if job.file.local == "" { defer os.Remove(local) }
+
+	name := job.name
+	switch {
+	case storedSHA1(ctx, name) == sha:
+		stats.unchanged.Add(1)
+	case job.album != "" && len(namesWithHash(sha, "")) > 0:
+		// Its metadata came with the stored copy, or belongs to the library
+		stats.linked.Add(1)
+		return namesWithHash(sha, "")[0], nil
+	default:
+		if !isLibraryFile(name) { return "", fmt.Errorf("%s is a reserved name", name) }
+		res := storeLocal(ctx, local, size, sha, name, false, nil)
+		if res.Error != "" { return "", fmt.Errorf("%s", res.Error) }
+		fmt.Println("✅", name)
+		stats.stored.Add(1)
+	}
+	if job.meta != nil { applyTakeoutMeta(ctx, name, *job.meta) }
+	return name, nil
+}
+
+// takeoutLocal is a local copy of f and its size and SHA1; files of an
+// unpacked directory are used where they are.
+func takeoutLocal(f takeoutFile) (local string, size int64, sha string, err error) {
+	if f.zf == nil {
+		size, sha, err = hashLocal(f.local)
+		return f.local, size, sha, err
+	}
+	rc, err := f.zf.Open()
+	if err != nil { return "", 0, "", err }
+	defer rc.Close()
+	tmp, err := createTemp("takeout-*"+path.Ext(f.name))
+	if err != nil { return "", 0, "", err }
+	h := sha1.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), rc)
+	tmp.Close()
+	if err != nil { os.Remove(tmp.Name()); return "", 0, "", fmt.Errorf("unpack failed: %w", err) }
+	return tmp.Name(), size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// applyTakeoutMeta writes what Google Photos knew about a file into its
+// sidecar. Capture time and location were editable there, so they win over
+// the EXIF values upload read.
+func applyTakeoutMeta(ctx context.Context, name string, m takeoutMeta) {
+	sc, _ := readSidecar(ctx, name)
+	before := sc
+	if m.Description != "" { sc.Caption = m.Description }
+	if ts, err := strconv.ParseInt(m.PhotoTakenTime.Timestamp, 10, 64); err == nil && ts > 0 {
+		t := time.Unix(ts, 0).UTC()
+		sc.CaptureTime = &t
+	}
+	for _, geo := range []takeoutGeo{ m.GeoData, m.GeoDataExif } {
+		if geo.Latitude != 0 || geo.Longitude != 0 { sc.Location = &geoPoint{ Lat: geo.Latitude, Lon: geo.Longitude }; break }
+	}
+	for _, p := range m.People {
+		if p.Name != "" && !slices.Contains(sc.People, p.Name) { sc.People = append(sc.People, p.Name) }
+	}
+	sc.Favorite = sc.Favorite || m.Favorited
+	if !sc.sameMoment(before) { sc.Weather = nil }
+	enrichWeather(ctx, name, &sc)
+	if err := writeSidecar(ctx, name, sc); err != nil { log.Printf("Takeout metadata for %s: %v", name, err) }
+}
+
+// importTakeoutAlbum adds items to the top-level album called title, creating
+// it if there is none, so a repeated import doesn't make a second one.
+func importTakeoutAlbum(title, description string, items []string) error {
+	if len(items) == 0 { return nil }
+	var a *album
+	for _, existing := range childAlbums("") {
+		if existing.Title == title { a = existing; break }
+	}
+	if a == nil {
+		a = &album{ ID: newID(), Title: title, Description: description, Position: len(childAlbums("")), Created: time.Now() }
+	}
+	added := 0
+	for _, name := range items {
+		if !slices.Contains(a.Items, name) { a.Items = append(a.Items, name); added++ }
+	}
+	if err := saveAlbum(a); err != nil { return err }
+	fmt.Printf("🗂️ Album %s: %d item(s) added\n", title, added)
+	return nil
+}
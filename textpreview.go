@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// ========== TEXT PREVIEWS ==========
+// Notes, Markdown, logs and source files are shown in the viewer instead of
+// only offering a download. The first TEXT_PREVIEW_KB (default 256) are read
+// into the page, escaped like any other template value; a longer file is
+// cut there with a note, so a huge log only costs that much. Markdown is
+// rendered in the browser (marked, then DOMPurify, so a note can't inject
+// scripts) and code is highlighted by highlight.js. Files that turn out not
+// to be UTF-8 text get the download card.
+
+// textLanguages maps the extensions previewed to their highlight.js
+// language ("" for plain text, "markdown" is rendered instead).
+var textLanguages = map[string]string{
+	".txt": "", ".log": "", ".text": "",
+	".md": "markdown", ".markdown": "markdown",
+	".csv": "plaintext", ".tsv": "plaintext",
+	".json": "json", ".yaml": "yaml", ".yml": "yaml", ".toml": "ini", ".ini": "ini", ".conf": "ini", ".env": "ini",
+	".xml": "xml", ".html": "xml", ".css": "css",
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript", ".rb": "ruby", ".rs": "rust",
+	".java": "java", ".kt": "kotlin", ".swift": "swift", ".c": "c", ".h": "c", ".cpp": "cpp", ".cs": "csharp",
+	".php": "php", ".sh": "bash", ".sql": "sql", ".diff": "diff", ".patch": "diff",
+}
+
+func isText(name string) bool {
+	_, ok := textLanguages[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+func textLanguage(name string) string { return textLanguages[strings.ToLower(path.Ext(name))] }
+
+// readTextPreview reads the start of the text file at key. ok is false when
+// it can't be read or isn't UTF-8.
+func readTextPreview(ctx context.Context, key string) (text string, truncated, ok bool) {
+	rc, err := getObject(ctx, key)
+	if err != nil { return "", false, false }
+	defer rc.Close()
+	limit := int64(envInt("TEXT_PREVIEW_KB", 256)) << 10
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil { return "", false, false }
+	if int64(len(data)) > limit {
+		data, truncated = data[:limit], true
+		// Don't let the cut split a character
+		for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ { data = data[:len(data)-1] }
+	}
+	if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) { return "", false, false }
+	return string(data), truncated, true
+}
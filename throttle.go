@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== LOGIN THROTTLE ==========
+// Failed logins are counted per account and per IP inside a sliding window.
+// Crossing the limit locks that key out for LOGIN_LOCKOUT. All auth log lines
+// use a fixed "[auth] ... user=%q from ip=%s" shape so fail2ban can match:
+//   failregex = \[auth\] authentication failure for user=".*" from ip=<HOST>
+
+type failures struct {
+	times       []time.Time
+	lockedUntil time.Time
+}
+
+type loginThrottle struct {
+	mu        sync.Mutex
+	byAccount map[string]*failures
+	byIP      map[string]*failures
+
+	maxPerAccount int
+	maxPerIP      int
+	window        time.Duration
+	lockout       time.Duration
+}
+
+var throttle *loginThrottle
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		byAccount:     map[string]*failures{},
+		byIP:          map[string]*failures{},
+		maxPerAccount: envInt("LOGIN_MAX_ATTEMPTS", 5),
+		maxPerIP:      envInt("LOGIN_MAX_ATTEMPTS_PER_IP", 20),
+		window:        envDuration("LOGIN_WINDOW", 15*time.Minute),
+		lockout:       envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+	}
+}
+
+// Locked returns how long the account or IP is still locked out, or 0.
+func (t *loginThrottle) Locked(user, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, f := range []*failures{ t.byAccount[strings.ToLower(user)], t.byIP[ip] } {
+		if f != nil && f.lockedUntil.After(now) && f.lockedUntil.Sub(now) > wait {
+			wait = f.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt and locks the account/IP when over the limit.
+func (t *loginThrottle) Fail(user, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.record(t.byAccount, strings.ToLower(user), t.maxPerAccount) {
+		log.Printf("[auth] account locked for user=%q from ip=%s for %s", user, ip, t.lockout)
+		go sendLockoutAlert("account "+user, ip, t.lockout)
+	}
+	if t.record(t.byIP, ip, t.maxPerIP) {
+		log.Printf("[auth] ip locked for user=%q from ip=%s for %s", user, ip, t.lockout)
+		go sendLockoutAlert("IP "+ip, ip, t.lockout)
+	}
+}
+
+// Succeed clears the account's failure history (the IP history is kept so a
+// valid login can't be used to reset a password-spraying IP).
+func (t *loginThrottle) Succeed(user, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.byAccount, strings.ToLower(user))
+}
+
+func (t *loginThrottle) record(m map[string]*failures, key string, max int) bool {
+	now := time.Now()
+	f := m[key]
+	if f == nil {
+		f = &failures{}
+		m[key] = f
+	}
+
+	// Drop attempts that fell out of the window
+	kept := f.times[:0]
+	for _, ts := range f.times {
+		if now.Sub(ts) < t.window { kept = append(kept, ts) }
+	}
+	f.times = append(kept, now)
+
+	if len(f.times) >= max && !f.lockedUntil.After(now) {
+		f.lockedUntil = now.Add(t.lockout)
+		f.times = nil
+		return true
+	}
+	return false
+}
+
+// sweep forgets entries with no recent failures and no active lockout.
+func (t *loginThrottle) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, m := range []map[string]*failures{ t.byAccount, t.byIP } {
+		for k, f := range m {
+			recent := len(f.times) > 0 && now.Sub(f.times[len(f.times)-1]) < t.window
+			if !recent && !f.lockedUntil.After(now) { delete(m, k) }
+		}
+	}
+}
+
+func (t *loginThrottle) runSweeper() {
+	for range time.Tick(t.window) { t.sweep() }
+}
+
+// clientIP returns the remote IP, trusting X-Forwarded-For only when
+// TRUST_PROXY is set (i.e. behind a reverse proxy we control).
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") != "" {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { return r.RemoteAddr }
+	return host
+}
+
+// ========== EMAIL ALERTS ==========
+// Optional: set ALERT_EMAIL_TO and SMTP_HOST (plus SMTP_PORT, SMTP_USER,
+// SMTP_PASS, SMTP_FROM as needed). Upload notifications (notify.go) go
+// through the same server to NOTIFY_EMAIL_TO.
+func sendLockoutAlert(what, ip string, d time.Duration) {
+	subject := "memories: login lockout"
+	body := fmt.Sprintf("%s was locked out for %s after repeated failed logins (last from %s).", what, d, ip)
+	if err := sendEmail(subject, body); err != nil {
+		log.Println("Failed to send lockout alert:", err)
+	}
+}
+
+func sendEmail(subject, body string) error {
+	return sendEmailTo(os.Getenv("ALERT_EMAIL_TO"), subject, body)
+}
+
+// sendEmailTo mails a comma-separated list of addresses through SMTP_HOST.
+func sendEmailTo(to, subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if to == "" || host == "" { return nil }
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" { port = "587" }
+	from := os.Getenv("SMTP_FROM")
+	if from == "" { from = os.Getenv("SMTP_USER") }
+
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)
+	}
+	// Subjects can carry file names, so they are encoded for non-ASCII
+	msg := "From: " + from + "\r\nTo: " + to + "\r\nSubject: " + mime.QEncoding.Encode("utf-8", subject) +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + body + "\r\n"
+	return smtp.SendMail(host+":"+port, auth, from, splitList(to), []byte(msg))
+}
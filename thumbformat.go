@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// ========== THUMBNAIL FORMATS ==========
+// Browsers whose Accept header allows it get WebP (or AVIF) thumbnails, which
+// are typically a third smaller than JPEG. A variant is encoded by ffmpeg from
+// the freshly rendered JPEG and stored next to it under its own extension
+// (thumb/photos/a.webp, thumb-600/photos/a.avif). THUMB_FORMATS lists the
+// formats to offer in order of preference: "webp" by default, "avif,webp" to
+// opt into AVIF (slow to encode), "" for JPEG only. A format ffmpeg can't
+// encode is switched off after the first failure.
+
+type thumbFormat struct {
+	name, ext, contentType string
+	args                   []string // ffmpeg output options
+}
+
+var jpegThumb = thumbFormat{ "jpeg", ".jpg", "image/jpeg", nil }
+
+var knownThumbFormats = []thumbFormat{
+	{ "webp", ".webp", "image/webp", []string{ "-c:v", "libwebp", "-quality", "75" } },
+	{ "avif", ".avif", "image/avif", []string{ "-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-cpu-used", "6" } },
+}
+
+var (
+	offeredThumbFormats []thumbFormat
+	brokenThumbFormats  sync.Map // name -> true once ffmpeg failed to encode it
+)
+
+func initThumbFormats() {
+	v, set := os.LookupEnv("THUMB_FORMATS")
+	if !set { v = "webp" }
+	for _, name := range strings.Split(v, ",") {
+		for _, f := range knownThumbFormats {
+			if f.name == strings.TrimSpace(name) { offeredThumbFormats = append(offeredThumbFormats, f) }
+		}
+	}
+}
+
+// negotiateThumbFormat picks the first offered format the client accepts.
+func negotiateThumbFormat(accept string) thumbFormat {
+	for _, f := range offeredThumbFormats {
+		if _, broken := brokenThumbFormats.Load(f.name); broken { continue }
+		if strings.Contains(accept, f.contentType) { return f }
+	}
+	return jpegThumb
+}
+
+// encodeThumb converts a JPEG thumbnail to f. On failure (other than ctx
+// ending) the format is switched off, since it usually means ffmpeg was built without the encoder.
+func encodeThumb(ctx context.Context, jpeg []byte, f thumbFormat) ([]byte, error) {
+	if f.name == jpegThumb.name { return jpeg, nil }
+	src, err := createTemp("thumb-*.jpg")
+	if err != nil { return nil, err }
+	defer os.Remove(src.Name())
+	_, err = src.Write(jpeg)
+	src.Close()
+	if err != nil { return nil, err }
+	out := strings.TrimSuffix(src.Name(), ".jpg") + f.ext
+	defer os.Remove(out)
+
+	args := append([]string{ "-y", "-i", src.Name() }, f.args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args, out)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		log.Printf("FFmpeg can't encode %s thumbnails, serving JPEG instead: %s", f.name, string(output))
+		brokenThumbFormats.Store(f.name, true)
+		return nil, fmt.Errorf("%s encode failed: %w", f.name, err)
+	}
+	return os.ReadFile(out)
+}
+
+// thumbVariantPaths lists every stored size, shape and format of an
+// original's thumbnail except the default JPEG.
+func thumbVariantPaths(originalKey string) []string {
+	var paths []string
+	for _, width := range append([]int{ thumbWidth }, thumbSizes...) {
+		for _, f := range append([]thumbFormat{ jpegThumb }, knownThumbFormats...) {
+			if width != thumbWidth || f.name != jpegThumb.name { paths = append(paths, getSizedThumbPath(originalKey, width, f, false)) }
+			paths = append(paths, getSizedThumbPath(originalKey, width, f, true))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,294 @@
+// Package thumbnailer renders the JPEG thumbnails of photos, camera RAW files
+// and videos. Uploads, /thumb/, the backfill and the RAW viewer preview all
+// go through GenerateThumbnail, so a new format only needs adding here.
+//
+// Photos are decoded in process with their EXIF rotation applied. Videos go
+// through ffmpeg, which grabs the picked frame, or several for a contact
+// sheet. RAW files go through dcraw,
+// or whichever dcraw-compatible command RAWDecoder names: the JPEG preview
+// most cameras embed (dcraw -e) is used when it is wide enough, otherwise
+// the sensor data is developed at half size (dcraw -w -h -T). SVGs are
+// rasterized at the thumbnail width by rsvg-convert, or whichever command
+// SVGRasterizer names, that takes the same -w and -f png flags.
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// RAWDecoder is the dcraw-compatible command RAW files are decoded with.
+var RAWDecoder = "dcraw"
+
+// SVGRasterizer is the rsvg-convert-compatible command SVGs are rendered with.
+var SVGRasterizer = "rsvg-convert"
+
+// TempDir is where temp files are made; "" is the system's temp dir.
+var TempDir = ""
+
+// ErrUnsupported is returned for files that get no thumbnail.
+var ErrUnsupported = errors.New("no thumbnail for this file type")
+
+// Frame is the frame of a video a thumbnail shows: the one Offset seconds
+// in (or halfway through, with Middle), or with Smart the most
+// representative of the ~100 frames from there on (ffmpeg's thumbnail
+// filter), which skips black frames and fade-ins. With Sheet the thumbnail is
+// a contact sheet instead, a Sheet×Sheet grid of frames spread evenly over
+// the video, for videos at least SheetOver seconds long; shorter ones get the
+// single frame. Middle and sheets need the video's length from ffprobe, and
+// fall back to the frame Offset in without it.
+type Frame struct {
+	Offset    float64 `json:"offset"` // seconds
+	Smart     bool    `json:"smart,omitempty"`
+	Middle    bool    `json:"middle,omitempty"`
+	Sheet     int     `json:"sheet,omitempty"`      // grid side, 2 or more; 0 for one frame
+	SheetOver float64 `json:"sheet_over,omitempty"` // seconds
+}
+
+// Options say how a thumbnail is rendered.
+type Options struct {
+	Width   int   // in pixels; the height follows the aspect ratio
+	Quality int   // JPEG quality 1-100; 0 is imaging's default (95)
+	Frame   Frame // videos only
+	Square  bool  // cropped to Width×Width around the center instead
+}
+
+func hasSuffix(name string, suffixes ...string) bool {
+	name = strings.ToLower(name)
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, s) { return true }
+	}
+	return false
+}
+
+// IsImage reports the photo types decoded in process. TIFF and BMP come
+// from golang.org/x/image through imaging.
+func IsImage(name string) bool { return hasSuffix(name, ".jpg", ".jpeg", ".png", ".gif", ".webp", ".tif", ".tiff", ".bmp") }
+func IsVideo(name string) bool { return hasSuffix(name, ".mp4", ".mov", ".mkv", ".webm") }
+func IsRAW(name string) bool   { return hasSuffix(name, ".cr2", ".nef", ".dng") }
+func IsSVG(name string) bool   { return hasSuffix(name, ".svg") }
+
+// Supported reports whether GenerateThumbnail can render name.
+func Supported(name string) bool { return IsImage(name) || IsVideo(name) || IsRAW(name) || IsSVG(name) }
+
+// GenerateThumbnail renders a JPEG thumbnail of the file called name, read
+// from r. The type comes from the name's extension. ffmpeg and dcraw read an
+// *os.File in place; any other reader is spooled to a temp file for them
+// first, since both need to seek.
+func GenerateThumbnail(ctx context.Context, r io.Reader, name string, opts Options) ([]byte, error) {
+	switch {
+	case IsImage(name):
+		return imageThumbnail(r, opts)
+	case IsVideo(name):
+		return withFile(r, name, func(local string) ([]byte, error) { return videoThumbnail(ctx, local, opts) })
+	case IsRAW(name):
+		return withFile(r, name, func(local string) ([]byte, error) { return rawThumbnail(ctx, local, opts) })
+	case IsSVG(name):
+		return svgThumbnail(ctx, r, opts)
+	}
+	return nil, ErrUnsupported
+}
+
+// withFile calls render with the path of a file holding r's contents.
+func withFile(r io.Reader, name string, render func(local string) ([]byte, error)) ([]byte, error) {
+	if f, ok := r.(*os.File); ok { return render(f.Name()) }
+	f, err := os.CreateTemp(TempDir, "thumb-src-*"+filepath.Ext(name))
+	if err != nil { return nil, err }
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil { return nil, fmt.Errorf("read failed: %w", err) }
+	return render(f.Name())
+}
+
+// fit scales img to the thumbnail's width, or fills a square of it.
+func fit(img image.Image, opts Options) image.Image {
+	if opts.Square { return imaging.Fill(img, opts.Width, opts.Width, imaging.Center, imaging.Lanczos) }
+	return imaging.Resize(img, opts.Width, 0, imaging.Lanczos)
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var opts []imaging.EncodeOption
+	if quality > 0 { opts = append(opts, imaging.JPEGQuality(quality)) }
+	buf := new(bytes.Buffer)
+	if err := imaging.Encode(buf, img, imaging.JPEG, opts...); err != nil { return nil, err }
+	return buf.Bytes(), nil
+}
+
+// ========== PHOTOS ==========
+func imageThumbnail(r io.Reader, opts Options) ([]byte, error) {
+	// Auto-orientation applies the EXIF rotation so portrait photos stay upright
+	img, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	if err != nil { return nil, fmt.Errorf("decode failed: %w", err) }
+	return encodeJPEG(fit(img, opts), opts.Quality)
+}
+
+// ========== VIDEOS ==========
+func videoThumbnail(ctx context.Context, local string, opts Options) ([]byte, error) {
+	f := opts.Frame
+	if f.Middle || f.Sheet > 1 {
+		duration, err := videoLength(ctx, local)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil { return nil, ctx.Err() }
+			log.Printf("No video length for %s (%v), using the frame %gs in", filepath.Base(local), err, f.Offset)
+		case f.Sheet > 1 && duration >= f.SheetOver:
+			return contactSheet(ctx, local, duration, opts)
+		case f.Middle:
+			f.Offset = duration / 2
+		}
+	}
+
+	// FFmpeg: seek to the offset, grab 1 frame (or the best of the next ~100)
+	imgData, err := grabFrame(ctx, append([]string{ "-i", local }, f.ffmpegArgs()...))
+	if err != nil { return nil, err }
+	img, err := imaging.Decode(bytes.NewReader(imgData))
+	if err != nil { return imgData, nil }
+	return encodeJPEG(fit(img, opts), opts.Quality)
+}
+
+// grabFrame runs ffmpeg with args and returns the image it writes.
+func grabFrame(ctx context.Context, args []string) ([]byte, error) {
+	tmpImg, err := os.CreateTemp(TempDir, "vid-thumb-*.jpg")
+	if err != nil { return nil, err }
+	tmpImgName := tmpImg.Name()
+	tmpImg.Close()
+	defer os.Remove(tmpImgName)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(append([]string{ "-y" }, args...), "-f", "image2", tmpImgName)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		log.Printf("FFmpeg failed: %s", string(out))
+		return nil, err
+	}
+	return os.ReadFile(tmpImgName)
+}
+
+// ffmpegArgs are the output options that grab the frame.
+func (f Frame) ffmpegArgs() []string {
+	args := []string{ "-ss", strconv.FormatFloat(f.Offset, 'f', 3, 64) }
+	if f.Smart { args = append(args, "-vf", "thumbnail") }
+	return append(args, "-frames:v", "1")
+}
+
+// videoLength is how long the video at local is, in seconds.
+func videoLength(ctx context.Context, local string) (float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", local).Output()
+	if err != nil { return 0, err }
+	secs, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || secs <= 0 { return 0, errors.New("no duration") }
+	return secs, nil
+}
+
+// sheetGap is the space between a contact sheet's frames, in pixels.
+const sheetGap = 2
+
+// contactSheet renders a grid of frames from the middle of equal parts of the
+// video. Each is seeked to before decoding (-ss before -i), so a long video
+// costs a few keyframes rather than a full decode; frames ffmpeg can't grab
+// are left black.
+func contactSheet(ctx context.Context, local string, duration float64, opts Options) ([]byte, error) {
+	n := opts.Frame.Sheet
+	cell := max((opts.Width-sheetGap*(n-1))/n, 1)
+	frames := make([]image.Image, n*n)
+	var wg sync.WaitGroup
+	running := make(chan struct{}, n) // a row's worth of ffmpegs at once
+	for i := range frames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			running <- struct{}{}
+			defer func() { <-running }()
+			at := duration * (float64(i) + 0.5) / float64(len(frames))
+			data, err := grabFrame(ctx, []string{ "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", local, "-frames:v", "1" })
+			if err != nil { return }
+			if img, err := imaging.Decode(bytes.NewReader(data)); err == nil { frames[i] = imaging.Resize(img, cell, 0, imaging.Lanczos) }
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil { return nil, ctx.Err() }
+
+	// Cells take the height of the first frame grabbed
+	cellHeight := 0
+	for _, img := range frames {
+		if img != nil { cellHeight = img.Bounds().Dy(); break }
+	}
+	if cellHeight == 0 { return nil, errors.New("ffmpeg grabbed no frames for the contact sheet") }
+	sheet := imaging.New(n*cell+(n-1)*sheetGap, n*cellHeight+(n-1)*sheetGap, color.Black)
+	for i, img := range frames {
+		if img == nil { continue }
+		at := image.Pt(i%n*(cell+sheetGap), i/n*(cellHeight+sheetGap))
+		sheet = imaging.Paste(sheet, imaging.CropCenter(img, cell, cellHeight), at)
+	}
+	if opts.Square { return encodeJPEG(fit(sheet, opts), opts.Quality) }
+	return encodeJPEG(sheet, opts.Quality)
+}
+
+// ========== RAW PHOTOS ==========
+// rawThumbnail is never scaled up: a developed half-size RAW or its embedded
+// preview may be narrower than width. Square ones are always Width wide.
+func rawThumbnail(ctx context.Context, local string, opts Options) ([]byte, error) {
+	img, err := decodeRAW(ctx, local, opts.Width)
+	if err != nil { return nil, err }
+	if opts.Square || img.Bounds().Dx() > opts.Width { img = fit(img, opts) }
+	return encodeJPEG(img, opts.Quality)
+}
+
+// decodeRAW returns the embedded preview of a RAW file when it is at least
+// width wide, otherwise the developed image.
+func decodeRAW(ctx context.Context, local string, width int) (image.Image, error) {
+	if data, err := exec.CommandContext(ctx, RAWDecoder, "-e", "-c", local).Output(); err == nil {
+		img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+		if err == nil && img.Bounds().Dx() >= width { return img, nil }
+	}
+
+	// -w: camera white balance, -h: half size (plenty for a preview), -T: TIFF
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, RAWDecoder, "-c", "-w", "-h", "-T", local)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		log.Printf("%s failed: %s", RAWDecoder, stderr.String())
+		return nil, fmt.Errorf("raw decode failed: %w", err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(out))
+	if err != nil { return nil, fmt.Errorf("raw decode failed: %w", err) }
+	return img, nil
+}
+
+// ========== SVG ==========
+// svgThumbnail rasterizes an SVG at the thumbnail width, its height following the
+// drawing's own aspect ratio, onto white: transparent areas would turn black
+// in a JPEG.
+func svgThumbnail(ctx context.Context, r io.Reader, opts Options) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, SVGRasterizer, "-w", strconv.Itoa(opts.Width), "-f", "png")
+	cmd.Stdin, cmd.Stderr = r, &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		log.Printf("%s failed: %s", SVGRasterizer, stderr.String())
+		return nil, fmt.Errorf("svg render failed: %w", err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(out))
+	if err != nil { return nil, fmt.Errorf("svg render failed: %w", err) }
+	bg := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+	flat := image.Image(imaging.Overlay(bg, img, image.Point{}, 1))
+	if opts.Square { flat = fit(flat, opts) }
+	return encodeJPEG(flat, opts.Quality)
+}
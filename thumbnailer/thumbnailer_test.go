@@ -0,0 +1,150 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// halves is a w×h image, red on the left half and blue on the right.
+func halves(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{ 255, 0, 0, 255 }
+			if x >= w/2 { c = color.RGBA{ 0, 0, 255, 255 } }
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+// withOrientation is a JPEG of img carrying an EXIF Orientation tag, in an
+// APP1 segment right after the SOI marker.
+func withOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{ Quality: 95 }); err != nil { t.Fatal(err) }
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian, first IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation >> 8), byte(orientation), 0, 0, // Orientation, SHORT, 1
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{ 0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2) }, payload...)
+	data := buf.Bytes()
+	return append(append([]byte{ 0xFF, 0xD8 }, app1...), data[2:]...)
+}
+
+func decode(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil { t.Fatalf("thumbnail is not a JPEG: %v", err) }
+	return img
+}
+
+func redder(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > b
+}
+
+func TestGenerateThumbnailWidth(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		width  int
+		wantW  int
+		wantH  int
+		square bool
+	}{
+		{ name: "a.png", data: encodePNG(t, halves(80, 40)), width: 20, wantW: 20, wantH: 10 },
+		{ name: "a.PNG", data: encodePNG(t, halves(40, 80)), width: 10, wantW: 10, wantH: 20 },
+		{ name: "b.jpg", data: withOrientation(t, halves(60, 30), 1), width: 30, wantW: 30, wantH: 15 },
+		{ name: "c.png", data: encodePNG(t, halves(80, 40)), width: 16, wantW: 16, wantH: 16, square: true },
+	} {
+		out, err := GenerateThumbnail(context.Background(), bytes.NewReader(tc.data), tc.name, Options{ Width: tc.width, Square: tc.square })
+		if err != nil { t.Errorf("%s: %v", tc.name, err); continue }
+		b := decode(t, out).Bounds()
+		if b.Dx() != tc.wantW || b.Dy() != tc.wantH { t.Errorf("%s: got %dx%d, want %dx%d", tc.name, b.Dx(), b.Dy(), tc.wantW, tc.wantH) }
+	}
+}
+
+func TestGenerateThumbnailOrientation(t *testing.T) {
+	// Orientation 6 is shown turned 90° clockwise: the stored 40×20 image
+	// stands up as 20×40, its red left half on top
+	data := withOrientation(t, halves(40, 20), 6)
+	out, err := GenerateThumbnail(context.Background(), bytes.NewReader(data), "portrait.jpg", Options{ Width: 10 })
+	if err != nil { t.Fatal(err) }
+	img := decode(t, out)
+	b := img.Bounds()
+	if b.Dx() != 10 || b.Dy() != 20 { t.Fatalf("got %dx%d, want 10x20", b.Dx(), b.Dy()) }
+	if !redder(img.At(5, 2)) || redder(img.At(5, 17)) { t.Error("the EXIF rotation was not applied") }
+}
+
+func TestGenerateThumbnailDecodeFailure(t *testing.T) {
+	_, err := GenerateThumbnail(context.Background(), strings.NewReader("not an image"), "broken.jpg", Options{ Width: 10 })
+	if err == nil { t.Fatal("no error for a file that doesn't decode") }
+	if errors.Is(err, ErrUnsupported) { t.Errorf("got ErrUnsupported for a supported type: %v", err) }
+	if !strings.Contains(err.Error(), "decode failed") { t.Errorf("got %v, want a decode error", err) }
+}
+
+func TestGenerateThumbnailUnsupported(t *testing.T) {
+	for _, name := range []string{ "notes.txt", "archive.zip", "noextension", "image.jpg.bak" } {
+		_, err := GenerateThumbnail(context.Background(), strings.NewReader("x"), name, Options{ Width: 10 })
+		if !errors.Is(err, ErrUnsupported) { t.Errorf("%s: got %v, want ErrUnsupported", name, err) }
+	}
+}
+
+func TestSuffixes(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		supported, raw, video bool
+	}{
+		{ "a.jpg", true, false, false },
+		{ "a.JPEG", true, false, false },
+		{ "dir.mp4/a.Png", true, false, false },
+		{ "a.tiff", true, false, false },
+		{ "b.CR2", true, true, false },
+		{ "b.nef", true, true, false },
+		{ "b.Dng", true, true, false },
+		{ "c.MOV", true, false, true },
+		{ "c.webm", true, false, true },
+		{ "c.mkv", true, false, true },
+		{ "d.Svg", true, false, false },
+		{ "e.txt", false, false, false },
+		{ "mp4", false, false, false },
+		{ "f.mp4.txt", false, false, false },
+	} {
+		if got := Supported(tc.name); got != tc.supported { t.Errorf("Supported(%q) = %v", tc.name, got) }
+		if got := IsRAW(tc.name); got != tc.raw { t.Errorf("IsRAW(%q) = %v", tc.name, got) }
+		if got := IsVideo(tc.name); got != tc.video { t.Errorf("IsVideo(%q) = %v", tc.name, got) }
+	}
+}
+
+func TestFrameArgs(t *testing.T) {
+	for _, tc := range []struct {
+		frame Frame
+		want  []string
+	}{
+		{ Frame{}, []string{ "-ss", "0.000", "-frames:v", "1" } },
+		{ Frame{ Offset: 1.5 }, []string{ "-ss", "1.500", "-frames:v", "1" } },
+		{ Frame{ Offset: 3, Smart: true }, []string{ "-ss", "3.000", "-vf", "thumbnail", "-frames:v", "1" } },
+	} {
+		if got := tc.frame.ffmpegArgs(); !slices.Equal(got, tc.want) { t.Errorf("%+v: got %q, want %q", tc.frame, got, tc.want) }
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// ========== THUMBNAIL RENDER POOL ==========
+// Requests for the same missing thumbnail (same original, size and format)
+// share one render: the first starts it and later ones wait for its result
+// instead of downloading the original and running ffmpeg again. The render
+// keeps going while anyone is still waiting and is cancelled once the last
+// of them goes away. Across originals at most THUMB_WORKERS (default: one
+// per CPU) renders run at once; the rest queue for a slot.
+
+var thumbSlots chan struct{}
+
+func initThumbPool() {
+	thumbSlots = make(chan struct{}, max(envInt("THUMB_WORKERS", runtime.NumCPU()), 1))
+}
+
+// acquireThumbSlot waits for a render slot; release it with releaseThumbSlot.
+func acquireThumbSlot(ctx context.Context) error {
+	select {
+	case thumbSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseThumbSlot() { <-thumbSlots }
+
+type renderedThumb struct {
+	data    []byte
+	format  thumbFormat
+	version string
+}
+
+type thumbFlight struct {
+	done    chan struct{}
+	result  renderedThumb
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type thumbFlightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*thumbFlight
+}
+
+var thumbFlights = &thumbFlightGroup{ flights: map[string]*thumbFlight{} }
+
+// Do runs render once per key at a time and hands its result to every
+// caller waiting on that key.
+func (g *thumbFlightGroup) Do(ctx context.Context, key string, render func(ctx context.Context) (renderedThumb, error)) (renderedThumb, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &thumbFlight{ done: make(chan struct{}), cancel: cancel }
+		g.flights[key] = f
+		go func() {
+			f.result, f.err = render(fctx)
+			g.mu.Lock()
+			if g.flights[key] == f { delete(g.flights, key) }
+			g.mu.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// Nobody wants it any more; the next request starts afresh
+			f.cancel()
+			if g.flights[key] == f { delete(g.flights, key) }
+		}
+		g.mu.Unlock()
+		return renderedThumb{}, ctx.Err()
+	}
+}
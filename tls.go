@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ========== HTTPS ==========
+// The server speaks HTTPS itself when given a certificate, either
+//
+//	TLS_CERT_FILE + TLS_KEY_FILE   PEM certificate (chain) and key files
+//	TLS_DOMAINS=photos.example.com Let's Encrypt certificates for these
+//	                               domains, kept in TLS_CACHE_DIR (default
+//	                               cache/autocert); TLS_EMAIL is the optional
+//	                               ACME account contact
+//
+// It then listens on :443 unless LISTEN_ADDR/PORT say otherwise, and a plain
+// HTTP listener on HTTP_REDIRECT_ADDR (default ":80", "off" for none)
+// redirects to HTTPS. With TLS_DOMAINS that listener also answers Let's
+// Encrypt's HTTP-01 challenges, so it must be reachable from the internet.
+
+type tlsSetup struct {
+	certFile, keyFile string
+	manager           *autocert.Manager
+}
+
+// tlsFromEnv is the configured TLS setup, nil for plain HTTP.
+func tlsFromEnv() *tlsSetup {
+	cert, key := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	domains := splitList(os.Getenv("TLS_DOMAINS"))
+	switch {
+	case cert != "" || key != "":
+		if cert == "" || key == "" { log.Fatal("❌ Set both TLS_CERT_FILE and TLS_KEY_FILE") }
+		if len(domains) > 0 { log.Println("⚠️ TLS_CERT_FILE is set, ignoring TLS_DOMAINS") }
+		return &tlsSetup{ certFile: cert, keyFile: key }
+	case len(domains) > 0:
+		dir := os.Getenv("TLS_CACHE_DIR")
+		if dir == "" { dir = filepath.Join("cache", "autocert") }
+		return &tlsSetup{ manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(dir),
+			Email:      os.Getenv("TLS_EMAIL"),
+		} }
+	}
+	return nil
+}
+
+func (t *tlsSetup) config() *tls.Config {
+	if t.manager != nil { return t.manager.TLSConfig() }
+	return &tls.Config{ MinVersion: tls.VersionTLS12 }
+}
+
+// listen serves srv over TLS until it is shut down.
+func (t *tlsSetup) listen(srv *http.Server) error {
+	srv.TLSConfig = t.config()
+	if t.manager != nil {
+		log.Printf("🔐 HTTPS with Let's Encrypt certificates for %s", os.Getenv("TLS_DOMAINS"))
+	} else {
+		log.Println("🔐 HTTPS with", t.certFile)
+	}
+	return srv.ListenAndServeTLS(t.certFile, t.keyFile)
+}
+
+// startRedirect runs the HTTP listener that sends clients to httpsAddr. It is
+// closed together with srv.
+func (t *tlsSetup) startRedirect(srv *http.Server, httpsAddr string) {
+	addr := os.Getenv("HTTP_REDIRECT_ADDR")
+	if addr == "off" { return }
+	if addr == "" { addr = ":80" }
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil { host = h }
+		if httpsPort != "" && httpsPort != "443" { host = net.JoinHostPort(host, httpsPort) }
+		status := http.StatusMovedPermanently
+		// A 301 may turn a POST into a GET; 308 keeps the method and body
+		if r.Method != http.MethodGet && r.Method != http.MethodHead { status = http.StatusPermanentRedirect }
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+	if t.manager != nil { h = t.manager.HTTPHandler(h) }
+
+	redirect := &http.Server{ Addr: addr, Handler: h, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: time.Minute }
+	srv.RegisterOnShutdown(func() { redirect.Close() })
+	go func() {
+		log.Println("↪️ Redirecting HTTP to HTTPS from", addr)
+		if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("⚠️ HTTP redirect listener on %s: %v", addr, err)
+		}
+	}()
+}
+
+// isTLSConfigured reports whether the server serves HTTPS itself.
+func isTLSConfigured() bool {
+	return os.Getenv("TLS_CERT_FILE") != "" || strings.TrimSpace(os.Getenv("TLS_DOMAINS")) != ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== VIDEO TRANSCODING ==========
+// .mov and .mkv often won't play in a browser, so the viewer plays an
+// H.264/AAC MP4 rendition from transcoded/<key without ext>.mp4 instead.
+// Large videos get an HLS rendition instead (see hls.go). Renditions are made
+// on the first view (or right after upload with TRANSCODE_ON_UPLOAD=1) by
+// TRANSCODE_WORKERS (default 1) ffmpeg workers, and until one is ready the
+// viewer says so. The original is never touched.
+
+func isVideo(name string) bool { return thumbnailer.IsVideo(name) }
+
+// needsTranscode reports whether browsers are unlikely to play name as is.
+func needsTranscode(name string) bool { return hasSuffix(name, ".mov", ".mkv") }
+
+// transcodedKey maps an original's storage key to its rendition.
+func transcodedKey(key string) string {
+	return path.Join("transcoded", strings.TrimSuffix(key, path.Ext(key))+".mp4")
+}
+
+// Rendition kinds.
+const (
+	renditionMP4 = "mp4"
+	renditionHLS = "hls"
+)
+
+type transcodeJob struct {
+	name, kind string
+}
+
+type transcoder struct {
+	mu    sync.Mutex
+	state map[string]string // kind + ":" + storage key -> "queued", "running" or "failed"
+	queue chan transcodeJob
+}
+
+var transcodes *transcoder
+
+func newTranscoder() *transcoder {
+	t := &transcoder{ state: map[string]string{}, queue: make(chan transcodeJob, 100) }
+	for n := envInt("TRANSCODE_WORKERS", 1); n > 0; n-- { go t.worker() }
+	return t
+}
+
+// renditionObject is the object whose presence means kind is ready for key.
+func renditionObject(kind, key string) string {
+	if kind == renditionHLS { return hlsDir(key) + "/index.m3u8" }
+	return transcodedKey(key)
+}
+
+// Status reports whether name's rendition of kind exists, and if not what is
+// happening to it ("" if nothing).
+func (t *transcoder) Status(ctx context.Context, name, kind string) (ready bool, state string) {
+	key := storageKey(name)
+	if objectExists(ctx, renditionObject(kind, key)) { return true, "" }
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return false, t.state[kind+":"+key]
+}
+
+// Enqueue schedules a rendition unless one is already queued or running.
+// A failed one is only retried when retry is set.
+func (t *transcoder) Enqueue(name, kind string, retry bool) string {
+	id := kind + ":" + storageKey(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st := t.state[id]; st == "queued" || st == "running" || (st == "failed" && !retry) { return st }
+	select {
+	case t.queue <- transcodeJob{ name, kind }:
+		t.state[id] = "queued"
+	default:
+		log.Printf("Transcode queue full, skipping %s (%s)", name, kind)
+	}
+	return t.state[id]
+}
+
+// Prepare is Status for the viewer: a missing rendition is queued, and a
+// failed one retried on ?transcode=retry.
+func (t *transcoder) Prepare(r *http.Request, name, kind string) (ready bool, state string) {
+	ready, state = t.Status(r.Context(), name, kind)
+	if ready { return true, "" }
+	if state == "" || (state == "failed" && r.URL.Query().Get("transcode") == "retry") { state = t.Enqueue(name, kind, true) }
+	return false, state
+}
+
+// Invalidate drops renditions made from an earlier upload under this key.
+func (t *transcoder) Invalidate(ctx context.Context, key string) {
+	deleteIfExists(ctx, transcodedKey(key))
+	deleteHLS(ctx, key)
+	t.mu.Lock()
+	delete(t.state, renditionMP4+":"+key)
+	delete(t.state, renditionHLS+":"+key)
+	t.mu.Unlock()
+}
+
+func (t *transcoder) set(id, state string) {
+	t.mu.Lock()
+	if state == "" { delete(t.state, id) } else { t.state[id] = state }
+	t.mu.Unlock()
+}
+
+func (t *transcoder) worker() {
+	for job := range t.queue {
+		key := storageKey(job.name)
+		id := job.kind + ":" + key
+		if shutdownCtx.Err() != nil { t.set(id, ""); continue }
+		t.set(id, "running")
+		background.Add(1)
+		var err error
+		if job.kind == renditionHLS {
+			err = segmentHLS(context.Background(), job.name, key)
+		} else {
+			err = transcode(context.Background(), job.name, key)
+		}
+		background.Done()
+		if err != nil {
+			log.Printf("Transcode %s (%s) failed: %v", job.name, job.kind, err)
+			t.set(id, "failed")
+			continue
+		}
+		t.set(id, "")
+		log.Printf("🎞️ Transcoded %s (%s)", job.name, job.kind)
+	}
+}
+
+// downloadTemp copies an object to a temp file; the caller removes it.
+func downloadTemp(ctx context.Context, key, ext string) (string, error) {
+	rc, err := getObject(ctx, key)
+	if err != nil { return "", fmt.Errorf("download failed: %w", err) }
+	defer rc.Close()
+	f, err := createTemp("transcode-src-*"+ext)
+	if err != nil { return "", err }
+	_, err = io.Copy(f, rc)
+	f.Close()
+	if err != nil { os.Remove(f.Name()); return "", fmt.Errorf("download failed: %w", err) }
+	return f.Name(), nil
+}
+
+func transcode(ctx context.Context, name, key string) error {
+	src, err := downloadTemp(ctx, key, filepath.Ext(name))
+	if err != nil { return err }
+	defer os.Remove(src)
+
+	out := src + ".mp4"
+	defer os.Remove(out)
+	// yuv420p + faststart: plays everywhere and starts before it's fully loaded
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", src,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("FFmpeg failed: %s", string(output))
+		return err
+	}
+
+	f, err := os.Open(out)
+	if err != nil { return err }
+	defer f.Close()
+	return store.Put(ctx, transcodedKey(key), f, objectAttrs{ ContentType: "video/mp4" })
+}
+
+// ========== TRANSCODED HANDLER ==========
+// GET /transcoded/{name} streams the rendition with Range support, so the
+// player can seek without downloading the whole file first.
+func transcodedHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/transcoded/")
+	if !allowRead(w, r, name) { return }
+	key := transcodedKey(storageKey(name))
+	attrs, err := store.Attrs(r.Context(), key)
+	if err != nil { http.NotFound(w, r); return }
+
+	rs := &objectReadSeeker{ ctx: r.Context(), key: key, size: attrs.Size }
+	defer rs.Close()
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "", attrs.Modified, rs)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ========== TRASH ==========
+// Deleting moves a file to trash/<id>/<name> (thumbnail and sidecar along
+// with it) and records where it came from in the "trash" bucket. In CAS mode
+// only the name is dropped; the blob stays until the item is purged. /trash
+// lists items with restore and delete-forever actions, and items older than
+// TRASH_RETENTION_DAYS (default 30, 0 keeps them forever) are purged daily.
+// The trash holds the newest version: the name's older B2 versions are
+// deleted with it (see versions.go), or they would show the file again.
+//
+// GET  /trash
+// POST /trash/{id}/restore
+// POST /trash/{id}/delete
+// POST /trash/empty
+
+type trashItem struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"` // original display name
+	Key     string    `json:"key"`  // trash/<id>/<name>; holds the sidecar in CAS mode too
+	Size    int64     `json:"size"`
+	CAS     *casEntry `json:"cas,omitempty"`
+	Albums  []string  `json:"albums,omitempty"` // album IDs to put it back into
+	Journal []string  `json:"journal,omitempty"` // journal entry IDs, likewise
+	Owner   *fileOwner `json:"owner,omitempty"` // charged again on restore (quota.go)
+	Deleted time.Time `json:"deleted"`
+}
+
+func trashItems() []trashItem {
+	var items []trashItem
+	dbEach("trash", func(key string, data []byte) error {
+		var it trashItem
+		if json.Unmarshal(data, &it) == nil { items = append(items, it) }
+		return nil
+	})
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items
+}
+
+// trashHolds reports whether a trashed item other than except keeps hash alive.
+func trashHolds(hash, except string) bool {
+	for _, it := range trashItems() {
+		if it.ID != except && it.CAS != nil && it.CAS.Hash == hash { return true }
+	}
+	return false
+}
+
+// trashFile moves name into the trash.
+func trashFile(ctx context.Context, name string) (trashItem, error) {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	id := hex.EncodeToString(raw)
+	it := trashItem{ ID: id, Name: name, Key: path.Join("trash", id, name), Owner: ownerOf(name), Deleted: time.Now() }
+	for _, a := range allAlbums() {
+		if slices.Contains(a.Items, name) { it.Albums = append(it.Albums, a.ID) }
+	}
+	for _, e := range journalEntries("", "") {
+		if slices.Contains(e.Photos, name) { it.Journal = append(it.Journal, e.ID) }
+	}
+
+	e, isCAS := casLookup(name)
+	switch {
+	case casMode && isCAS:
+		it.CAS, it.Size = &e, e.Size
+		if err := moveSidecar(ctx, name, it.Key); err != nil { return it, err }
+		if err := dbPut("trash", id, it); err != nil { moveSidecar(ctx, it.Key, name); return it, err }
+		dbDelete("cas_names", name)
+	default:
+		attrs, err := store.Attrs(ctx, name)
+		if err != nil { return it, moveError{ 404, name + " not found" } }
+		it.Size = attrs.Size
+		if err := moveObjects(ctx, name, it.Key); err != nil { return it, err }
+		if err := dbPut("trash", id, it); err != nil {
+			if merr := moveObjects(ctx, it.Key, name); merr != nil { log.Printf("Trash %s: stranded at %s: %v", name, it.Key, merr) }
+			return it, err
+		}
+	}
+	forgetFile(name)
+	return it, nil
+}
+
+func restoreTrash(ctx context.Context, it trashItem) error {
+	if _, ok := apiStat(ctx, it.Name); ok { return moveError{ 409, it.Name + " exists again; rename or delete it first" } }
+
+	if it.CAS != nil {
+		if err := casPut(it.Name, *it.CAS); err != nil { return err }
+		if err := moveSidecar(ctx, it.Key, it.Name); err != nil { dbDelete("cas_names", it.Name); return err }
+	} else if err := moveObjects(ctx, it.Key, it.Name); err != nil {
+		return err
+	}
+	dbDelete("trash", it.ID)
+	catalogRefresh(ctx, it.Name)
+	if it.Owner != nil { chargeUploads(it.Owner.User, uploadResult{ Name: it.Name, bytes: it.Owner.Size }) }
+
+	for _, a := range allAlbums() {
+		if slices.Contains(it.Albums, a.ID) && !slices.Contains(a.Items, it.Name) {
+			a.Items = append(a.Items, it.Name)
+			saveAlbum(a)
+		}
+	}
+	for _, id := range it.Journal {
+		var e journalEntry
+		if found, _ := dbGet("journal", id, &e); found && !slices.Contains(e.Photos, it.Name) {
+			e.Photos = append(e.Photos, it.Name)
+			dbPut("journal", e.ID, e)
+		}
+	}
+	if sc, ok := readSidecar(ctx, it.Name); ok {
+		indexSidecar(it.Name, sc)
+		if sc.Weather != nil { enrichWeather(ctx, it.Name, &sc) }
+	}
+	return nil
+}
+
+// purgeTrash deletes an item for good.
+func purgeTrash(ctx context.Context, it trashItem) error {
+	if it.CAS != nil {
+		if !casReferenced(it.CAS.Hash, it.ID) {
+			if err := casRemoveObject(ctx, it.CAS.Hash, it.Name); err != nil { return err }
+		}
+	} else {
+		if err := deleteForGood(ctx, it.Key); err != nil { return err }
+		removeThumbs(ctx, it.Key)
+		if needsTranscode(it.Key) { store.Delete(ctx, transcodedKey(it.Key)) }
+		if isVideo(it.Key) { deleteHLS(ctx, it.Key) }
+	}
+	// An edited photo's bytes as uploaded go with it
+	if sc, ok := readSidecar(ctx, it.Key); ok && it.CAS == nil && sc.Original != "" { deleteIfExists(ctx, sc.Original) }
+	deleteIfExists(ctx, sidecarKey(it.Key))
+	return dbDelete("trash", it.ID)
+}
+
+// runTrashPurge removes expired items once a day.
+func runTrashPurge() {
+	days := envInt("TRASH_RETENTION_DAYS", 30)
+	if days <= 0 { return }
+	for {
+		cutoff := time.Now().AddDate(0, 0, -days)
+		for _, it := range trashItems() {
+			if it.Deleted.After(cutoff) { continue }
+			if err := purgeTrash(context.Background(), it); err != nil {
+				log.Printf("Trash purge %s failed: %v", it.Name, err)
+				continue
+			}
+			log.Printf("🗑️ Purged %s (deleted %s)", it.Name, it.Deleted.Format("2006-01-02"))
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// ========== TRASH HANDLER ==========
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet { ctx = context.WithoutCancel(ctx) }
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/trash"), "/")
+	// Items from folders closed to the user aren't theirs to see, restore or
+	// purge
+	user := currentUser(r)
+
+	if rest == "" {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		days := envInt("TRASH_RETENTION_DAYS", 30)
+		type row struct {
+			Item    trashItem
+			Size    string
+			Expires string
+		}
+		var rows []row
+		for _, it := range trashItems() {
+			if !canRead(user, it.Name) { continue }
+			rw := row{ Item: it, Size: humanReadableSize(it.Size) }
+			if days > 0 { rw.Expires = it.Deleted.AddDate(0, 0, days).Format("02 Jan 2006") }
+			rows = append(rows, rw)
+		}
+		tpls.ExecuteTemplate(w, "trash.html", map[string]any{ "BucketName": bktName, "Items": rows })
+		return
+	}
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+
+	if rest == "empty" {
+		for _, it := range trashItems() {
+			if !canRead(user, it.Name) { continue }
+			if err := purgeTrash(ctx, it); err != nil { log.Printf("Trash purge %s failed: %v", it.Name, err) }
+		}
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	var it trashItem
+	if found, _ := dbGet("trash", id, &it); !found || !canRead(user, it.Name) { http.NotFound(w, r); return }
+
+	var err error
+	switch action {
+	case "restore":
+		err = restoreTrash(ctx, it)
+	case "delete":
+		err = purgeTrash(ctx, it)
+	default:
+		http.NotFound(w, r); return
+	}
+	if err != nil {
+		log.Printf("Trash %s %s failed: %v", action, it.Name, err)
+		status := http.StatusBadGateway
+		if me, ok := err.(moveError); ok { status = me.status }
+		http.Error(w, fmt.Sprintf("%s failed: %v", action, err), status)
+		return
+	}
+	log.Printf("🗑️ Trash %s: %s", action, it.Name)
+	if action == "restore" { http.Redirect(w, r, "/viewer/"+it.Name, http.StatusSeeOther); return }
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ========== UPLOAD NAMES ==========
+// Upload names (folder, custom name, the file's own name or its path in a
+// picked folder) are cleaned before anything is stored:
+//
+//   - ".." anywhere is rejected, not resolved, so "a/b/../c" can't land on
+//     "a/c"; empty and "." segments are dropped, "\" counts as "/".
+//   - control characters go, and so do leading/trailing spaces and trailing
+//     dots (which Windows can't keep); segments are cut to 255 bytes.
+//   - UPLOAD_NAMES picks what else is replaced by "_": "safe" (default)
+//     the characters Windows forbids, `:*?"<>|`; "strict" everything but
+//     letters, digits and ".-_"; "keep" nothing more.
+//
+// When the name is taken, the collision policy decides: "rename" (the
+// default, UPLOAD_COLLISION changes it) stores "IMG (1).jpg" instead,
+// "reject" fails the file, "overwrite" replaces what's there. A request picks
+// its own with the collision field, so replacing is always asked for.
+
+var errNameTraversal = errors.New("invalid name: \"..\" is not allowed")
+
+// cleanUploadName joins folder and name into a library name.
+func cleanUploadName(folder, name string) (string, error) {
+	mode := os.Getenv("UPLOAD_NAMES")
+	var segments []string
+	for _, seg := range strings.Split(strings.ReplaceAll(folder+"/"+name, `\`, "/"), "/") {
+		if seg == ".." || strings.TrimSpace(seg) == ".." { return "", errNameTraversal }
+		if seg = cleanSegment(seg, mode); seg != "" { segments = append(segments, seg) }
+	}
+	if len(segments) == 0 { return "", errors.New("invalid name: empty") }
+	cleaned := strings.Join(segments, "/")
+	if !isLibraryFile(cleaned) { return "", fmt.Errorf("invalid name: %s is reserved", cleaned) }
+	return cleaned, nil
+}
+
+func cleanSegment(seg, mode string) string {
+	seg = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case mode == "strict" && !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".-_", r)):
+			return '_'
+		case mode != "keep" && strings.ContainsRune(`:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, seg)
+	seg = strings.TrimRight(strings.TrimSpace(seg), ". ")
+	for len(seg) > 255 {
+		_, size := utf8.DecodeLastRuneInString(seg)
+		seg = seg[:len(seg)-size]
+	}
+	return seg
+}
+
+// collisionPolicy is the request's collision field, else UPLOAD_COLLISION.
+func collisionPolicy(field string) (string, error) {
+	policy := field
+	if policy == "" { policy = os.Getenv("UPLOAD_COLLISION") }
+	switch policy {
+	case "":
+		return "rename", nil
+	case "rename", "reject", "overwrite":
+		return policy, nil
+	}
+	return "", fmt.Errorf("collision must be rename, reject or overwrite")
+}
+
+func nameTakenMessage(name string) string { return name + " already exists" }
+
+// uploadClaims are names handed to uploads still being stored, so two files
+// called IMG.jpg in one request (or two requests at once) get different names.
+var uploadClaims = struct {
+	sync.Mutex
+	names map[string]bool
+}{ names: map[string]bool{} }
+
+// claimUploadName applies the collision policy to name and reserves the
+// result until release is called, once the file is stored. Only the
+// reservation is made under the lock: storage is asked afterwards, so one
+// slow lookup doesn't hold up every other upload.
+func claimUploadName(ctx context.Context, name, policy string) (claimed string, release func(), err error) {
+	// reserve takes n unless another upload has it; overwrite takes it anyway
+	reserve := func(n string, always bool) bool {
+		uploadClaims.Lock()
+		defer uploadClaims.Unlock()
+		if uploadClaims.names[n] && !always { return false }
+		uploadClaims.names[n] = true
+		return true
+	}
+	unreserve := func(n string) {
+		uploadClaims.Lock()
+		delete(uploadClaims.names, n)
+		uploadClaims.Unlock()
+	}
+	// claim is reserve for a name nothing is stored under yet
+	claim := func(n string) bool {
+		if !reserve(n, false) { return false }
+		if _, exists := apiStat(ctx, n); exists { unreserve(n); return false }
+		return true
+	}
+	claimed = name
+	switch {
+	case policy == "overwrite":
+		reserve(name, true)
+	case claim(name):
+	case policy == "reject":
+		return "", nil, errors.New(nameTakenMessage(name))
+	default:
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		for n := 1; ; n++ {
+			claimed = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+			if claim(claimed) { break }
+		}
+	}
+	return claimed, func() { unreserve(claimed) }, nil
+}
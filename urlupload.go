@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ========== UPLOAD FROM URL ==========
+// POST /upload/url fetches a remote file (the url field) and stores it like
+// an upload, with the same folder, custom_name, duplicates, collision and
+// organize fields, so a shared media link can be saved without downloading
+// it first. The file is named by custom_name, else the server's
+// Content-Disposition, else the last segment of the URL (after redirects),
+// given an extension from its type if it has none.
+//
+// Only the types in URL_UPLOAD_TYPES (default image/,video/,audio/,
+// application/pdf) are taken, by the answer's Content-Type or, when that
+// says nothing (application/octet-stream), by the name; RAW files count as
+// images. An answer that sniffs as HTML is refused either way: a link to the
+// page a photo is on rather than the photo is the usual mistake. A file over
+// URL_UPLOAD_MAX_MB (default 500) is refused, and the fetch gives up after
+// URL_UPLOAD_TIMEOUT (default 10m).
+//
+// Only public addresses are fetched, so the server can't be made to reach
+// itself or the network it sits in; URL_UPLOAD_PRIVATE=1 allows those too.
+
+var errNotPublic = errors.New("not a public address")
+
+var urlUploadClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{ Timeout: 30 * time.Second, Control: publicOnly }).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 { return errors.New("too many redirects") }
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" { return errors.New("redirected away from http") }
+		return nil
+	},
+}
+
+// publicOnly refuses connections to loopback, private, link-local and other
+// non-public addresses. It runs on the resolved address, so redirects and
+// names pointing inside are caught too.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	if os.Getenv("URL_UPLOAD_PRIVATE") == "1" { return nil }
+	host, _, err := net.SplitHostPort(address)
+	if err != nil { return err }
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() { return fmt.Errorf("%s: %w", host, errNotPublic) }
+	return nil
+}
+
+func urlUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "POST only", http.StatusMethodNotAllowed); return }
+	prog := trackUpload(r)
+	defer prog.finish()
+	rawURL := r.FormValue("url")
+	if rawURL == "" { http.Error(w, "no url", 400); return }
+	user := currentUser(r)
+	res := fetchUpload(r.Context(), rawURL, user, r.Form, prog)
+	results := []uploadResult{ res }
+	notifyUploads(requestOrigin(r), user, results...)
+	answerUploads(w, r, results)
+}
+
+// fetchUpload downloads rawURL to a temp file and stores it as user's upload
+// named per fields.
+func fetchUpload(ctx context.Context, rawURL, user string, fields map[string][]string, prog *uploadProgress) uploadResult {
+	res := uploadResult{ Name: rawURL }
+	fail := func(msg string, err error) uploadResult {
+		log.Printf("Upload from %s: %s: %v", rawURL, msg, err)
+		res.Error = msg
+		return res
+	}
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" { return fail("the URL must start with http:// or https://", err) }
+
+	fetchCtx, cancel := context.WithTimeout(ctx, envDuration("URL_UPLOAD_TIMEOUT", 10*time.Minute))
+	defer cancel()
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, u.String(), nil)
+	if err != nil { return fail("bad URL", err) }
+	req.Header.Set("User-Agent", "memories")
+	resp, err := urlUploadClient.Do(req)
+	if errors.Is(err, errNotPublic) { return fail("that URL points to a private address", err) }
+	if err != nil { return fail("fetch failed", err) }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { return fail("fetch failed: "+resp.Status, errors.New(resp.Status)) }
+	limit := int64(envInt("URL_UPLOAD_MAX_MB", 500)) << 20
+	tooBig := fmt.Sprintf("the file is over the %dMB limit", limit>>20)
+	if resp.ContentLength > limit { return fail(tooBig, fmt.Errorf("%d bytes", resp.ContentLength)) }
+	if resp.ContentLength > 0 {
+		if err := fitsQuota(user, resp.ContentLength); err != nil { return fail(err.Error(), err) }
+	}
+
+	// The first bytes show a web page whatever the server calls it
+	body := bufio.NewReaderSize(resp.Body, 512)
+	head, _ := body.Peek(512)
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	objectPath, err := uploadPath(fields, remoteFileName(resp, declared), 0)
+	if err != nil { return fail(err.Error(), err) }
+	res.Name = objectPath
+	if strings.HasPrefix(http.DetectContentType(head), "text/html") { return fail("that URL is a web page, not a file", errors.New(declared)) }
+	if !urlTypeAllowed(declared, objectPath) { return fail("not a media file ("+declared+")", errors.New(declared)) }
+
+	policy, err := collisionPolicy(formField(fields, "collision"))
+	if err != nil { return fail(err.Error(), err) }
+	dated, err := organizeByDate(formField(fields, "organize"), objectPath)
+	if err != nil { return fail(err.Error(), err) }
+	release := func() {}
+	defer func() { release() }()
+	// Before fetching the rest, unless the name depends on the bytes
+	if !dated {
+		if objectPath, release, err = claimUploadName(ctx, objectPath, policy); err != nil { return fail(err.Error(), err) }
+		res.Name = objectPath
+	}
+
+	fp := prog.addFile(objectPath, "receiving")
+	if room, limited := quotaRoom(user); limited { limit = min(limit, room) }
+	local, size, sha, err := spoolUpload(io.LimitReader(body, limit+1), objectPath)
+	if err != nil { fp.setStage("failed"); return fail("fetch failed", err) }
+	defer os.Remove(local)
+	hold, err := holdQuota(user, size)
+	if err != nil { fp.setStage("failed"); return fail(err.Error(), err) }
+	defer hold()
+	if size > limit { fp.setStage("failed"); return fail(tooBig, fmt.Errorf("more than %d bytes", limit)) }
+	if dated {
+		if objectPath, release, err = claimUploadName(ctx, datedName(objectPath, local), policy); err != nil { fp.setStage("failed"); return fail(err.Error(), err) }
+		res.Name = objectPath
+	}
+	log.Printf("🌐 Fetched %s (%s) from %s", objectPath, humanReadableSize(size), u.Host)
+	fp.setStage("storing")
+	// Fetched: the rest happens even if the client goes away now
+	res = storeLocal(context.WithoutCancel(ctx), local, size, sha, objectPath, formField(fields, "duplicates") == "skip", fp)
+	chargeUploads(user, res)
+	return res
+}
+
+// remoteFileName names a fetched file: the Content-Disposition filename,
+// else the final URL's last path segment, else "download", with an
+// extension for contentType if it has none.
+func remoteFileName(resp *http.Response, contentType string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil { name = path.Base(params["filename"]) }
+	if name == "" || name == "." || name == "/" { name = path.Base(resp.Request.URL.Path) }
+	if name == "." || name == "/" { name = "download" }
+	if path.Ext(name) == "" { name += typeExtension(contentType) }
+	return name
+}
+
+// typeExtension is the usual extension for a content type, or "".
+func typeExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg": return ".jpg"
+	case "image/heic": return ".heic"
+	case "video/quicktime": return ".mov"
+	case "video/mp4": return ".mp4"
+	case "audio/mpeg": return ".mp3"
+	}
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 { return exts[0] }
+	return ""
+}
+
+// urlTypeAllowed reports whether a fetched file of the declared type, to be
+// stored as name, is one URL_UPLOAD_TYPES takes.
+func urlTypeAllowed(declared, name string) bool {
+	if declared == "" || declared == "application/octet-stream" {
+		if isRAW(name) { return true }
+		declared = detectContentType(name)
+	}
+	types := splitList(os.Getenv("URL_UPLOAD_TYPES"))
+	if len(types) == 0 { types = []string{ "image/", "video/", "audio/", "application/pdf" } }
+	for _, t := range types {
+		if strings.HasPrefix(declared, t) { return true }
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== VERSION HISTORY ==========
+// On B2 every overwrite of a name (an edit, a re-upload over it, a restore)
+// leaves the old bytes behind as an older file version, billed like any
+// other. /versions/{name} lists them:
+//
+//	GET  /versions/{name}             the history page
+//	GET  /versions/{name}?id=ID       the bytes of one version
+//	POST /versions/{name} op=restore  copy version id back as the newest
+//	POST /versions/{name} op=delete   delete version id for good
+//	POST /versions/{name} op=prune    delete every version but the newest
+//
+// A restore is a copy inside B2, so nothing is downloaded, and is itself a
+// new version that can be undone the same way. The newest version can't be
+// deleted here: that is what the trash is for, and trashing a file drops its
+// history with the name. Backends without versions,
+// and content-addressed mode (where blobs are never overwritten), have no
+// history to show.
+
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/versions"), "/")
+	if !isLibraryFile(name) || !canRead(currentUser(r), name) { http.NotFound(w, r); return }
+	key := storageKey(name)
+	vs, key, ok := versionsOf(key)
+	if !ok || casMode { http.Error(w, "this storage backend keeps no file versions", 404); return }
+	versions, err := vs.Versions(r.Context(), key)
+	if err != nil { log.Printf("Versions of %s failed: %v", name, err); http.Error(w, "listing versions failed", 502); return }
+	if len(versions) == 0 { missingFile(w, r, name); return }
+	find := func(id string) (objectVersion, bool) {
+		for _, v := range versions {
+			if v.ID == id { return v, true }
+		}
+		return objectVersion{}, false
+	}
+
+	if r.Method == http.MethodPost {
+		ctx := context.WithoutCancel(r.Context())
+		op, id := r.FormValue("op"), r.FormValue("id")
+		v, found := find(id)
+		current := id == versions[0].ID && !versions[0].Hidden
+		switch {
+		case op == "prune":
+			removed := 0
+			for i, v := range versions {
+				if i == 0 && !v.Hidden { continue }
+				if err := vs.DeleteVersion(ctx, key, v.ID); err != nil { log.Printf("Deleting a version of %s failed: %v", name, err); continue }
+				removed++
+			}
+			log.Printf("🗂️ Deleted %d old version(s) of %s", removed, name)
+		case !found:
+			http.Error(w, "no such version", 404)
+			return
+		case op == "restore":
+			if v.Hidden || current { http.Error(w, "pick an older version to restore", 400); return }
+			if err := vs.RestoreVersion(ctx, key, id); err != nil { log.Printf("Restoring %s failed: %v", name, err); http.Error(w, "restore failed", 502); return }
+			versionRestored(ctx, name)
+			log.Printf("🗂️ Restored %s to its version of %s", name, v.Uploaded.Format("2006-01-02 15:04:05"))
+		case op == "delete":
+			if current { http.Error(w, "the newest version can't be deleted here, move the file to the trash instead", 400); return }
+			if err := vs.DeleteVersion(ctx, key, id); err != nil { log.Printf("Deleting a version of %s failed: %v", name, err); http.Error(w, "delete failed", 502); return }
+			log.Printf("🗂️ Deleted a version of %s", name)
+		default:
+			http.Error(w, "op must be restore, delete or prune", 400)
+			return
+		}
+		http.Redirect(w, r, "/versions/"+name, http.StatusSeeOther)
+		return
+	}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		v, found := find(id)
+		if !found || v.Hidden { http.NotFound(w, r); return }
+		rc, err := vs.GetVersion(r.Context(), key, id)
+		if err != nil { log.Printf("Reading a version of %s failed: %v", name, err); http.Error(w, "reading the version failed", 502); return }
+		defer rc.Close()
+		w.Header().Set("Content-Type", detectContentType(name))
+		sandboxSVG(w, name)
+		w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+		if r.URL.Query().Get("download") != "" { w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(name))) }
+		io.Copy(w, rc)
+		return
+	}
+
+	var rows []map[string]any
+	var oldBytes int64
+	for i, v := range versions {
+		current := i == 0 && !v.Hidden
+		if !current { oldBytes += v.Size }
+		sha := v.SHA1
+		if len(sha) > 12 { sha = sha[:12] }
+		rows = append(rows, map[string]any{
+			"ID":       v.ID,
+			"Uploaded": v.Uploaded.Local().Format("02 Jan 2006 15:04:05"),
+			"Size":     humanReadableSize(v.Size),
+			"SHA1":     sha,
+			"Hidden":   v.Hidden,
+			"Current":  current,
+			"IsImage":  thumbnailer.IsImage(name),
+		})
+	}
+	tpls.ExecuteTemplate(w, "versions.html", map[string]any{
+		"BucketName": bktName,
+		"FileName":   name,
+		"Versions":   rows,
+		"Old":        len(versions) - 1,
+		"OldSize":    humanReadableSize(oldBytes),
+	})
+}
+
+// versionRestored brings everything derived from name's bytes up to date
+// after older ones became the newest again.
+func versionRestored(ctx context.Context, name string) {
+	key := storageKey(name)
+	catalogRefresh(ctx, name)
+	removeThumbs(ctx, key)
+	if isVideo(name) { transcodes.Invalidate(ctx, key) }
+	if isThumbable(name) {
+		if err := regenerateThumb(ctx, name); err != nil { log.Printf("Thumbnail for restored %s failed: %v", name, err) }
+	}
+	if hasEXIF(name) {
+		if rc, err := getObject(ctx, key); err == nil {
+			if info, ok := decodeEXIF(rc); ok { saveEXIF(ctx, name, info) }
+			rc.Close()
+		}
+	}
+}
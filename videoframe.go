@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ishushreyas/memories/thumbnailer"
+)
+
+// ========== VIDEO THUMBNAIL FRAMES ==========
+// A video's thumbnail is the frame VIDEO_THUMB_OFFSET (default 1s) in. With
+// VIDEO_THUMB_MODE=smart ffmpeg's thumbnail filter instead picks the most
+// representative of the ~100 frames from there on, which skips black frames
+// and fade-ins at the cost of decoding a few seconds more; with
+// VIDEO_THUMB_MODE=middle it is the frame halfway through.
+//
+// Videos of VIDEO_SHEET_MINUTES or longer (default 0, none) get a contact
+// sheet instead: a VIDEO_SHEET_GRID×VIDEO_SHEET_GRID (default 3×3) grid of
+// frames spread over the whole video, which says more about an hour of
+// footage than any one frame. Middle frames and sheets need ffprobe to know
+// the length; without it the frame VIDEO_THUMB_OFFSET in is used.
+//
+// POST /thumb/regenerate re-renders one file's thumbnail (login required):
+//
+//	name      the file
+//	offset    seconds into a video, e.g. 4.5 (optional)
+//	mode      "smart", "offset", "middle" or "sheet" (optional)
+//	grid      frames per side of a sheet, 2-6 (optional)
+//
+// A video's choice is kept in its sidecar, so other sizes rendered later use
+// the same frame; a sheet picked this way is used whatever the length.
+
+type framePick = thumbnailer.Frame
+
+func defaultFramePick() framePick {
+	pick := framePick{
+		Offset: envDuration("VIDEO_THUMB_OFFSET", time.Second).Seconds(),
+		Smart:  os.Getenv("VIDEO_THUMB_MODE") == "smart",
+		Middle: os.Getenv("VIDEO_THUMB_MODE") == "middle",
+	}
+	if minutes := envInt("VIDEO_SHEET_MINUTES", 0); minutes > 0 { pick.Sheet, pick.SheetOver = sheetGrid(), float64(minutes*60) }
+	return pick
+}
+
+// framePickFor is the frame choice for name: its own if one was made at
+// /thumb/regenerate, else the default.
+func framePickFor(ctx context.Context, name string) framePick {
+	if sc, _ := readSidecar(ctx, name); sc.VideoFrame != nil { return *sc.VideoFrame }
+	return defaultFramePick()
+}
+
+// sheetGrid is VIDEO_SHEET_GRID, kept to 2-6.
+func sheetGrid() int { return min(max(envInt("VIDEO_SHEET_GRID", 3), 2), 6) }
+
+// ========== REGENERATE HANDLER ==========
+func thumbRegenerateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	name := strings.Trim(r.FormValue("name"), "/")
+	if _, ok := apiStat(r.Context(), name); !ok || !isLibraryFile(name) { http.Error(w, "no such file", 404); return }
+	ctx := context.WithoutCancel(r.Context())
+
+	offset, mode := strings.TrimSpace(r.FormValue("offset")), r.FormValue("mode")
+	if isVideo(name) && (offset != "" || mode != "") {
+		sc, _ := readSidecar(ctx, name)
+		pick := defaultFramePick()
+		if sc.VideoFrame != nil { pick = *sc.VideoFrame }
+		if offset != "" {
+			secs, err := strconv.ParseFloat(strings.TrimSuffix(offset, "s"), 64)
+			if err != nil || secs < 0 { http.Error(w, "offset must be a number of seconds", 400); return }
+			pick.Offset = secs
+		}
+		switch mode {
+		case "":
+		case "smart": pick.Smart, pick.Middle, pick.Sheet = true, false, 0
+		case "offset": pick.Smart, pick.Middle, pick.Sheet = false, false, 0
+		case "middle": pick.Smart, pick.Middle, pick.Sheet = false, true, 0
+		case "sheet":
+			pick.Sheet, pick.SheetOver = sheetGrid(), 0
+			if g := r.FormValue("grid"); g != "" {
+				n, err := strconv.Atoi(g)
+				if err != nil || n < 2 || n > 6 { http.Error(w, "grid must be 2 to 6", 400); return }
+				pick.Sheet = n
+			}
+		default: http.Error(w, `mode must be "smart", "offset", "middle" or "sheet"`, 400); return
+		}
+		sc.VideoFrame = &pick
+		if err := writeSidecar(ctx, name, sc); err != nil {
+			log.Println("Failed to write sidecar:", err)
+			http.Error(w, "save failed", 500); return
+		}
+	}
+
+	if err := regenerateThumb(ctx, name); err != nil { http.Error(w, fmt.Sprint("thumbnail failed: ", err), 500); return }
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, 200, map[string]any{ "name": name, "regenerated": true })
+		return
+	}
+	http.Redirect(w, r, "/viewer/"+name, http.StatusSeeOther)
+}
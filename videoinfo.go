@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ========== VIDEO METADATA ==========
+// ffprobe reads a video's duration, resolution, codecs and bitrate once at
+// upload (and in the backfill for older videos); they are kept in the
+// sidecar like EXIF. The "videos" bucket (name -> videoInfo) indexes them,
+// so grid cards can show the duration without reading any sidecar. A video
+// ffprobe can't read gets an empty entry, so the backfill doesn't try it
+// again.
+
+type videoInfo struct {
+	Duration float64 `json:"duration,omitempty"` // seconds
+	Width    int     `json:"width,omitempty"`    // as played, i.e. after rotation
+	Height   int     `json:"height,omitempty"`
+	Codec    string  `json:"codec,omitempty"` // "h264", "hevc"
+	Audio    string  `json:"audio,omitempty"` // "aac", "" without sound
+	Bitrate  int64   `json:"bitrate,omitempty"` // bits per second, all streams
+}
+
+// String is the viewer's summary: "1:23 · 1920×1080 · H264/AAC · 4.2 Mbit/s".
+func (v videoInfo) String() string {
+	var parts []string
+	if v.Duration > 0 { parts = append(parts, formatDuration(v.Duration)) }
+	if v.Width > 0 && v.Height > 0 { parts = append(parts, fmt.Sprintf("%d×%d", v.Width, v.Height)) }
+	if v.Codec != "" {
+		codecs := strings.ToUpper(v.Codec)
+		if v.Audio != "" { codecs += "/" + strings.ToUpper(v.Audio) }
+		parts = append(parts, codecs)
+	}
+	if v.Bitrate > 0 { parts = append(parts, fmt.Sprintf("%.1f Mbit/s", float64(v.Bitrate)/1e6)) }
+	return strings.Join(parts, " · ")
+}
+
+// formatDuration writes seconds as "0:07", "12:34" or "1:02:03".
+func formatDuration(seconds float64) string {
+	s := int(math.Round(seconds))
+	if s >= 3600 { return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60) }
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+var hasFFprobe bool
+
+func initVideoInfo() {
+	_, err := exec.LookPath("ffprobe")
+	hasFFprobe = err == nil
+	if !hasFFprobe { log.Println("⚠️ ffprobe is not installed, videos get no duration or resolution") }
+}
+
+// probeVideo runs ffprobe on a local video. ok is false when it can't read
+// the file (or isn't installed).
+func probeVideo(ctx context.Context, local string) (info videoInfo, ok bool) {
+	if !hasFFprobe { return info, false }
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", local).Output()
+	if err != nil { return info, false }
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			Tags      struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideData []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil { return info, false }
+
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, s := range probe.Streams {
+		switch {
+		case s.CodecType == "video" && info.Codec == "":
+			info.Codec, info.Width, info.Height = s.CodecName, s.Width, s.Height
+			// Phones record portrait video as landscape plus a rotation
+			rotation, _ := strconv.Atoi(s.Tags.Rotate)
+			for _, sd := range s.SideData {
+				if sd.Rotation != 0 { rotation = int(sd.Rotation) }
+			}
+			if rotation%180 != 0 { info.Width, info.Height = info.Height, info.Width }
+		case s.CodecType == "audio" && info.Audio == "":
+			info.Audio = s.CodecName
+		}
+	}
+	return info, info.Codec != ""
+}
+
+// saveVideoInfo merges probed video metadata into the name's sidecar.
+func saveVideoInfo(ctx context.Context, name string, info videoInfo) {
+	sc, _ := readSidecar(ctx, name)
+	sc.Video = &info
+	if err := writeSidecar(ctx, name, sc); err != nil {
+		log.Printf("Failed to save video metadata for %s: %v", name, err)
+	}
+}
+
+// probeAndSave records a video's metadata, or an empty entry when ffprobe
+// can't read it.
+func probeAndSave(ctx context.Context, name, local string) {
+	info, _ := probeVideo(ctx, local)
+	saveVideoInfo(ctx, name, info)
+}
+
+// probeHead probes the start of a streamed upload. Most containers keep
+// what ffprobe needs up front; for the others the backfill tries again with
+// the whole file, so nothing is saved when it fails.
+func probeHead(ctx context.Context, name string, head []byte) {
+	tmp, err := createTemp("probe-*"+path.Ext(name))
+	if err != nil { return }
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(head)
+	tmp.Close()
+	if err != nil { return }
+	if info, ok := probeVideo(ctx, tmp.Name()); ok { saveVideoInfo(ctx, name, info) }
+}
+
+func indexVideo(name string, sc sidecar) {
+	if sc.Video == nil { dbDelete("videos", name); return }
+	if err := dbPut("videos", name, *sc.Video); err != nil { log.Printf("Video index update %s failed: %v", name, err) }
+}
+
+// videoDuration is the grid badge of a video, "" if its length isn't known.
+func videoDuration(name string) string {
+	var info videoInfo
+	if found, _ := dbGet("videos", name, &info); !found || info.Duration <= 0 { return "" }
+	return formatDuration(info.Duration)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ========== WATCHED FOLDERS ==========
+// A local directory (a phone-sync folder, a scanner's output) can be kept
+// uploaded: it is scanned every WATCH_INTERVAL (default 5m) and new or
+// changed files go up like with `memories sync`, thumbnails and all. Either
+// set WATCH_DIR and WATCH_FOLDER for the server to do it, or run
+//
+//	memories watch DIR FOLDER/
+//
+// on its own (with the server stopped, like every command). Files modified
+// in the last WATCH_SETTLE (default 30s) wait for the next scan, so one still
+// being copied in isn't uploaded half-written. Files whose bytes are already
+// anywhere in the library are skipped, so photos that also arrive through
+// the upload page aren't stored twice. The size, time and SHA1 of every file
+// seen are kept in the "watch" bucket, so a scan only hashes what changed;
+// files deleted from the directory stay in the library.
+
+type watchState struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA1     string    `json:"sha1"`
+}
+
+// initWatch starts watching WATCH_DIR in the server.
+func initWatch() {
+	dir := os.Getenv("WATCH_DIR")
+	if dir == "" { return }
+	folder := strings.Trim(os.Getenv("WATCH_FOLDER"), "/")
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() { log.Printf("⚠️ WATCH_DIR %s is not a directory, not watching it", dir); return }
+	log.Printf("👀 Watching %s for %s/", dir, folder)
+	go runWatch(shutdownCtx, dir, folder)
+}
+
+func watchCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 { return usageError("watch takes a local directory and a folder") }
+	dir, folder := args[0], strings.Trim(args[1], "/")
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() { return fmt.Errorf("%s is not a directory", dir) }
+	// Ctrl-C stops between files, not halfway through an upload
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("👀 Watching %s for %s/ (Ctrl-C to stop)\n", dir, folder)
+	runWatch(ctx, dir, folder)
+	beginShutdown() // pending upload notifications go out now
+	return nil
+}
+
+func runWatch(ctx context.Context, dir, folder string) {
+	every := envDuration("WATCH_INTERVAL", 5*time.Minute)
+	for {
+		if stored, err := watchScan(ctx, dir, folder); err != nil {
+			log.Printf("Watch %s: %v", dir, err)
+		} else if stored > 0 {
+			log.Printf("👀 Watch %s: %d file(s) stored", dir, stored)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+// watchScan uploads what changed in dir since the last scan.
+func watchScan(ctx context.Context, dir, folder string) (int, error) {
+	files, err := localFiles(dir, folder)
+	if err != nil { return 0, err }
+	settle := envDuration("WATCH_SETTLE", 30*time.Second)
+	var stored []uploadResult
+	for _, f := range files {
+		if ctx.Err() != nil { break }
+		st, err := os.Stat(f.local)
+		if err != nil || time.Since(st.ModTime()) < settle { continue }
+		key, _ := filepath.Abs(f.local)
+		var seen watchState
+		if found, _ := dbGet("watch", key, &seen); found && seen.Size == st.Size() && seen.Modified.Equal(st.ModTime()) { continue }
+
+		size, sha, err := hashLocal(f.local)
+		if err != nil { log.Printf("Watch %s: %v", f.local, err); continue }
+		if sha != seen.SHA1 && storedSHA1(ctx, f.name) != sha {
+			// A file started is finished; the scan stops before the next one
+			res := storeLocal(context.WithoutCancel(ctx), f.local, size, sha, f.name, true, nil)
+			if res.Error != "" { continue } // tried again next scan
+			if !res.Skipped { stored = append(stored, res) }
+		}
+		dbPut("watch", key, watchState{ Size: size, Modified: st.ModTime(), SHA1: sha })
+	}
+	// No one's quota: this only takes a replaced file off its uploader's
+	chargeUploads("", stored...)
+	notifyUploads("", "", stored...)
+	return len(stored), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ========== WEATHER ENRICHMENT ==========
+// When a sidecar has both a capture time and a location, the historical
+// weather for that hour is looked up once and stored in the sidecar. A copy
+// goes into the "weather" DB bucket so the year-in-review page doesn't have to
+// read every sidecar from B2.
+//
+// WEATHER_PROVIDER selects the source: "open-meteo" (free, no key) or empty to
+// disable. Other providers only need to implement weatherProvider.
+
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type weather struct {
+	Summary  string  `json:"summary"`
+	TempC    float64 `json:"temp_c"`
+	PrecipMM float64 `json:"precip_mm"`
+	Source   string  `json:"source"`
+}
+
+func (w weather) String() string {
+	return fmt.Sprintf("%s, %.0f°C", w.Summary, w.TempC)
+}
+
+type weatherProvider interface {
+	Lookup(ctx context.Context, t time.Time, at geoPoint) (*weather, error)
+}
+
+var weatherSource weatherProvider
+
+func initWeather() {
+	switch p := os.Getenv("WEATHER_PROVIDER"); p {
+	case "":
+	case "open-meteo":
+		weatherSource = openMeteo{}
+		log.Println("🌦️ Weather enrichment via Open-Meteo")
+	default:
+		log.Printf("⚠️  Unknown WEATHER_PROVIDER %q; weather enrichment disabled", p)
+	}
+}
+
+// weatherRecord is the DB copy used by the year-in-review page.
+type weatherRecord struct {
+	Name     string    `json:"name"`
+	Captured time.Time `json:"captured"`
+	Weather  weather   `json:"weather"`
+}
+
+// enrichWeather fills sc.Weather if it's missing and the sidecar has enough
+// context. Lookup failures are logged and leave the sidecar unchanged.
+func enrichWeather(ctx context.Context, name string, sc *sidecar) {
+	if weatherSource == nil || sc.CaptureTime == nil || sc.Location == nil { return }
+	if sc.Weather == nil {
+		wx, err := weatherSource.Lookup(ctx, *sc.CaptureTime, *sc.Location)
+		if err != nil {
+			log.Printf("Weather lookup failed for %s: %v", name, err)
+			return
+		}
+		sc.Weather = wx
+	}
+	dbPut("weather", name, weatherRecord{ Name: name, Captured: *sc.CaptureTime, Weather: *sc.Weather })
+}
+
+// ========== OPEN-METEO ==========
+// Uses the historical archive API, hourly resolution.
+type openMeteo struct{}
+
+// WMO weather interpretation codes, grouped.
+func wmoSummary(code int) string {
+	switch {
+	case code == 0: return "Clear"
+	case code <= 3: return "Partly cloudy"
+	case code <= 48: return "Fog"
+	case code <= 57: return "Drizzle"
+	case code <= 67: return "Rain"
+	case code <= 77: return "Snow"
+	case code <= 82: return "Showers"
+	case code <= 86: return "Snow showers"
+	default: return "Thunderstorm"
+	}
+}
+
+func (openMeteo) Lookup(ctx context.Context, t time.Time, at geoPoint) (*weather, error) {
+	t = t.UTC()
+	day := t.Format("2006-01-02")
+	q := url.Values{
+		"latitude":   { strconv.FormatFloat(at.Lat, 'f', 4, 64) },
+		"longitude":  { strconv.FormatFloat(at.Lon, 'f', 4, 64) },
+		"start_date": { day },
+		"end_date":   { day },
+		"hourly":     { "temperature_2m,precipitation,weather_code" },
+		"timezone":   { "UTC" },
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://archive-api.open-meteo.com/v1/archive?"+q.Encode(), nil)
+	if err != nil { return nil, err }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return nil, fmt.Errorf("open-meteo: %s", resp.Status) }
+
+	var body struct {
+		Hourly struct {
+			Temperature []float64 `json:"temperature_2m"`
+			Precip      []float64 `json:"precipitation"`
+			Code        []int     `json:"weather_code"`
+		} `json:"hourly"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil { return nil, err }
+
+	h := t.Hour()
+	if h >= len(body.Hourly.Temperature) || h >= len(body.Hourly.Precip) || h >= len(body.Hourly.Code) {
+		return nil, fmt.Errorf("open-meteo: no data for %s", t.Format(time.RFC3339))
+	}
+	return &weather{
+		Summary:  wmoSummary(body.Hourly.Code[h]),
+		TempC:    math.Round(body.Hourly.Temperature[h]*10) / 10,
+		PrecipMM: body.Hourly.Precip[h],
+		Source:   "open-meteo",
+	}, nil
+}
+
+// ========== YEAR IN REVIEW ==========
+// GET /review?year=2025 -> photos with weather for the year, by month, with
+// the coldest/hottest/wettest moments called out.
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil { year = time.Now().Year() }
+
+	var records []weatherRecord
+	user := currentUser(r)
+	dbEach("weather", func(key string, data []byte) error {
+		var rec weatherRecord
+		if json.Unmarshal(data, &rec) == nil && rec.Captured.Local().Year() == year && canRead(user, rec.Name) { records = append(records, rec) }
+		return nil
+	})
+	sort.Slice(records, func(i, j int) bool { return records[i].Captured.Before(records[j].Captured) })
+
+	var months []map[string]any
+	highlights := map[string]weatherRecord{}
+	for _, rec := range records {
+		label := rec.Captured.Local().Format("January")
+		if len(months) == 0 || months[len(months)-1]["Label"] != label {
+			months = append(months, map[string]any{ "Label": label, "Photos": []weatherRecord{} })
+		}
+		last := months[len(months)-1]
+		last["Photos"] = append(last["Photos"].([]weatherRecord), rec)
+
+		if c, ok := highlights["Coldest"]; !ok || rec.Weather.TempC < c.Weather.TempC { highlights["Coldest"] = rec }
+		if h, ok := highlights["Hottest"]; !ok || rec.Weather.TempC > h.Weather.TempC { highlights["Hottest"] = rec }
+		if wet, ok := highlights["Wettest"]; rec.Weather.PrecipMM > 0 && (!ok || rec.Weather.PrecipMM > wet.Weather.PrecipMM) { highlights["Wettest"] = rec }
+	}
+
+	tpls.ExecuteTemplate(w, "review.html", map[string]any{
+		"BucketName": bktName,
+		"Year":       year,
+		"Prev":       year - 1,
+		"Next":       year + 1,
+		"Months":     months,
+		"Highlights": highlights,
+	})
+}
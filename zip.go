@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ========== ZIP DOWNLOAD ==========
+// GET  /download-zip?prefix=photos/2023/  everything under a folder, recursively
+// POST /download-zip  name=a.jpg&name=b.mp4 a selection (too long for a URL)
+//
+// The archive is written straight to the response while each object streams
+// from B2, so nothing is buffered on disk. Entries are stored uncompressed:
+// photos and videos don't shrink, and it keeps the server's CPU out of it.
+// Selections too big to wait for can be exported instead (see export.go).
+
+type zipItem struct {
+	name     string // display name
+	size     int64  // 0 if not listed
+	modified time.Time
+}
+
+// isLibraryFile reports whether a bucket key is something users uploaded, as
+// opposed to generated thumbnails and renditions, CAS blobs, sidecars and the
+// trash.
+func isLibraryFile(name string) bool {
+	top, _, nested := strings.Cut(name, "/")
+	return !(nested && isInternalFolder(top)) && !isSidecar(name)
+}
+
+// isInternalFolder reports whether a top-level folder holds generated files.
+func isInternalFolder(folder string) bool {
+	if size, ok := strings.CutPrefix(folder, "thumb-"); ok {
+		// thumb-600, thumb-square, thumb-square-600
+		if size == "square" { return true }
+		if _, err := strconv.Atoi(strings.TrimPrefix(size, "square-")); err == nil { return true }
+	}
+	return folder == "thumb" || folder == "thumb-anim" || folder == "transcoded" || folder == "preview" || folder == "upright" || folder == "hls" || folder == "trash" || folder == "exports" || folder == originalsFolder || (casMode && folder == "objects")
+}
+
+func zipHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var items []zipItem
+	archive := bktName
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		for _, name := range r.PostForm["name"] {
+			if name = strings.Trim(name, "/"); name == "" { continue }
+			if !allowRead(w, r, name) { return }
+			items = append(items, zipItem{ name: name })
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+		items = slices.CompactFunc(items, func(a, b zipItem) bool { return a.name == b.name })
+		archive += "-selection"
+	} else {
+		prefix := strings.Trim(r.URL.Query().Get("prefix"), "/")
+		listPrefix := keyPrefix
+		if prefix != "" { listPrefix = prefix + "/"; archive = path.Base(prefix) }
+		if !allowRead(w, r, prefix) { return }
+		all, err := zipItemsUnder(ctx, listPrefix)
+		if err != nil { log.Println("Zip listing failed:", err); http.Error(w, "listing failed", 502); return }
+		user := currentUser(r)
+		for _, it := range all {
+			if canRead(user, it.name) { items = append(items, it) }
+		}
+	}
+	if len(items) == 0 { http.Error(w, "nothing to download", 404); return }
+
+	base := zipBase(items)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", archive+".zip"))
+	zw := zip.NewWriter(w)
+	for _, it := range items {
+		if err := addZipEntry(ctx, zw, base, it); err != nil {
+			// Headers are long gone; a truncated archive is all we can signal
+			log.Printf("Zip %s: %s: %v", archive, it.name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil { log.Printf("Zip %s: %v", archive, err) }
+	log.Printf("📦 Zipped %d file(s) as %s.zip", len(items), archive)
+}
+
+// zipBase is the folder all items share; paths inside the archive are
+// relative to it.
+func zipBase(items []zipItem) string {
+	base := parentFolder(items[0].name)
+	for _, it := range items[1:] {
+		for base != "" && !strings.HasPrefix(it.name, base+"/") { base = parentFolder(base) }
+	}
+	return base
+}
+
+// addZipEntry streams one file from storage into the archive.
+func addZipEntry(ctx context.Context, zw *zip.Writer, base string, it zipItem) error {
+	hdr := &zip.FileHeader{ Name: strings.TrimPrefix(strings.TrimPrefix(it.name, base), "/"), Method: zip.Store }
+	if !it.modified.IsZero() { hdr.Modified = it.modified }
+	entry, err := zw.CreateHeader(hdr)
+	if err != nil { return err }
+	rc, err := getObject(ctx, storageKey(it.name))
+	if err != nil { return err }
+	defer rc.Close()
+	_, err = io.Copy(entry, rc)
+	return err
+}
+
+// zipItemsUnder lists every library file below prefix, including
+// content-addressed names, in name order.
+func zipItemsUnder(ctx context.Context, prefix string) ([]zipItem, error) {
+	var items []zipItem
+	seen := map[string]bool{}
+	err := listAll(ctx, prefix, func(f *objectAttrs) {
+		if isLibraryFile(f.Name) { items = append(items, zipItem{ f.Name, f.Size, f.Modified }); seen[f.Name] = true }
+	})
+	if err != nil { return nil, err }
+	if casMode {
+		entries, names := casEntries()
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) && !seen[name] { items = append(items, zipItem{ name, entries[name].Size, entries[name].Uploaded }) }
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	return items, nil
+}